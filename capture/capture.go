@@ -0,0 +1,108 @@
+// Package capture dumps the exporter's traffic with the gateway to a file
+// for a while, so maintainers can see exactly what new firmware sends.
+// Credentials and session tokens are redacted.
+package capture
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	mu    sync.Mutex
+	out   *os.File
+	until time.Time
+)
+
+// Start writes every request and response through a wrapped transport to
+// path, appending, until d has passed.
+func Start(path string, d time.Duration) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if out != nil {
+		out.Close()
+	}
+	out, until = f, time.Now().Add(d)
+	glog.Warningf("Capturing gateway traffic to %s until %s", path, until.Format(time.RFC3339))
+	return nil
+}
+
+// sensitiveFields matches JSON string fields holding credentials, such as
+// the password sent to /login/Basic and the token it returns.
+var sensitiveFields = regexp.MustCompile(`("(?:password|token|access_token|refresh_token)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+const kRedacted = "REDACTED"
+
+func redact(dump []byte) []byte {
+	return sensitiveFields.ReplaceAll(dump, []byte(`$1"`+kRedacted+`"`))
+}
+
+// sensitiveHeaders matches the lines of a dump with credentials or
+// session cookies.  The dump's lines end in \r\n; the \r is put back.
+var sensitiveHeaders = regexp.MustCompile(`(?im)^((?:Authorization|Cookie|Set-Cookie):).*$`)
+
+// write appends a dump to the capture file, and reports whether capturing
+// is on.
+func write(label string, dump []byte) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return false
+	}
+	if time.Now().After(until) {
+		glog.Infof("Finished capturing gateway traffic to %s", out.Name())
+		out.Close()
+		out = nil
+		return false
+	}
+	if dump == nil {
+		return true
+	}
+	dump = sensitiveHeaders.ReplaceAll(redact(dump), []byte("$1 "+kRedacted+"\r"))
+	if _, err := fmt.Fprintf(out, "### %s %s\n%s\n\n", time.Now().Format(time.RFC3339Nano), label, dump); err != nil {
+		glog.Errorf("Writing traffic capture: %v", err)
+	}
+	return true
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+// Wrap returns a RoundTripper which captures traffic while Start's
+// duration lasts, passing every request to base.
+func Wrap(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !write("", nil) {
+		return t.base.RoundTrip(req)
+	}
+	if dump, err := httputil.DumpRequestOut(req, true); err != nil {
+		glog.Errorf("httputil.DumpRequestOut(): %v", err)
+	} else {
+		write("request to "+req.URL.Path, dump)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		write("error", []byte(err.Error()))
+		return nil, err
+	}
+	if dump, err := httputil.DumpResponse(resp, true); err != nil {
+		glog.Errorf("httputil.DumpResponse(): %v", err)
+	} else {
+		write("response to "+req.URL.Path, dump)
+	}
+	return resp, nil
+}
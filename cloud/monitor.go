@@ -0,0 +1,503 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/egress"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall/vitals"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// kOwnerAPI is Tesla's owner API, which accepts the tokens issued to the
+// ownerapi client (see kClientID).  The Fleet API doesn't.
+const kOwnerAPI = "https://owner-api.teslamotors.com"
+
+const (
+	// kLiveStatusInterval is how long a live status is reused, so the
+	// several Get methods of one poll share one request.
+	kLiveStatusInterval = 5 * time.Second
+	// kSiteInfoInterval is how long the site's configuration is reused.
+	// It only changes when the owner changes a setting in the app.
+	kSiteInfoInterval = 5 * time.Minute
+	// kLifetimeInterval is how long the lifetime energy totals are reused.
+	// They are slow for the API to compute, and the energy counters only
+	// advance this often as a result.
+	kLifetimeInterval = 5 * time.Minute
+)
+
+// Options describes how to reach an energy site through Tesla's cloud.
+type Options struct {
+	// RefreshToken is a Tesla OAuth refresh token.  See NewTokenSource.
+	RefreshToken string
+	// SiteID is the energy site to monitor.  If zero, the first energy
+	// site on the account is used.
+	SiteID int64
+	// BaseURL is the API to talk to.  If empty, Tesla's owner API is
+	// used.
+	BaseURL string
+	// Timeout bounds each request to the API.
+	Timeout time.Duration
+}
+
+// monitor implements powerwall.Monitor on top of the cloud API.  The cloud
+// knows less than the gateway does, so several methods return empty
+// results rather than errors, and those metrics read as zero.
+type monitor struct {
+	opts   Options
+	tokens *TokenSource
+	cli    *http.Client
+	siteID int64
+	loc    *time.Location
+
+	mu        sync.Mutex
+	backups   []powerwall.BackupEvent // the last backup history fetched
+	backupsAt time.Time
+	responses map[string]cachedResponse // by URL, for getCached
+}
+
+// cachedResponse is an API response kept by getCached.
+type cachedResponse struct {
+	raw json.RawMessage
+	at  time.Time
+}
+
+// New returns a powerwall.Monitor backed by the Tesla cloud API.  Rotated
+// refresh tokens are kept in store.
+func New(opts Options, store *state.Store) (powerwall.Monitor, error) {
+	tokens, err := NewTokenSource(opts.RefreshToken, store)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BaseURL == "" {
+		opts.BaseURL = kOwnerAPI
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	r := &monitor{
+		opts:   opts,
+		tokens: tokens,
+		cli:    &http.Client{Transport: egress.Wrap(nil)},
+		siteID: opts.SiteID,
+
+		responses: make(map[string]cachedResponse),
+	}
+	if r.siteID == 0 {
+		if r.siteID, err = r.findSite(); err != nil {
+			return nil, fmt.Errorf("findSite(): %v", err)
+		}
+	}
+	return r, nil
+}
+
+// Destinations lists the hosts the cloud backend talks to with opts.
+func Destinations(opts Options) []string {
+	base := opts.BaseURL
+	if base == "" {
+		base = kOwnerAPI
+	}
+	rval := []string{kAuthHost}
+	if u, err := url.Parse(base); err == nil {
+		rval = append(rval, u.Host)
+	}
+	return rval
+}
+
+type envelope struct {
+	Response json.RawMessage `json:"response"`
+}
+
+// get fetches path from the API and decodes the response field into v.
+// endpoint names the gateway endpoint the caller stands in for, so errors
+// are attributed the same way as with the local backend.
+func (m *monitor) get(endpoint, path string, query url.Values, v interface{}) error {
+	raw, err := m.getRaw(path, query)
+	if err != nil {
+		return &powerwall.RequestError{Endpoint: endpoint, Err: err}
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &powerwall.RequestError{Endpoint: endpoint, Err: fmt.Errorf("decoding %s: %v", path, err)}
+	}
+	return nil
+}
+
+// getCached is get, reusing a response fetched less than ttl ago.
+func (m *monitor) getCached(ttl time.Duration, endpoint, path string, query url.Values, v interface{}) error {
+	key := path + "?" + query.Encode()
+	m.mu.Lock()
+	c, ok := m.responses[key]
+	m.mu.Unlock()
+	if !ok || time.Since(c.at) >= ttl {
+		raw, err := m.getRaw(path, query)
+		if err != nil {
+			return &powerwall.RequestError{Endpoint: endpoint, Err: err}
+		}
+		c = cachedResponse{raw: raw, at: time.Now()}
+		m.mu.Lock()
+		m.responses[key] = c
+		m.mu.Unlock()
+	}
+	if err := json.Unmarshal(c.raw, v); err != nil {
+		return &powerwall.RequestError{Endpoint: endpoint, Err: fmt.Errorf("decoding %s: %v", path, err)}
+	}
+	return nil
+}
+
+func (m *monitor) getRaw(path string, query url.Values) (json.RawMessage, error) {
+	token, err := m.tokens.AccessToken()
+	if err != nil {
+		return nil, err
+	}
+	u := m.opts.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := m.cli.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("m.cli.Do(): %v", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			glog.Errorf("resp.Body.Close(): %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d %s", path, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading body of response: %v", err)
+	}
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", path, err)
+	}
+	return env.Response, nil
+}
+
+type product struct {
+	EnergySiteID int64  `json:"energy_site_id"`
+	SiteName     string `json:"site_name"`
+}
+
+func (m *monitor) findSite() (int64, error) {
+	var products []product
+	if err := m.get("/site_info", "/api/1/products", nil, &products); err != nil {
+		return 0, err
+	}
+	for _, p := range products {
+		if p.EnergySiteID != 0 {
+			glog.Infof("Using energy site %d (%s)", p.EnergySiteID, p.SiteName)
+			return p.EnergySiteID, nil
+		}
+	}
+	return 0, fmt.Errorf("the account has no energy sites")
+}
+
+func (m *monitor) sitePath(suffix string) string {
+	return fmt.Sprintf("/api/1/energy_sites/%d/%s", m.siteID, suffix)
+}
+
+type siteInfo struct {
+	SiteName             string                  `json:"site_name"`
+	BackupReservePercent float64                 `json:"backup_reserve_percent"`
+	DefaultRealMode      powerwall.OperatingMode `json:"default_real_mode"`
+	TimeZone             string                  `json:"installation_time_zone"`
+	NameplatePower       float64                 `json:"nameplate_power"`  // W
+	NameplateEnergy      float64                 `json:"nameplate_energy"` // Wh
+	BatteryCount         int                     `json:"battery_count"`
+	Version              string                  `json:"version"`
+	Utility              string                  `json:"utility"`
+}
+
+func (m *monitor) siteInfo() (*siteInfo, error) {
+	var rval siteInfo
+	if err := m.getCached(kSiteInfoInterval, "/site_info", m.sitePath("site_info"), nil, &rval); err != nil {
+		return nil, err
+	}
+	return &rval, nil
+}
+
+type liveStatus struct {
+	SolarPower        float64 `json:"solar_power"`
+	PercentageCharged float64 `json:"percentage_charged"`
+	BatteryPower      float64 `json:"battery_power"`
+	LoadPower         float64 `json:"load_power"`
+	GridStatus        string  `json:"grid_status"` // "Active"
+	GridPower         float64 `json:"grid_power"`
+	IslandStatus      string  `json:"island_status"` // "on_grid"
+}
+
+func (m *monitor) liveStatus(endpoint string) (*liveStatus, error) {
+	var rval liveStatus
+	if err := m.getCached(kLiveStatusInterval, endpoint, m.sitePath("live_status"), nil, &rval); err != nil {
+		return nil, err
+	}
+	return &rval, nil
+}
+
+// lifetimeEnergy is the one entry of a lifetime energy history, in Wh.
+type lifetimeEnergy struct {
+	SolarEnergyExported               float64 `json:"solar_energy_exported"`
+	GridEnergyImported                float64 `json:"grid_energy_imported"`
+	GridEnergyExportedFromSolar       float64 `json:"grid_energy_exported_from_solar"`
+	GridEnergyExportedFromBattery     float64 `json:"grid_energy_exported_from_battery"`
+	BatteryEnergyExported             float64 `json:"battery_energy_exported"`
+	BatteryEnergyImportedFromGrid     float64 `json:"battery_energy_imported_from_grid"`
+	BatteryEnergyImportedFromSolar    float64 `json:"battery_energy_imported_from_solar"`
+	ConsumerEnergyImportedFromGrid    float64 `json:"consumer_energy_imported_from_grid"`
+	ConsumerEnergyImportedFromSolar   float64 `json:"consumer_energy_imported_from_solar"`
+	ConsumerEnergyImportedFromBattery float64 `json:"consumer_energy_imported_from_battery"`
+}
+
+type energyHistory struct {
+	TimeSeries []lifetimeEnergy `json:"time_series"`
+}
+
+func (m *monitor) lifetimeEnergy() (*lifetimeEnergy, error) {
+	q := url.Values{}
+	q.Set("kind", "energy")
+	q.Set("period", "lifetime")
+	var h energyHistory
+	if err := m.getCached(kLifetimeInterval, "/meters/aggregates", m.sitePath("calendar_history"), q, &h); err != nil {
+		return nil, err
+	}
+	var rval lifetimeEnergy
+	for _, e := range h.TimeSeries {
+		rval.SolarEnergyExported += e.SolarEnergyExported
+		rval.GridEnergyImported += e.GridEnergyImported
+		rval.GridEnergyExportedFromSolar += e.GridEnergyExportedFromSolar
+		rval.GridEnergyExportedFromBattery += e.GridEnergyExportedFromBattery
+		rval.BatteryEnergyExported += e.BatteryEnergyExported
+		rval.BatteryEnergyImportedFromGrid += e.BatteryEnergyImportedFromGrid
+		rval.BatteryEnergyImportedFromSolar += e.BatteryEnergyImportedFromSolar
+		rval.ConsumerEnergyImportedFromGrid += e.ConsumerEnergyImportedFromGrid
+		rval.ConsumerEnergyImportedFromSolar += e.ConsumerEnergyImportedFromSolar
+		rval.ConsumerEnergyImportedFromBattery += e.ConsumerEnergyImportedFromBattery
+	}
+	return &rval, nil
+}
+
+func (m *monitor) Close() error {
+	return nil
+}
+
+func (m *monitor) GetSiteInfo() (*powerwall.SiteInfo, error) {
+	si, err := m.siteInfo()
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(si.TimeZone)
+	if err != nil {
+		logthrottle.Errorf("timezone "+si.TimeZone, "The cloud reports timezone %q, but we can't decode it because: %v", si.TimeZone, err)
+		loc = nil
+	}
+	return &powerwall.SiteInfo{
+		SiteName:               si.SiteName,
+		TimeZone:               powerwall.NewTimeZone(loc),
+		NominalSystemEnergykWh: si.NameplateEnergy / 1000,
+		NominalSystemPowerkW:   si.NameplatePower / 1000,
+		GridCode: powerwall.GridCode{
+			Utility: si.Utility,
+		},
+	}, nil
+}
+
+func (m *monitor) GetOperation() (*powerwall.Operation, error) {
+	si, err := m.siteInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &powerwall.Operation{
+		RealMode:             si.DefaultRealMode,
+		BackupReservePercent: si.BackupReservePercent,
+	}, nil
+}
+
+func (m *monitor) GetPowerwalls() (*powerwall.Powerwalls, error) {
+	si, err := m.siteInfo()
+	if err != nil {
+		return nil, err
+	}
+	// The cloud doesn't describe the batteries individually.
+	return &powerwall.Powerwalls{
+		Powerwalls: make([]powerwall.Powerwall, si.BatteryCount),
+	}, nil
+}
+
+func (m *monitor) GetStatus() (*powerwall.Status, error) {
+	si, err := m.siteInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &powerwall.Status{Version: si.Version}, nil
+}
+
+func (m *monitor) GetAggregates() (*powerwall.Aggregates, error) {
+	ls, err := m.liveStatus("/meters/aggregates")
+	if err != nil {
+		return nil, err
+	}
+	e, err := m.lifetimeEnergy()
+	if err != nil {
+		return nil, err
+	}
+	return &powerwall.Aggregates{
+		Site: powerwall.MeterDetails{
+			InstantPower:   ls.GridPower,
+			EnergyImported: e.GridEnergyImported,
+			EnergyExported: e.GridEnergyExportedFromSolar + e.GridEnergyExportedFromBattery,
+		},
+		Battery: powerwall.MeterDetails{
+			InstantPower:   ls.BatteryPower,
+			EnergyImported: e.BatteryEnergyImportedFromGrid + e.BatteryEnergyImportedFromSolar,
+			EnergyExported: e.BatteryEnergyExported,
+		},
+		Load: powerwall.MeterDetails{
+			InstantPower:   ls.LoadPower,
+			EnergyImported: e.ConsumerEnergyImportedFromGrid + e.ConsumerEnergyImportedFromSolar + e.ConsumerEnergyImportedFromBattery,
+		},
+		Solar: powerwall.MeterDetails{
+			InstantPower:   ls.SolarPower,
+			EnergyExported: e.SolarEnergyExported,
+		},
+	}, nil
+}
+
+func (m *monitor) GetSOE() (*powerwall.SOE, error) {
+	ls, err := m.liveStatus("/system_status/soe")
+	if err != nil {
+		return nil, err
+	}
+	return &powerwall.SOE{Percentage: ls.PercentageCharged}, nil
+}
+
+func (m *monitor) GetGridStatus() (*powerwall.GridStatus, error) {
+	ls, err := m.liveStatus("/system_status/grid_status")
+	if err != nil {
+		return nil, err
+	}
+	rval := &powerwall.GridStatus{Status: powerwall.GridConnected}
+	if ls.GridStatus != "Active" {
+		rval.Status = powerwall.IslandedActive
+	}
+	return rval, nil
+}
+
+// kBackupHistoryInterval is how long GetBackupEvents repeats the last
+// history it fetched.  Backup events are rare, and the API is rate limited.
+const kBackupHistoryInterval = 5 * time.Minute
+
+type backupHistory struct {
+	Events []struct {
+		Timestamp string `json:"timestamp"` // "2021-06-18T08:13:22-07:00"
+		Duration  int64  `json:"duration"`  // ms
+	} `json:"events"`
+}
+
+func (m *monitor) GetBackupEvents() ([]powerwall.BackupEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.backups != nil && time.Since(m.backupsAt) < kBackupHistoryInterval {
+		return m.backups, nil
+	}
+	q := url.Values{}
+	q.Set("kind", "backup")
+	var h backupHistory
+	if err := m.get("/backup_events", m.sitePath("history"), q, &h); err != nil {
+		return nil, err
+	}
+	rval := make([]powerwall.BackupEvent, 0, len(h.Events))
+	for _, e := range h.Events {
+		start, err := time.Parse(time.RFC3339, e.Timestamp)
+		if err != nil {
+			return nil, &powerwall.RequestError{Endpoint: "/backup_events", Err: fmt.Errorf("backup event timestamp %q: %v", e.Timestamp, err)}
+		}
+		rval = append(rval, powerwall.BackupEvent{
+			Start:    start,
+			Duration: time.Duration(e.Duration) * time.Millisecond,
+		})
+	}
+	m.backups, m.backupsAt = rval, time.Now()
+	return rval, nil
+}
+
+// The cloud has nothing corresponding to these gateway endpoints.
+
+func (m *monitor) GetNetworks() ([]powerwall.Network, error) {
+	return nil, nil
+}
+
+func (m *monitor) GetConfig() (*powerwall.Config, error) {
+	return &powerwall.Config{}, nil
+}
+
+func (m *monitor) GetSiteMaster() (*powerwall.SiteMaster, error) {
+	return &powerwall.SiteMaster{Running: true, ConnectedToTesla: true}, nil
+}
+
+func (m *monitor) GetMetersSite() ([]powerwall.CTMeter, error) {
+	return nil, nil
+}
+
+func (m *monitor) GetMetersSolar() ([]powerwall.CTMeter, error) {
+	return nil, nil
+}
+
+func (m *monitor) GetMetersReadings() (map[string]powerwall.MeterReading, error) {
+	return nil, nil
+}
+
+func (m *monitor) GetVitals() ([]vitals.Device, error) {
+	return nil, nil
+}
+
+func (m *monitor) GetGridFaults() ([]powerwall.GridFault, error) {
+	return nil, nil
+}
+
+func (m *monitor) GetSolars() ([]powerwall.Solar, error) {
+	return nil, nil
+}
+
+func (m *monitor) GetInstaller() (*powerwall.Installer, error) {
+	return &powerwall.Installer{}, nil
+}
+
+func (m *monitor) GetWifiStatus() (*powerwall.WifiStatus, error) {
+	return &powerwall.WifiStatus{}, nil
+}
+
+// GetRaw returns the cloud response standing in for a gateway endpoint.
+func (m *monitor) GetRaw(endpoint string) (json.RawMessage, error) {
+	var path string
+	switch endpoint {
+	case "/site_info", "/operation", "/powerwalls", "/status":
+		path = m.sitePath("site_info")
+	case "/meters/aggregates", "/system_status/soe", "/system_status/grid_status":
+		path = m.sitePath("live_status")
+	default:
+		return nil, &powerwall.RequestError{Endpoint: endpoint, Err: fmt.Errorf("not available from the cloud")}
+	}
+	raw, err := m.getRaw(path, nil)
+	if err != nil {
+		return nil, &powerwall.RequestError{Endpoint: endpoint, Err: err}
+	}
+	return raw, nil
+}
@@ -0,0 +1,147 @@
+// Package cloud talks to Tesla's cloud API, for sites whose gateway can't
+// be reached on the local network.
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/egress"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// kAuthHost serves Tesla's OAuth endpoints.
+	kAuthHost = "auth.tesla.com"
+	// kTokenURL is Tesla's OAuth token endpoint.
+	kTokenURL = "https://" + kAuthHost + "/oauth2/v3/token"
+	// kClientID is the client the owner app, teslapy and Home Assistant
+	// all use.  Refresh tokens are tied to it.
+	kClientID = "ownerapi"
+	// kTokenKey is where the current token is kept in the state store.
+	kTokenKey = "tesla_token"
+	// kRefreshEarly renews access tokens this long before they expire.
+	kRefreshEarly = time.Minute
+)
+
+// Token is an OAuth token for the Tesla cloud API.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+	// Seed is the refresh token the user configured which this token
+	// descends from.  Tesla rotates refresh tokens, so once the one the
+	// user gave us has been used we have to remember its successor.
+	Seed string `json:"seed"`
+}
+
+// TokenSource hands out access tokens, refreshing them as needed.
+type TokenSource struct {
+	store  *state.Store
+	client *http.Client
+
+	mu    sync.Mutex
+	token Token
+}
+
+// NewTokenSource returns a TokenSource starting from refreshToken, such as
+// the one Home Assistant's Tesla integration or teslapy keep in their
+// cache files.  Rotated tokens are saved in store, which should be backed
+// by a file only the exporter can read, so restarts don't need the token
+// re-issued.  If store already holds a token descended from refreshToken,
+// that one is used instead.
+func NewTokenSource(refreshToken string, store *state.Store) (*TokenSource, error) {
+	if refreshToken == "" {
+		return nil, fmt.Errorf("a Tesla refresh token is required")
+	}
+	rval := &TokenSource{
+		store:  store,
+		client: &http.Client{Timeout: 30 * time.Second, Transport: egress.Wrap(nil)},
+		token: Token{
+			RefreshToken: refreshToken,
+			Seed:         refreshToken,
+		},
+	}
+	var saved Token
+	ok, err := store.Get(kTokenKey, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("store.Get(): %v", err)
+	}
+	if ok && saved.Seed == refreshToken {
+		rval.token = saved
+	}
+	return rval, nil
+}
+
+// AccessToken returns a current access token.
+func (t *TokenSource) AccessToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token.AccessToken != "" && time.Until(t.token.Expiry) > kRefreshEarly {
+		return t.token.AccessToken, nil
+	}
+	if err := t.refresh(); err != nil {
+		return "", fmt.Errorf("refresh(): %v", err)
+	}
+	return t.token.AccessToken, nil
+}
+
+type refreshRequest struct {
+	GrantType    string `json:"grant_type"`
+	ClientID     string `json:"client_id"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// refresh trades the refresh token for a new access token.  t.mu must be
+// held.
+func (t *TokenSource) refresh() error {
+	body, err := json.Marshal(refreshRequest{
+		GrantType:    "refresh_token",
+		ClientID:     kClientID,
+		RefreshToken: t.token.RefreshToken,
+		Scope:        "openid email offline_access",
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(kTokenURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			glog.Errorf("closing token response: %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint returned %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	var r refreshResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("decoding token response: %v", err)
+	}
+	t.token.AccessToken = r.AccessToken
+	t.token.Expiry = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	if r.RefreshToken != "" {
+		t.token.RefreshToken = r.RefreshToken
+	}
+	if err := t.store.Put(kTokenKey, t.token); err != nil {
+		// The old refresh token may already be invalid, so losing the
+		// new one means the user has to supply a fresh token after a
+		// restart.
+		glog.Errorf("Saving the refreshed Tesla token: %v", err)
+	}
+	glog.Infof("Refreshed Tesla access token, valid until %v", t.token.Expiry)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// kEnvPrefix starts the environment variable for each flag, followed by
+// the flag's name in upper case: POWERWALL_POLL_INTERVAL sets
+// --poll_interval.
+const kEnvPrefix = "POWERWALL_"
+
+var (
+	// commandLine holds the flags given on the command line or by
+	// loadEnvironment, which --config_file doesn't override.
+	commandLine map[string]bool
+	// fromConfig holds the flags the last read of --config_file set, so a
+	// reload can put back the defaults of any it no longer sets.
+	fromConfig = make(map[string]bool)
+)
+
+// configSetting is one line of --config_file.
+type configSetting struct {
+	line        int
+	name, value string
+}
+
+// envName returns the environment variable which sets the named flag.
+func envName(flagName string) string {
+	return kEnvPrefix + strings.ToUpper(flagName)
+}
+
+// loadEnvironment sets the flags not given on the command line from their
+// environment variables, for containers configured without a wrapper
+// script.  It must run before the first loadConfigFile, so the variables
+// take precedence over --config_file as the command line does.
+func loadEnvironment() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if e := flag.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), e)
+		}
+	})
+	return err
+}
+
+// loadConfigFile sets the flags in --config_file, one per line as on the
+// command line: --name=value, or just --name for a boolean.  Blank lines
+// and lines starting with # are ignored.
+func loadConfigFile() error {
+	if commandLine == nil {
+		commandLine = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			commandLine[f.Name] = true
+		})
+	}
+	if *configFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return err
+	}
+	settings, err := parseConfig(string(b))
+	if err != nil {
+		return err
+	}
+	for name := range fromConfig {
+		f := flag.Lookup(name)
+		if err := f.Value.Set(f.DefValue); err != nil {
+			return fmt.Errorf("resetting --%s: %v", name, err)
+		}
+	}
+	fromConfig = make(map[string]bool)
+	for _, s := range settings {
+		if commandLine[s.name] {
+			continue
+		}
+		if err := flag.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("line %d: --%s: %v", s.line, s.name, err)
+		}
+		fromConfig[s.name] = true
+	}
+	return nil
+}
+
+// parseConfig parses the contents of --config_file, checking that each
+// line names a flag other than --config_file itself.
+func parseConfig(contents string) ([]configSetting, error) {
+	var rval []configSetting
+	for i, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s := configSetting{line: i + 1}
+		s.name = strings.TrimLeft(line, "-")
+		eq := strings.Index(s.name, "=")
+		if eq >= 0 {
+			s.name, s.value = s.name[:eq], s.name[eq+1:]
+		}
+		f := flag.Lookup(s.name)
+		switch {
+		case f == nil:
+			return nil, fmt.Errorf("line %d: no such flag --%s", s.line, s.name)
+		case s.name == "config_file":
+			return nil, fmt.Errorf("line %d: --config_file can't be set from a config file", s.line)
+		case eq < 0 && !isBoolFlag(f):
+			return nil, fmt.Errorf("line %d: --%s needs a value", s.line, s.name)
+		case eq < 0:
+			s.value = "true"
+		}
+		rval = append(rval, s)
+	}
+	return rval, nil
+}
+
+// isBoolFlag reports whether f may be given without a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+// BreakerOptions configure the circuit breaker which stops polling a
+// gateway that has gone away, as during a firmware update.  While it is
+// open, scrapes are answered with the last metrics polled, and
+// cache_age_seconds shows how stale they are.
+type BreakerOptions struct {
+	// Failures is how many polls in a row must fail to open the breaker.
+	// 0 turns the breaker off.
+	Failures int
+	// MaxBackoff caps the wait between attempts while the breaker is open.
+	// The wait starts at kBreakerBackoff and doubles after each failed
+	// attempt.
+	MaxBackoff time.Duration
+}
+
+// kBreakerBackoff is how long the breaker first waits before trying the
+// gateway again.
+const kBreakerBackoff = 10 * time.Second
+
+// errBreakerOpen is returned instead of polling while the breaker is open.
+var errBreakerOpen = errors.New("the gateway is unreachable; not polling it until the circuit breaker's backoff is up")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	// breakerHalfOpen lets one poll through to see if the gateway is back.
+	breakerHalfOpen
+)
+
+// breaker counts failed polls and decides when to stop and resume polling.
+type breaker struct {
+	opts  BreakerOptions
+	gauge prometheus.Gauge
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+}
+
+func newBreaker(opts BreakerOptions, gauge prometheus.Gauge) *breaker {
+	if opts.MaxBackoff < kBreakerBackoff {
+		opts.MaxBackoff = kBreakerBackoff
+	}
+	return &breaker{opts: opts, gauge: gauge}
+}
+
+// allow reports whether to poll the gateway now.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		glog.Infof("Circuit breaker half open: trying the gateway again")
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// A trial poll is already under way.
+		return false
+	}
+	return true
+}
+
+// record notes the outcome of a poll allow let through.
+func (b *breaker) record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.opts.Failures <= 0 {
+		return
+	}
+	if err == nil {
+		if b.state != breakerClosed {
+			glog.Infof("Circuit breaker closed: the gateway is answering again after %d failed polls", b.failures)
+			b.gauge.Set(0)
+		}
+		b.state, b.failures, b.backoff = breakerClosed, 0, 0
+		return
+	}
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		b.backoff *= 2
+		if b.backoff > b.opts.MaxBackoff {
+			b.backoff = b.opts.MaxBackoff
+		}
+	case b.failures >= b.opts.Failures:
+		b.backoff = kBreakerBackoff
+		glog.Warningf("Circuit breaker open: %d polls in a row failed, the last with: %v", b.failures, err)
+		b.gauge.Set(1)
+	default:
+		return
+	}
+	b.state = breakerOpen
+	b.openUntil = now.Add(b.backoff)
+	glog.Infof("Circuit breaker: next trying the gateway in %s", b.backoff)
+}
+
+// tripped reports whether the breaker has stopped regular polling.
+func (b *breaker) tripped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
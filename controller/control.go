@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	gohttp "net/http"
+	"strconv"
+	"strings"
+)
+
+// serveControl changes the gateway's settings at /control, for home
+// automation such as raising the backup reserve ahead of a storm.  It takes
+// a POST with form values backup_reserve_percent and/or mode.
+func (p *PollEngine) serveControl(rw gohttp.ResponseWriter, req *gohttp.Request) {
+	if req.Method != gohttp.MethodPost {
+		rw.Header().Set("Allow", gohttp.MethodPost)
+		gohttp.Error(rw, "use POST", gohttp.StatusMethodNotAllowed)
+		return
+	}
+	// p.mon is the unwrapped monitor; wrappers don't forward Controller.
+	c, ok := p.mon.(powerwall.Controller)
+	if !ok {
+		gohttp.Error(rw, "this backend can't change the gateway's settings", gohttp.StatusNotImplemented)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		gohttp.Error(rw, err.Error(), gohttp.StatusBadRequest)
+		return
+	}
+	reserve, mode := req.Form.Get("backup_reserve_percent"), req.Form.Get("mode")
+	if reserve == "" && mode == "" {
+		gohttp.Error(rw, "set backup_reserve_percent or mode", gohttp.StatusBadRequest)
+		return
+	}
+	var percent float64
+	if reserve != "" {
+		var err error
+		percent, err = strconv.ParseFloat(reserve, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			gohttp.Error(rw, fmt.Sprintf("backup_reserve_percent %q: want a number from 0 to 100", reserve), gohttp.StatusBadRequest)
+			return
+		}
+	}
+	if mode != "" && !powerwall.OperatingMode(mode).Known() {
+		var modes []string
+		for _, m := range powerwall.OperatingModes {
+			modes = append(modes, string(m))
+		}
+		gohttp.Error(rw, fmt.Sprintf("unknown mode %q; try one of %s", mode, strings.Join(modes, ", ")), gohttp.StatusBadRequest)
+		return
+	}
+	if mode != "" {
+		if err := c.SetOperatingMode(powerwall.OperatingMode(mode)); err != nil {
+			glog.Errorf("SetOperatingMode(%s): %v", mode, err)
+			gohttp.Error(rw, err.Error(), gohttp.StatusBadGateway)
+			return
+		}
+		glog.Infof("%s set the operating mode to %s", req.RemoteAddr, mode)
+	}
+	if reserve != "" {
+		if err := c.SetBackupReservePercent(percent); err != nil {
+			glog.Errorf("SetBackupReservePercent(%v): %v", percent, err)
+			gohttp.Error(rw, err.Error(), gohttp.StatusBadGateway)
+			return
+		}
+		glog.Infof("%s set the backup reserve to %v%%", req.RemoteAddr, percent)
+	}
+	if s, ok := p.fetch.(*scheduledMonitor); ok {
+		s.forget("/operation")
+	}
+	rw.WriteHeader(gohttp.StatusNoContent)
+}
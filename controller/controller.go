@@ -4,86 +4,330 @@ package controller
 import (
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/cloud"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/derive"
 	"github.com/jeffbstewart/powerwall_prometheus_exporter/http"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/modbus"
 	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
 	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/snmp"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/version"
 	"github.com/jeffbstewart/powerwall_prometheus_exporter/view"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"math/rand"
 	gohttp "net/http"
+	"sync"
 	"time"
 )
 
+// PollMode selects what drives polling of the gateway.
+type PollMode string
+
+const (
+	// PollOnScrape polls the gateway every time /metrics is fetched.
+	PollOnScrape PollMode = "scrape"
+	// PollInBackground polls the gateway every PollInterval, and /metrics
+	// serves the results of the most recent poll.
+	PollInBackground PollMode = "background"
+)
+
+// Backend selects where the gateway's data comes from.
+type Backend string
+
+const (
+	// LocalBackend talks to the gateway on the local network.
+	LocalBackend Backend = "local"
+	// CloudBackend talks to Tesla's cloud API, for firmware that no
+	// longer allows local access.  It reports fewer metrics.
+	CloudBackend Backend = "cloud"
+)
+
 type Options struct {
+	Backend      Backend
 	Powerwall    powerwall.Options
+	Cloud        cloud.Options
 	View         view.Options
+	Sinks        []string // view sinks to send each poll to; just prometheus if empty.
+	Derive       derive.Options
 	PollInterval time.Duration
-	HTTPPort     int
+	PollMode     PollMode
+	Poll         model.PollOptions
+	HTTP         http.Options
+	SNMP         snmp.Options
+	Modbus       modbus.Options
+	Governor     GovernorOptions
+	Probe        ProbeOptions
+	Breaker      BreakerOptions
+	Push         PushOptions
+	Schedule     Schedule
+	// StateFile is where state that should survive a restart is kept, in
+	// any form state.Open accepts.  If empty, nothing is saved.
+	StateFile string
+	// FailPollsRatio fails this fraction of polls, chosen at random, after
+	// the first, so users can check their alerting.  Never set it in
+	// production.
+	FailPollsRatio float64
+	// GatewayLogs serves the gateway's logs at /debug/gatewaylogs.  They
+	// can be sensitive, so only turn it on behind authentication.
+	GatewayLogs bool
+	// AllowControl serves /control, which changes the gateway's backup
+	// reserve and operating mode.  It needs a build with the control tag,
+	// and should only be turned on behind authentication.
+	AllowControl bool
+	// Reload, if set, returns fresh Options for Run to rebuild the
+	// exporter with on SIGHUP, or a POST to /-/reload if ReloadEndpoint.
+	Reload func() (Options, error)
+	// ReloadEndpoint serves /-/reload.  It is off by default, as anyone
+	// who can reach the web interface could otherwise rebuild the
+	// exporter at will.
+	ReloadEndpoint bool
 }
 
 type PollEngine struct {
+	// mon must stay the Monitor the backend returned, not a wrapper such
+	// as scheduledMonitor: serveControl and the health checks look for
+	// the interfaces it implements beyond Monitor.
 	mon         powerwall.Monitor
+	fetch       powerwall.Monitor // mon following schedule, for polls.
+	schedule    Schedule
+	mode        PollMode
+	pollOpts    model.PollOptions
 	ticker      *time.Ticker
 	close       chan struct{}
 	fixed       *model.FixedInfo
-	view        *view.PrometheusCounters
+	deriver     *derive.Deriver
+	sinks       []view.Sink
+	sinkNames   []string // the name of each of sinks, as given to view.NewSink
+	self        *selfMetrics
+	governor    *governor
+	breaker     *breaker
 	promHandler gohttp.Handler
+	interval    time.Duration
+	stateFile   string
+	failRatio   float64
+
+	// flight coalesces concurrent polls, so simultaneous scrapes by two
+	// Prometheus servers poll the gateway once.
+	flight singleflight.Group
+
+	// looping is done once loop has returned.
+	looping sync.WaitGroup
+
+	// mu guards the outcome of the most recent polls.
+	mu           sync.Mutex
+	lastSuccess  time.Time
+	lastErr      error
+	lastPoll     time.Time
+	lastDuration time.Duration
+	latest       *model.TeslaEnergyGatewayMetrics
+	gateways     []string
 }
 
 func (p *PollEngine) ServeHTTP(rw gohttp.ResponseWriter, req *gohttp.Request) {
-	before := time.Now()
-	if err := p.poll(); err != nil {
-		glog.Errorf("PollEngine.pollOnce(): %v", err)
-		rw.WriteHeader(500)
-		return
+	p.afterPoll(p.promHandler).ServeHTTP(rw, req)
+}
+
+// afterPoll wraps a handler which renders the metrics.  In scrape mode it
+// polls the gateway first.
+func (p *PollEngine) afterPoll(h gohttp.Handler) gohttp.Handler {
+	if p.mode == PollInBackground {
+		return h
 	}
-	elapsed := time.Now().Sub(before)
-	glog.Infof("Successfully polled the gateway stats in %s", elapsed)
-	p.promHandler.ServeHTTP(rw, req)
+	return gohttp.HandlerFunc(func(rw gohttp.ResponseWriter, req *gohttp.Request) {
+		before := time.Now()
+		if err := p.poll(); err != nil {
+			// With the breaker open, the last metrics are better than
+			// none; cache_age_seconds says how old they are.
+			if !p.breaker.tripped() || p.snapshot() == nil {
+				glog.Errorf("PollEngine.pollOnce(): %v", err)
+				rw.WriteHeader(500)
+				return
+			}
+			glog.V(1).Infof("Serving stale metrics: %v", err)
+		} else {
+			glog.Infof("Successfully polled the gateway stats in %s", time.Now().Sub(before))
+		}
+		h.ServeHTTP(rw, req)
+	})
 }
 
-// Run starts the controller loop.  Normally it does not return.
-func Run(opts Options) error {
-	mon, err := powerwall.New(opts.Powerwall)
-	if err != nil {
-		return fmt.Errorf("powerwall.New(): %v", err)
+// start polls the gateway every interval until the engine is closed.
+func (p *PollEngine) start() {
+	p.looping.Add(1)
+	go func() {
+		defer p.looping.Done()
+		p.loop()
+	}()
+}
+
+// Close stops polling, waiting for a poll in progress to finish, and
+// closes the sinks that need it.
+func (p *PollEngine) Close() error {
+	p.ticker.Stop()
+	close(p.close)
+	p.looping.Wait()
+	var rval error
+	for _, s := range p.sinks {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil && rval == nil {
+				rval = fmt.Errorf("%T.Close(): %v", s, err)
+			}
+		}
 	}
-	fixed, err := model.New(mon)
-	if err != nil {
-		return fmt.Errorf("model.New(): %v", err)
+	return rval
+}
+
+// loop polls the gateway on every tick until the engine is closed.
+func (p *PollEngine) loop() {
+	for {
+		select {
+		case <-p.close:
+			return
+		case <-p.ticker.C:
+			select {
+			case <-p.close:
+				return
+			default:
+			}
+			before := time.Now()
+			if err := p.poll(); err == errBreakerOpen {
+				continue
+			} else if err != nil {
+				glog.Errorf("PollEngine.poll(): %v", err)
+				continue
+			}
+			glog.V(1).Infof("Successfully polled the gateway stats in %s", time.Now().Sub(before))
+		}
 	}
-	v, err := view.New(fixed, opts.View)
-	if err != nil {
-		return fmt.Errorf("view.New(): %v", err)
+}
+
+// promHandler serves the default registry.  With conventional names it
+// also offers the OpenMetrics format, which carries unit metadata.
+func promHandler(opts view.Options) gohttp.Handler {
+	if !opts.ConventionalNames {
+		return promhttp.Handler()
 	}
-	r := &PollEngine{
-		mon:         mon,
-		ticker:      time.NewTicker(opts.PollInterval),
-		close:       make(chan struct{}),
-		fixed:       fixed,
-		view:        v,
-		promHandler: promhttp.Handler(),
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}))
+}
+
+// poll refreshes the exported metrics from the gateway and records how
+// that went in the exporter's own metrics.  A call made while another's
+// poll is running waits for that one and returns its result.
+func (p *PollEngine) poll() error {
+	leader := false
+	_, err, _ := p.flight.Do("poll", func() (interface{}, error) {
+		leader = true
+		return nil, p.pollAlone()
+	})
+	if !leader {
+		p.self.coalesced.Inc()
 	}
+	return err
+}
 
-	// don't bring up the web interface until we've populated the metrics.
-	if err := r.poll(); err != nil {
-		return fmt.Errorf("poll(): %v", err)
+// pollAlone does the work of poll, which runs one at a time.
+func (p *PollEngine) pollAlone() error {
+	before := time.Now()
+	if !p.breaker.allow(before) {
+		// The metrics served are the last ones polled, but the gateway
+		// isn't up, and alerts on powerwall_up should say so.
+		p.self.up.Set(0)
+		return errBreakerOpen
 	}
-	gohttp.Handle("/metrics", r)
-	if err := http.ServeMetrics(opts.HTTPPort); err != nil { // blocks normally.
-		return fmt.Errorf("http.ServeMetrics: %v", err)
+	err := p.pollOnce()
+	elapsed := time.Now().Sub(before)
+	p.self.observe(elapsed, err)
+	p.governor.observe(elapsed)
+	p.mu.Lock()
+	p.lastPoll, p.lastDuration = before, elapsed
+	p.lastErr = err
+	if err == nil {
+		p.lastSuccess = time.Now()
 	}
-	return nil
+	p.mu.Unlock()
+	return err
 }
 
-func (p *PollEngine) Close() error {
-	p.close <- struct{}{}
+// kReadyPolls is how many poll intervals may pass without a successful
+// poll before the exporter reports itself not ready.
+const kReadyPolls = 3
+
+// ready returns an error unless a poll succeeded recently.  In scrape mode
+// polls only happen when scraped, so there it's enough that the most
+// recent one succeeded.
+func (p *PollEngine) ready() error {
+	p.mu.Lock()
+	last, lastErr := p.lastSuccess, p.lastErr
+	p.mu.Unlock()
+	if p.mode != PollInBackground {
+		if lastErr != nil {
+			return fmt.Errorf("the most recent poll failed: %v", lastErr)
+		}
+		return nil
+	}
+	if since := time.Since(last); since > kReadyPolls*p.interval {
+		return fmt.Errorf("no successful poll for %s", since.Round(time.Second))
+	}
 	return nil
 }
 
-func (p *PollEngine) poll() error {
-	stats, err := model.Poll(p.mon, p.fixed)
+func (p *PollEngine) pollOnce() error {
+	stats, err := model.Poll(p.fetch, p.fixed, p.governor.apply(p.pollOpts))
+	if err == nil && p.failRatio > 0 && rand.Float64() < p.failRatio {
+		err = fmt.Errorf("failure injected by --fail_scrapes_ratio")
+	}
+	// Every poll allow let through must be recorded, or a half open
+	// breaker would wait for its trial poll forever.
+	p.breaker.record(err, time.Now())
 	if err != nil {
 		return err
 	}
-	return p.view.Update(stats)
+	for _, err := range stats.Failed {
+		p.self.scrapeError(err)
+	}
+	p.deriver.Apply(stats)
+	// A sink that can't deliver, such as one whose broker is down, is no
+	// reason to stop serving the others or /metrics.
+	for i, s := range p.sinks {
+		if err := s.Update(stats); err != nil {
+			name := p.sinkNames[i]
+			p.self.sinkErrors.WithLabelValues(name).Inc()
+			logthrottle.Errorf("sink "+name, "The %s sink failed: %v", name, err)
+		}
+	}
+	p.mu.Lock()
+	p.latest = stats
+	p.mu.Unlock()
+	return nil
+}
+
+// status describes the engine for the landing page.
+func (p *PollEngine) status() http.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rval := http.Status{
+		Version:          version.Get().Version,
+		Gateways:         p.gateways,
+		LastPoll:         p.lastPoll,
+		LastPollDuration: p.lastDuration,
+	}
+	if p.lastErr != nil {
+		rval.LastError = p.lastErr.Error()
+	}
+	return rval
+}
+
+// snapshot returns the most recent successful poll, or nil if there
+// hasn't been one.
+func (p *PollEngine) snapshot() *model.TeslaEnergyGatewayMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latest
 }
@@ -0,0 +1,10 @@
+//go:build windows
+
+package controller
+
+import "time"
+
+// cpuTime isn't implemented on Windows, so CPU budgets are ignored there.
+func cpuTime() (time.Duration, bool) {
+	return 0, false
+}
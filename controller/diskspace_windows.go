@@ -0,0 +1,10 @@
+//go:build windows
+
+package controller
+
+import "fmt"
+
+// freeBytes isn't implemented on Windows.
+func freeBytes(path string) (uint64, error) {
+	return 0, fmt.Errorf("not supported on windows")
+}
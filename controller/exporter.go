@@ -0,0 +1,568 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/cloud"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/derive"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/http"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/modbus"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/snmp"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/view"
+	"github.com/prometheus/client_golang/prometheus"
+	gohttp "net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// kShutdownTimeout is how long Stop waits for web requests in flight.
+const kShutdownTimeout = 5 * time.Second
+
+// Exporter is a configured exporter which can be started and stopped, so
+// it can be embedded in a larger program and restarted with new Options
+// without the process exiting.
+type Exporter struct {
+	opts   Options
+	store  *state.Store
+	engine *PollEngine // nil when only serving /probe.
+	srv    *http.Server
+	snmp   *snmp.Agent
+	modbus *modbus.Server
+	push   *pusher
+	probe  *prober // nil without probe modules.
+	// collectors were registered with the default registry by New, and
+	// are unregistered by Stop.
+	collectors []prometheus.Collector
+
+	errs     chan error
+	mu       sync.Mutex
+	started  bool
+	stopping bool
+	// generation counts reloads, so servers closed by one aren't reported
+	// as failures.
+	generation int
+	// reloading serializes Reload and Stop.
+	reloading sync.Mutex
+}
+
+// Run starts an exporter.  Normally it does not return.  If opts.Reload
+// is set, SIGHUP rebuilds the exporter with the Options it returns.
+func Run(opts Options) error {
+	return RunUntil(opts, nil)
+}
+
+// RunUntil is Run, but stops the exporter and returns once stop is
+// closed, for service managers which ask for shutdown other than by
+// signal.
+func RunUntil(opts Options, stop <-chan struct{}) error {
+	e, err := New(opts)
+	if err != nil {
+		return err
+	}
+	e.Start()
+	hup := make(chan os.Signal, 1)
+	if opts.Reload != nil {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+	for {
+		select {
+		case err := <-e.Errors():
+			return err
+		case <-stop:
+			return e.Stop()
+		case <-hup:
+			if err := e.reload(); err != nil {
+				glog.Errorf("reload(): %v", err)
+			}
+		}
+	}
+}
+
+// New logs in to the gateway and polls it once, so the web interface has
+// metrics to serve as soon as Start is called.
+func New(opts Options) (*Exporter, error) {
+	e, err := newExporter(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Reload != nil && opts.ReloadEndpoint {
+		e.srv.HandleFunc("/-/reload", e.serveReload)
+	}
+	return e, nil
+}
+
+// newExporter is New without the /-/reload route, which must reload the
+// Exporter owning the listener rather than one built by a reload.
+func newExporter(opts Options) (rval *Exporter, err error) {
+	switch opts.PollMode {
+	case PollOnScrape, PollInBackground:
+	default:
+		return nil, fmt.Errorf("unknown poll mode %q, want %q or %q", opts.PollMode, PollOnScrape, PollInBackground)
+	}
+	switch opts.Backend {
+	case LocalBackend, CloudBackend:
+	default:
+		return nil, fmt.Errorf("unknown backend %q, want %q or %q", opts.Backend, LocalBackend, CloudBackend)
+	}
+	e := &Exporter{
+		opts: opts,
+		errs: make(chan error, 3),
+	}
+	if opts.Backend == LocalBackend && opts.Powerwall.Gateway == "" {
+		if len(opts.Probe.Modules) == 0 {
+			return nil, fmt.Errorf("no gateway to poll and no probe modules")
+		}
+		// Serve /probe without a gateway of our own, for when
+		// Prometheus supplies every target.
+		e.srv = http.New(opts.HTTP)
+		e.srv.Handle("/metrics", promHandler(opts.View))
+		e.probe = newProber(opts)
+		e.srv.Handle("/probe", e.probe)
+		return e, nil
+	}
+	// Undo whatever was set up if we don't make it to the end.
+	defer func() {
+		if err != nil {
+			e.unregister()
+			if e.store != nil {
+				e.store.Close()
+			}
+		}
+	}()
+
+	e.store, err = state.Open(opts.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("state.Open(): %v", err)
+	}
+	id, err := instanceID(e.store, opts.StateFile != "")
+	if err != nil {
+		return nil, fmt.Errorf("instanceID(): %v", err)
+	}
+	if opts.View.LabelInstanceID {
+		opts.View.InstanceID = id
+	}
+	deriver, err := derive.New(opts.Derive, e.store)
+	if err != nil {
+		return nil, fmt.Errorf("derive.New(): %v", err)
+	}
+	var mon powerwall.Monitor
+	if opts.Backend == CloudBackend {
+		mon, err = cloud.New(opts.Cloud, e.store)
+		if err != nil {
+			return nil, fmt.Errorf("cloud.New(): %v", err)
+		}
+	} else {
+		metrics := powerwall.NewMetrics(opts.View.Namespace)
+		if err := e.register(metrics.Collectors()...); err != nil {
+			return nil, err
+		}
+		opts.Powerwall.Metrics = metrics
+		mon, err = powerwall.New(opts.Powerwall)
+		if err != nil {
+			return nil, fmt.Errorf("powerwall.New(): %v", err)
+		}
+	}
+	fetch := scheduled(mon, opts.Schedule)
+	fixed, err := model.New(fetch, opts.Poll)
+	if err != nil {
+		return nil, fmt.Errorf("model.New(): %v", err)
+	}
+	if len(opts.Sinks) == 0 {
+		opts.Sinks = []string{"prometheus"}
+	}
+	opts.View.State = e.store
+	var sinks []view.Sink
+	for _, name := range opts.Sinks {
+		s, err := view.NewSink(name, fixed, opts.View)
+		if err != nil {
+			return nil, fmt.Errorf("view.NewSink(%q): %v", name, err)
+		}
+		if c, ok := s.(prometheus.Collector); ok {
+			e.collectors = append(e.collectors, c)
+		}
+		sinks = append(sinks, s)
+	}
+	self, err := newSelfMetrics(id)
+	if err != nil {
+		return nil, fmt.Errorf("newSelfMetrics(): %v", err)
+	}
+	e.collectors = append(e.collectors, self.collectors()...)
+	r := &PollEngine{
+		mon:         mon,
+		fetch:       fetch,
+		schedule:    opts.Schedule,
+		mode:        opts.PollMode,
+		pollOpts:    opts.Poll,
+		ticker:      time.NewTicker(opts.PollInterval),
+		close:       make(chan struct{}),
+		fixed:       fixed,
+		deriver:     deriver,
+		sinks:       sinks,
+		sinkNames:   opts.Sinks,
+		self:        self,
+		governor:    newGovernor(opts.Governor, opts.Poll, self.shed),
+		breaker:     newBreaker(opts.Breaker, self.breakerOpen),
+		promHandler: promHandler(opts.View),
+		interval:    opts.PollInterval,
+		stateFile:   e.store.Path(),
+		gateways:    []string{opts.Powerwall.Gateway},
+	}
+	if opts.Backend == CloudBackend {
+		r.gateways = []string{"Tesla cloud"}
+	}
+
+	// don't bring up the web interface until we've populated the metrics.
+	if err := r.poll(); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("poll(): %v", err)
+	}
+	if opts.FailPollsRatio > 0 {
+		glog.Warningf("Deliberately failing %.0f%% of polls", opts.FailPollsRatio*100)
+		r.failRatio = opts.FailPollsRatio
+	}
+	e.engine = r
+	if opts.SNMP.Port != 0 {
+		e.snmp = snmp.New(opts.SNMP, r.snapshot)
+	}
+	if opts.Modbus.Port != 0 {
+		e.modbus = modbus.New(opts.Modbus, r.snapshot)
+	}
+	if opts.Push.enabled() {
+		e.push = newPusher(opts.Push, r, r.gateways[0])
+	}
+	opts.HTTP.Ready = r.ready
+	opts.HTTP.Status = r.status
+	e.srv = http.New(opts.HTTP)
+	e.srv.Handle("/metrics", r)
+	e.srv.HandleFunc("/health/deep", r.deepHealth)
+	e.srv.Handle("/json", r.afterPoll(view.JSONHandler(prometheus.DefaultGatherer)))
+	e.srv.Handle("/dashboard", view.DashboardHandler(opts.View))
+	e.srv.Handle("/homeassistant", r.afterPoll(view.HomeAssistantHandler(fixed, r.snapshot)))
+	e.srv.Handle("/api/ha/", r.afterPoll(view.PypowerwallHandler(r.snapshot)))
+	e.srv.Handle("/json/snapshot", r.afterPoll(gohttp.HandlerFunc(r.serveSnapshot)))
+	for _, v := range view.SnapshotVersions {
+		e.srv.Handle(fmt.Sprintf("/api/v%d/snapshot", v), r.afterPoll(view.SnapshotHandler(v, r.snapshot)))
+	}
+	if len(opts.Probe.Modules) != 0 {
+		e.probe = newProber(opts)
+		e.srv.Handle("/probe", e.probe)
+	}
+	if opts.GatewayLogs {
+		e.srv.HandleFunc("/debug/gatewaylogs", r.serveGatewayLogs)
+	}
+	if opts.AllowControl {
+		e.srv.HandleFunc("/control", r.serveControl)
+	}
+	for _, s := range sinks {
+		if h, ok := s.(*view.History); ok {
+			e.srv.Handle("/history", h)
+		}
+	}
+	return e, nil
+}
+
+// Start begins background polling, if configured, and serving.  It
+// returns at once; a server which fails is reported on Errors.
+func (e *Exporter) Start() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.started {
+		return
+	}
+	e.started = true
+	e.startWorkers()
+	go e.serve("http.ListenAndServe", kEveryGeneration, e.srv.ListenAndServe)
+}
+
+// startWorkers starts everything but the web server.  e.mu must be held.
+func (e *Exporter) startWorkers() {
+	if e.engine != nil && e.engine.mode == PollInBackground {
+		e.engine.start()
+	}
+	if e.snmp != nil {
+		go e.serve("snmp.ListenAndServe", e.generation, e.snmp.ListenAndServe)
+	}
+	if e.modbus != nil {
+		go e.serve("modbus.ListenAndServe", e.generation, e.modbus.ListenAndServe)
+	}
+	if e.push != nil {
+		e.push.start()
+	}
+}
+
+// kEveryGeneration is the generation of the web server, which reloads
+// keep.
+const kEveryGeneration = -1
+
+// serve runs a server, reporting on Errors if it stops other than by Stop
+// or by the reload ending its generation.
+func (e *Exporter) serve(name string, generation int, listenAndServe func() error) {
+	err := listenAndServe()
+	e.mu.Lock()
+	quiet := e.stopping || (generation != kEveryGeneration && generation != e.generation)
+	e.mu.Unlock()
+	if quiet {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("stopped unexpectedly")
+	}
+	glog.Errorf("%s: %v", name, err)
+	e.errs <- fmt.Errorf("%s: %v", name, err)
+}
+
+// Errors delivers an error for each server which stops unexpectedly.
+func (e *Exporter) Errors() <-chan error {
+	return e.errs
+}
+
+// Stop shuts the exporter down and unregisters its metrics, so another
+// Exporter can be created in its place.
+func (e *Exporter) Stop() error {
+	e.reloading.Lock()
+	defer e.reloading.Unlock()
+	e.mu.Lock()
+	e.stopping = true
+	started := e.started
+	e.mu.Unlock()
+
+	var rval error
+	if started {
+		ctx, cancel := context.WithTimeout(context.Background(), kShutdownTimeout)
+		defer cancel()
+		if err := e.srv.Shutdown(ctx); err != nil && err != gohttp.ErrServerClosed {
+			rval = fmt.Errorf("http.Shutdown(): %v", err)
+		}
+	}
+	if err := e.stopWorkers(); err != nil && rval == nil {
+		rval = err
+	}
+	return rval
+}
+
+// stopWorkers closes everything but the web server and unregisters the
+// metrics, ending the current generation.
+func (e *Exporter) stopWorkers() error {
+	e.mu.Lock()
+	started := e.started
+	e.generation++
+	e.mu.Unlock()
+
+	var rval error
+	keep := func(err error) {
+		if err != nil && rval == nil {
+			rval = err
+		}
+	}
+	if started {
+		if e.snmp != nil {
+			keep(e.snmp.Close())
+		}
+		if e.modbus != nil {
+			keep(e.modbus.Close())
+		}
+	}
+	if e.push != nil {
+		e.push.Close()
+	}
+	if e.probe != nil {
+		e.probe.Close()
+	}
+	if e.engine != nil {
+		keep(e.engine.Close())
+		keep(e.engine.mon.Close())
+	}
+	e.unregister()
+	if e.store != nil {
+		keep(e.store.Close())
+	}
+	e.store, e.engine, e.snmp, e.modbus, e.push, e.probe = nil, nil, nil, nil, nil, nil
+	return rval
+}
+
+// Reload rebuilds the exporter from opts: it logs in again, polls, and
+// replaces the sinks, the SNMP, Modbus and push servers, and the web
+// routes, without closing the web listener.  The listener itself, from
+// opts.HTTP's Port, ListenAddress and TLS files, only changes on restart.
+// If the exporter can't be built from opts, it goes back to its previous
+// Options and Reload says why.  If those fail too, as when the gateway is
+// unreachable, the probes and /-/reload keep answering while the previous
+// Options are retried in the background.
+func (e *Exporter) Reload(opts Options) error {
+	e.reloading.Lock()
+	defer e.reloading.Unlock()
+	return e.reloadLocked(opts)
+}
+
+// reloadLocked is Reload, with e.reloading held.
+func (e *Exporter) reloadLocked(opts Options) error {
+	e.mu.Lock()
+	stopping, prev := e.stopping, e.opts
+	e.mu.Unlock()
+	if stopping {
+		return fmt.Errorf("exporter is stopped")
+	}
+	if opts.HTTP.Port != prev.HTTP.Port || opts.HTTP.ListenAddress != prev.HTTP.ListenAddress ||
+		opts.HTTP.TLSCert != prev.HTTP.TLSCert || opts.HTTP.TLSKey != prev.HTTP.TLSKey {
+		glog.Warning("The web interface's port, listen address and TLS files only change on restart")
+	}
+	// Nothing to serve until the new exporter is built, but the probes
+	// still answer.
+	drained := e.srv.Swap(e.unavailable(prev, fmt.Errorf("reloading the configuration")))
+	// Scrapes still being served may be using the state store and the
+	// sinks, so let them finish before closing those.
+	select {
+	case <-drained:
+	case <-time.After(kShutdownTimeout):
+		glog.Warningf("Requests still running after %s; reloading regardless", kShutdownTimeout)
+	}
+	if err := e.stopWorkers(); err != nil {
+		glog.Errorf("stopWorkers(): %v", err)
+	}
+	err := e.rebuild(opts)
+	if err == nil {
+		glog.Info("Reloaded the configuration")
+		return nil
+	}
+	glog.Errorf("Reload failed, going back to the previous configuration: %v", err)
+	if perr := e.rebuild(prev); perr != nil {
+		err = fmt.Errorf("%v; the previous configuration failed too: %v", err, perr)
+		// Typically the gateway is unreachable, so keep trying the
+		// previous configuration until it comes back.
+		e.srv.Swap(e.unavailable(prev, err))
+		e.mu.Lock()
+		generation := e.generation
+		e.mu.Unlock()
+		go e.recover(prev, generation)
+	}
+	return err
+}
+
+// unavailable returns what e's listener serves while there is no
+// exporter built: /healthz, /-/reload if configured, and /readyz, which
+// fails with why.  Everything else fails the same way.
+func (e *Exporter) unavailable(opts Options, why error) gohttp.Handler {
+	opts.HTTP.Ready = func() error { return why }
+	opts.HTTP.Status = nil
+	srv := http.New(opts.HTTP)
+	srv.HandleFunc("/metrics", func(rw gohttp.ResponseWriter, req *gohttp.Request) {
+		gohttp.Error(rw, why.Error(), gohttp.StatusServiceUnavailable)
+	})
+	if opts.Reload != nil && opts.ReloadEndpoint {
+		srv.HandleFunc("/-/reload", e.serveReload)
+	}
+	return srv
+}
+
+// recover rebuilds the exporter from opts after a reload left it with
+// nothing to serve, backing off as the circuit breaker does, until it
+// succeeds or Stop or another reload ends generation.
+func (e *Exporter) recover(opts Options, generation int) {
+	maxBackoff := opts.Breaker.MaxBackoff
+	if maxBackoff < kBreakerBackoff {
+		maxBackoff = kBreakerBackoff
+	}
+	for backoff := kBreakerBackoff; ; backoff *= 2 {
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		time.Sleep(backoff)
+		e.reloading.Lock()
+		e.mu.Lock()
+		done := e.stopping || e.generation != generation
+		e.mu.Unlock()
+		if done {
+			e.reloading.Unlock()
+			return
+		}
+		err := e.rebuild(opts)
+		e.reloading.Unlock()
+		if err == nil {
+			glog.Info("Recovered the previous configuration")
+			return
+		}
+		glog.Errorf("Rebuilding the previous configuration failed; will retry: %v", err)
+	}
+}
+
+// rebuild builds a new exporter from opts and takes over its parts,
+// serving its routes on e's listener.
+func (e *Exporter) rebuild(opts Options) error {
+	n, err := newExporter(opts)
+	if err != nil {
+		return err
+	}
+	if opts.Reload != nil && opts.ReloadEndpoint {
+		n.srv.HandleFunc("/-/reload", e.serveReload)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.opts, e.store, e.engine, e.snmp, e.modbus, e.push, e.probe = n.opts, n.store, n.engine, n.snmp, n.modbus, n.push, n.probe
+	e.collectors = n.collectors
+	if e.started {
+		e.startWorkers()
+	}
+	e.srv.Swap(n.srv)
+	return nil
+}
+
+// reload rebuilds the exporter with the Options from Options.Reload.
+// Loading them sets flags, so it is serialized with the reload itself.
+func (e *Exporter) reload() error {
+	e.reloading.Lock()
+	defer e.reloading.Unlock()
+	e.mu.Lock()
+	load := e.opts.Reload
+	e.mu.Unlock()
+	if load == nil {
+		return fmt.Errorf("reloading is not configured")
+	}
+	opts, err := load()
+	if err != nil {
+		return fmt.Errorf("Reload(): %v", err)
+	}
+	return e.reloadLocked(opts)
+}
+
+// serveReload reloads the configuration on POST, as Prometheus' own
+// /-/reload does.
+func (e *Exporter) serveReload(rw gohttp.ResponseWriter, req *gohttp.Request) {
+	if req.Method != gohttp.MethodPost && req.Method != gohttp.MethodPut {
+		rw.Header().Set("Allow", "POST, PUT")
+		gohttp.Error(rw, "POST to reload the configuration", gohttp.StatusMethodNotAllowed)
+		return
+	}
+	http.Untrack(req)
+	if err := e.reload(); err != nil {
+		gohttp.Error(rw, err.Error(), gohttp.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+// register registers cs with the default registry, to be unregistered
+// with the rest of e's collectors.
+func (e *Exporter) register(cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := prometheus.Register(c); err != nil {
+			return fmt.Errorf("prometheus.Register(): %v", err)
+		}
+		e.collectors = append(e.collectors, c)
+	}
+	return nil
+}
+
+func (e *Exporter) unregister() {
+	for _, c := range e.collectors {
+		prometheus.Unregister(c)
+	}
+	e.collectors = nil
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"io"
+	gohttp "net/http"
+	"time"
+)
+
+// DumpLogs logs in to the gateway and writes its logs, a gzipped tarball,
+// to w, so support bundles can be grabbed without visiting the
+// gateway's web interface.
+func DumpLogs(opts Options, w io.Writer) error {
+	if opts.Backend == CloudBackend {
+		return fmt.Errorf("the Tesla cloud doesn't serve gateway logs")
+	}
+	mon, err := powerwall.New(opts.Powerwall)
+	if err != nil {
+		return fmt.Errorf("powerwall.New(): %v", err)
+	}
+	defer mon.Close()
+	return mon.(powerwall.LogFetcher).GetLogs(context.Background(), w)
+}
+
+// headerWriter sets the download headers on the first Write, so a failure
+// before the gateway sends anything can still be reported as an error.
+type headerWriter struct {
+	rw      gohttp.ResponseWriter
+	started bool
+}
+
+func (h *headerWriter) Write(b []byte) (int, error) {
+	if !h.started {
+		h.started = true
+		h.rw.Header().Set("Content-Type", "application/gzip")
+		h.rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gateway-logs-%s.tar.gz"`, time.Now().Format("20060102-150405")))
+	}
+	return h.rw.Write(b)
+}
+
+// serveGatewayLogs serves the gateway's logs at /debug/gatewaylogs.
+func (p *PollEngine) serveGatewayLogs(rw gohttp.ResponseWriter, req *gohttp.Request) {
+	f, ok := p.mon.(powerwall.LogFetcher)
+	if !ok {
+		gohttp.Error(rw, "this backend can't fetch gateway logs", gohttp.StatusNotImplemented)
+		return
+	}
+	w := &headerWriter{rw: rw}
+	if err := f.GetLogs(req.Context(), w); err != nil {
+		glog.Errorf("GetLogs(): %v", err)
+		if !w.started {
+			gohttp.Error(rw, err.Error(), gohttp.StatusBadGateway)
+		}
+	}
+}
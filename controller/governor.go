@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+// GovernorOptions are resource budgets for constrained hardware.  When a
+// poll goes over budget, the low priority parts of polling are turned off
+// one at a time, and turned back on once things have been calm for a
+// while.
+type GovernorOptions struct {
+	// CPUBudget is the fraction of one core the exporter may use,
+	// averaged between polls.  0 means no budget.
+	CPUBudget float64
+	// LatencyBudget is how long a poll may take.  0 means no budget.
+	LatencyBudget time.Duration
+}
+
+const (
+	// kCalmPolls is how many polls in a row must come in well under
+	// budget before a shed collector is turned back on.
+	kCalmPolls = 10
+	kCollector = "collector"
+	kReason    = "reason"
+)
+
+// kShedOrder lists the collectors the governor may shed, least important
+// first.
+var kShedOrder = []string{model.CollectorOverlay, model.CollectorVitals, model.CollectorGridFaults}
+
+type shedCollector struct {
+	collector, reason string
+}
+
+// governor decides which collectors to shed.
+type governor struct {
+	opts    GovernorOptions
+	enabled []string // from kShedOrder, those polling would otherwise run.
+	gauge   *prometheus.GaugeVec
+
+	mu      sync.Mutex
+	last    time.Time
+	lastCPU time.Duration
+	shed    []shedCollector
+	calm    int
+}
+
+func newGovernor(opts GovernorOptions, poll model.PollOptions, gauge *prometheus.GaugeVec) *governor {
+	g := &governor{opts: opts, gauge: gauge}
+	for _, c := range kShedOrder {
+		switch {
+		case c == model.CollectorOverlay && poll.Overlay == nil:
+		case c == model.CollectorVitals && !poll.Vitals:
+		default:
+			g.enabled = append(g.enabled, c)
+		}
+	}
+	g.last = time.Now()
+	g.lastCPU, _ = cpuTime()
+	return g
+}
+
+// apply returns opts with the shed collectors turned off.
+func (g *governor) apply(opts model.PollOptions) model.PollOptions {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.shed) == 0 {
+		return opts
+	}
+	opts.Shed = make(map[string]bool)
+	for _, s := range g.shed {
+		opts.Shed[s.collector] = true
+	}
+	return opts
+}
+
+// observe checks a poll which took elapsed, and the CPU used since the
+// previous one, against the budgets.
+func (g *governor) observe(elapsed time.Duration) {
+	if g.opts.CPUBudget <= 0 && g.opts.LatencyBudget <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	cpu, haveCPU := cpuTime()
+	var cpuUsed float64
+	if wall := now.Sub(g.last); haveCPU && wall > 0 {
+		cpuUsed = float64(cpu-g.lastCPU) / float64(wall)
+	}
+	g.last, g.lastCPU = now, cpu
+	cpuBudget := g.opts.CPUBudget > 0 && haveCPU
+	latencyBudget := g.opts.LatencyBudget > 0
+
+	reason := ""
+	switch {
+	case cpuBudget && cpuUsed > g.opts.CPUBudget:
+		reason = "cpu"
+	case latencyBudget && elapsed > g.opts.LatencyBudget:
+		reason = "latency"
+	}
+	if reason != "" {
+		g.calm = 0
+		if len(g.shed) < len(g.enabled) {
+			c := g.enabled[len(g.shed)]
+			g.shed = append(g.shed, shedCollector{c, reason})
+			g.gauge.WithLabelValues(c, reason).Set(1)
+			glog.Warningf("Over the %s budget (CPU %.0f%% of a core, poll took %s); turning off %s", reason, cpuUsed*100, elapsed, c)
+		}
+		return
+	}
+	if (cpuBudget && cpuUsed > g.opts.CPUBudget/2) || (latencyBudget && elapsed > g.opts.LatencyBudget/2) {
+		g.calm = 0
+		return
+	}
+	g.calm++
+	if g.calm >= kCalmPolls && len(g.shed) > 0 {
+		g.calm = 0
+		s := g.shed[len(g.shed)-1]
+		g.shed = g.shed[:len(g.shed)-1]
+		g.gauge.DeleteLabelValues(s.collector, s.reason)
+		glog.Infof("Back under budget; turning %s on again", s.collector)
+	}
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	gohttp "net/http"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// kMaxClockSkew is how far the gateway's clock may drift from ours.
+	kMaxClockSkew = 2 * time.Minute
+	// kMinFreeBytes is the least free space we want next to the state
+	// file.
+	kMinFreeBytes = 10 << 20
+)
+
+// healthCheck is the outcome of one check in the deep health report.
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Weight int    `json:"weight"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthReport is served at /health/deep.
+type healthReport struct {
+	// Score is the weighted percentage of checks that passed.
+	Score int `json:"score"`
+	// Status is "healthy" if every check passed, "unhealthy" if the
+	// gateway can't be reached, and "degraded" otherwise.
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+// deepHealth judges the most recent polls and serves a scored report.  It
+// answers 503 when unhealthy, so it can be used as a probe as well.
+func (p *PollEngine) deepHealth(rw gohttp.ResponseWriter, req *gohttp.Request) {
+	r := p.evaluateHealth()
+	rw.Header().Set("Content-Type", "application/json")
+	if r.Status == "unhealthy" {
+		rw.WriteHeader(gohttp.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		glog.Errorf("encoding health report: %v", err)
+	}
+}
+
+func (p *PollEngine) evaluateHealth() healthReport {
+	var checks []healthCheck
+	add := func(name string, weight int, err error) {
+		c := healthCheck{Name: name, Weight: weight, OK: err == nil}
+		if err != nil {
+			c.Detail = err.Error()
+		}
+		checks = append(checks, c)
+	}
+
+	// Every check is judged from the polls already made, so probing
+	// this page adds nothing to the gateway's load.
+	p.mu.Lock()
+	polled, err, latest := p.lastPoll, p.lastErr, p.latest
+	p.mu.Unlock()
+	if polled.IsZero() {
+		err = fmt.Errorf("the gateway hasn't been polled yet")
+	}
+	add("gateway_reachable", 40, err)
+	if err != nil && powerwall.IsAuthError(err) {
+		add("login_valid", 20, fmt.Errorf("the gateway rejected our credentials: %v", err))
+	} else {
+		add("login_valid", 20, nil)
+	}
+	if latest != nil && !latest.StartTime.IsZero() {
+		gatewayNow := latest.StartTime.Add(latest.Uptime)
+		skew := latest.PolledAt.Sub(gatewayNow)
+		if skew < 0 {
+			skew = -skew
+		}
+		var err error
+		if skew > kMaxClockSkew {
+			err = fmt.Errorf("gateway clock is %s away from ours", skew.Round(time.Second))
+		}
+		add("clock_skew", 10, err)
+	}
+
+	if fr, ok := p.mon.(powerwall.FreshnessReporter); ok {
+		last := fr.LastSuccess()
+		var endpoints []string
+		for ep := range last {
+			endpoints = append(endpoints, ep)
+		}
+		sort.Strings(endpoints)
+		for _, ep := range endpoints {
+			var err error
+			limit := kReadyPolls * p.interval
+			if d := kReadyPolls * p.schedule[ep]; d > limit {
+				limit = d
+			}
+			if age := time.Since(last[ep]); age > limit {
+				err = fmt.Errorf("last successful response %s ago", age.Round(time.Second))
+			}
+			add("fresh:"+ep, 5, err)
+		}
+	}
+
+	if p.stateFile != "" {
+		free, err := freeBytes(filepath.Dir(p.stateFile))
+		if err == nil && free < kMinFreeBytes {
+			err = fmt.Errorf("only %d bytes free for the state file", free)
+		}
+		add("state_disk_space", 10, err)
+	}
+
+	r := healthReport{Checks: checks, Status: "healthy"}
+	total, passed := 0, 0
+	for _, c := range checks {
+		total += c.Weight
+		if c.OK {
+			passed += c.Weight
+		} else if r.Status == "healthy" {
+			r.Status = "degraded"
+		}
+	}
+	if total > 0 {
+		r.Score = passed * 100 / total
+	}
+	if !checks[0].OK {
+		r.Status = "unhealthy"
+	}
+	return r
+}
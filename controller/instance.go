@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+)
+
+const kInstanceIDKey = "instance_id"
+
+// instanceID returns the ID of this exporter installation, generating and
+// saving one the first time.  Without a state file a new ID is made on
+// every start, which defeats the purpose, so that is logged.
+func instanceID(store *state.Store, persistent bool) (string, error) {
+	var rval string
+	ok, err := store.Get(kInstanceIDKey, &rval)
+	if err != nil {
+		return "", err
+	}
+	if ok && rval != "" {
+		return rval, nil
+	}
+	rval = uuid.New().String()
+	if err := store.Put(kInstanceIDKey, rval); err != nil {
+		return "", fmt.Errorf("saving instance ID: %v", err)
+	}
+	if !persistent {
+		glog.Warningf("Generated instance ID %s, but without --state_file it will change when the exporter restarts", rval)
+	} else {
+		glog.Infof("Generated instance ID %s", rval)
+	}
+	return rval, nil
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+const kEndpoint = "endpoint"
+
+// selfMetrics describe the health of the exporter itself, as opposed to
+// the gateway, so dashboards can tell "gateway down" from "exporter
+// broken".
+type selfMetrics struct {
+	scrapeDuration prometheus.Gauge
+	scrapeErrors   *prometheus.CounterVec
+	up             prometheus.Gauge
+	info           prometheus.Gauge
+	shed           *prometheus.GaugeVec
+	breakerOpen    prometheus.Gauge
+	coalesced      prometheus.Counter
+	sinkErrors     *prometheus.CounterVec
+}
+
+func newSelfMetrics(instanceID string) (*selfMetrics, error) {
+	r := &selfMetrics{
+		scrapeDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "powerwall_scrape_duration_seconds",
+			Help: "time taken by the most recent poll of the gateway",
+		}),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "powerwall_scrape_errors_total",
+			Help: "number of polls of the gateway which failed, by the endpoint which failed",
+		}, []string{kEndpoint}),
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "powerwall_up",
+			Help: "if 1, the most recent poll of the gateway succeeded",
+		}),
+		info: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "powerwall_exporter_instance_info",
+			Help:        "always 1; labeled with the ID generated when this exporter installation first ran",
+			ConstLabels: prometheus.Labels{"instance_id": instanceID},
+		}),
+	}
+	r.shed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "powerwall_collector_shed",
+		Help: "1 for each low priority collector turned off to stay within the resource budgets, labeled with the budget that was exceeded",
+	}, []string{kCollector, kReason})
+	r.breakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "powerwall_circuit_breaker_open",
+		Help: "if 1, the gateway stopped answering and is only being tried now and then; the exported gateway metrics are the last ones polled",
+	})
+	r.coalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "powerwall_coalesced_scrapes_total",
+		Help: "scrapes which arrived while another's poll of the gateway was running, and shared its result rather than polling again",
+	})
+	r.sinkErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "powerwall_sink_errors_total",
+		Help: "polls a sink failed to deliver, by sink",
+	}, []string{"sink"})
+	r.info.Set(1)
+	for i, c := range r.collectors() {
+		if err := prometheus.Register(c); err != nil {
+			// Leave nothing half registered.
+			for _, c := range r.collectors()[:i] {
+				prometheus.Unregister(c)
+			}
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (s *selfMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		s.scrapeDuration,
+		s.scrapeErrors,
+		s.up,
+		s.info,
+		s.shed,
+		s.breakerOpen,
+		s.coalesced,
+		s.sinkErrors,
+	}
+}
+
+// observe records the outcome of a poll which took elapsed and returned err.
+func (s *selfMetrics) observe(elapsed time.Duration, err error) {
+	s.scrapeDuration.Set(elapsed.Seconds())
+	if err == nil {
+		s.up.Set(1)
+		return
+	}
+	s.up.Set(0)
+	s.scrapeError(err)
+}
+
+// scrapeError counts err, from a poll or one of its optional collectors,
+// against the endpoint which failed.
+func (s *selfMetrics) scrapeError(err error) {
+	endpoint := "none"
+	var re *powerwall.RequestError
+	if errors.As(err, &re) {
+		endpoint = re.Endpoint
+	}
+	s.scrapeErrors.With(prometheus.Labels{kEndpoint: endpoint}).Inc()
+}
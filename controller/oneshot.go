@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/view"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"io"
+)
+
+// Formats OneShot can write.
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// OneShot polls the gateway once, writes the metrics to w in the given
+// format, and shuts down, for checking credentials and for cron jobs.
+func OneShot(opts Options, w io.Writer, format string) error {
+	if format != TextFormat && format != JSONFormat {
+		return fmt.Errorf("unknown format %q, want %s or %s", format, TextFormat, JSONFormat)
+	}
+	e, err := New(opts)
+	if err != nil {
+		return err
+	}
+	defer e.Stop()
+	if e.engine == nil {
+		return fmt.Errorf("there is no gateway to poll")
+	}
+	if format == JSONFormat {
+		return view.WriteJSON(w, prometheus.DefaultGatherer)
+	}
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("Gather(): %v", err)
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
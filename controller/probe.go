@@ -0,0 +1,267 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/view"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
+	gohttp "net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kDefaultModule is the module /probe uses when the request doesn't
+	// name one.
+	kDefaultModule = "default"
+	// kProbeIdle is how long a probed target may go unscraped before its
+	// Monitor is closed and forgotten.
+	kProbeIdle = 10 * time.Minute
+	// kAllow starts a probe modules line listing a module's targets.
+	kAllow = "allow "
+)
+
+// ProbeModule is a login /probe can use with a gateway.
+type ProbeModule struct {
+	Username string
+	Password string
+	// Targets are the gateways this login may be used with.  /probe
+	// refuses any other, so a caller can't have the exporter send the
+	// credentials to a host of their choosing.
+	Targets []string
+}
+
+// allows returns true if gateway is one of m's Targets.
+func (m ProbeModule) allows(gateway string) bool {
+	for _, t := range m.Targets {
+		if t == gateway {
+			return true
+		}
+	}
+	return false
+}
+
+// ProbeOptions configures the multi-target /probe endpoint, which polls
+// whichever gateway Prometheus names in ?target=, logging in with the
+// credentials named in ?module=.
+type ProbeOptions struct {
+	// Modules maps module names to logins.  If empty, /probe is not served.
+	Modules map[string]ProbeModule
+}
+
+// LoadProbeModules reads module:username:password lines from path, and
+// "allow module gateway..." lines naming the gateways each module may
+// probe.  Every module needs at least one allowed gateway.  Blank lines
+// and lines starting with # are ignored.
+func LoadProbeModules(path string) (map[string]ProbeModule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rval := make(map[string]ProbeModule)
+	allowed := make(map[string][]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, kAllow) {
+			fields := strings.Fields(strings.TrimPrefix(line, kAllow))
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: want allow module gateway...", path, i+1)
+			}
+			allowed[fields[0]] = append(allowed[fields[0]], fields[1:]...)
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%s:%d: want module:username:password", path, i+1)
+		}
+		rval[parts[0]] = ProbeModule{Username: parts[1], Password: parts[2]}
+	}
+	for name, targets := range allowed {
+		m, ok := rval[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: allow line for unknown module %q", path, name)
+		}
+		m.Targets = targets
+		rval[name] = m
+	}
+	for name, m := range rval {
+		if len(m.Targets) == 0 {
+			return nil, fmt.Errorf("%s: module %q has no allow line naming the gateways it may probe", path, name)
+		}
+	}
+	return rval, nil
+}
+
+// prober serves /probe.  It keeps a logged in Monitor for each target and
+// module it has been asked about, so repeated scrapes don't log in again.
+// Probed targets are polled on every scrape and don't get derived metrics,
+// which need state kept between polls.
+type prober struct {
+	opts        ProbeOptions
+	request     powerwall.RequestPolicy
+	maxRequests int
+	view        view.Options
+	pollOpts    model.PollOptions
+
+	mu      sync.Mutex
+	targets map[string]*probeTarget
+}
+
+// probeTarget is a gateway being probed.  mu serializes logging in to it
+// and polls of it; lastUsed is guarded by the prober's mu.
+type probeTarget struct {
+	mu    sync.Mutex
+	mon   powerwall.Monitor // nil until logged in
+	fixed *model.FixedInfo
+	view  *view.PrometheusCounters
+
+	lastUsed time.Time
+}
+
+func newProber(opts Options) *prober {
+	return &prober{
+		opts:        opts.Probe,
+		request:     opts.Powerwall.Request,
+		maxRequests: opts.Powerwall.MaxRequestsPerMinute,
+		view:        opts.View,
+		pollOpts:    opts.Poll,
+		targets:     make(map[string]*probeTarget),
+	}
+}
+
+// target returns the probeTarget for the given gateway and module, and
+// closes the targets which haven't been probed for kProbeIdle.  The
+// target is logged in by its first poll, so a slow gateway holds up only
+// its own probes.
+func (p *prober) target(gateway, module string) *probeTarget {
+	key := module + "@" + gateway
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, t := range p.targets {
+		if k != key && now.Sub(t.lastUsed) > kProbeIdle {
+			delete(p.targets, k)
+			go t.close()
+		}
+	}
+	t, ok := p.targets[key]
+	if !ok {
+		t = &probeTarget{}
+		p.targets[key] = t
+	}
+	t.lastUsed = now
+	return t
+}
+
+// login logs in to gateway, if t isn't already.  t.mu must be held.
+func (t *probeTarget) login(p *prober, gateway string, login ProbeModule) error {
+	if t.mon != nil {
+		return nil
+	}
+	mon, err := powerwall.New(powerwall.Options{
+		Gateway:              gateway,
+		Username:             login.Username,
+		Password:             login.Password,
+		Request:              p.request,
+		MaxRequestsPerMinute: p.maxRequests,
+	})
+	if err != nil {
+		return fmt.Errorf("powerwall.New(): %v", err)
+	}
+	fixed, err := model.New(mon, p.pollOpts)
+	if err != nil {
+		mon.Close()
+		return fmt.Errorf("model.New(): %v", err)
+	}
+	t.mon, t.fixed, t.view = mon, fixed, view.NewCollector(fixed, p.view)
+	return nil
+}
+
+// close closes t's Monitor, once any poll of it is done.
+func (t *probeTarget) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.mon != nil {
+		t.mon.Close()
+		t.mon = nil
+	}
+}
+
+// Close closes every target's Monitor.  A reload builds a new prober, so
+// this one's targets would otherwise never be probed, and closed, again.
+func (p *prober) Close() {
+	p.mu.Lock()
+	targets := p.targets
+	p.targets = make(map[string]*probeTarget)
+	p.mu.Unlock()
+	for _, t := range targets {
+		t.close()
+	}
+}
+
+func (p *prober) ServeHTTP(rw gohttp.ResponseWriter, req *gohttp.Request) {
+	gateway := req.URL.Query().Get("target")
+	if gateway == "" {
+		gohttp.Error(rw, "missing target parameter", gohttp.StatusBadRequest)
+		return
+	}
+	module := req.URL.Query().Get("module")
+	if module == "" {
+		module = kDefaultModule
+	}
+	login, ok := p.opts.Modules[module]
+	if !ok {
+		gohttp.Error(rw, fmt.Sprintf("unknown module %q", module), gohttp.StatusBadRequest)
+		return
+	}
+	if !login.allows(gateway) {
+		gohttp.Error(rw, fmt.Sprintf("module %q may not probe %q", module, gateway), gohttp.StatusForbidden)
+		return
+	}
+
+	success := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "powerwall_probe_success",
+		Help: "if 1, the probe of the target succeeded",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "powerwall_probe_duration_seconds",
+		Help: "how long the probe of the target took",
+	})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(success, duration)
+
+	before := time.Now()
+	t := p.target(gateway, module)
+	v, err := t.poll(p, gateway, login)
+	duration.Set(time.Now().Sub(before).Seconds())
+	if err != nil {
+		glog.Errorf("probing %s: %v", gateway, err)
+	} else {
+		success.Set(1)
+		reg.MustRegister(v)
+	}
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rw, req)
+}
+
+// poll logs in to the target if need be, polls it and returns its
+// metrics.
+func (t *probeTarget) poll(p *prober, gateway string, login ProbeModule) (*view.PrometheusCounters, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.login(p, gateway, login); err != nil {
+		return nil, err
+	}
+	stats, err := model.Poll(t.mon, t.fixed, p.pollOpts)
+	if err != nil {
+		return nil, err
+	}
+	return t.view, t.view.Update(stats)
+}
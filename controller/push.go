@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/egress"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	gohttp "net/http"
+	"sync"
+	"time"
+)
+
+// PushOptions configures pushing the metrics out, for sites on networks
+// Prometheus can't scrape into.
+type PushOptions struct {
+	// PushgatewayURL is a Prometheus Pushgateway to push to, such as
+	// http://pushgateway:9091.  Empty means don't.
+	PushgatewayURL string
+	// Interval is how often to push.
+	Interval time.Duration
+	// Job is the job label the Pushgateway groups the metrics under.
+	// Empty means powerwall_exporter.
+	Job string
+}
+
+func (p PushOptions) enabled() bool {
+	return p.PushgatewayURL != ""
+}
+
+// pusher pushes the default registry to the Pushgateway every interval.
+// In scrape mode nothing else polls the gateway, so it polls before each
+// push.
+type pusher struct {
+	engine  *PollEngine
+	gateway *push.Pusher
+	ticker  *time.Ticker
+	close   chan struct{}
+	looping sync.WaitGroup
+}
+
+// newPusher returns a pusher for engine, which pushes with the given
+// instance label.
+func newPusher(opts PushOptions, engine *PollEngine, instance string) *pusher {
+	cli := &gohttp.Client{Timeout: opts.Interval, Transport: egress.Wrap(nil)}
+	job := opts.Job
+	if job == "" {
+		job = "powerwall_exporter"
+	}
+	return &pusher{
+		engine: engine,
+		gateway: push.New(opts.PushgatewayURL, job).
+			Gatherer(prometheus.DefaultGatherer).
+			Grouping("instance", instance).
+			Client(cli),
+		ticker: time.NewTicker(opts.Interval),
+		close:  make(chan struct{}),
+	}
+}
+
+func (p *pusher) start() {
+	p.looping.Add(1)
+	go func() {
+		defer p.looping.Done()
+		for {
+			select {
+			case <-p.close:
+				return
+			case <-p.ticker.C:
+				if err := p.pushOnce(); err != nil {
+					glog.Errorf("pusher.pushOnce(): %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (p *pusher) pushOnce() error {
+	if p.engine.mode == PollOnScrape {
+		// As with scrapes, push the last metrics while the breaker is
+		// open.
+		if err := p.engine.poll(); err != nil && !p.engine.breaker.tripped() {
+			return fmt.Errorf("poll(): %v", err)
+		}
+	}
+	if err := p.gateway.Push(); err != nil {
+		return fmt.Errorf("Push(): %v", err)
+	}
+	return nil
+}
+
+// Close stops pushing, waiting for a push in progress to finish.
+func (p *pusher) Close() {
+	p.ticker.Stop()
+	close(p.close)
+	p.looping.Wait()
+}
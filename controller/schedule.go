@@ -0,0 +1,303 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall/vitals"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule slows down fetching of individual gateway endpoints, keyed by
+// path relative to /api such as /networks.  Endpoints not listed are
+// fetched on every poll, so the poll interval sets the fastest rate; a
+// poll between fetches of a scheduled endpoint repeats its last response.
+type Schedule map[string]time.Duration
+
+const (
+	kVitalsEndpoint = "/devices/vitals"
+	// kBackupEventsEndpoint is the cloud backend's backup history, which
+	// the gateway itself doesn't serve.
+	kBackupEventsEndpoint = "/backup_events"
+)
+
+// ParseSchedule parses comma separated endpoint=interval settings, such as
+// /networks=5m,/status=5m.  The leading slash may be left out.
+func ParseSchedule(spec string) (Schedule, error) {
+	rval := make(Schedule)
+	if spec == "" {
+		return rval, nil
+	}
+	known := map[string]bool{kVitalsEndpoint: true, kBackupEventsEndpoint: true}
+	for _, ep := range powerwall.Endpoints {
+		known[ep] = true
+	}
+	for _, part := range strings.Split(spec, ",") {
+		eq := strings.SplitN(part, "=", 2)
+		if len(eq) != 2 {
+			return nil, fmt.Errorf("%q: want endpoint=interval", part)
+		}
+		ep := "/" + strings.TrimPrefix(strings.TrimSpace(eq[0]), "/")
+		if !known[ep] {
+			var names []string
+			for k := range known {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown endpoint %q; try one of %s", ep, strings.Join(names, ", "))
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(eq[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", eq[1], err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("%s: interval must be positive", ep)
+		}
+		rval[ep] = d
+	}
+	return rval, nil
+}
+
+// scheduledMonitor is a Monitor which repeats an endpoint's last response
+// until its scheduled interval has passed.  Only the endpoints the model
+// reads are scheduled; GetRaw always fetches.  Every method is written
+// out, rather than embedding the Monitor, so a method added to Monitor
+// can't silently bypass the schedule.
+type scheduledMonitor struct {
+	mon      powerwall.Monitor
+	schedule Schedule
+
+	mu    sync.Mutex
+	cache map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	at    time.Time
+	value interface{}
+}
+
+// scheduled returns mon, wrapped to follow schedule if it has any
+// entries.
+func scheduled(mon powerwall.Monitor, schedule Schedule) powerwall.Monitor {
+	if len(schedule) == 0 {
+		return mon
+	}
+	return &scheduledMonitor{
+		mon:      mon,
+		schedule: schedule,
+		cache:    make(map[string]cachedResponse),
+	}
+}
+
+// get returns endpoint's last response if it is still on schedule, and
+// otherwise fetches it.  Failures aren't cached, so the next poll tries
+// again.
+func (s *scheduledMonitor) get(endpoint string, fetch func() (interface{}, error)) (interface{}, error) {
+	interval, ok := s.schedule[endpoint]
+	if !ok {
+		return fetch()
+	}
+	s.mu.Lock()
+	c, ok := s.cache[endpoint]
+	s.mu.Unlock()
+	if ok && time.Since(c.at) < interval {
+		return c.value, nil
+	}
+	v, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.cache[endpoint] = cachedResponse{at: time.Now(), value: v}
+	s.mu.Unlock()
+	return v, nil
+}
+
+// forget drops endpoint's last response, so the next poll fetches it.
+func (s *scheduledMonitor) forget(endpoint string) {
+	s.mu.Lock()
+	delete(s.cache, endpoint)
+	s.mu.Unlock()
+}
+
+func (s *scheduledMonitor) Close() error {
+	return s.mon.Close()
+}
+
+func (s *scheduledMonitor) GetRaw(endpoint string) (json.RawMessage, error) {
+	return s.mon.GetRaw(endpoint)
+}
+
+// LastSuccess forwards to the Monitor if it is a FreshnessReporter, and
+// otherwise reports nothing.
+func (s *scheduledMonitor) LastSuccess() map[string]time.Time {
+	if fr, ok := s.mon.(powerwall.FreshnessReporter); ok {
+		return fr.LastSuccess()
+	}
+	return nil
+}
+
+// GetLogs forwards to the Monitor if it is a LogFetcher.
+func (s *scheduledMonitor) GetLogs(ctx context.Context, w io.Writer) error {
+	if lf, ok := s.mon.(powerwall.LogFetcher); ok {
+		return lf.GetLogs(ctx, w)
+	}
+	return fmt.Errorf("this backend can't fetch the gateway's logs")
+}
+
+func (s *scheduledMonitor) GetNetworks() ([]powerwall.Network, error) {
+	v, err := s.get("/networks", func() (interface{}, error) { return s.mon.GetNetworks() })
+	if err != nil {
+		return nil, err
+	}
+	return v.([]powerwall.Network), nil
+}
+
+func (s *scheduledMonitor) GetSiteInfo() (*powerwall.SiteInfo, error) {
+	v, err := s.get("/site_info", func() (interface{}, error) { return s.mon.GetSiteInfo() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.SiteInfo), nil
+}
+
+func (s *scheduledMonitor) GetOperation() (*powerwall.Operation, error) {
+	v, err := s.get("/operation", func() (interface{}, error) { return s.mon.GetOperation() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.Operation), nil
+}
+
+func (s *scheduledMonitor) GetConfig() (*powerwall.Config, error) {
+	v, err := s.get("/config", func() (interface{}, error) { return s.mon.GetConfig() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.Config), nil
+}
+
+func (s *scheduledMonitor) GetPowerwalls() (*powerwall.Powerwalls, error) {
+	v, err := s.get("/powerwalls", func() (interface{}, error) { return s.mon.GetPowerwalls() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.Powerwalls), nil
+}
+
+func (s *scheduledMonitor) GetStatus() (*powerwall.Status, error) {
+	v, err := s.get("/status", func() (interface{}, error) { return s.mon.GetStatus() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.Status), nil
+}
+
+func (s *scheduledMonitor) GetSiteMaster() (*powerwall.SiteMaster, error) {
+	v, err := s.get("/sitemaster", func() (interface{}, error) { return s.mon.GetSiteMaster() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.SiteMaster), nil
+}
+
+func (s *scheduledMonitor) GetAggregates() (*powerwall.Aggregates, error) {
+	v, err := s.get("/meters/aggregates", func() (interface{}, error) { return s.mon.GetAggregates() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.Aggregates), nil
+}
+
+func (s *scheduledMonitor) GetMetersSite() ([]powerwall.CTMeter, error) {
+	v, err := s.get("/meters/site", func() (interface{}, error) { return s.mon.GetMetersSite() })
+	if err != nil {
+		return nil, err
+	}
+	return v.([]powerwall.CTMeter), nil
+}
+
+func (s *scheduledMonitor) GetMetersSolar() ([]powerwall.CTMeter, error) {
+	v, err := s.get("/meters/solar", func() (interface{}, error) { return s.mon.GetMetersSolar() })
+	if err != nil {
+		return nil, err
+	}
+	return v.([]powerwall.CTMeter), nil
+}
+
+func (s *scheduledMonitor) GetMetersReadings() (map[string]powerwall.MeterReading, error) {
+	v, err := s.get("/meters/readings", func() (interface{}, error) { return s.mon.GetMetersReadings() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]powerwall.MeterReading), nil
+}
+
+func (s *scheduledMonitor) GetSOE() (*powerwall.SOE, error) {
+	v, err := s.get("/system_status/soe", func() (interface{}, error) { return s.mon.GetSOE() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.SOE), nil
+}
+
+func (s *scheduledMonitor) GetGridStatus() (*powerwall.GridStatus, error) {
+	v, err := s.get("/system_status/grid_status", func() (interface{}, error) { return s.mon.GetGridStatus() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.GridStatus), nil
+}
+
+func (s *scheduledMonitor) GetGridFaults() ([]powerwall.GridFault, error) {
+	v, err := s.get("/system_status/grid_faults", func() (interface{}, error) { return s.mon.GetGridFaults() })
+	if err != nil {
+		return nil, err
+	}
+	return v.([]powerwall.GridFault), nil
+}
+
+func (s *scheduledMonitor) GetSolars() ([]powerwall.Solar, error) {
+	v, err := s.get("/solars", func() (interface{}, error) { return s.mon.GetSolars() })
+	if err != nil {
+		return nil, err
+	}
+	return v.([]powerwall.Solar), nil
+}
+
+func (s *scheduledMonitor) GetInstaller() (*powerwall.Installer, error) {
+	v, err := s.get("/installer", func() (interface{}, error) { return s.mon.GetInstaller() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.Installer), nil
+}
+
+func (s *scheduledMonitor) GetWifiStatus() (*powerwall.WifiStatus, error) {
+	v, err := s.get("/networks/wifi_scan", func() (interface{}, error) { return s.mon.GetWifiStatus() })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*powerwall.WifiStatus), nil
+}
+
+func (s *scheduledMonitor) GetVitals() ([]vitals.Device, error) {
+	v, err := s.get(kVitalsEndpoint, func() (interface{}, error) { return s.mon.GetVitals() })
+	if err != nil {
+		return nil, err
+	}
+	return v.([]vitals.Device), nil
+}
+
+func (s *scheduledMonitor) GetBackupEvents() ([]powerwall.BackupEvent, error) {
+	v, err := s.get(kBackupEventsEndpoint, func() (interface{}, error) { return s.mon.GetBackupEvents() })
+	if err != nil {
+		return nil, err
+	}
+	return v.([]powerwall.BackupEvent), nil
+}
@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	gohttp "net/http"
+)
+
+// snapshotJSON is the document served at /json/snapshot.
+type snapshotJSON struct {
+	Snapshot *model.TeslaEnergyGatewayMetrics `json:"snapshot"`
+}
+
+// serveSnapshot serves the most recent poll in full, for home automation
+// tools that would rather not parse the Prometheus format.  It never
+// reaches the gateway itself, so scraping it can't add to the gateway's
+// load.
+func (p *PollEngine) serveSnapshot(rw gohttp.ResponseWriter, req *gohttp.Request) {
+	doc := snapshotJSON{Snapshot: p.snapshot()}
+	if doc.Snapshot == nil {
+		gohttp.Error(rw, "the gateway hasn't been polled yet", gohttp.StatusServiceUnavailable)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(doc); err != nil {
+		glog.Errorf("encoding snapshot: %v", err)
+	}
+}
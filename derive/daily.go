@@ -0,0 +1,109 @@
+package derive
+
+import (
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"time"
+)
+
+const kDailyKey = "daily_summary"
+
+type meterReading struct {
+	To   float64 `json:"to"`
+	From float64 `json:"from"`
+}
+
+// dailyState is what dailyTracker persists.
+type dailyState struct {
+	// Day is the local date the Start readings were taken on.
+	Day   string                           `json:"day"`
+	Start map[model.MeterType]meterReading `json:"start"`
+	Last  *model.DailySummary              `json:"last,omitempty"`
+}
+
+// dailyTracker notes the lifetime meter readings at the first poll of each
+// local day, and when the day rolls over summarizes the day before from
+// the difference.
+type dailyTracker struct {
+	st dailyState
+}
+
+func (d *dailyTracker) restore(store *state.Store) error {
+	_, err := store.Get(kDailyKey, &d.st)
+	return err
+}
+
+func readings(m *model.TeslaEnergyGatewayMetrics) map[model.MeterType]meterReading {
+	rval := make(map[model.MeterType]meterReading)
+	for mt, meter := range m.Meters {
+		rval[mt] = meterReading{To: meter.CumulativeEnergyTo, From: meter.CumulativeEnergyFrom}
+	}
+	return rval
+}
+
+func (d *dailyTracker) observe(opts Options, now time.Time, m *model.TeslaEnergyGatewayMetrics) {
+	if !opts.DailySummary {
+		return
+	}
+	loc := m.Fixed.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	local := now.In(loc)
+	day := local.Format("2006-01-02")
+	switch {
+	case d.st.Day == "":
+		d.st.Day = day
+		d.st.Start = readings(m)
+	case d.st.Day != day:
+		d.st.Last = summarize(d.st, readings(m), m.Fixed, loc)
+		glog.Infof("Summary for %s: solar %.0f Wh, usage %.0f Wh, grid import %.0f Wh, grid export %.0f Wh, %.2f battery cycles",
+			d.st.Day, d.st.Last.SolarWh, d.st.Last.UsageWh, d.st.Last.ImportWh, d.st.Last.ExportWh, d.st.Last.BatteryCycles)
+		d.st.Day = day
+		d.st.Start = readings(m)
+	}
+	m.Derived.LastDailySummary = d.st.Last
+	m.Derived.Today = today(d.st.Start, readings(m))
+}
+
+// today returns the energy through each meter between the start of the
+// day and now.
+func today(start, now map[model.MeterType]meterReading) map[model.MeterType]model.MeterEnergy {
+	rval := make(map[model.MeterType]model.MeterEnergy)
+	for mt, r := range now {
+		rval[mt] = model.MeterEnergy{
+			ToWh:   r.To - start[mt].To,
+			FromWh: r.From - start[mt].From,
+		}
+	}
+	return rval
+}
+
+// summarize computes the summary for st.Day from the readings at its start
+// and at the first poll after it.  If the exporter was down over midnight,
+// the summary covers everything since st.Day began.
+func summarize(st dailyState, end map[model.MeterType]meterReading, fixed model.FixedInfo, loc *time.Location) *model.DailySummary {
+	day, err := time.ParseInLocation("2006-01-02", st.Day, loc)
+	if err != nil {
+		glog.Errorf("Bad day %q in daily summary state: %v", st.Day, err)
+	}
+	delta := func(mt model.MeterType) meterReading {
+		return meterReading{
+			To:   end[mt].To - st.Start[mt].To,
+			From: end[mt].From - st.Start[mt].From,
+		}
+	}
+	rval := &model.DailySummary{
+		Day:                day,
+		SolarWh:            delta(model.Solar).From,
+		UsageWh:            delta(model.Load).To,
+		ImportWh:           delta(model.Total).To,
+		ExportWh:           delta(model.Total).From,
+		BatteryDischargeWh: delta(model.Battery).From,
+	}
+	if fixed.NominalSystemEnergykWh > 0 {
+		rval.BatteryCycles = rval.BatteryDischargeWh / (fixed.NominalSystemEnergykWh * 1000)
+	}
+	return rval
+}
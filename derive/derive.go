@@ -0,0 +1,108 @@
+// Package derive computes values which depend on more than one poll of
+// the gateway, and records them in the snapshot's Derived field.
+package derive
+
+import (
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"sync"
+	"time"
+)
+
+// Options describes how derived values are computed.
+type Options struct {
+	// GapThreshold is the longest expected time between two polls.  Longer
+	// silences, including exporter restarts, are reported as gaps.
+	GapThreshold time.Duration
+	// DailySummary summarizes each local day once it ends.  Days follow
+	// the gateway's time zone.
+	DailySummary bool
+	// Smoothing filters noisy metrics, keyed by metric name.  The raw
+	// values are still exported.  See ParseSmoothing.
+	Smoothing map[string]Smoothing
+	// RateWindow is how far back the rates of change of the battery's
+	// charge and power look.  0 turns them off.
+	RateWindow time.Duration
+	// Tariff, if set, prices the energy bought from and sold to the grid.
+	Tariff *Tariff
+}
+
+// Deriver carries the history needed to derive values from successive
+// snapshots.
+type Deriver struct {
+	opts  Options
+	store *state.Store
+
+	mu     sync.Mutex
+	soe    soeGapTracker
+	daily  dailyTracker
+	smooth smoother
+	cost   costTracker
+	outage outageTracker
+	shed   sheddingTracker
+	rates  rateTracker
+	record recordsTracker
+}
+
+// New returns a Deriver which restores its history from store.
+func New(opts Options, store *state.Store) (*Deriver, error) {
+	d := &Deriver{
+		opts:   opts,
+		store:  store,
+		smooth: newSmoother(opts),
+	}
+	if err := d.soe.restore(store); err != nil {
+		return nil, err
+	}
+	if err := d.daily.restore(store); err != nil {
+		return nil, err
+	}
+	if err := d.cost.restore(store); err != nil {
+		return nil, err
+	}
+	if err := d.outage.restore(store); err != nil {
+		return nil, err
+	}
+	if err := d.shed.restore(store); err != nil {
+		return nil, err
+	}
+	if err := d.record.restore(store); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Apply fills in m.Derived using m and the snapshots seen before it, and
+// saves the trackers' history.  A store that can't be written loses the
+// history on restart, but is no reason to fail the poll, so it is only
+// logged.
+func (d *Deriver) Apply(m *model.TeslaEnergyGatewayMetrics) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.smooth.observe(m)
+	d.rates.observe(d.opts, now, m)
+	d.soe.observe(d.opts, now, m)
+	d.daily.observe(d.opts, now, m)
+	d.cost.observe(d.opts, now, m)
+	d.outage.observe(d.opts, now, m)
+	d.shed.observe(d.opts, now, m)
+	d.record.observe(d.opts, now, m)
+	// One write for them all; the store skips those which didn't change.
+	values := map[string]interface{}{
+		kLastSOEKey:  d.soe.last,
+		kOutageKey:   d.outage.st,
+		kSheddingKey: d.shed.st,
+		kRecordsKey:  d.record.st,
+	}
+	if d.opts.DailySummary {
+		values[kDailyKey] = d.daily.st
+	}
+	if d.opts.Tariff != nil {
+		values[kTariffKey] = d.cost.st
+	}
+	if err := d.store.PutAll(values); err != nil {
+		logthrottle.Errorf("derive state", "Saving derived state: %v", err)
+	}
+}
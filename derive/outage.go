@@ -0,0 +1,81 @@
+package derive
+
+import (
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"time"
+)
+
+const kOutageKey = "grid_outages"
+
+// outageState is what outageTracker persists.
+type outageState struct {
+	// LastPoll is when the gateway was last seen, and Islanded whether it
+	// was off grid then.
+	LastPoll        time.Time `json:"last_poll"`
+	Islanded        bool      `json:"islanded"`
+	Outages         float64   `json:"outages"`
+	IslandedSeconds float64   `json:"islanded_seconds"`
+	LastOutage      time.Time `json:"last_outage"`
+}
+
+// outageTracker counts grid outages and how long the site spends off
+// grid, from the grid status at each poll.
+type outageTracker struct {
+	st outageState
+}
+
+func (o *outageTracker) restore(store *state.Store) error {
+	_, err := store.Get(kOutageKey, &o.st)
+	return err
+}
+
+// watched returns the time since the previous poll at last, or zero if
+// there was none or the gap is too long to trust.  Time the exporter
+// wasn't watching only counts if it's no more than a missed poll or two.
+func watched(opts Options, last, now time.Time) time.Duration {
+	elapsed := now.Sub(last)
+	if last.IsZero() || (opts.GapThreshold > 0 && elapsed > opts.GapThreshold) {
+		return 0
+	}
+	return elapsed
+}
+
+// islanded reports whether status means the site is off grid, and false
+// if status isn't recognized.
+func islanded(status powerwall.SystemStatus) (bool, bool) {
+	switch status {
+	case powerwall.GridConnected:
+		return false, true
+	case powerwall.IslandedReady, powerwall.IslandedActive, powerwall.TransitionToGrid:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+func (o *outageTracker) observe(opts Options, now time.Time, m *model.TeslaEnergyGatewayMetrics) {
+	off, known := islanded(m.GridStatus)
+	if !known {
+		off = o.st.Islanded
+	}
+	if o.st.Islanded {
+		o.st.IslandedSeconds += watched(opts, o.st.LastPoll, now).Seconds()
+	}
+	if off && !o.st.Islanded {
+		o.st.Outages++
+		o.st.LastOutage = now
+		glog.Warningf("The site went off grid (grid status %s)", m.GridStatus)
+	} else if !off && o.st.Islanded {
+		glog.Infof("The site is back on grid after an outage starting %s", o.st.LastOutage.Format(time.RFC3339))
+	}
+	o.st.Islanded = off
+	o.st.LastPoll = now
+	m.Derived.Outages = model.OutageStats{
+		Count:           o.st.Outages,
+		IslandedSeconds: o.st.IslandedSeconds,
+		LastOutage:      o.st.LastOutage,
+	}
+}
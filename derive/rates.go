@@ -0,0 +1,62 @@
+package derive
+
+import (
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"time"
+)
+
+type rateSample struct {
+	t            time.Time
+	soe, battery float64
+}
+
+// rateTracker fits a line through the battery's charge and power over the
+// last RateWindow, so dashboards get rates of change without deriv() on a
+// handful of noisy gauge samples.  Samples start over when the exporter
+// restarts.
+type rateTracker struct {
+	samples []rateSample
+}
+
+func (r *rateTracker) observe(opts Options, now time.Time, m *model.TeslaEnergyGatewayMetrics) {
+	if opts.RateWindow <= 0 {
+		return
+	}
+	r.samples = append(r.samples, rateSample{t: now, soe: m.PowerwallChargePercent, battery: m.Meters[model.Battery].InstantPower})
+	cutoff := now.Add(-opts.RateWindow)
+	for len(r.samples) > 0 && r.samples[0].t.Before(cutoff) {
+		r.samples = r.samples[1:]
+	}
+	if len(r.samples) < 2 {
+		return
+	}
+	soe, ok := slope(r.samples, func(s rateSample) float64 { return s.soe })
+	if !ok {
+		return
+	}
+	battery, _ := slope(r.samples, func(s rateSample) float64 { return s.battery })
+	m.Derived.Rates = &model.Rates{
+		SOEPercentPerHour:         soe * 3600,
+		BatteryRampWattsPerSecond: battery,
+	}
+}
+
+// slope is the least squares slope of value over the samples, per second.
+// It returns false if the samples all share one time.
+func slope(samples []rateSample, value func(rateSample) float64) (float64, bool) {
+	t0 := samples[0].t
+	var n, sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x, y := s.t.Sub(t0).Seconds(), value(s)
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0, false
+	}
+	return (n*sxy - sx*sy) / d, true
+}
@@ -0,0 +1,114 @@
+package derive
+
+import (
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"math"
+	"time"
+)
+
+const (
+	kRecordsKey = "records"
+	// kRecordDays is how many local days the rolling records cover.
+	kRecordDays = 30
+)
+
+// record is the personal bests over some span.
+type record struct {
+	Seen                   bool    `json:"seen"`
+	LongestIslandedSeconds float64 `json:"longest_islanded_seconds"`
+	MinChargePercent       float64 `json:"min_charge_percent"`
+	MaxBatteryWatts        float64 `json:"max_battery_watts"`
+}
+
+// update folds a poll into r, and reports whether r changed.
+func (r *record) update(islanded, charge, battery float64) bool {
+	before := *r
+	if !r.Seen {
+		r.Seen, r.MinChargePercent = true, charge
+	}
+	r.LongestIslandedSeconds = math.Max(r.LongestIslandedSeconds, islanded)
+	r.MinChargePercent = math.Min(r.MinChargePercent, charge)
+	r.MaxBatteryWatts = math.Max(r.MaxBatteryWatts, battery)
+	return *r != before
+}
+
+func (r record) model() model.Record {
+	return model.Record{
+		LongestIslanded:  time.Duration(r.LongestIslandedSeconds * float64(time.Second)),
+		MinChargePercent: r.MinChargePercent,
+		MaxBatteryWatts:  r.MaxBatteryWatts,
+	}
+}
+
+// recordsState is what recordsTracker persists.
+type recordsState struct {
+	// LastPoll is when the gateway was last seen, Islanded whether it was
+	// off grid then, and RunSeconds how long it had been, counting only
+	// the time between polls close enough together to trust.
+	LastPoll   time.Time `json:"last_poll"`
+	Islanded   bool      `json:"islanded"`
+	RunSeconds float64   `json:"run_seconds"`
+	AllTime    record    `json:"all_time"`
+	// Days holds each recent local day's records, keyed by date.
+	Days map[string]record `json:"days"`
+}
+
+// recordsTracker keeps the longest time off grid, the lowest charge and
+// the most power the battery has supplied, all time and over the last
+// kRecordDays days.
+type recordsTracker struct {
+	st recordsState
+}
+
+func (r *recordsTracker) restore(store *state.Store) error {
+	_, err := store.Get(kRecordsKey, &r.st)
+	return err
+}
+
+func (r *recordsTracker) observe(opts Options, now time.Time, m *model.TeslaEnergyGatewayMetrics) {
+	loc := m.Fixed.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	local := now.In(loc)
+	day := local.Format("2006-01-02")
+	if r.st.Days == nil {
+		r.st.Days = make(map[string]record)
+	}
+	off, known := islanded(m.GridStatus)
+	if !known {
+		off = r.st.Islanded
+	}
+	switch {
+	case !off:
+		r.st.RunSeconds = 0
+	case r.st.Islanded:
+		r.st.RunSeconds += watched(opts, r.st.LastPoll, now).Seconds()
+	}
+	r.st.LastPoll, r.st.Islanded = now, off
+	run := r.st.RunSeconds
+	charge, battery := m.PowerwallChargePercent, math.Max(m.Meters[model.Battery].InstantPower, 0)
+	r.st.AllTime.update(run, charge, battery)
+	today := r.st.Days[day]
+	if today.update(run, charge, battery) {
+		r.st.Days[day] = today
+	}
+	oldest := local.AddDate(0, 0, -(kRecordDays - 1)).Format("2006-01-02")
+	var recent record
+	for d, rec := range r.st.Days {
+		if d < oldest {
+			delete(r.st.Days, d)
+			continue
+		}
+		if !recent.Seen {
+			recent = rec
+			continue
+		}
+		recent.update(rec.LongestIslandedSeconds, rec.MinChargePercent, rec.MaxBatteryWatts)
+	}
+	m.Derived.Records = &model.Records{
+		AllTime:    r.st.AllTime.model(),
+		Last30Days: recent.model(),
+	}
+}
@@ -0,0 +1,52 @@
+package derive
+
+import (
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"time"
+)
+
+const kSheddingKey = "bubble_shedding"
+
+// sheddingState is what sheddingTracker persists.
+type sheddingState struct {
+	// LastPoll is when the gateway was last seen, and Since when the
+	// current spell of shedding began, or zero if it wasn't shedding then.
+	LastPoll time.Time `json:"last_poll"`
+	Since    time.Time `json:"since"`
+	Spells   float64   `json:"spells"`
+	Seconds  float64   `json:"seconds"`
+}
+
+// sheddingTracker counts how often and for how long the gateway sheds
+// load while islanded, which it calls bubble shedding.
+type sheddingTracker struct {
+	st sheddingState
+}
+
+func (s *sheddingTracker) restore(store *state.Store) error {
+	_, err := store.Get(kSheddingKey, &s.st)
+	return err
+}
+
+func (s *sheddingTracker) observe(opts Options, now time.Time, m *model.TeslaEnergyGatewayMetrics) {
+	shedding := !s.st.Since.IsZero()
+	if shedding {
+		s.st.Seconds += watched(opts, s.st.LastPoll, now).Seconds()
+	}
+	if m.BubbleShedding && !shedding {
+		s.st.Spells++
+		s.st.Since = now
+		glog.Warningf("The gateway is shedding load")
+	} else if !m.BubbleShedding && shedding {
+		glog.Infof("The gateway stopped shedding load after %v", now.Sub(s.st.Since).Round(time.Second))
+		s.st.Since = time.Time{}
+	}
+	s.st.LastPoll = now
+	m.Derived.Shedding = model.SheddingStats{
+		Count:   s.st.Spells,
+		Seconds: s.st.Seconds,
+		Since:   s.st.Since,
+	}
+}
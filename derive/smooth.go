@@ -0,0 +1,164 @@
+package derive
+
+import (
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Filter names for Smoothing.Filter.
+const (
+	EWMA   = "ewma"
+	Median = "median"
+)
+
+// Smoothing configures the filter applied to one metric.
+type Smoothing struct {
+	// Filter is EWMA or Median.
+	Filter string
+	// Param is the weight of the newest sample, between 0 and 1, for
+	// EWMA, or the number of samples for Median.
+	Param float64
+}
+
+func (s Smoothing) String() string {
+	return fmt.Sprintf("%s:%g", s.Filter, s.Param)
+}
+
+// smoothable lists the metrics that can be smoothed, and how to read each
+// from a snapshot.
+var smoothable = map[string]func(m *model.TeslaEnergyGatewayMetrics) float64{
+	"powerwall_charge_percent": func(m *model.TeslaEnergyGatewayMetrics) float64 {
+		return m.PowerwallChargePercent
+	},
+	"instant_power_site":    meterPower(model.Total),
+	"instant_power_load":    meterPower(model.Load),
+	"instant_power_solar":   meterPower(model.Solar),
+	"instant_power_battery": meterPower(model.Battery),
+}
+
+func meterPower(mt model.MeterType) func(m *model.TeslaEnergyGatewayMetrics) float64 {
+	return func(m *model.TeslaEnergyGatewayMetrics) float64 {
+		return m.Meters[mt].InstantPower
+	}
+}
+
+// ParseSmoothing parses a comma separated list of metric=filter:param
+// settings, such as "powerwall_charge_percent=ewma:0.2".
+func ParseSmoothing(spec string) (map[string]Smoothing, error) {
+	rval := make(map[string]Smoothing)
+	if spec == "" {
+		return rval, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		eq := strings.SplitN(part, "=", 2)
+		if len(eq) != 2 {
+			return nil, fmt.Errorf("%q: want metric=filter:param", part)
+		}
+		metric := strings.TrimSpace(eq[0])
+		if _, ok := smoothable[metric]; !ok {
+			return nil, fmt.Errorf("%q can't be smoothed; try one of %s", metric, strings.Join(smoothableNames(), ", "))
+		}
+		colon := strings.SplitN(eq[1], ":", 2)
+		if len(colon) != 2 {
+			return nil, fmt.Errorf("%q: want filter:param", eq[1])
+		}
+		param, err := strconv.ParseFloat(colon[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", colon[1], err)
+		}
+		s := Smoothing{Filter: colon[0], Param: param}
+		switch s.Filter {
+		case EWMA:
+			if param <= 0 || param > 1 {
+				return nil, fmt.Errorf("%s: ewma weight must be in (0, 1]", metric)
+			}
+		case Median:
+			if param < 1 || param != float64(int(param)) {
+				return nil, fmt.Errorf("%s: median window must be a positive whole number", metric)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown filter %q, want %q or %q", metric, s.Filter, EWMA, Median)
+		}
+		rval[metric] = s
+	}
+	return rval, nil
+}
+
+func smoothableNames() []string {
+	var rval []string
+	for name := range smoothable {
+		rval = append(rval, name)
+	}
+	sort.Strings(rval)
+	return rval
+}
+
+type filter interface {
+	apply(v float64) float64
+}
+
+type ewmaFilter struct {
+	alpha  float64
+	value  float64
+	primed bool
+}
+
+func (e *ewmaFilter) apply(v float64) float64 {
+	if !e.primed {
+		e.value, e.primed = v, true
+		return v
+	}
+	e.value = e.alpha*v + (1-e.alpha)*e.value
+	return e.value
+}
+
+type medianFilter struct {
+	n      int
+	window []float64
+}
+
+func (m *medianFilter) apply(v float64) float64 {
+	m.window = append(m.window, v)
+	if len(m.window) > m.n {
+		m.window = m.window[1:]
+	}
+	sorted := append([]float64(nil), m.window...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// smoother runs the configured filters over successive snapshots.  Filter
+// state starts over when the exporter restarts.
+type smoother struct {
+	filters map[string]filter
+}
+
+func newSmoother(opts Options) smoother {
+	s := smoother{filters: make(map[string]filter)}
+	for metric, sm := range opts.Smoothing {
+		switch sm.Filter {
+		case EWMA:
+			s.filters[metric] = &ewmaFilter{alpha: sm.Param}
+		case Median:
+			s.filters[metric] = &medianFilter{n: int(sm.Param)}
+		}
+	}
+	return s
+}
+
+func (s *smoother) observe(m *model.TeslaEnergyGatewayMetrics) {
+	if len(s.filters) == 0 {
+		return
+	}
+	m.Derived.Smoothed = make(map[string]float64)
+	for metric, f := range s.filters {
+		m.Derived.Smoothed[metric] = f.apply(smoothable[metric](m))
+	}
+}
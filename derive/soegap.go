@@ -0,0 +1,52 @@
+package derive
+
+import (
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"time"
+)
+
+const kLastSOEKey = "last_soe"
+
+type soeSample struct {
+	Time    time.Time `json:"time"`
+	Percent float64   `json:"percent"`
+}
+
+// soeGapTracker notices when polls stop for a while and measures how much
+// the battery charge moved while nobody was looking, so dashboards can
+// tell real battery behavior from holes in the data.
+type soeGapTracker struct {
+	last    *soeSample
+	lastGap *model.SOEGap
+}
+
+func (s *soeGapTracker) restore(store *state.Store) error {
+	var last soeSample
+	ok, err := store.Get(kLastSOEKey, &last)
+	if err != nil {
+		return err
+	}
+	if ok {
+		s.last = &last
+	}
+	return nil
+}
+
+func (s *soeGapTracker) observe(opts Options, now time.Time, m *model.TeslaEnergyGatewayMetrics) {
+	cur := soeSample{Time: now, Percent: m.PowerwallChargePercent}
+	if s.last != nil && opts.GapThreshold > 0 {
+		if elapsed := cur.Time.Sub(s.last.Time); elapsed > opts.GapThreshold {
+			s.lastGap = &model.SOEGap{
+				End:           cur.Time,
+				Duration:      elapsed,
+				ChangePercent: cur.Percent - s.last.Percent,
+			}
+			glog.Warningf("No poll for %s; powerwall charge moved %.1f%% (from %.1f%% to %.1f%%) in the meantime",
+				elapsed, s.lastGap.ChangePercent, s.last.Percent, cur.Percent)
+		}
+	}
+	s.last = &cur
+	m.Derived.LastSOEGap = s.lastGap
+}
@@ -0,0 +1,234 @@
+package derive
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const kTariffKey = "tariff_cost"
+
+// Tariff is a time of use electricity tariff, read by LoadTariff from a
+// file such as:
+//
+//	{
+//	  "currency": "USD",
+//	  "import_rate": 0.21,
+//	  "export_rate": 0.05,
+//	  "periods": [
+//	    {"name": "peak", "days": ["mon", "tue", "wed", "thu", "fri"],
+//	     "start": "16:00", "end": "21:00", "import_rate": 0.45, "export_rate": 0.12}
+//	  ]
+//	}
+//
+// Rates are per kWh.  Outside every period, the top level rates apply.
+type Tariff struct {
+	Currency   string         `json:"currency"`
+	ImportRate float64        `json:"import_rate"`
+	ExportRate float64        `json:"export_rate"`
+	Periods    []TariffPeriod `json:"periods"`
+}
+
+// TariffPeriod is a window of the week with its own rates.  The first
+// period matching a time applies.
+type TariffPeriod struct {
+	Name string `json:"name"`
+	// Days are three letter day names, such as "mon".  Empty means every
+	// day.
+	Days []string `json:"days"`
+	// Start and End are local times, HH:MM.  An End before Start runs
+	// past midnight.
+	Start      string  `json:"start"`
+	End        string  `json:"end"`
+	ImportRate float64 `json:"import_rate"`
+	ExportRate float64 `json:"export_rate"`
+
+	start, end int // minutes past midnight.
+}
+
+// kOffPeak names the time outside every period.
+const kOffPeak = "off_peak"
+
+// LoadTariff reads a tariff from path.
+func LoadTariff(path string) (*Tariff, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rval Tariff
+	if err := json.Unmarshal(b, &rval); err != nil {
+		return nil, fmt.Errorf("decoding tariff %s: %v", path, err)
+	}
+	for i := range rval.Periods {
+		p := &rval.Periods[i]
+		if p.start, err = minutes(p.Start); err != nil {
+			return nil, fmt.Errorf("tariff period %q start: %v", p.Name, err)
+		}
+		if p.end, err = minutes(p.End); err != nil {
+			return nil, fmt.Errorf("tariff period %q end: %v", p.Name, err)
+		}
+		for _, d := range p.Days {
+			if _, ok := kDays[strings.ToLower(d)]; !ok {
+				return nil, fmt.Errorf("tariff period %q: unknown day %q", p.Name, d)
+			}
+		}
+	}
+	return &rval, nil
+}
+
+var kDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func minutes(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// rates returns the period in effect at local and its rates.
+func (t *Tariff) rates(local time.Time) (string, float64, float64) {
+	now := local.Hour()*60 + local.Minute()
+	for _, p := range t.Periods {
+		if !p.onDay(local.Weekday()) {
+			continue
+		}
+		in := now >= p.start && now < p.end
+		if p.end <= p.start {
+			in = now >= p.start || now < p.end
+		}
+		if in {
+			return p.Name, p.ImportRate, p.ExportRate
+		}
+	}
+	return kOffPeak, t.ImportRate, t.ExportRate
+}
+
+// nextChange returns the first time after local at which a period may
+// start or end: a period's start or end time, or midnight, when the day
+// changes.
+func (t *Tariff) nextChange(local time.Time) time.Time {
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	rval := day.AddDate(0, 0, 1)
+	for _, p := range t.Periods {
+		for _, m := range []int{p.start, p.end} {
+			if at := day.Add(time.Duration(m) * time.Minute); at.After(local) && at.Before(rval) {
+				rval = at
+			}
+		}
+	}
+	return rval
+}
+
+// price returns what importing importWh and exporting exportWh evenly
+// between from and to cost and earned, at the rates of each period the
+// time spans.
+func (t *Tariff) price(from, to time.Time, importWh, exportWh float64) (float64, float64) {
+	total := to.Sub(from)
+	if total <= 0 {
+		_, importRate, exportRate := t.rates(to)
+		return importWh / 1000 * importRate, exportWh / 1000 * exportRate
+	}
+	var cost, credit float64
+	for s := from; s.Before(to); {
+		e := t.nextChange(s)
+		if e.After(to) {
+			e = to
+		}
+		_, importRate, exportRate := t.rates(s)
+		share := float64(e.Sub(s)) / float64(total)
+		cost += share * importWh / 1000 * importRate
+		credit += share * exportWh / 1000 * exportRate
+		s = e
+	}
+	return cost, credit
+}
+
+func (p *TariffPeriod) onDay(d time.Weekday) bool {
+	if len(p.Days) == 0 {
+		return true
+	}
+	for _, name := range p.Days {
+		if kDays[strings.ToLower(name)] == d {
+			return true
+		}
+	}
+	return false
+}
+
+// costState is what costTracker persists.
+type costState struct {
+	// LastPoll is when the previous poll was, and ImportWh and ExportWh
+	// the site meter's lifetime readings then.
+	LastPoll time.Time `json:"last_poll"`
+	ImportWh float64   `json:"import_wh"`
+	ExportWh float64   `json:"export_wh"`
+	Cost     float64   `json:"cost"`
+	Credit   float64   `json:"credit"`
+}
+
+// costTracker prices the energy bought from and sold to the grid between
+// each pair of polls.  The energy is taken to flow evenly between them, so
+// a gap spanning several periods is priced at each one's rates in turn.
+type costTracker struct {
+	st *costState
+}
+
+func (c *costTracker) restore(store *state.Store) error {
+	var st costState
+	ok, err := store.Get(kTariffKey, &st)
+	if err != nil {
+		return err
+	}
+	if ok {
+		c.st = &st
+	}
+	return nil
+}
+
+func (c *costTracker) observe(opts Options, now time.Time, m *model.TeslaEnergyGatewayMetrics) {
+	if opts.Tariff == nil {
+		return
+	}
+	loc := m.Fixed.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	local := now.In(loc)
+	period, _, _ := opts.Tariff.rates(local)
+	site := m.Meters[model.Total]
+	if c.st == nil {
+		c.st = &costState{}
+	} else {
+		bought := site.CumulativeEnergyTo - c.st.ImportWh
+		sold := site.CumulativeEnergyFrom - c.st.ExportWh
+		// State saved before LastPoll was kept is priced at today's rates.
+		from := local
+		if !c.st.LastPoll.IsZero() {
+			from = c.st.LastPoll.In(loc)
+		}
+		if bought < 0 || sold < 0 {
+			glog.Warningf("Site meter went backwards (import %.0f Wh, export %.0f Wh); not pricing this poll", bought, sold)
+		} else {
+			cost, credit := opts.Tariff.price(from, local, bought, sold)
+			c.st.Cost += cost
+			c.st.Credit += credit
+		}
+	}
+	c.st.LastPoll = now
+	c.st.ImportWh, c.st.ExportWh = site.CumulativeEnergyTo, site.CumulativeEnergyFrom
+	m.Derived.Tariff = &model.TariffCost{
+		Currency:     opts.Tariff.Currency,
+		Period:       period,
+		GridCost:     c.st.Cost,
+		ExportCredit: c.st.Credit,
+	}
+}
@@ -0,0 +1,92 @@
+// Package egress accounts for every outbound request the exporter makes,
+// and can refuse any that go somewhere unexpected, for users auditing what
+// their monitoring tools talk to.
+package egress
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const kDestination = "destination"
+
+var (
+	outbound = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "powerwall_outbound_requests_total",
+		Help: "number of outbound requests made by the exporter, by destination host",
+	}, []string{kDestination})
+	blocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "powerwall_outbound_requests_blocked_total",
+		Help: "number of outbound requests refused because the destination is not in the allowlist",
+	}, []string{kDestination})
+)
+
+func init() {
+	prometheus.MustRegister(outbound, blocked)
+}
+
+var (
+	mu sync.RWMutex
+	// allowed is nil when every destination is allowed.
+	allowed map[string]bool
+)
+
+// Allow restricts outbound requests to the given hosts.  Hosts may include
+// a port, in which case only that port is allowed.
+func Allow(hosts ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	allowed = make(map[string]bool)
+	for _, h := range hosts {
+		allowed[strings.ToLower(h)] = true
+	}
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	glog.Infof("Outbound requests are restricted to: %s", strings.Join(sorted, ", "))
+}
+
+// AllowAll lifts any restriction set by Allow.
+func AllowAll() {
+	mu.Lock()
+	defer mu.Unlock()
+	allowed = nil
+}
+
+func permitted(req *http.Request) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	if allowed == nil {
+		return true
+	}
+	return allowed[strings.ToLower(req.URL.Host)] || allowed[strings.ToLower(req.URL.Hostname())]
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+// Wrap returns a RoundTripper which counts requests by destination and
+// refuses those not allowed, passing the rest to base.  If base is nil,
+// http.DefaultTransport is used.
+func Wrap(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if !permitted(req) {
+		blocked.WithLabelValues(host).Inc()
+		glog.Errorf("Refusing outbound request to %s, which is not in the allowlist", req.URL.Host)
+		return nil, fmt.Errorf("outbound requests to %s are not allowed", req.URL.Host)
+	}
+	outbound.WithLabelValues(host).Inc()
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/view"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	exportFrom   string
+	exportTo     string
+	exportFormat string
+	exportOutput string
+)
+
+func init() {
+	subcommands["export"] = &subcommand{
+		help: "write the polls recorded in --history_db between --from and --to as CSV or Parquet, for solar production audits in pandas or a spreadsheet",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&exportFrom, "from", "", "export polls at or after this time, as 2006-01-02 or RFC 3339.  Empty starts at the oldest")
+			fs.StringVar(&exportTo, "to", "", "export polls before this time, as 2006-01-02 or RFC 3339.  Empty ends now")
+			fs.StringVar(&exportFormat, "export_format", "csv", "csv or parquet")
+			fs.StringVar(&exportOutput, "output", "-", "file to write, or - for standard output")
+		},
+		run: export,
+	}
+}
+
+func export() error {
+	if *historyDB == "" {
+		return fmt.Errorf("export needs --history_db")
+	}
+	from, err := exportTime("from", exportFrom, time.Unix(0, 0))
+	if err != nil {
+		return err
+	}
+	to, err := exportTime("to", exportTo, time.Now())
+	if err != nil {
+		return err
+	}
+	var write func(io.Writer, []view.HistoryPoint) error
+	switch exportFormat {
+	case "csv":
+		write = view.WriteHistoryCSV
+	case "parquet":
+		write = view.WriteHistoryParquet
+	default:
+		return fmt.Errorf("--export_format=%q: want csv or parquet", exportFormat)
+	}
+	h, err := view.OpenHistoryReadOnly(*historyDB)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	points, err := h.Polls(from, to)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", *historyDB, err)
+	}
+	if exportOutput == "-" {
+		return write(os.Stdout, points)
+	}
+	f, err := os.Create(exportOutput)
+	if err != nil {
+		return err
+	}
+	if err := write(f, points); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %v", exportOutput, err)
+	}
+	return f.Close()
+}
+
+// exportTime parses --from or --to, a date in local time or an RFC 3339
+// time, returning def if v is empty.
+func exportTime(name, v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("--%s=%q: want 2006-01-02 or RFC 3339", name, v)
+	}
+	return t, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/view"
+	"os"
+)
+
+func init() {
+	subcommands["gen-rules"] = &subcommand{
+		help: "print Prometheus alerting rules for grid outages, a low battery, an unreachable gateway and a battery not charging from solar, using the metric names of the current flags",
+		run:  genRules,
+	}
+}
+
+func genRules() error {
+	opts, err := viewOptions()
+	if err != nil {
+		return err
+	}
+	return view.AlertRules(opts, os.Stdout)
+}
@@ -0,0 +1,216 @@
+package http
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a handler with additional behavior.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h with each middleware in turn.  The first middleware is
+// the outermost, so Chain(h, a, b) serves requests through a, then b,
+// then h.
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// statusRecorder remembers the status code and size of a response so
+// it can be logged after the fact.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Logging logs one line per request with its status, size and latency.
+func Logging() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			before := time.Now()
+			rec := &statusRecorder{ResponseWriter: rw}
+			next.ServeHTTP(rec, req)
+			glog.Infof("%s %s %s: %d, %d bytes in %s", req.RemoteAddr, req.Method, req.URL.Path, rec.status, rec.bytes, time.Now().Sub(before))
+		})
+	}
+}
+
+// gzipResponseWriter compresses what the handler writes once it knows
+// the response has a body.  HEAD, 204 and 304 responses have none, so
+// they go out as they are rather than with an empty gzip stream.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	head        bool
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	if !g.head && code != http.StatusNoContent && code != http.StatusNotModified {
+		g.Header().Del("Content-Length")
+		g.Header().Set("Content-Encoding", "gzip")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.gz.Write(b)
+}
+
+// close finishes the gzip stream, if there is one.
+func (g *gzipResponseWriter) close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
+
+// Gzip compresses responses for clients that accept gzip encoding.
+func Gzip() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			gw := &gzipResponseWriter{ResponseWriter: rw, head: req.Method == http.MethodHead}
+			defer func() {
+				if err := gw.close(); err != nil {
+					glog.Errorf("gzip Close(): %v", err)
+				}
+			}()
+			rw.Header().Add("Vary", "Accept-Encoding")
+			// Inner handlers (promhttp in particular) compress on their own
+			// if asked to; make sure they don't do it twice.
+			inner := req.Clone(req.Context())
+			inner.Header.Del("Accept-Encoding")
+			next.ServeHTTP(gw, inner)
+		})
+	}
+}
+
+// BcryptAuth rejects requests that do not present one of users, whose
+// passwords are stored as bcrypt hashes, as in a file made with
+// htpasswd -B.  See LoadUsers.  The liveness and readiness probes stay
+// open, since the orchestrators that call them rarely have credentials.
+func BcryptAuth(realm string, users map[string]string) Middleware {
+	// Unknown users are checked against a hash too, so the time taken
+	// doesn't tell them apart from known ones.
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(fmt.Sprintf("bcrypt.GenerateFromPassword(): %v", err))
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/healthz" || req.URL.Path == "/readyz" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			user, pass, ok := req.BasicAuth()
+			if ok {
+				hash, found := users[user]
+				if !found {
+					hash = string(dummy)
+				}
+				if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil && found {
+					next.ServeHTTP(rw, req)
+					return
+				}
+			}
+			rw.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
+
+// LoadUsers reads a file of user:bcrypt-hash lines, as written by
+// htpasswd -B.  Blank lines and lines starting with # are ignored.
+func LoadUsers(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rval := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			return nil, fmt.Errorf("%s:%d: want user:bcrypt-hash", path, i+1)
+		}
+		rval[parts[0]] = parts[1]
+	}
+	return rval, nil
+}
+
+type prefixKey struct{}
+
+// Prefix serves the wrapped handler underneath the given path prefix,
+// for use behind reverse proxies that do not strip it.  Requests outside
+// the prefix get a 404.
+func Prefix(prefix string) Middleware {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(next http.Handler) http.Handler {
+		strip := http.StripPrefix(prefix, next)
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if prefix == "" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			if req.URL.Path == prefix {
+				http.Redirect(rw, req, prefix+"/", http.StatusFound)
+				return
+			}
+			if !strings.HasPrefix(req.URL.Path, prefix+"/") {
+				http.NotFound(rw, req)
+				return
+			}
+			ctx := context.WithValue(req.Context(), prefixKey{}, prefix)
+			strip.ServeHTTP(rw, req.WithContext(ctx))
+		})
+	}
+}
+
+// PathPrefix returns the prefix stripped by the Prefix middleware, if any.
+// Handlers use it to build links that work behind the prefix.
+func PathPrefix(req *http.Request) string {
+	p, _ := req.Context().Value(prefixKey{}).(string)
+	return p
+}
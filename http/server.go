@@ -1,15 +1,240 @@
+// Package http serves the exporter's web interface.
 package http
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/locale"
+	"html/template"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// ServeMetrics does not return under normal operation.
-func ServeMetrics(port int) error {
-	http.Handle("/", http.RedirectHandler("/metrics", 302))
-	addr := fmt.Sprintf(":%d", port)
-	glog.Infof("Serving metrics on port %d at /metrics", port)
-	return http.ListenAndServe(addr, nil) // blocks normally.
+// Options describes how the web interface should be served.
+type Options struct {
+	// Port is the TCP port to listen on.
+	Port int
+	// ListenAddress is the address to bind Port on, such as 127.0.0.1.
+	// Empty means every interface.  unix:/path/to/socket listens on a unix
+	// socket instead, and Port is ignored.
+	ListenAddress string
+	// TLSCert and TLSKey are PEM files for serving HTTPS.  If either is
+	// empty, plain HTTP is served.
+	TLSCert, TLSKey string
+	// Middleware wraps every registered route.  The first entry is the
+	// outermost wrapper, so it sees the request first.
+	Middleware []Middleware
+	// Ready reports whether the exporter is ready to serve, for /readyz.
+	// A nil Ready means always ready.
+	Ready func() error
+	// Status describes the exporter for the landing page.  May be nil.
+	Status func() Status
+	// Locale is the language of the landing page.  The zero value is
+	// English.
+	Locale locale.Locale
+}
+
+// Status is what the landing page shows about the exporter.
+type Status struct {
+	Version          string
+	Gateways         []string
+	LastPoll         time.Time
+	LastPollDuration time.Duration
+	// LastError is the error from the most recent poll, or empty if it
+	// succeeded.
+	LastError string
+}
+
+// Server is a small web server with its own route table, so it can be
+// embedded in other programs and exercised in tests without touching
+// net/http's DefaultServeMux.
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+	srv  *http.Server
+
+	mu      sync.RWMutex
+	handler http.Handler
+	// inflight counts the requests being served by handler.
+	inflight *sync.WaitGroup
+}
+
+// New returns a Server which shows a status page at / and answers
+// liveness and readiness probes at /healthz and /readyz.  Callers register
+// their own routes with Handle before calling ListenAndServe.
+func New(opts Options) *Server {
+	s := &Server{
+		opts: opts,
+		mux:  http.NewServeMux(),
+
+		inflight: new(sync.WaitGroup),
+	}
+	s.srv = &http.Server{Handler: s}
+	s.mux.HandleFunc("/", s.landingPage)
+	s.mux.HandleFunc("/healthz", func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "ok")
+	})
+	s.mux.HandleFunc("/readyz", func(rw http.ResponseWriter, req *http.Request) {
+		if opts.Ready != nil {
+			if err := opts.Ready(); err != nil {
+				http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(rw, "ok")
+	})
+	s.handler = Chain(s.mux, opts.Middleware...)
+	return s
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><title>Powerwall Exporter</title></head>
+<body>
+<h1>Powerwall Exporter</h1>
+<p><a href="{{.Prefix}}/metrics">{{call .T "Metrics"}}</a></p>
+{{with .Status}}
+<table>
+<tr><td>{{call $.T "Version"}}</td><td>{{.Version}}</td></tr>
+<tr><td>{{call $.T "Gateway"}}</td><td>{{range .Gateways}}{{.}} {{end}}</td></tr>
+<tr><td>{{call $.T "Last poll"}}</td><td>{{if .LastPoll.IsZero}}{{call $.T "never"}}{{else}}{{.LastPoll.Format "2006-01-02 15:04:05 MST"}}, {{call $.T "took"}} {{.LastPollDuration}}{{end}}</td></tr>
+<tr><td>{{call $.T "Last error"}}</td><td>{{if .LastError}}{{.LastError}}{{else}}{{call $.T "none"}}{{end}}</td></tr>
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+func (s *Server) landingPage(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(rw, req)
+		return
+	}
+	lang := s.opts.Locale
+	if lang == "" {
+		lang = locale.English
+	}
+	data := struct {
+		Lang   locale.Locale
+		T      func(string) string
+		Prefix string
+		Status *Status
+	}{Lang: lang, T: lang.Text, Prefix: PathPrefix(req)}
+	if s.opts.Status != nil {
+		st := s.opts.Status()
+		data.Status = &st
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(rw, data); err != nil {
+		glog.Errorf("landingTemplate.Execute(): %v", err)
+	}
+}
+
+// Handle registers a handler for the given pattern.  Routes registered
+// here are wrapped by Options.Middleware.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers a handler function for the given pattern.
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// ServeHTTP dispatches the request through the middleware chain to the
+// registered routes.
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.RLock()
+	t := &tracker{wg: s.inflight}
+	t.wg.Add(1)
+	h := s.handler
+	s.mu.RUnlock()
+	defer t.done()
+	t.parent, _ = req.Context().Value(trackerKey{}).(*tracker)
+	h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), trackerKey{}, t)))
+}
+
+type trackerKey struct{}
+
+// tracker counts a request as in flight until it is done.  parent is the
+// tracker of the Server which passed the request on, if any.
+type tracker struct {
+	wg     *sync.WaitGroup
+	once   sync.Once
+	parent *tracker
+}
+
+func (t *tracker) done() {
+	t.once.Do(t.wg.Done)
+}
+
+// Untrack stops counting req as in flight, so the channel from Swap
+// doesn't wait for it.  Handlers which themselves Swap the Server serving
+// them, such as a reload, must call it first.
+func Untrack(req *http.Request) {
+	for t, _ := req.Context().Value(trackerKey{}).(*tracker); t != nil; t = t.parent {
+		t.done()
+	}
+}
+
+// Swap serves h in place of s's own routes and middleware from the next
+// request on, without closing the listener.  h is typically another
+// Server, built from new Options, which is never started itself.  The
+// returned channel is closed once the requests the previous handler was
+// serving have finished.
+func (s *Server) Swap(h http.Handler) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = h
+	prev := s.inflight
+	s.inflight = new(sync.WaitGroup)
+	rval := make(chan struct{})
+	go func() {
+		prev.Wait()
+		close(rval)
+	}()
+	return rval
+}
+
+// ListenAndServe does not return under normal operation.
+func (s *Server) ListenAndServe() error {
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	srv := s.srv
+	if s.opts.TLSCert != "" && s.opts.TLSKey != "" {
+		glog.Infof("Serving metrics over HTTPS on %s at /metrics", l.Addr())
+		return srv.ServeTLS(l, s.opts.TLSCert, s.opts.TLSKey) // blocks normally.
+	}
+	glog.Infof("Serving metrics on %s at /metrics", l.Addr())
+	return srv.Serve(l) // blocks normally.
+}
+
+// Shutdown stops the server, waiting until ctx is done for requests in
+// flight to finish.  ListenAndServe then returns http.ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+const kUnixPrefix = "unix:"
+
+func (s *Server) listen() (net.Listener, error) {
+	if strings.HasPrefix(s.opts.ListenAddress, kUnixPrefix) {
+		path := strings.TrimPrefix(s.opts.ListenAddress, kUnixPrefix)
+		// A socket left behind by an earlier run would make Listen fail.
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", net.JoinHostPort(s.opts.ListenAddress, strconv.Itoa(s.opts.Port)))
 }
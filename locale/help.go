@@ -0,0 +1,72 @@
+package locale
+
+// helpText translates metric help, keyed by the metric's historical name
+// so it doesn't depend on Options.ConventionalNames.  Units are given
+// only where the English gives them, since some historical units change
+// with conventional names and a misread unit is worse than English help.  Metrics not listed keep their English help.
+var helpText = map[Locale]map[string]string{
+	German: {
+		"powerwall_charge_percent":      "Ladezustand der Powerwalls in Prozent der Nennenergie",
+		"app_charge_percent":            "Ladezustand der Powerwalls in Prozent, wie ihn die Tesla-App anzeigt, die eine Reserve am unteren Ende der Batterie ausblendet",
+		"app_power_kw":                  "Leistung, wie sie der Startbildschirm der Tesla-App anzeigt, in kW auf eine Nachkommastelle.  powerwall ist beim Entladen positiv, grid beim Netzbezug",
+		"energy_remaining_watt_hours":   "verbleibende Energie in den Powerwalls in Wattstunden, aus dem Rohladezustand oder wie die Tesla-App sie berechnet",
+		"nominal_system_energy_kWh":     "Nennenergie, die der Wechselrichter liefern kann",
+		"nominal_system_power_kW":       "Nennleistung, die der Wechselrichter liefern kann",
+		"max_site_meter_power_kW":       "höchste Leistung, für die der Standortzähler ausgelegt ist, um vor einer Überlastung des Hausanschlusses oder Gateways zu warnen",
+		"num_powerwalls":                "Anzahl der vom Energy Gateway verwalteten Powerwall-Batteriesysteme",
+		"total_solar_rating_W":          "Nennleistung aller an den Wechselrichter angeschlossenen Solaranlagen zusammen, in Watt",
+		"operating_mode":                "1 für die Betriebsart der Powerwalls, 0 für die anderen.  Im Modus backup werden die Powerwalls nur für Notstrom entladen; im Modus self_consumption wechseln sie zwischen Laden und Entladen",
+		"backup_reserve_percent":        "Prozent der Batteriekapazität, die nur bei einem Netzausfall genutzt werden",
+		"uptime_seconds":                "Laufzeit des Tesla Energy Gateway in Sekunden",
+		"build_info":                    "1, mit der vollständigen Softwareversion, dem Git-Hash, dem Gerätetyp und dem Synchronisationstyp des Gateways als Labels",
+		"instant_power":                 "vom angegebenen Zähler momentan gemessene Leistung, in Watt",
+		"cumulative_power":              "über die Lebensdauer des angegebenen Zählers gemessene Energie, in Wh",
+		"instant_average_voltage":       "vom angegebenen Zähler momentan gemessene elektrische Spannung, in Volt",
+		"instant_total_current_amps":    "vom angegebenen Zähler momentan gemessener elektrischer Strom, in Ampere",
+		"temperature_celsius":           "vom angegebenen Sensor gemeldete Temperatur in Grad Celsius, etwa eines Wechselrichter-Kühlkörpers oder der Umgebungsluft, um eine thermische Leistungsminderung sichtbar zu machen",
+		"grid_connected":                "1, wenn das Netz zur Stromversorgung verfügbar ist",
+		"grid_active":                   "1, wenn das Netz gerade Strom liefert",
+		"grid_status":                   "1 für den vom Gateway gemeldeten Netzstatus, 0 für die anderen",
+		"daily_energy_kwh":              "Energie durch jeden Zähler seit Mitternacht in der Zeitzone des Gateways, wie das Gateway sie meldet oder wie der Exporter sie aus den Lebensdauerzählern berechnet",
+		"self_powered_percent":          "Prozent des heutigen Hausverbrauchs, der aus Solar und Batterie statt aus dem Netz gedeckt wurde, wie die Tagesansicht der Tesla-App es anzeigt",
+		"grid_cost_total":               "geschätzte Kosten der aus dem Netz bezogenen Energie nach dem konfigurierten Tarif, seit Beginn des Exporter-Zustands",
+		"export_credit_total":           "geschätzte Vergütung der ins Netz eingespeisten Energie nach dem konfigurierten Tarif, seit Beginn des Exporter-Zustands",
+		"grid_outages_total":            "Anzahl der Netzausfälle am Standort seit Beginn des Exporter-Zustands",
+		"time_islanded_seconds_total":   "Zeit in Sekunden, die der Standort im Inselbetrieb verbracht hat, während der Exporter lief",
+		"last_outage_timestamp_seconds": "Unix-Zeit in Sekunden, zu der der letzte Netzausfall begann",
+		"soe_change_percent_per_hour":   "Änderungsrate des Powerwall-Ladezustands in Prozent pro Stunde, über das konfigurierte Zeitfenster angepasst",
+		"snapshot_timestamp_seconds":    "Unix-Zeit in Sekunden, zu der die Abfrage der exportierten Werte begann",
+	},
+	French: {
+		"powerwall_charge_percent":      "charge des Powerwalls en pourcentage de l'énergie nominale",
+		"app_charge_percent":            "charge des Powerwalls en pourcentage telle que l'affiche l'application Tesla, qui masque une réserve au bas de la batterie",
+		"app_power_kw":                  "puissance telle que l'affiche l'écran d'accueil de l'application Tesla, en kW à une décimale.  powerwall est positif en décharge, grid en soutirage",
+		"energy_remaining_watt_hours":   "énergie restante dans les Powerwalls en wattheures, d'après la charge brute ou telle que l'application Tesla la calcule",
+		"nominal_system_energy_kWh":     "énergie nominale que l'onduleur peut fournir",
+		"nominal_system_power_kW":       "puissance nominale que l'onduleur peut fournir",
+		"max_site_meter_power_kW":       "puissance maximale pour laquelle le compteur du site est dimensionné, pour alerter avant une surcharge du branchement ou de la passerelle",
+		"num_powerwalls":                "nombre de batteries Powerwall gérées par la passerelle d'énergie",
+		"total_solar_rating_W":          "puissance nominale totale de tous les champs solaires raccordés à l'onduleur, en watts",
+		"operating_mode":                "1 pour le mode de fonctionnement des Powerwalls, 0 pour les autres.  En mode backup les Powerwalls ne servent qu'à l'alimentation de secours ; en mode self_consumption elles alternent entre charge et décharge",
+		"backup_reserve_percent":        "pourcentage de la capacité de la batterie utilisé uniquement en cas de coupure du réseau",
+		"uptime_seconds":                "durée de fonctionnement de la passerelle Tesla Energy Gateway, en secondes",
+		"build_info":                    "1, avec comme labels la version complète du logiciel de la passerelle, le hash git, le type d'appareil et le type de synchronisation",
+		"instant_power":                 "puissance mesurée à un instant donné par le compteur indiqué, en watts",
+		"cumulative_power":              "énergie mesurée sur toute la durée de vie du compteur indiqué, en Wh",
+		"instant_average_voltage":       "tension électrique mesurée à un instant donné par le compteur indiqué, en volts",
+		"instant_total_current_amps":    "courant électrique mesuré à un instant donné par le compteur indiqué, en ampères",
+		"temperature_celsius":           "température en degrés Celsius signalée par le capteur indiqué, comme le dissipateur d'un onduleur ou l'air ambiant, pour rendre visible le déclassement thermique",
+		"grid_connected":                "1 si le réseau est disponible pour fournir de l'électricité",
+		"grid_active":                   "1 si le réseau fournit actuellement de l'électricité",
+		"grid_status":                   "1 pour l'état du réseau signalé par la passerelle, 0 pour les autres",
+		"daily_energy_kwh":              "énergie passée par chaque compteur depuis minuit dans le fuseau horaire de la passerelle, telle que la passerelle la signale ou que l'exporteur la calcule à partir des relevés cumulés",
+		"self_powered_percent":          "pourcentage de la consommation du jour couvert par le solaire et la batterie plutôt que par le réseau, comme l'affiche la vue quotidienne de l'application Tesla",
+		"grid_cost_total":               "coût estimé de l'énergie achetée au réseau selon le tarif configuré, depuis le début de l'état de l'exporteur",
+		"export_credit_total":           "crédit estimé pour l'énergie vendue au réseau selon le tarif configuré, depuis le début de l'état de l'exporteur",
+		"grid_outages_total":            "nombre de coupures du réseau sur le site depuis le début de l'état de l'exporteur",
+		"time_islanded_seconds_total":   "temps en secondes passé par le site hors réseau pendant que l'exporteur fonctionnait",
+		"last_outage_timestamp_seconds": "heure Unix en secondes du début de la dernière coupure du réseau",
+		"soe_change_percent_per_hour":   "vitesse de variation de la charge des Powerwalls en pourcentage par heure, ajustée sur la fenêtre configurée",
+		"snapshot_timestamp_seconds":    "heure Unix en secondes du début de l'interrogation dont proviennent les valeurs exportées",
+	},
+}
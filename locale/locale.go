@@ -0,0 +1,58 @@
+// Package locale translates the exporter's metric help text and web pages.
+// English is the source language: anything without a translation is shown
+// in English rather than not at all.
+package locale
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Locale is a language the exporter can describe itself in.
+type Locale string
+
+const (
+	English Locale = "en"
+	German  Locale = "de"
+	French  Locale = "fr"
+)
+
+// Locales lists the supported locales.
+var Locales = []Locale{English, German, French}
+
+// Parse returns the locale named by s, which may be a bare language code
+// such as de or a POSIX or BCP 47 locale such as de_CH.UTF-8 or fr-CA.
+// Empty means English.
+func Parse(s string) (Locale, error) {
+	if s == "" {
+		return English, nil
+	}
+	lang := strings.ToLower(s)
+	if i := strings.IndexAny(lang, "_-."); i >= 0 {
+		lang = lang[:i]
+	}
+	for _, l := range Locales {
+		if string(l) == lang {
+			return l, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported locale %q, want one of %v", s, Locales)
+}
+
+// Help returns the help text of the metric with the given historical name
+// in l, or english if there is no translation.
+func (l Locale) Help(name, english string) string {
+	if t, ok := helpText[l][name]; ok {
+		return t
+	}
+	return english
+}
+
+// Text returns the web interface string english in l, or english itself
+// if there is no translation.
+func (l Locale) Text(english string) string {
+	if t, ok := uiText[l][english]; ok {
+		return t
+	}
+	return english
+}
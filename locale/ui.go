@@ -0,0 +1,41 @@
+package locale
+
+// uiText translates the landing page and dashboard, keyed by the English.
+var uiText = map[Locale]map[string]string{
+	German: {
+		"Metrics":              "Metriken",
+		"Version":              "Version",
+		"Gateway":              "Gateway",
+		"Last poll":            "Letzte Abfrage",
+		"never":                "nie",
+		"took":                 "Dauer",
+		"Last error":           "Letzter Fehler",
+		"none":                 "keiner",
+		"Battery charge":       "Batterieladung",
+		"Battery charge (app)": "Batterieladung (App)",
+		"Power":                "Leistung",
+		"Energy per hour":      "Energie pro Stunde",
+		"Grid status":          "Netzstatus",
+		"Backup reserve":       "Notstromreserve",
+		"Energy flows":         "Energieflüsse",
+		"Data source":          "Datenquelle",
+	},
+	French: {
+		"Metrics":              "Métriques",
+		"Version":              "Version",
+		"Gateway":              "Passerelle",
+		"Last poll":            "Dernière interrogation",
+		"never":                "jamais",
+		"took":                 "durée",
+		"Last error":           "Dernière erreur",
+		"none":                 "aucune",
+		"Battery charge":       "Charge de la batterie",
+		"Battery charge (app)": "Charge de la batterie (app)",
+		"Power":                "Puissance",
+		"Energy per hour":      "Énergie par heure",
+		"Grid status":          "État du réseau",
+		"Backup reserve":       "Réserve de secours",
+		"Energy flows":         "Flux d'énergie",
+		"Data source":          "Source de données",
+	},
+}
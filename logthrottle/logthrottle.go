@@ -0,0 +1,80 @@
+// Package logthrottle logs recurring warnings at most once per interval,
+// so a problem that shows up on every poll doesn't flood the log when
+// polling every second.
+package logthrottle
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+var suppressed = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "powerwall_suppressed_log_messages_total",
+	Help: "number of log messages not written because the same message was logged recently",
+})
+
+func init() {
+	prometheus.MustRegister(suppressed)
+}
+
+// signature tracks a message which has been logged.
+type signature struct {
+	last       time.Time
+	suppressed int
+}
+
+var (
+	mu       sync.Mutex
+	interval = 5 * time.Minute
+	seen     = make(map[string]*signature)
+)
+
+// SetInterval sets how long a message is suppressed after it's logged.
+// 0 logs every message.
+func SetInterval(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	interval = d
+}
+
+// Warningf logs a warning unless one with the same key was logged within
+// the interval.  key identifies the message independently of values which
+// vary between occurrences, such as a reading.
+func Warningf(key, format string, args ...interface{}) {
+	if msg, ok := message(key, format, args); ok {
+		glog.WarningDepth(1, msg)
+	}
+}
+
+// Errorf is like Warningf, but logs at error severity.
+func Errorf(key, format string, args ...interface{}) {
+	if msg, ok := message(key, format, args); ok {
+		glog.ErrorDepth(1, msg)
+	}
+}
+
+// message returns the message to log, and false if it should be
+// suppressed.
+func message(key, format string, args []interface{}) (string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	s, ok := seen[key]
+	if !ok {
+		s = &signature{}
+		seen[key] = s
+	} else if now.Sub(s.last) < interval {
+		s.suppressed++
+		suppressed.Inc()
+		return "", false
+	}
+	msg := fmt.Sprintf(format, args...)
+	if s.suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d similar messages suppressed)", msg, s.suppressed)
+	}
+	s.last, s.suppressed = now, 0
+	return msg, true
+}
@@ -0,0 +1,189 @@
+// Package modbus serves the key gateway metrics as a read-only Modbus TCP
+// register map, for building management systems and energy displays that
+// can't talk to Tesla.
+//
+// Input registers and holding registers hold the same values:
+//
+//	0     state of energy, hundredths of a percent
+//	1     grid status: 0 unknown, 1 connected, 2 islanded ready,
+//	      3 islanded active, 4 transitioning to grid
+//	2-3   site (grid) power, watts, signed 32 bit, high word first
+//	4-5   load power, watts, signed 32 bit
+//	6-7   solar power, watts, signed 32 bit
+//	8-9   battery power, watts, signed 32 bit
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"io"
+	"net"
+	"sync"
+)
+
+// Options describes how to serve Modbus.
+type Options struct {
+	// Port is the TCP port to listen on, usually 502.  If zero, there is
+	// no server.
+	Port int
+}
+
+// Function codes and exception codes we use.
+const (
+	fcReadHolding = 0x03
+	fcReadInput   = 0x04
+
+	exIllegalFunction = 0x01
+	exIllegalAddress  = 0x02
+	exDeviceFailure   = 0x04
+)
+
+// kMaxRegisters is the most registers a single read may ask for.
+const kMaxRegisters = 125
+
+var gridStatusValues = map[powerwall.SystemStatus]uint16{
+	powerwall.GridConnected:    1,
+	powerwall.IslandedReady:    2,
+	powerwall.IslandedActive:   3,
+	powerwall.TransitionToGrid: 4,
+}
+
+// registers lays out a snapshot in the register map.
+func registers(m *model.TeslaEnergyGatewayMetrics) []uint16 {
+	rval := []uint16{
+		uint16(m.PowerwallChargePercent * 100),
+		gridStatusValues[m.GridStatus],
+	}
+	for _, mt := range []model.MeterType{model.Total, model.Load, model.Solar, model.Battery} {
+		w := uint32(int32(m.Meters[mt].InstantPower))
+		rval = append(rval, uint16(w>>16), uint16(w))
+	}
+	return rval
+}
+
+// Server answers Modbus requests from the most recent snapshot.
+type Server struct {
+	opts   Options
+	latest func() *model.TeslaEnergyGatewayMetrics
+
+	mu     sync.Mutex
+	l      net.Listener
+	closed bool
+}
+
+// New returns a Server which reads values from latest.  latest may return
+// nil before the first poll.
+func New(opts Options, latest func() *model.TeslaEnergyGatewayMetrics) *Server {
+	return &Server{opts: opts, latest: latest}
+}
+
+// ListenAndServe does not return under normal operation.  After Close, it
+// returns nil.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.opts.Port))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return l.Close()
+	}
+	s.l = l
+	s.mu.Unlock()
+	glog.Infof("Serving Modbus TCP on port %d", s.opts.Port)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// Close stops accepting connections.  Connections already open are left
+// to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.l == nil {
+		return nil
+	}
+	return s.l.Close()
+}
+
+// serve handles requests on one connection until the client hangs up.
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			glog.V(1).Infof("Closing Modbus connection: %v", err)
+		}
+	}()
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				glog.V(1).Infof("Reading Modbus request from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		// MBAP header: transaction, protocol, length, unit.  length
+		// counts the unit byte and the PDU.
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		if binary.BigEndian.Uint16(header[2:4]) != 0 || length < 2 || length > 254 {
+			glog.V(1).Infof("Dropping malformed Modbus request from %s", conn.RemoteAddr())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			glog.V(1).Infof("Reading Modbus request from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		resp := s.handle(pdu)
+		out := make([]byte, 7, 7+len(resp))
+		copy(out, header)
+		binary.BigEndian.PutUint16(out[4:6], uint16(len(resp)+1))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			glog.V(1).Infof("Writing Modbus response to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// handle returns the response PDU for a request PDU.
+func (s *Server) handle(pdu []byte) []byte {
+	fc := pdu[0]
+	exception := func(code byte) []byte {
+		return []byte{fc | 0x80, code}
+	}
+	if fc != fcReadHolding && fc != fcReadInput {
+		return exception(exIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(exIllegalAddress)
+	}
+	start := int(binary.BigEndian.Uint16(pdu[1:3]))
+	count := int(binary.BigEndian.Uint16(pdu[3:5]))
+	m := s.latest()
+	if m == nil {
+		return exception(exDeviceFailure)
+	}
+	regs := registers(m)
+	if count < 1 || count > kMaxRegisters || start+count > len(regs) {
+		return exception(exIllegalAddress)
+	}
+	rval := []byte{fc, byte(count * 2)}
+	for _, r := range regs[start : start+count] {
+		rval = append(rval, byte(r>>8), byte(r))
+	}
+	return rval
+}
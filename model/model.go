@@ -2,9 +2,18 @@ package model
 
 import (
 	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/overlay"
 	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall/vitals"
+	"golang.org/x/sync/errgroup"
+	"math"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,18 +23,39 @@ type FixedInfo struct {
 	// from site info:
 	NominalSystemEnergykWh float64
 	NominalSystemPowerkW   float64
+	MaxSiteMeterPowerkW    float64 // zero if unknown
 	SiteName               string
+	Utility                string
+	// Location is the gateway's time zone, or nil if it couldn't be
+	// decoded.
+	Location *time.Location
+	// OffGridSolarCapable is true if the grid code's name matches a
+	// standard requiring solar inverters to back off when the powerwalls
+	// shift the frequency, which is what lets solar keep running during an
+	// outage.  It is a guess from the name, not from the inverters.
+	OffGridSolarCapable bool
+	// FrequencyShiftSettings holds the grid code overrides which tune the
+	// frequency shift, by name.
+	FrequencyShiftSettings map[string]float64
+	// NominalFrequencyHz is the grid's frequency from the grid code, or
+	// zero if it doesn't say.
+	NominalFrequencyHz float64
 	// from powerwalls:
 	NumPowerwalls          int
 	PowerwallSerialNumbers []string
 	// from config:
 	VIN string
+	// from status:
+	DIN string
 	// from solars:
 	TotalSolarPowerRatingWatts int
 	// nothing usefin in installer.
+	// UnknownEnumValues lists enumeration values reported while fetching
+	// the fixed info that the powerwall package does not recognize.
+	UnknownEnumValues []powerwall.UnknownValue
 }
 
-func fetchFixedInfo(mon powerwall.Monitor) (*FixedInfo, error) {
+func fetchFixedInfo(mon powerwall.Monitor, opts PollOptions) (*FixedInfo, error) {
 	si, err := mon.GetSiteInfo()
 	if err != nil {
 		return nil, fmt.Errorf("mon.GetSiteInfo(): %v", err)
@@ -38,14 +68,26 @@ func fetchFixedInfo(mon powerwall.Monitor) (*FixedInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("mon.GetConfig(): %v", err)
 	}
-	solars, err := mon.GetSolars()
+	var solars []powerwall.Solar
+	if !opts.Disabled[CollectorSolars] {
+		if solars, err = mon.GetSolars(); err != nil {
+			return nil, fmt.Errorf("mon.GetSolars(): %v", err)
+		}
+	}
+	status, err := mon.GetStatus()
 	if err != nil {
-		return nil, fmt.Errorf("mon.GetSolars(): %v", err)
+		return nil, fmt.Errorf("mon.GetStatus(): %v", err)
 	}
 	fi := FixedInfo{
 		NominalSystemEnergykWh: si.NominalSystemEnergykWh,
 		NominalSystemPowerkW:   si.NominalSystemPowerkW,
+		MaxSiteMeterPowerkW:    maxSiteMeterPower(si.MaxSiteMeterPowerkW),
 		SiteName:               si.SiteName,
+		Utility:                si.GridCode.Utility,
+		Location:               si.TimeZone.Location(),
+		OffGridSolarCapable:    offGridSolarCapable(si.GridCode),
+		FrequencyShiftSettings: frequencyShiftSettings(si.GridCode),
+		NominalFrequencyHz:     float64(si.GridCode.Frequency),
 		NumPowerwalls:          len(pws.Powerwalls),
 		PowerwallSerialNumbers: func() []string {
 			var rval []string
@@ -55,6 +97,7 @@ func fetchFixedInfo(mon powerwall.Monitor) (*FixedInfo, error) {
 			return rval
 		}(),
 		VIN: config.VIN,
+		DIN: status.DIN,
 		TotalSolarPowerRatingWatts: func() int {
 			var rval int
 			for _, s := range solars {
@@ -73,6 +116,16 @@ type NetworkInterfaceDetails struct {
 	Enabled        bool
 	Primary        bool
 	SignalStrength int
+	// DHCP is true if the interface's address is assigned by DHCP rather
+	// than configured statically.
+	DHCP bool
+	// Addresses are the interface's IP addresses, in CIDR notation.
+	Addresses       []string
+	Gateway         string
+	HardwareAddress string
+	// State is the interface's connection state, as the gateway reports
+	// it.
+	State string
 }
 
 type MeterType int
@@ -99,6 +152,28 @@ func (m MeterType) String() string {
 	}
 }
 
+// MarshalText names the meter, so maps keyed by meter read well as JSON.
+func (m MeterType) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText accepts a meter's name, or the number older state files
+// recorded.
+func (m *MeterType) UnmarshalText(b []byte) error {
+	for _, mt := range []MeterType{Total, Load, Solar, Battery} {
+		if string(b) == mt.String() {
+			*m = mt
+			return nil
+		}
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return fmt.Errorf("unknown meter %q", b)
+	}
+	*m = MeterType(n)
+	return nil
+}
+
 type MeterDetails struct {
 	InstantPower          float64
 	InstantReactivePower  float64
@@ -107,34 +182,515 @@ type MeterDetails struct {
 	CumulativeEnergyFrom  float64
 	InstantAverageVoltage float64
 	InstantTotalCurrent   float64
+	Frequency             float64
+}
+
+// CTDetails is the reading of one current transformer clamp.
+type CTDetails struct {
+	// CT names the clamp: "a", "b" or "c".
+	CT        string
+	RealPower float64
+	Voltage   float64
+	Current   float64
+}
+
+// CTMeterDetails describes a meter with current transformer clamps, such as
+// a Neurio meter.
+type CTMeterDetails struct {
+	// Location is where the meter measures: "site" or "solar".
+	Location string
+	Serial   string
+	CTs      []CTDetails
+}
+
+// RevenueMeter is the lifetime totals of a revenue grade meter, which
+// matter for SREC reporting.
+type RevenueMeter struct {
+	// Location is where the meter measures, such as "site".
+	Location   string
+	Serial     string
+	ImportedWh float64
+	ExportedWh float64
+}
+
+// PVString is one solar string feeding a Tesla inverter.
+type PVString struct {
+	// DIN identifies the inverter.
+	DIN string
+	// String is the inverter's name for the string: "A", "B", "C" or "D".
+	String  string
+	Voltage float64
+	Current float64
+	Power   float64
+}
+
+// Temperature is one temperature sensor reading from the vitals, such as
+// an inverter's heat sink, a powerwall's POD, or the ambient air.
+type Temperature struct {
+	// Serial identifies the device, falling back to its DIN.
+	Serial string
+	// Component is the subsystem, such as "PVAC" or "THC".
+	Component string
+	// Sensor is the name of the vital, such as "THC_AmbientTemp".
+	Sensor  string
+	Celsius float64
+}
+
+// pvStringNames are the suffixes the inverter vitals use for each string.
+var pvStringNames = []string{"A", "B", "C", "D"}
+
+// GridFaultHistory summarizes the faults the gateway remembers.
+type GridFaultHistory struct {
+	// Count is the number of faults in the gateway's history.
+	Count int
+	// CountByName breaks Count down by alert name, such as
+	// "PINV_a008_vfCheckRocof".
+	CountByName map[string]int
+	// MostRecent is the time of the newest fault, or zero if there are none.
+	MostRecent time.Time
+}
+
+// BackupEventHistory summarizes the times the site has run on its
+// batteries without the grid.
+type BackupEventHistory struct {
+	Count int
+	// Last is when the most recent event began, or zero if there are
+	// none.
+	Last time.Time
+}
+
+// GatewayHardware identifies the gateway itself, so a replacement shows
+// up in the metrics history.
+type GatewayHardware struct {
+	// DIN is the gateway's device identification number, its part number
+	// and serial number joined by "--".
+	DIN          string
+	PartNumber   string // "1232100-00-E"
+	SerialNumber string // "TG000000000000"
+}
+
+// parseDIN splits a DIN such as "1232100-00-E--TG000000000000" into its
+// part and serial numbers.  A DIN without "--" is left whole.
+func parseDIN(din string) GatewayHardware {
+	rval := GatewayHardware{DIN: din}
+	if i := strings.Index(din, "--"); i >= 0 {
+		rval.PartNumber, rval.SerialNumber = din[:i], din[i+2:]
+	}
+	return rval
+}
+
+// PowerwallDetails describes the state of one battery.
+type PowerwallDetails struct {
+	SerialNumber        string
+	PartNumber          string
+	Type                string // "acpw"
+	GridState           powerwall.GridState
+	UnderPhaseDetection bool
+	Updating            bool
+	// FailedChecks lists the diagnostic checks that failed, by diagnostic
+	// and check name.
+	FailedChecks []FailedCheck
+}
+
+// FailedCheck names a failed powerwall diagnostic check.
+type FailedCheck struct {
+	// Diagnostic is the name of the diagnostic, such as "Commissioning".
+	Diagnostic string
+	// Check is the name of the check, such as "CAN connectivity".
+	Check string
 }
 
 type SoftwareVersion struct {
 	Major, Minor, Release int64
+	// Full is the version as the gateway reports it, which may have more
+	// parts than Major, Minor and Release, or a build suffix.  Components
+	// missing from it are zero.
+	Full       string
+	GitHash    string
+	DeviceType string
+	SyncType   string
 }
 
 type TeslaEnergyGatewayMetrics struct {
 	Fixed FixedInfo
+	// PolledAt is when the poll began.  Every reading in it is taken to
+	// be from then.
+	PolledAt time.Time
+	// Skipped holds the optional collectors, such as CollectorNetworks,
+	// which this poll left out, so their metrics can be left out too
+	// rather than reported as zero.
+	Skipped map[string]bool
+	// Failed holds the errors of the optional collectors whose endpoints
+	// failed this poll.  They're in Skipped too; the rest of the poll
+	// goes on without them.
+	Failed map[string]error
 	// from operation:
 	Mode                 powerwall.OperatingMode
 	BackupReservePercent float64
+	// Off grid, above FreqShiftLoadShedSOE percent charge the gateway
+	// shifts its frequency by up to FreqShiftLoadShedDeltaF Hz to make
+	// the solar inverters curtail.  Both are zero from the cloud backend,
+	// which doesn't report them.
+	FreqShiftLoadShedSOE    float64
+	FreqShiftLoadShedDeltaF float64
 	// from status:
 	Uptime            time.Duration
+	StartTime         time.Time // by the gateway's clock; zero if it didn't say
 	Version           SoftwareVersion
+	Hardware          GatewayHardware
+	Deprecations      []powerwall.Deprecation // endpoints known broken in Version
 	NetworkInterfaces map[powerwall.NetworkInterface]NetworkInterfaceDetails
 	// sitemaster
 	SiteMasterRunning          bool
 	SiteMasterConnectedToTesla bool
 	SiteMasterSupplyingPower   bool
 	Meters                     map[MeterType]MeterDetails
+	CTMeters                   []CTMeterDetails
+	// from meters/readings, if PollOptions.MeterReadings:
+	RevenueMeters []RevenueMeter
+	// GatewayToday is each meter's energy since local midnight as the
+	// gateway counts it, for the meters whose firmware reports it.
+	GatewayToday map[MeterType]MeterEnergy
 	// from soe:
 	PowerwallChargePercent float64
+	// from powerwalls:
+	Powerwalls         []PowerwallDetails
+	Updating           bool
+	Enumerating        bool
+	GridQualifying     bool
+	GridCodeValidating bool
+	BubbleShedding     bool
 	// from gridstatus:
+	GridStatus    powerwall.SystemStatus
 	GridConnected bool
 	GridActive    bool
+	// from grid faults:
+	GridFaults GridFaultHistory
+	// from the backup history, or nil if the backend keeps none:
+	BackupEvents *BackupEventHistory
+	// from wifi_scan, if PollOptions.Wifi:
+	WifiNetworks []powerwall.WifiNetwork
+	// from vitals, if PollOptions.Vitals:
+	Devices      []vitals.Device
+	PVStrings    []PVString
+	Temperatures []Temperature
+	// OverlayValues are fields read as described by PollOptions.Overlay.
+	OverlayValues []overlay.Value
+	// UnknownEnumValues lists enumeration values reported during this poll
+	// that the powerwall package does not recognize.
+	UnknownEnumValues []powerwall.UnknownValue
+	// Derived is filled in by the derive package from this and prior polls.
+	Derived Derived
+}
+
+// SOEGap describes how much the powerwall charge moved while the exporter
+// was not polling.
+type SOEGap struct {
+	// End is when polling resumed.
+	End time.Time
+	// Duration is the time between the polls either side of the gap.
+	Duration time.Duration
+	// ChangePercent is the charge after the gap minus the charge before.
+	ChangePercent float64
+}
+
+// DailySummary recaps the energy flows over one local day.  Energy is in
+// watt hours.
+type DailySummary struct {
+	// Day is midnight at the start of the day summarized.
+	Day                time.Time
+	SolarWh            float64
+	UsageWh            float64
+	ImportWh           float64
+	ExportWh           float64
+	BatteryDischargeWh float64
+	// BatteryCycles is BatteryDischargeWh as a fraction of the nominal
+	// system energy.
+	BatteryCycles float64
+}
+
+// MeterEnergy is the energy through a meter in each direction over some
+// period.
+type MeterEnergy struct {
+	ToWh, FromWh float64
+}
+
+// OutageStats summarizes the grid outages seen since the exporter's state
+// began.
+type OutageStats struct {
+	Count           float64
+	IslandedSeconds float64
+	// LastOutage is when the most recent outage began, or zero if there
+	// hasn't been one.
+	LastOutage time.Time
+}
+
+// SheddingStats summarizes the gateway's bubble shedding, where it sheds
+// load while islanded, since the exporter's state began.
+type SheddingStats struct {
+	Count   float64
+	Seconds float64
+	// Since is when the current spell of shedding began, or zero if the
+	// gateway isn't shedding.
+	Since time.Time
+}
+
+// TariffCost is the running cost of grid energy under the configured
+// tariff.
+type TariffCost struct {
+	Currency string
+	// Period names the tariff period in effect.
+	Period       string
+	GridCost     float64
+	ExportCredit float64
 }
 
-var versionRegex = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)`)
+// Record is the extremes seen over some span.
+type Record struct {
+	// LongestIslanded is the longest time spent off grid in one outage.
+	LongestIslanded  time.Duration
+	MinChargePercent float64
+	// MaxBatteryWatts is the most power the battery has supplied.
+	MaxBatteryWatts float64
+}
+
+// Records are the site's personal records.
+type Records struct {
+	AllTime    Record
+	Last30Days Record
+}
+
+// Rates are rates of change fitted over the recent polls.
+type Rates struct {
+	SOEPercentPerHour         float64
+	BatteryRampWattsPerSecond float64
+}
+
+// Derived holds values computed from more than one poll.
+type Derived struct {
+	// LastSOEGap is the most recent gap in polling, or nil if there has
+	// not been one.
+	LastSOEGap *SOEGap
+	// LastDailySummary recaps the most recent complete day, or nil if
+	// daily summaries are off or no day has finished yet.
+	LastDailySummary *DailySummary
+	// Today holds each meter's energy since local midnight, or since the
+	// exporter started if that was later.  It is nil if daily summaries
+	// are off.
+	Today map[MeterType]MeterEnergy
+	// Tariff is nil unless a tariff is configured.
+	Tariff   *TariffCost
+	Outages  OutageStats
+	Shedding SheddingStats
+	// Records is nil until the first poll has been seen.
+	Records *Records
+	// Rates is nil unless rates of change are configured and there are
+	// enough polls to fit them.
+	Rates *Rates
+	// Smoothed holds filtered values of noisy metrics, keyed by metric
+	// name, for the metrics smoothing is configured for.
+	Smoothed map[string]float64
+}
+
+// kAppReservePercent is the slice of the battery the Tesla app hides.  The
+// app shows 0% when the gateway reports this much charge.
+const kAppReservePercent = 5
+
+// AppChargePercent is PowerwallChargePercent rescaled the way the Tesla
+// app shows it, which is why the app and the gateway disagree.
+func (p *TeslaEnergyGatewayMetrics) AppChargePercent() float64 {
+	rval := (p.PowerwallChargePercent - kAppReservePercent) / (100 - kAppReservePercent) * 100
+	if rval < 0 {
+		return 0
+	}
+	return rval
+}
+
+// EnergyRemainingWh is the energy left in the powerwalls according to the
+// gateway's charge percent.
+func (p *TeslaEnergyGatewayMetrics) EnergyRemainingWh() float64 {
+	return p.PowerwallChargePercent / 100 * p.Fixed.NominalSystemEnergykWh * 1000
+}
+
+// AppEnergyRemainingWh is the energy left according to the Tesla app.
+func (p *TeslaEnergyGatewayMetrics) AppEnergyRemainingWh() float64 {
+	return p.AppChargePercent() / 100 * p.Fixed.NominalSystemEnergykWh * 1000
+}
+
+// kNoSiteMeterLimitkW is what gateways without a configured site limit
+// report as max_site_meter_power_kW.
+const kNoSiteMeterLimitkW = 1000000000
+
+// maxSiteMeterPower returns the site meter's rating in kW, or zero if the
+// gateway reports none.
+func maxSiteMeterPower(kW int64) float64 {
+	if kW >= kNoSiteMeterLimitkW {
+		return 0
+	}
+	return float64(kW)
+}
+
+// kFrequencyWattCodes are parts of grid code names for standards which
+// require inverters to curtail output as the frequency rises, which the
+// powerwalls use to throttle solar while off grid.
+var kFrequencyWattCodes = []string{"UL1741SA", "UL1741SB", "1547", "AS4777", "4105", "G99", "50549"}
+
+func offGridSolarCapable(gc powerwall.GridCode) bool {
+	for _, s := range []string{gc.Code, gc.Region} {
+		normalized := strings.ToUpper(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(s))
+		for _, c := range kFrequencyWattCodes {
+			if strings.Contains(normalized, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func frequencyShiftSettings(gc powerwall.GridCode) map[string]float64 {
+	rval := make(map[string]float64)
+	for _, o := range gc.Overrides {
+		if !strings.Contains(o.Name, "freq") {
+			continue
+		}
+		if v, ok := o.Float(); ok {
+			rval[o.Name] = v
+		}
+	}
+	return rval
+}
+
+// SitePowerUtilization is the power flowing through the site meter as a
+// fraction of the most the site is rated for, negative when exporting.
+// It returns false if the gateway doesn't report the rating.
+func (p *TeslaEnergyGatewayMetrics) SitePowerUtilization() (float64, bool) {
+	if p.Fixed.MaxSiteMeterPowerkW <= 0 {
+		return 0, false
+	}
+	return p.Meters[Total].InstantPower / (p.Fixed.MaxSiteMeterPowerkW * 1000), true
+}
+
+// SelfPoweredPercent is how much of today's home usage came from solar
+// and the battery rather than the grid, as the Tesla app's daily view
+// shows it.  It returns false if there's nothing to go on yet.
+func (p *TeslaEnergyGatewayMetrics) SelfPoweredPercent() (float64, bool) {
+	usage := p.Derived.Today[Load].ToWh
+	if p.Derived.Today == nil || usage <= 0 {
+		return 0, false
+	}
+	rval := (1 - p.Derived.Today[Total].ToWh/usage) * 100
+	return math.Min(100, math.Max(0, rval)), true
+}
+
+// EnergyFlow is power moving from one part of the site to another.
+type EnergyFlow struct {
+	From, To string
+	Watts    float64
+}
+
+// EnergyFlowRoutes lists the From and To of every flow EnergyFlows
+// reports, in order.
+var EnergyFlowRoutes = [][2]string{
+	{"solar", "home"},
+	{"solar", "battery"},
+	{"solar", "grid"},
+	{"battery", "home"},
+	{"battery", "grid"},
+	{"grid", "home"},
+	{"grid", "battery"},
+}
+
+// EnergyFlows splits the meter readings into where the power is going,
+// the way the Tesla app draws it.  Solar goes to the home first, then the
+// battery, then the grid; the home draws on solar, then the battery, then
+// the grid.
+func (p *TeslaEnergyGatewayMetrics) EnergyFlows() []EnergyFlow {
+	pos := func(v float64) float64 { return math.Max(v, 0) }
+	solar := pos(p.Meters[Solar].InstantPower)
+	home := pos(p.Meters[Load].InstantPower)
+	gridImport, gridExport := pos(p.Meters[Total].InstantPower), pos(-p.Meters[Total].InstantPower)
+	discharge, charge := pos(p.Meters[Battery].InstantPower), pos(-p.Meters[Battery].InstantPower)
+
+	solarToHome := math.Min(solar, home)
+	solarToBattery := math.Min(solar-solarToHome, charge)
+	solarToGrid := math.Min(solar-solarToHome-solarToBattery, gridExport)
+	batteryToHome := math.Min(discharge, home-solarToHome)
+	batteryToGrid := pos(math.Min(discharge-batteryToHome, gridExport-solarToGrid))
+	gridToHome := pos(math.Min(gridImport, home-solarToHome-batteryToHome))
+	gridToBattery := pos(math.Min(gridImport-gridToHome, charge-solarToBattery))
+	watts := []float64{solarToHome, solarToBattery, solarToGrid, batteryToHome, batteryToGrid, gridToHome, gridToBattery}
+	var rval []EnergyFlow
+	for i, r := range EnergyFlowRoutes {
+		rval = append(rval, EnergyFlow{From: r[0], To: r[1], Watts: watts[i]})
+	}
+	return rval
+}
+
+// AppPower is one of the power readings on the Tesla app's home screen.
+type AppPower struct {
+	// Name is what the app calls it: "home", "solar", "powerwall" or
+	// "grid".
+	Name string
+	KW   float64
+}
+
+// AppPowers reproduces the Tesla app's home screen: kW rounded to one
+// decimal place, with solar never below zero.  As in the app, the
+// powerwall is positive when discharging and the grid is positive when
+// importing.
+func (p *TeslaEnergyGatewayMetrics) AppPowers() []AppPower {
+	kw := func(w float64) float64 {
+		// Adding 0 turns a rounded -0 into 0, which the app never shows.
+		return math.Round(w/100)/10 + 0
+	}
+	return []AppPower{
+		{Name: "home", KW: kw(math.Max(p.Meters[Load].InstantPower, 0))},
+		{Name: "solar", KW: kw(math.Max(p.Meters[Solar].InstantPower, 0))},
+		{Name: "powerwall", KW: kw(p.Meters[Battery].InstantPower)},
+		{Name: "grid", KW: kw(p.Meters[Total].InstantPower)},
+	}
+}
+
+// unknown logs an unrecognized enumeration value and describes it.
+func unknown(typ, value string) powerwall.UnknownValue {
+	logthrottle.Warningf("unknown "+typ+" "+value, "The gateway reported %s %q, which this exporter does not recognize", typ, value)
+	return powerwall.UnknownValue{Type: typ, Value: value}
+}
+
+// unknownMu guards UnknownEnumValues while a poll's endpoints are fetched
+// concurrently.
+var unknownMu sync.Mutex
+
+// addUnknown records an enumeration value the powerwall package doesn't
+// recognize.
+func (p *TeslaEnergyGatewayMetrics) addUnknown(typ, value string) {
+	unknownMu.Lock()
+	defer unknownMu.Unlock()
+	p.UnknownEnumValues = append(p.UnknownEnumValues, unknown(typ, value))
+}
+
+// versionRegex matches the first A.B.C in a version, allowing for missing
+// components, a v prefix, a fourth component or a build suffix, as in
+// 23.44.0 eb113390.
+var versionRegex = regexp.MustCompile(`(\d+)(?:\.(\d+))?(?:\.(\d+))?`)
+
+// parseVersion fills in v's Major, Minor and Release from full as best it
+// can, leaving components it can't find at zero.  It reports whether it
+// found any.  It never fails, since a firmware's version formatting isn't
+// worth losing the rest of the poll over.
+func parseVersion(full string, v *SoftwareVersion) bool {
+	parts := versionRegex.FindStringSubmatch(full)
+	if parts == nil {
+		return false
+	}
+	for i, c := range []*int64{&v.Major, &v.Minor, &v.Release} {
+		// Out of range components are left at zero too.
+		if n, err := strconv.ParseInt(parts[i+1], 10, 64); err == nil {
+			*c = n
+		}
+	}
+	return true
+}
 
 func (p *TeslaEnergyGatewayMetrics) getOperations(mon powerwall.Monitor) error {
 	operation, err := mon.GetOperation()
@@ -142,7 +698,12 @@ func (p *TeslaEnergyGatewayMetrics) getOperations(mon powerwall.Monitor) error {
 		return err
 	}
 	p.Mode = operation.RealMode
+	if !p.Mode.Known() {
+		p.addUnknown("OperatingMode", string(p.Mode))
+	}
 	p.BackupReservePercent = operation.BackupReservePercent
+	p.FreqShiftLoadShedSOE = operation.FreqShiftLoadShedSOE
+	p.FreqShiftLoadShedDeltaF = operation.FreqShiftLoadShedDeltaF
 	return nil
 }
 
@@ -152,25 +713,41 @@ func (p *TeslaEnergyGatewayMetrics) getStatus(mon powerwall.Monitor) error {
 		return err
 	}
 	p.Uptime = status.UpTime.Duration()
-	versionParts := versionRegex.FindStringSubmatch(status.Version)
-	if len(versionParts) != 4 {
-		return fmt.Errorf("version %q unexpected, want A.B.C", status.Version)
-	}
-	p.Version.Major, err = strconv.ParseInt(versionParts[1], 10, 64)
-	if err != nil {
-		return err
-	}
-	p.Version.Minor, err = strconv.ParseInt(versionParts[2], 10, 64)
-	if err != nil {
-		return err
+	p.StartTime = status.StartTime.Time()
+	p.Hardware = parseDIN(status.DIN)
+	p.Version.Full = status.Version
+	p.Version.GitHash = status.GitHash
+	p.Version.DeviceType = status.DeviceType
+	p.Version.SyncType = status.SyncType
+	if !parseVersion(status.Version, &p.Version) {
+		logthrottle.Warningf("version "+status.Version, "The gateway reported version %q, which has no A.B.C in it; exporting it as 0.0.0", status.Version)
+		return nil
 	}
-	p.Version.Release, err = strconv.ParseInt(versionParts[3], 10, 64)
-	if err != nil {
-		return err
+	p.Deprecations = powerwall.DeprecationsFor(p.Version.Major, p.Version.Minor, p.Version.Release)
+	for _, d := range p.Deprecations {
+		warnDeprecation(status.Version, d)
 	}
 	return nil
 }
 
+var (
+	warnedMu sync.Mutex
+	warned   = make(map[string]bool)
+)
+
+// warnDeprecation logs each deprecated endpoint once per firmware version,
+// rather than on every poll.
+func warnDeprecation(version string, d powerwall.Deprecation) {
+	warnedMu.Lock()
+	defer warnedMu.Unlock()
+	key := version + d.Endpoint
+	if warned[key] {
+		return
+	}
+	warned[key] = true
+	glog.Warningf("Gateway firmware %s affects %s, which this exporter uses: %s", version, d.Endpoint, d.Note)
+}
+
 func (p *TeslaEnergyGatewayMetrics) getNetworks(mon powerwall.Monitor) error {
 	networks, err := mon.GetNetworks()
 	if err != nil {
@@ -178,14 +755,25 @@ func (p *TeslaEnergyGatewayMetrics) getNetworks(mon powerwall.Monitor) error {
 	}
 	p.NetworkInterfaces = make(map[powerwall.NetworkInterface]NetworkInterfaceDetails)
 	for _, nw := range networks {
-		p.NetworkInterfaces[nw.Interface] = NetworkInterfaceDetails{
-			Transport:      nw.Interface,
-			Name:           nw.Name,
-			Enabled:        nw.Enabled,
-			Active:         nw.Active,
-			Primary:        nw.Primary,
-			SignalStrength: nw.Info.SignalStrength,
+		if !nw.Interface.Known() {
+			p.addUnknown("NetworkInterface", string(nw.Interface))
 		}
+		d := NetworkInterfaceDetails{
+			Transport:       nw.Interface,
+			Name:            nw.Name,
+			Enabled:         nw.Enabled,
+			Active:          nw.Active,
+			Primary:         nw.Primary,
+			SignalStrength:  nw.Info.SignalStrength,
+			DHCP:            nw.DHCP,
+			Gateway:         nw.Info.Gateway,
+			HardwareAddress: nw.Info.HardwareAddress,
+			State:           nw.Info.State,
+		}
+		for _, ip := range nw.Info.Networks {
+			d.Addresses = append(d.Addresses, fmt.Sprintf("%s/%d", ip.IPAddress, ip.Netmask))
+		}
+		p.NetworkInterfaces[nw.Interface] = d
 	}
 	return nil
 }
@@ -216,12 +804,86 @@ func (p *TeslaEnergyGatewayMetrics) getAggregates(mon powerwall.Monitor) error {
 			CumulativeEnergyTo:    d.EnergyImported,
 			InstantAverageVoltage: d.InstantAverageVoltage,
 			InstantTotalCurrent:   d.InstantTotalCurrent,
+			Frequency:             d.Frequency,
 		}
 	}
 	p.Meters[Total] = getdetails(agg.Site)
 	p.Meters[Load] = getdetails(agg.Load)
 	p.Meters[Solar] = getdetails(agg.Solar)
 	p.Meters[Battery] = getdetails(agg.Battery)
+	for mt, d := range map[MeterType]powerwall.MeterDetails{
+		Total:   agg.Site,
+		Load:    agg.Load,
+		Solar:   agg.Solar,
+		Battery: agg.Battery,
+	} {
+		if d.EnergyImportedToday == nil || d.EnergyExportedToday == nil {
+			continue
+		}
+		if p.GatewayToday == nil {
+			p.GatewayToday = make(map[MeterType]MeterEnergy)
+		}
+		p.GatewayToday[mt] = MeterEnergy{ToWh: *d.EnergyImportedToday, FromWh: *d.EnergyExportedToday}
+	}
+	return nil
+}
+
+// getCTMeters reads the gateway's CT meters.  Gateways without a meter at
+// a location fail its endpoint rather than returning an empty list, so a
+// failure just means there are no CT meters there.
+func (p *TeslaEnergyGatewayMetrics) getCTMeters(mon powerwall.Monitor) error {
+	site, err := mon.GetMetersSite()
+	if err != nil {
+		glog.V(1).Infof("Reading the site CT meters, taking there to be none: %v", err)
+		site = nil
+	}
+	solar, err := mon.GetMetersSolar()
+	if err != nil {
+		glog.V(1).Infof("Reading the solar CT meters, taking there to be none: %v", err)
+		solar = nil
+	}
+	for _, meter := range append(site, solar...) {
+		r := meter.CachedReadings
+		d := CTMeterDetails{
+			Location: meter.Location,
+			Serial:   meter.Connection.DeviceSerial,
+		}
+		cts := []CTDetails{
+			{CT: "a", RealPower: r.RealPowerA, Voltage: r.VoltageL1N, Current: r.CurrentA},
+			{CT: "b", RealPower: r.RealPowerB, Voltage: r.VoltageL2N, Current: r.CurrentB},
+			{CT: "c", RealPower: r.RealPowerC, Voltage: r.VoltageL3N, Current: r.CurrentC},
+		}
+		for i, ct := range cts {
+			// Skip clamps the meter says aren't connected.
+			if i < len(meter.CTs) && !meter.CTs[i] {
+				continue
+			}
+			d.CTs = append(d.CTs, ct)
+		}
+		p.CTMeters = append(p.CTMeters, d)
+	}
+	return nil
+}
+
+func (p *TeslaEnergyGatewayMetrics) getMeterReadings(mon powerwall.Monitor) error {
+	readings, err := mon.GetMetersReadings()
+	if err != nil {
+		return err
+	}
+	for serial, r := range readings {
+		if !r.Connected {
+			continue
+		}
+		p.RevenueMeters = append(p.RevenueMeters, RevenueMeter{
+			Location:   r.Location,
+			Serial:     serial,
+			ImportedWh: r.EnergyImported,
+			ExportedWh: r.EnergyExported,
+		})
+	}
+	sort.Slice(p.RevenueMeters, func(i, j int) bool {
+		return p.RevenueMeters[i].Serial < p.RevenueMeters[j].Serial
+	})
 	return nil
 }
 
@@ -237,37 +899,303 @@ func (p *TeslaEnergyGatewayMetrics) getSOE(mon powerwall.Monitor) error {
 		return err
 	}
 	p.GridActive = gridstatus.Active
+	p.GridStatus = gridstatus.Status
+	if !gridstatus.Status.Known() {
+		p.addUnknown("SystemStatus", string(gridstatus.Status))
+	}
 	p.GridConnected = gridstatus.Status == powerwall.GridConnected
 	return nil
 }
 
-func (p *TeslaEnergyGatewayMetrics) getDynamicInfo(fixed *FixedInfo, mon powerwall.Monitor) error {
+func (p *TeslaEnergyGatewayMetrics) getPowerwalls(mon powerwall.Monitor) error {
+	pws, err := mon.GetPowerwalls()
+	if err != nil {
+		return err
+	}
+	p.Updating = pws.Updating
+	p.Enumerating = pws.Enumerating
+	p.GridQualifying = pws.GridQualifying
+	p.GridCodeValidating = pws.GridCodeValidating
+	p.BubbleShedding = pws.BubbleShedding
+	for _, pw := range pws.Powerwalls {
+		if !pw.GridState.Known() {
+			p.addUnknown("GridState", string(pw.GridState))
+		}
+		d := PowerwallDetails{
+			SerialNumber:        pw.PackageSerialNumber,
+			PartNumber:          pw.PackagePartNumber,
+			Type:                pw.Type,
+			GridState:           pw.GridState,
+			UnderPhaseDetection: pw.UnderPhaseDetection,
+			Updating:            pw.Updating,
+		}
+		for _, diag := range []powerwall.Diagnostic{pw.CommissioningDiagnostic, pw.UpdateDiagnostic} {
+			for _, c := range diag.Checks {
+				if c.Status == "fail" {
+					d.FailedChecks = append(d.FailedChecks, FailedCheck{Diagnostic: diag.Name, Check: c.Name})
+				}
+			}
+		}
+		p.Powerwalls = append(p.Powerwalls, d)
+	}
+	return nil
+}
+
+func (p *TeslaEnergyGatewayMetrics) getWifi(mon powerwall.Monitor) error {
+	status, err := mon.GetWifiStatus()
+	if err != nil {
+		return err
+	}
+	// Mesh networks can show one SSID on a channel from several access
+	// points.  Keep the one the gateway is joined to, or else the
+	// strongest, so each SSID and channel is reported once.
+	index := make(map[powerwall.WifiNetwork]int)
+	for _, w := range status.Networks {
+		key := powerwall.WifiNetwork{SSID: w.SSID, Channel: w.Channel}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(p.WifiNetworks)
+			p.WifiNetworks = append(p.WifiNetworks, w)
+			continue
+		}
+		if prev := p.WifiNetworks[i]; !prev.Connected && (w.Connected || w.RSSI > prev.RSSI) {
+			p.WifiNetworks[i] = w
+		}
+	}
+	return nil
+}
+
+func (p *TeslaEnergyGatewayMetrics) getGridFaults(mon powerwall.Monitor) error {
+	faults, err := mon.GetGridFaults()
+	if err != nil {
+		return err
+	}
+	p.GridFaults = GridFaultHistory{
+		Count:       len(faults),
+		CountByName: make(map[string]int),
+	}
+	for _, f := range faults {
+		p.GridFaults.CountByName[f.AlertName]++
+		if t := f.Timestamp.Time(); t.After(p.GridFaults.MostRecent) {
+			p.GridFaults.MostRecent = t
+		}
+	}
+	return nil
+}
+
+func (p *TeslaEnergyGatewayMetrics) getBackupEvents(mon powerwall.Monitor) error {
+	events, err := mon.GetBackupEvents()
+	if err != nil || events == nil {
+		return err
+	}
+	p.BackupEvents = &BackupEventHistory{Count: len(events)}
+	for _, e := range events {
+		if e.Start.After(p.BackupEvents.Last) {
+			p.BackupEvents.Last = e.Start
+		}
+	}
+	return nil
+}
+
+func (p *TeslaEnergyGatewayMetrics) getVitals(mon powerwall.Monitor) error {
+	devices, err := mon.GetVitals()
+	if err != nil {
+		return err
+	}
+	p.Devices = devices
+	for _, d := range devices {
+		serial := d.SerialNumber
+		if serial == "" {
+			serial = d.DIN
+		}
+		for name, v := range d.Values {
+			if !strings.HasSuffix(name, "Temp") {
+				continue
+			}
+			p.Temperatures = append(p.Temperatures, Temperature{
+				Serial:    serial,
+				Component: vitals.Component(name),
+				Sensor:    name,
+				Celsius:   v,
+			})
+		}
+		for _, s := range pvStringNames {
+			v, ok := d.Values["PVAC_PVMeasuredVoltage_"+s]
+			if !ok {
+				continue
+			}
+			p.PVStrings = append(p.PVStrings, PVString{
+				DIN:     d.DIN,
+				String:  s,
+				Voltage: v,
+				Current: d.Values["PVAC_PVCurrent_"+s],
+				Power:   d.Values["PVAC_PVMeasuredPower_"+s],
+			})
+		}
+	}
+	return nil
+}
+
+// getOverlay reads the overlay's fields for the gateway's firmware.  The
+// overlay describes fields we haven't vetted, so an endpoint that fails
+// is logged and skipped rather than failing the poll.
+func (p *TeslaEnergyGatewayMetrics) getOverlay(mon powerwall.Monitor, o *overlay.Overlay) error {
+	for endpoint, fields := range o.FieldsFor(p.Version.Major, p.Version.Minor, p.Version.Release) {
+		raw, err := mon.GetRaw(endpoint)
+		if err != nil {
+			logthrottle.Warningf("overlay "+endpoint, "Reading overlay fields from %s: %v", endpoint, err)
+			continue
+		}
+		values, err := overlay.Extract(raw, fields)
+		if err != nil {
+			logthrottle.Warningf("overlay "+endpoint, "Reading overlay fields from %s: %v", endpoint, err)
+			continue
+		}
+		p.OverlayValues = append(p.OverlayValues, values...)
+	}
+	return nil
+}
+
+func (p *TeslaEnergyGatewayMetrics) getDynamicInfo(fixed *FixedInfo, mon powerwall.Monitor, opts PollOptions) error {
 	p.Fixed = *fixed
+	p.Skipped = make(map[string]bool)
+	skip := func(collector string) bool {
+		if opts.Disabled[collector] || opts.Shed[collector] {
+			p.Skipped[collector] = true
+			return true
+		}
+		return false
+	}
 	ops := []func(mon powerwall.Monitor) error{
 		p.getOperations,
 		p.getStatus,
-		p.getNetworks,
 		p.getSiteMaster,
 		p.getAggregates,
 		p.getSOE,
+		p.getPowerwalls,
 	}
-	for _, op := range ops {
-		if err := op(mon); err != nil {
-			return err
+	// An optional collector's endpoint failing, as some do on some
+	// firmware, loses only its own metrics.
+	var mu sync.Mutex
+	optional := func(collector string, op func(mon powerwall.Monitor) error) {
+		if skip(collector) {
+			return
 		}
+		ops = append(ops, func(mon powerwall.Monitor) error {
+			if err := op(mon); err != nil {
+				logthrottle.Warningf("collector "+collector, "The %s collector failed: %v", collector, err)
+				mu.Lock()
+				defer mu.Unlock()
+				p.Skipped[collector] = true
+				if p.Failed == nil {
+					p.Failed = make(map[string]error)
+				}
+				p.Failed[collector] = err
+			}
+			return nil
+		})
+	}
+	optional(CollectorNetworks, p.getNetworks)
+	optional(CollectorCTMeters, p.getCTMeters)
+	optional(CollectorGridFaults, p.getGridFaults)
+	optional(CollectorBackupEvents, p.getBackupEvents)
+	if opts.MeterReadings {
+		optional(CollectorMeterReadings, p.getMeterReadings)
+	}
+	if opts.Wifi {
+		optional(CollectorWifi, p.getWifi)
+	}
+	if opts.Vitals {
+		optional(CollectorVitals, p.getVitals)
+	}
+	withOverlay := opts.Overlay != nil && !skip(CollectorOverlay)
+	skip(CollectorSolars) // polled by New; only marked here.
+	limit := opts.Concurrency
+	if limit < 1 {
+		limit = 1
+	}
+	var g errgroup.Group
+	g.SetLimit(limit)
+	for _, op := range ops {
+		op := op
+		g.Go(func() error {
+			return op(mon)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	// The overlay's fields depend on the version getStatus read.
+	if withOverlay {
+		return p.getOverlay(mon, opts.Overlay)
 	}
 	return nil
 }
 
-// New retrieves fixed fields from an energy gateway.
-func New(mon powerwall.Monitor) (*FixedInfo, error) {
-	return fetchFixedInfo(mon)
+// New retrieves fixed fields from an energy gateway.  opts are those
+// the gateway will be polled with.
+func New(mon powerwall.Monitor, opts PollOptions) (*FixedInfo, error) {
+	return fetchFixedInfo(mon, opts)
+}
+
+// The optional parts of a poll, which PollOptions.Disabled can turn off.
+// Grid faults, vitals and the overlay are low priority, so
+// PollOptions.Shed can skip them too.
+const (
+	CollectorNetworks      = "networks"
+	CollectorCTMeters      = "ct_meters"
+	CollectorSolars        = "solars"
+	CollectorGridFaults    = "grid_faults"
+	CollectorBackupEvents  = "backup_events"
+	CollectorWifi          = "wifi"
+	CollectorMeterReadings = "meter_readings"
+	CollectorVitals        = "vitals"
+	CollectorOverlay       = "overlay"
+)
+
+// Collectors lists the collectors users choose between.  Wi-Fi, meter
+// readings and vitals are off unless PollOptions.Wifi,
+// PollOptions.MeterReadings and PollOptions.Vitals ask for them; the
+// overlay is configured by PollOptions.Overlay alone.
+var Collectors = []string{
+	CollectorNetworks,
+	CollectorCTMeters,
+	CollectorSolars,
+	CollectorGridFaults,
+	CollectorBackupEvents,
+	CollectorWifi,
+	CollectorMeterReadings,
+	CollectorVitals,
+}
+
+// PollOptions selects optional parts of a poll.
+type PollOptions struct {
+	// Vitals fetches /devices/vitals, which firmware 23.44 and later
+	// don't serve.
+	Vitals bool
+	// Wifi fetches the gateway's scan of the Wi-Fi networks around it.
+	Wifi bool
+	// MeterReadings fetches /meters/readings, the revenue grade meter
+	// totals, which not every gateway serves.
+	MeterReadings bool
+	// Overlay, if set, describes fields to read which this exporter
+	// doesn't know about.
+	Overlay *overlay.Overlay
+	// Concurrency is how many endpoints a poll fetches at once.  Less
+	// than 2 fetches them one at a time.
+	Concurrency int
+	// Disabled turns off the named collectors, such as CollectorNetworks,
+	// for gateways where their endpoints hang or fail.
+	Disabled map[string]bool
+	// Shed skips the named low priority collectors, such as
+	// CollectorVitals, even if they're otherwise enabled.
+	Shed map[string]bool
 }
 
 // Poll retrieves dynamic fields from an energy gateway.
-func Poll(mon powerwall.Monitor, fixed *FixedInfo) (*TeslaEnergyGatewayMetrics, error) {
-	r := &TeslaEnergyGatewayMetrics{}
-	if err := r.getDynamicInfo(fixed, mon); err != nil {
+func Poll(mon powerwall.Monitor, fixed *FixedInfo, opts PollOptions) (*TeslaEnergyGatewayMetrics, error) {
+	r := &TeslaEnergyGatewayMetrics{PolledAt: time.Now()}
+	if err := r.getDynamicInfo(fixed, mon, opts); err != nil {
 		return nil, err
 	}
 	return r, nil
@@ -0,0 +1,222 @@
+// Package overlay reads fields the exporter doesn't know about yet out of
+// gateway responses, as described by a schema overlay: a JSON file,
+// maintained by the community, listing new fields by firmware version.
+// Fields in the overlay are exported as generic gauges, so a firmware
+// release that adds something interesting doesn't have to wait for an
+// exporter release.  Nothing is sent anywhere; the overlay is only read.
+//
+// An overlay looks like:
+//
+//	{
+//	  "fields": [
+//	    {
+//	      "min_version": "24.4.0",
+//	      "endpoint": "/system_status",
+//	      "path": "battery_blocks.*.nominal_energy_remaining",
+//	      "name": "battery_block_energy_remaining"
+//	    }
+//	  ]
+//	}
+//
+// path names the value with dot separated object keys and array indexes.
+// A * matches every element of an array, and the matched positions are
+// reported as the value's index.
+package overlay
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/egress"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field describes one value to export.
+type Field struct {
+	// MinVersion and MaxVersion bound the firmware versions, A.B.C, the
+	// field applies to.  Either may be empty for no bound.
+	MinVersion string `json:"min_version"`
+	MaxVersion string `json:"max_version"`
+	// Endpoint is the gateway path, relative to /api, to read the field
+	// from.
+	Endpoint string `json:"endpoint"`
+	// Path locates the value in the endpoint's response.
+	Path string `json:"path"`
+	// Name identifies the field in the exported metrics.
+	Name string `json:"name"`
+}
+
+// Overlay is a parsed schema overlay.
+type Overlay struct {
+	Fields []Field `json:"fields"`
+}
+
+// Value is a field read from a gateway response.
+type Value struct {
+	Endpoint string
+	Name     string
+	// Index holds the array positions matched by * in the field's path,
+	// comma separated, or is empty if there were none.
+	Index string
+	Value float64
+}
+
+const kFetchTimeout = 30 * time.Second
+
+// Load reads an overlay from an http or https URL, or from a file.
+func Load(src string) (*Overlay, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		b, err = fetch(src)
+	} else {
+		b, err = ioutil.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rval Overlay
+	if err := json.Unmarshal(b, &rval); err != nil {
+		return nil, fmt.Errorf("decoding overlay %s: %v", src, err)
+	}
+	for i, f := range rval.Fields {
+		if f.Endpoint == "" || f.Path == "" || f.Name == "" {
+			return nil, fmt.Errorf("overlay %s: field %d needs an endpoint, path and name", src, i)
+		}
+		for _, v := range []string{f.MinVersion, f.MaxVersion} {
+			if _, err := parseVersion(v); err != nil {
+				return nil, fmt.Errorf("overlay %s: field %s: %v", src, f.Name, err)
+			}
+		}
+	}
+	return &rval, nil
+}
+
+func fetch(url string) ([]byte, error) {
+	cli := &http.Client{
+		Transport: egress.Wrap(http.DefaultTransport),
+		Timeout:   kFetchTimeout,
+	}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+var versionRegex = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)`)
+
+// parseVersion parses A.B.C.  An empty version parses as nil.
+func parseVersion(v string) ([]int64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	parts := versionRegex.FindStringSubmatch(v)
+	if parts == nil {
+		return nil, fmt.Errorf("version %q unexpected, want A.B.C", v)
+	}
+	var rval []int64
+	for _, p := range parts[1:] {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		rval = append(rval, n)
+	}
+	return rval, nil
+}
+
+// compare returns -1, 0 or 1 as a is before, the same as, or after b.
+func compare(a, b []int64) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// FieldsFor returns the fields which apply to the given firmware version,
+// grouped by endpoint.
+func (o *Overlay) FieldsFor(major, minor, release int64) map[string][]Field {
+	version := []int64{major, minor, release}
+	rval := make(map[string][]Field)
+	for _, f := range o.Fields {
+		// Versions were checked by Load.
+		if min, _ := parseVersion(f.MinVersion); min != nil && compare(version, min) < 0 {
+			continue
+		}
+		if max, _ := parseVersion(f.MaxVersion); max != nil && compare(version, max) > 0 {
+			continue
+		}
+		rval[f.Endpoint] = append(rval[f.Endpoint], f)
+	}
+	return rval
+}
+
+// Extract reads the values of fields out of raw, the response from their
+// endpoint.  Values which are missing, or aren't numbers or booleans, are
+// skipped.
+func Extract(raw json.RawMessage, fields []Field) ([]Value, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var rval []Value
+	for _, f := range fields {
+		walk(doc, strings.Split(f.Path, "."), nil, func(index []string, v float64) {
+			rval = append(rval, Value{
+				Endpoint: f.Endpoint,
+				Name:     f.Name,
+				Index:    strings.Join(index, ","),
+				Value:    v,
+			})
+		})
+	}
+	return rval, nil
+}
+
+// walk follows path through doc, calling found for each value it leads to.
+func walk(doc interface{}, path []string, index []string, found func(index []string, v float64)) {
+	if len(path) == 0 {
+		switch v := doc.(type) {
+		case float64:
+			found(index, v)
+		case bool:
+			if v {
+				found(index, 1)
+			} else {
+				found(index, 0)
+			}
+		}
+		return
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if next, ok := d[path[0]]; ok {
+			walk(next, path[1:], index, found)
+		}
+	case []interface{}:
+		if path[0] == "*" {
+			for i, next := range d {
+				walk(next, path[1:], append(index[:len(index):len(index)], strconv.Itoa(i)), found)
+			}
+			return
+		}
+		i, err := strconv.Atoi(path[0])
+		if err == nil && i >= 0 && i < len(d) {
+			walk(d[i], path[1:], index, found)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writeTarget is somewhere the exporter writes at runtime, and the flag
+// that says where.
+type writeTarget struct {
+	flag string
+	path string
+	// dir is set when path is a directory files are created in, rather
+	// than a file.
+	dir bool
+}
+
+// writeTargets lists where the exporter will write with the flags given.
+// Everything it writes is named by a flag, so a read-only root filesystem
+// only needs these pointed somewhere writable.
+func writeTargets() []writeTarget {
+	var rval []writeTarget
+	switch {
+	case *stateFile == "", strings.HasPrefix(*stateFile, "redis://"):
+	case strings.HasPrefix(*stateFile, "bolt:"):
+		rval = append(rval, writeTarget{flag: "state_file", path: strings.TrimPrefix(*stateFile, "bolt:")})
+	default:
+		rval = append(rval, writeTarget{flag: "state_file", path: *stateFile})
+	}
+	if *captureFile != "" {
+		rval = append(rval, writeTarget{flag: "capture_file", path: *captureFile})
+	}
+	if *jsonFile != "" {
+		rval = append(rval, writeTarget{flag: "json_file", path: *jsonFile})
+	}
+	if *historyDB != "" {
+		rval = append(rval, writeTarget{flag: "history_db", path: *historyDB})
+	}
+	if *dumpLogs != "" && *dumpLogs != "-" {
+		rval = append(rval, writeTarget{flag: "dump_logs", path: *dumpLogs})
+	}
+	if strings.HasPrefix(*listenAddress, kUnixPrefix) {
+		rval = append(rval, writeTarget{flag: "listen_address", path: strings.TrimPrefix(*listenAddress, kUnixPrefix)})
+	}
+	// glog writes log files unless told to log to stderr, and exits on
+	// the first message if it can't.
+	if f := flag.Lookup("logtostderr"); f == nil || f.Value.String() != "true" {
+		dir := os.TempDir()
+		if f := flag.Lookup("log_dir"); f != nil && f.Value.String() != "" {
+			dir = f.Value.String()
+		}
+		rval = append(rval, writeTarget{flag: "log_dir", path: dir, dir: true})
+	}
+	return rval
+}
+
+const kUnixPrefix = "unix:"
+
+// checkWritable returns an error unless the exporter can write t: create
+// files in its directory, as the atomic replacement of the state and json
+// files does, and append to it if it already exists.
+func checkWritable(t writeTarget) error {
+	dir := t.path
+	if !t.dir {
+		dir = filepath.Dir(t.path)
+	}
+	f, err := ioutil.TempFile(dir, ".powerwall-exporter-check")
+	if err != nil {
+		return fmt.Errorf("can't create files in %s: %v", dir, err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("can't remove files from %s: %v", dir, err)
+	}
+	if t.dir {
+		return nil
+	}
+	if fi, err := os.Stat(t.path); err == nil && fi.Mode().IsRegular() {
+		f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return fmt.Errorf("can't write %s: %v", t.path, err)
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// bindTarget is a port the exporter listens on, and the flag that says
+// which.
+type bindTarget struct {
+	flag    string
+	network string
+	port    int
+}
+
+func bindTargets() []bindTarget {
+	var rval []bindTarget
+	if !strings.HasPrefix(*listenAddress, kUnixPrefix) {
+		rval = append(rval, bindTarget{flag: "port", network: "tcp", port: *port})
+	}
+	if *snmpPort != 0 {
+		rval = append(rval, bindTarget{flag: "snmp_port", network: "udp", port: *snmpPort})
+	}
+	if *modbusPort != 0 {
+		rval = append(rval, bindTarget{flag: "modbus_port", network: "tcp", port: *modbusPort})
+	}
+	return rval
+}
+
+// checkBind returns an error unless b's port can be bound, with a hint
+// when a dropped capability is the likely reason.
+func checkBind(b bindTarget) error {
+	addr := net.JoinHostPort(*listenAddress, strconv.Itoa(b.port))
+	var err error
+	if b.network == "udp" {
+		var c net.PacketConn
+		if c, err = net.ListenPacket("udp", net.JoinHostPort("", strconv.Itoa(b.port))); err == nil {
+			c.Close()
+		}
+	} else {
+		var l net.Listener
+		if l, err = net.Listen("tcp", addr); err == nil {
+			l.Close()
+		}
+	}
+	if b.port < 1024 && errors.Is(err, syscall.EACCES) {
+		return fmt.Errorf("%v; ports below 1024 need root or CAP_NET_BIND_SERVICE, such as systemd's AmbientCapabilities=CAP_NET_BIND_SERVICE", err)
+	}
+	return err
+}
+
+// checkWriteTargets exits with a clear error if the exporter won't be able
+// to write somewhere it needs to, rather than failing at the first poll
+// or log message.
+func checkWriteTargets() {
+	for _, t := range writeTargets() {
+		if err := checkWritable(t); err != nil {
+			// Not glog, which may be what can't write.
+			fmt.Fprintf(os.Stderr, "--%s: %v.  Point it somewhere writable\n", t.flag, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// selfCheckPermissions prints whether each file the exporter would write
+// is writable and each port can be bound, and reports whether they all
+// are.
+func selfCheckPermissions() bool {
+	ok := true
+	report := func(what string, err error) {
+		if err != nil {
+			ok = false
+			fmt.Printf("FAIL %s: %v\n", what, err)
+			return
+		}
+		fmt.Printf("ok   %s\n", what)
+	}
+	for _, t := range writeTargets() {
+		report(fmt.Sprintf("--%s=%s", t.flag, t.path), checkWritable(t))
+	}
+	for _, b := range bindTargets() {
+		report(fmt.Sprintf("--%s=%d (%s)", b.flag, b.port, b.network), checkBind(b))
+	}
+	return ok
+}
@@ -0,0 +1,36 @@
+package powerwall
+
+import (
+	"fmt"
+)
+
+// Controller changes the gateway's settings.  The monitor returned by New
+// implements it only in builds with the control tag; other builds are
+// read-only, and refuse to send the gateway anything but a login.
+type Controller interface {
+	// SetBackupReservePercent sets the state of energy, 0 to 100, that the
+	// Powerwalls hold back for outages.
+	SetBackupReservePercent(percent float64) error
+	// SetOperatingMode switches the gateway to mode.
+	SetOperatingMode(mode OperatingMode) error
+}
+
+// readOnlyError is returned when a read-only build is asked to change the
+// gateway.
+type readOnlyError struct {
+	method   HTTPMethod
+	endpoint string
+}
+
+func (r *readOnlyError) Error() string {
+	return fmt.Sprintf("%s %s: this build is read-only; rebuild with -tags control", r.method, r.endpoint)
+}
+
+// checkReadOnly refuses any request other than a GET or a login unless
+// ControlSupported.
+func checkReadOnly(method HTTPMethod, endpoint string) error {
+	if ControlSupported || method == kGet || endpoint == "/login/Basic" {
+		return nil
+	}
+	return &readOnlyError{method: method, endpoint: endpoint}
+}
@@ -0,0 +1,7 @@
+//go:build !control
+
+package powerwall
+
+// ControlSupported reports whether this build can change the gateway's
+// settings.
+const ControlSupported = false
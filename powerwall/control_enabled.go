@@ -0,0 +1,73 @@
+//go:build control
+
+package powerwall
+
+import (
+	"context"
+	"fmt"
+)
+
+// ControlSupported reports whether this build can change the gateway's
+// settings.
+const ControlSupported = true
+
+// operationRequest holds the settings POST /operation changes.  Sending the
+// whole Operation would also overwrite the frequency shift settings.
+type operationRequest struct {
+	RealMode             OperatingMode `json:"real_mode"`
+	BackupReservePercent float64       `json:"backup_reserve_percent"`
+}
+
+func (m *monitor) SetBackupReservePercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("backup reserve %v%% is outside 0 to 100", percent)
+	}
+	return m.setOperation(func(req *operationRequest) {
+		req.BackupReservePercent = percent
+	})
+}
+
+func (m *monitor) SetOperatingMode(mode OperatingMode) error {
+	if !mode.Known() {
+		return fmt.Errorf("unknown operating mode %q", mode)
+	}
+	return m.setOperation(func(req *operationRequest) {
+		req.RealMode = mode
+	})
+}
+
+// setOperation reads the current operation settings, applies change and
+// writes them back, then has the gateway apply them.  Concurrent calls
+// take turns, so neither undoes the other's change.
+func (m *monitor) setOperation(change func(*operationRequest)) error {
+	m.controlMu.Lock()
+	defer m.controlMu.Unlock()
+	op, err := m.GetOperation()
+	if err != nil {
+		return err
+	}
+	req := operationRequest{
+		RealMode:             op.RealMode,
+		BackupReservePercent: op.BackupReservePercent,
+	}
+	change(&req)
+	var resp Operation
+	if err := m.issueRequest(kPost, "/operation", &req, &resp); err != nil {
+		return err
+	}
+	return m.commit()
+}
+
+// commit has the gateway apply changed settings.  The response isn't
+// useful, so it isn't decoded.
+func (m *monitor) commit() error {
+	const endpoint = "/config/completed"
+	err := m.withRetries(kGet, endpoint, func(ctx context.Context) error {
+		_, err := m.fetch(ctx, kGet, endpoint, nil)
+		return err
+	})
+	if err != nil {
+		return &RequestError{Endpoint: endpoint, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package powerwall
+
+// Deprecation records a gateway endpoint that stopped working, or changed
+// incompatibly, in a firmware release.
+type Deprecation struct {
+	Endpoint string
+	// Major, Minor and Release give the first firmware version affected.
+	Major, Minor, Release int64
+	// Note says what happened to the endpoint.
+	Note string
+}
+
+// Deprecations lists the endpoint changes we know about.  Add to it as
+// firmware updates break things.
+var Deprecations = []Deprecation{
+	{
+		Endpoint: "/networks",
+		Major:    23, Minor: 44, Release: 0,
+		Note: "restricted to installer logins; network metrics will disappear",
+	},
+	{
+		Endpoint: "/devices/vitals",
+		Major:    23, Minor: 44, Release: 0,
+		Note: "removed; vitals, temperature and per-string solar metrics will disappear",
+	},
+	{
+		Endpoint: "/installer",
+		Major:    23, Minor: 44, Release: 0,
+		Note: "restricted to installer logins",
+	},
+}
+
+// DeprecationsFor returns the entries of Deprecations that apply to the
+// given firmware version.
+func DeprecationsFor(major, minor, release int64) []Deprecation {
+	var rval []Deprecation
+	for _, d := range Deprecations {
+		if major != d.Major {
+			if major > d.Major {
+				rval = append(rval, d)
+			}
+			continue
+		}
+		if minor != d.Minor {
+			if minor > d.Minor {
+				rval = append(rval, d)
+			}
+			continue
+		}
+		if release >= d.Release {
+			rval = append(rval, d)
+		}
+	}
+	return rval
+}
@@ -1,24 +1,28 @@
 package powerwall
 
-import (
-	"encoding/json"
-	"fmt"
-)
+// The enumerations below hold the string the gateway reported, so a value
+// Tesla introduces in a new firmware release decodes cleanly instead of
+// failing the whole request.  Known() reports whether this package
+// recognizes the value; String() returns the original string for values
+// it does not.
+
+// UnknownValue describes an enumeration value this package does not
+// recognize.
+type UnknownValue struct {
+	// Type is the name of the enumeration, such as "OperatingMode".
+	Type string
+	// Value is the string the gateway reported.
+	Value string
+}
 
-type NetworkInterface int
+type NetworkInterface string
 
 const (
-	Ethernet NetworkInterface = iota
-	Cellular
-	Wifi
+	Ethernet NetworkInterface = "EthType"
+	Cellular NetworkInterface = "GsmType"
+	Wifi     NetworkInterface = "WifiType"
 )
 
-var stringToInterface = map[string]NetworkInterface{
-	"EthType":  Ethernet,
-	"GsmType":  Cellular,
-	"WifiType": Wifi,
-}
-
 func (n NetworkInterface) String() string {
 	switch n {
 	case Ethernet:
@@ -28,33 +32,34 @@ func (n NetworkInterface) String() string {
 	case Wifi:
 		return "wifi"
 	default:
-		return "unknownNetworkType"
+		return string(n)
 	}
 }
 
-func (n *NetworkInterface) UnmarshalJSON(b []byte) error {
-	var s string
-	if err := json.Unmarshal(b, &s); err != nil {
-		return err
-	}
-	var ok bool
-	*n, ok = stringToInterface[s]
-	if !ok {
-		return fmt.Errorf("unknown NetworkInterface %q", s)
+// Known returns false if the gateway reported a network interface type
+// this package does not recognize.
+func (n NetworkInterface) Known() bool {
+	switch n {
+	case Ethernet, Cellular, Wifi:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
 
-type OperatingMode int
+type OperatingMode string
 
 const (
-	Backup OperatingMode = iota
-	SelfConsumption
-	Autonomous
-	Scheduler
-	SiteControl
+	Backup          OperatingMode = "backup"
+	SelfConsumption OperatingMode = "self_consumption"
+	Autonomous      OperatingMode = "autonomous"
+	Scheduler       OperatingMode = "scheduler"
+	SiteControl     OperatingMode = "site_control"
 )
 
+// OperatingModes lists every OperatingMode this package recognizes.
+var OperatingModes = []OperatingMode{Backup, SelfConsumption, Autonomous, Scheduler, SiteControl}
+
 func (o OperatingMode) String() string {
 	switch o {
 	case Backup:
@@ -68,40 +73,33 @@ func (o OperatingMode) String() string {
 	case SiteControl:
 		return "SiteControl"
 	default:
-		return "UnknownOperatingMode"
+		return string(o)
 	}
 }
 
-var stringToOperatingMode = map[string]OperatingMode{
-	"backup":           Backup,
-	"self_consumption": SelfConsumption,
-	"autonomous":       Autonomous,
-	"scheduler":        Scheduler,
-	"site_control":     SiteControl,
-}
-
-func (n *OperatingMode) UnmarshalJSON(b []byte) error {
-	var s string
-	if err := json.Unmarshal(b, &s); err != nil {
-		return err
-	}
-	var ok bool
-	*n, ok = stringToOperatingMode[s]
-	if !ok {
-		return fmt.Errorf("unknown OperatingMode %q", s)
+// Known returns false if the gateway reported an operating mode this
+// package does not recognize.
+func (o OperatingMode) Known() bool {
+	switch o {
+	case Backup, SelfConsumption, Autonomous, Scheduler, SiteControl:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
 
-type SystemStatus int
+type SystemStatus string
 
 const (
-	GridConnected SystemStatus = iota
-	IslandedReady
-	IslandedActive
-	TransitionToGrid
+	GridConnected    SystemStatus = "SystemGridConnected"
+	IslandedReady    SystemStatus = "SystemIslandedReady"
+	IslandedActive   SystemStatus = "SystemIslandedActive"
+	TransitionToGrid SystemStatus = "SystemTransitionToGrid"
 )
 
+// SystemStatuses lists every SystemStatus this package recognizes.
+var SystemStatuses = []SystemStatus{GridConnected, IslandedReady, IslandedActive, TransitionToGrid}
+
 func (s SystemStatus) String() string {
 	switch s {
 	case GridConnected:
@@ -113,69 +111,54 @@ func (s SystemStatus) String() string {
 	case TransitionToGrid:
 		return "TransitionToGrid"
 	default:
-		return "UnknownSystemStatus"
+		return string(s)
 	}
 }
 
-var stringToSystemStatus = map[string]SystemStatus{
-	"SystemGridConnected":    GridConnected,
-	"SystemIslandedReady":    IslandedReady,
-	"SystemIslandedActive":   IslandedActive,
-	"SystemTransitionToGrid": TransitionToGrid,
-}
-
-func (s *SystemStatus) UnmarshalJSON(b []byte) error {
-	var j string
-	if err := json.Unmarshal(b, &j); err != nil {
-		return err
-	}
-	var ok bool
-	*s, ok = stringToSystemStatus[j]
-	if !ok {
-		return fmt.Errorf("unknown SystemStatus %q", j)
+// Known returns false if the gateway reported a grid status this package
+// does not recognize.
+func (s SystemStatus) Known() bool {
+	switch s {
+	case GridConnected, IslandedReady, IslandedActive, TransitionToGrid:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
 
-type GridState int
+// jrester code suggets values here include:
+// Grid_Compliant, Grid_Qualifying, Grid_Uncompliant
+type GridState string
 
 const (
-	Compliant GridState = iota
-	Qualifying
-	Uncompliant
+	Compliant   GridState = "Grid_Compliant"
+	Qualifying  GridState = "Grid_Qualifying"
+	Uncompliant GridState = "Grid_Uncompliant"
 )
 
-var stringToGridState = map[string]GridState{
-	"Grid_Compliant":   Compliant,
-	"Grid_Qualifying":  Qualifying,
-	"Grid_Uncompliant": Uncompliant,
-}
+// GridStates lists every GridState this package recognizes.
+var GridStates = []GridState{Compliant, Qualifying, Uncompliant}
 
 func (g GridState) String() string {
 	switch g {
 	case Compliant:
-		return "Complaint"
+		return "Compliant"
 	case Qualifying:
 		return "Qualifying"
 	case Uncompliant:
 		return "Uncompliant"
 	default:
-		return "UnknownGridState"
+		return string(g)
 	}
 }
 
-func (g *GridState) UnmarshalJSON(b []byte) error {
-	var s string
-	if err := json.Unmarshal(b, &s); err != nil {
-		return err
-	}
-	var ok bool
-	*g, ok = stringToGridState[s]
-	if !ok {
-		return fmt.Errorf("unknown GridState %q", s)
+// Known returns false if the gateway reported a grid state this package
+// does not recognize.
+func (g GridState) Known() bool {
+	switch g {
+	case Compliant, Qualifying, Uncompliant:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
-
-// jrester code suggets values here include:
-// Grid_Compliant, Grid_Qualifying, Grid_Uncompliant
@@ -3,7 +3,7 @@ package powerwall
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
 	"math"
 	"regexp"
 	"strconv"
@@ -28,7 +28,7 @@ func (t *TimeZone) UnmarshalJSON(b []byte) error {
 		// this is failing the whole shebang when run on a machine
 		// without go installed.  Just log it and live without
 		// knowing the timezone.
-		glog.Errorf("The server reports timezone %q, but we can't decode it because: %v", s, err)
+		logthrottle.Errorf("timezone "+s, "The server reports timezone %q, but we can't decode it because: %v", s, err)
 		return nil
 	}
 	t.loc = ld
@@ -83,6 +83,29 @@ func (t *Time) UnmarshalJSON(b []byte) error {
 	return fmt.Errorf("no layout matched timestamp %q", s)
 }
 
+// MillisecondTime decodes a count of milliseconds since the Unix epoch.
+type MillisecondTime struct {
+	t time.Time
+}
+
+func (m MillisecondTime) Time() time.Time {
+	return m.t
+}
+
+func (m *MillisecondTime) UnmarshalJSON(b []byte) error {
+	var ms int64
+	if err := json.Unmarshal(b, &ms); err != nil {
+		return err
+	}
+	if ms == 0 {
+		var zero time.Time
+		m.t = zero
+		return nil
+	}
+	m.t = time.Unix(0, ms*int64(time.Millisecond))
+	return nil
+}
+
 type FloatDurationSeconds struct {
 	d time.Duration
 }
@@ -138,3 +161,9 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	d.d = r
 	return nil
 }
+
+// NewTimeZone returns a TimeZone for loc, for Monitors that learn the time
+// zone some other way than decoding the gateway's site info.
+func NewTimeZone(loc *time.Location) TimeZone {
+	return TimeZone{loc: loc}
+}
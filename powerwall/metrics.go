@@ -0,0 +1,72 @@
+package powerwall
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Metrics describe a Monitor's requests to the gateway.  The exporter
+// registers them with the rest of its metrics, in its namespace; a nil
+// *Metrics records nothing.
+type Metrics struct {
+	// endpointLatency records how long each attempt at a gateway request
+	// takes, so endpoints that slow down after a firmware update stand
+	// out.  It is a native histogram for servers that support them, with
+	// classic buckets for those that don't.
+	endpointLatency *prometheus.HistogramVec
+	// certExpiry is when the gateway's TLS certificate expires, as seen
+	// at the last connection.  Only the exporter's own Monitor records
+	// it, so there is one gateway and no need for a label.
+	certExpiry prometheus.Gauge
+	// rateLimitWait is how long requests have been held back by
+	// Options.MaxRequestsPerMinute.
+	rateLimitWait prometheus.Counter
+}
+
+// NewMetrics returns Metrics named within namespace.
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		endpointLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:                       namespace,
+			Name:                            "powerwall_endpoint_latency_seconds",
+			Help:                            "time taken by each attempt at a request to the gateway, by endpoint",
+			Buckets:                         []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  100,
+			NativeHistogramMinResetDuration: time.Hour,
+		}, []string{"endpoint"}),
+		certExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "gateway_tls_cert_expiry_timestamp_seconds",
+			Help:      "unix time the gateway's TLS certificate expires, as of the last connection to it",
+		}),
+		rateLimitWait: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gateway_rate_limit_wait_seconds_total",
+			Help:      "time requests to the gateway have waited for --max_requests_per_minute",
+		}),
+	}
+}
+
+// Collectors returns the metrics, for registering.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.endpointLatency, m.certExpiry, m.rateLimitWait}
+}
+
+func (m *Metrics) observeLatency(endpoint string, d time.Duration) {
+	if m != nil {
+		m.endpointLatency.WithLabelValues(endpoint).Observe(d.Seconds())
+	}
+}
+
+func (m *Metrics) setCertExpiry(at time.Time) {
+	if m != nil {
+		m.certExpiry.Set(float64(at.Unix()))
+	}
+}
+
+func (m *Metrics) addRateLimitWait(d time.Duration) {
+	if m != nil {
+		m.rateLimitWait.Add(d.Seconds())
+	}
+}
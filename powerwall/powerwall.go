@@ -3,14 +3,19 @@ package powerwall
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/capture"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/egress"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall/vitals"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
+	"sync"
 	"time"
 )
 
@@ -32,31 +37,76 @@ type Options struct {
 	// browser at the gateway and going through the customer
 	// account setup flow before using this monitor.
 	Username string
-	// Password should be the "customer" password for the gateway.
+	// Password should be the "customer" password for the gateway, or the
+	// installer password with InstallerRole.
 	Password string
-}
+	// Role is the account to log in to.  Empty means CustomerRole.
+	Role Role
+	// Request is the timeout and retry policy for requests to the gateway.
+	Request RequestPolicy
+	// EndpointPolicies overrides Request for specific endpoints, keyed by
+	// path relative to /api, such as "/system_status/grid_faults".
+	EndpointPolicies map[string]RequestPolicy
+	// MaxRequestsPerMinute limits the requests made to Gateway by all
+	// monitors together, whether polling, probing or scraping on demand,
+	// since its web server falls over under load.  Zero means no limit.
+	MaxRequestsPerMinute int
+	// Metrics, if set, records the requests made.  Only the exporter's
+	// own Monitor should have it; probes of other gateways would
+	// overwrite its certificate expiry.
+	Metrics *Metrics
+}
+
+// Role is a gateway account.
+type Role string
+
+const (
+	// CustomerRole is the homeowner's account.
+	CustomerRole Role = "customer"
+	// InstallerRole is the installer's account, which recent firmware
+	// requires for endpoints such as /devices/vitals and the meter
+	// configuration.
+	InstallerRole Role = "installer"
+)
 
 // New returns a powerwall.Monitor that can extract information from
 // the gateway.
 func New(opts Options) (Monitor, error) {
+	switch opts.Role {
+	case "":
+		opts.Role = CustomerRole
+	case CustomerRole, InstallerRole:
+	default:
+		return nil, fmt.Errorf("unknown role %q, want %q or %q", opts.Role, CustomerRole, InstallerRole)
+	}
 	// Tesla Energy Gateway has an invalid SSL certificate.
-	// We want to talk to it anyway.
+	// We want to talk to it anyway, but note when it expires, since
+	// expired certificates have broken other tools.
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				if len(cs.PeerCertificates) > 0 {
+					opts.Metrics.setCertExpiry(cs.PeerCertificates[0].NotAfter)
+				}
+				return nil
+			},
+		},
 	}
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		return nil, err
 	}
+	// Each attempt has its own deadline; see RequestPolicy.
 	cli := &http.Client{
 		Jar:       jar,
-		Timeout:   5 * time.Second,
-		Transport: tr,
+		Transport: egress.Wrap(capture.Wrap(limitRate(opts.Gateway, opts.MaxRequestsPerMinute, opts.Metrics, tr))),
 	}
 	r := &monitor{
-		cli:     cli,
-		opts:    opts,
-		baseUrl: fmt.Sprintf("https://%s/api", opts.Gateway),
+		cli:         cli,
+		opts:        opts,
+		baseUrl:     fmt.Sprintf("https://%s/api", opts.Gateway),
+		lastSuccess: make(map[string]time.Time),
 	}
 	if err := r.login(); err != nil {
 		return nil, err
@@ -74,10 +124,44 @@ type Monitor interface {
 	GetStatus() (*Status, error)
 	GetSiteMaster() (*SiteMaster, error)
 	GetAggregates() (*Aggregates, error)
+	GetMetersSite() ([]CTMeter, error)
+	GetMetersSolar() ([]CTMeter, error)
+	GetMetersReadings() (map[string]MeterReading, error)
 	GetSOE() (*SOE, error)
 	GetGridStatus() (*GridStatus, error)
+	GetGridFaults() ([]GridFault, error)
 	GetSolars() ([]Solar, error)
 	GetInstaller() (*Installer, error)
+	GetWifiStatus() (*WifiStatus, error)
+	// GetBackupEvents returns the times the site has run on its batteries
+	// without the grid, or nil if the backend keeps no such history.
+	GetBackupEvents() ([]BackupEvent, error)
+	// GetRaw returns the undecoded response from one of Endpoints.
+	GetRaw(endpoint string) (json.RawMessage, error)
+	// GetVitals returns the devices reported by /devices/vitals, which
+	// newer firmware no longer serves.
+	GetVitals() ([]vitals.Device, error)
+}
+
+// Endpoints lists the paths, relative to /api, which the Monitor reads.
+var Endpoints = []string{
+	"/networks",
+	"/site_info",
+	"/operation",
+	"/config",
+	"/powerwalls",
+	"/status",
+	"/sitemaster",
+	"/meters/aggregates",
+	"/meters/site",
+	"/meters/solar",
+	"/meters/readings",
+	"/system_status/soe",
+	"/system_status/grid_status",
+	"/system_status/grid_faults",
+	"/solars",
+	"/installer",
+	"/networks/wifi_scan",
 }
 
 type monitor struct {
@@ -85,15 +169,38 @@ type monitor struct {
 	cli       *http.Client
 	opts      Options
 	authToken string
+
+	mu          sync.Mutex
+	lastSuccess map[string]time.Time
+
+	// controlMu serializes changes to the gateway's settings, each of
+	// which reads the settings and writes them back.
+	controlMu sync.Mutex
 }
 
-const kCustomer = "customer"
+// FreshnessReporter is implemented by Monitors which track when each
+// endpoint last answered successfully.
+type FreshnessReporter interface {
+	// LastSuccess returns the time of the last successful request to each
+	// endpoint.
+	LastSuccess() map[string]time.Time
+}
+
+func (m *monitor) LastSuccess() map[string]time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rval := make(map[string]time.Time)
+	for k, v := range m.lastSuccess {
+		rval[k] = v
+	}
+	return rval
+}
 
 type loginRequest struct {
-	Username   string `json:"username"` // "customer"
+	Username   string `json:"username"` // the Role
 	Email      string `json:"email"`
 	Password   string `json:"password"`
-	ForceSmOff bool   `json:"force_sm_off"`
+	ForceSmOff bool   `json:"force_sm_off"` // would stop the site master; never set.
 }
 
 type loginResponse struct {
@@ -106,45 +213,99 @@ type loginResponse struct {
 	LoginTime string   `json:"loginTime"` // YYYY-MM-DDTHH:MM:SS.XXXXXXXXX-HH:MM
 }
 
+// RequestError reports which gateway endpoint a failed request was for.
+type RequestError struct {
+	// Endpoint is the path of the request relative to /api, such as
+	// "/system_status/soe".
+	Endpoint string
+	Err      error
+}
+
+func (r *RequestError) Error() string {
+	return fmt.Sprintf("%s: %v", r.Endpoint, r.Err)
+}
+
+func (r *RequestError) Unwrap() error {
+	return r.Err
+}
+
+// decodeError is returned when the gateway's response can't be decoded.
+type decodeError struct {
+	err error
+}
+
+func (d *decodeError) Error() string {
+	return d.err.Error()
+}
+
 func (m *monitor) issueRequest(method HTTPMethod, endpoint string, payload interface{}, response interface{}) error {
+	err := m.withRetries(method, endpoint, func(ctx context.Context) error {
+		before := time.Now()
+		defer func() {
+			m.opts.Metrics.observeLatency(endpoint, time.Since(before))
+		}()
+		return m.doRequest(ctx, method, endpoint, payload, response)
+	})
+	if err != nil {
+		return &RequestError{Endpoint: endpoint, Err: err}
+	}
+	m.mu.Lock()
+	m.lastSuccess[endpoint] = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *monitor) doRequest(ctx context.Context, method HTTPMethod, endpoint string, payload interface{}, response interface{}) error {
+	bodyBytes, err := m.fetch(ctx, method, endpoint, payload)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(response); err != nil {
+		return &decodeError{fmt.Errorf("json Decode server response at endpoint %s: %v\nResponse:\n%s", endpoint, err, string(bodyBytes))}
+	}
+	return nil
+}
+
+// fetch issues one request and returns the undecoded response body.
+func (m *monitor) fetch(ctx context.Context, method HTTPMethod, endpoint string, payload interface{}) ([]byte, error) {
+	if err := checkReadOnly(method, endpoint); err != nil {
+		return nil, err
+	}
 	var body io.Reader
 	if payload != nil {
 		var buf bytes.Buffer
 		err := json.NewEncoder(&buf).Encode(payload)
 		if err != nil {
-			return fmt.Errorf("json Encode: %v", err)
+			return nil, fmt.Errorf("json Encode: %v", err)
 		}
 		body = &buf
 	}
-	hreq, err := http.NewRequest(string(method), fmt.Sprintf("%s%s", m.baseUrl, endpoint), body)
+	hreq, err := http.NewRequestWithContext(ctx, string(method), fmt.Sprintf("%s%s", m.baseUrl, endpoint), body)
 	if err != nil {
-		return fmt.Errorf("http.NewRequest: %v", err)
+		return nil, fmt.Errorf("http.NewRequest: %v", err)
 	}
 	hresp, err := m.cli.Do(hreq)
 	if err != nil {
-		return fmt.Errorf("c.cli.Do(): %v", err)
-	}
-	if got, want := hresp.StatusCode, 200; got != want {
-		return fmt.Errorf("basic login: got status code %d, want %d", got, want)
+		return nil, fmt.Errorf("c.cli.Do(): %v", err)
 	}
 	defer func() {
 		if err := hresp.Body.Close(); err != nil {
 			glog.Errorf("hresp.Body.Close(): %v", err)
 		}
 	}()
+	if hresp.StatusCode != 200 {
+		return nil, &statusError{code: hresp.StatusCode}
+	}
 	bodyBytes, err := ioutil.ReadAll(hresp.Body)
 	if err != nil {
-		return fmt.Errorf("reading body of response: %v", err)
-	}
-	if err := json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(response); err != nil {
-		return fmt.Errorf("json Decode server response at endpoint %s: %v\nResponse:\n%s", endpoint, err, string(bodyBytes))
+		return nil, fmt.Errorf("reading body of response: %v", err)
 	}
-	return nil
+	return bodyBytes, nil
 }
 
 func (m *monitor) login() error {
 	req := loginRequest{
-		Username: kCustomer,
+		Username: string(m.opts.Role),
 		Email:    m.opts.Username,
 		Password: m.opts.Password,
 	}
@@ -202,10 +363,28 @@ type GridCode struct {
 	Utility      string `json:"utility"`     // Eversource Energy (NSTAR-Cambridge Electric Light)
 	Retailer     string `json:"retailer"`    // *
 	Region       string `json:"region"`      // UL1741SA-IOS-NE:2018
-	// can't determine the schema for overrides, so I'm ignoring it
 	// In my case, they reduced the frequency shift when the batteries are full to
 	// prevent problems with the UPS, so I see:
 	// "grid_code_overrides":[{"name":"soc_freq_droop_config_df_max","value":2.5}]
+	Overrides []GridCodeOverride `json:"grid_code_overrides"`
+}
+
+// GridCodeOverride is a setting the installer changed from the grid
+// code's default.
+type GridCodeOverride struct {
+	Name string `json:"name"`
+	// Value is left undecoded, since we've only seen numbers and can't
+	// rule out anything else.
+	Value json.RawMessage `json:"value"`
+}
+
+// Float returns the override's value if it is a number.
+func (g GridCodeOverride) Float() (float64, bool) {
+	var rval float64
+	if err := json.Unmarshal(g.Value, &rval); err != nil {
+		return 0, false
+	}
+	return rval, true
 }
 
 type SiteInfo struct {
@@ -325,6 +504,8 @@ type Status struct {
 	// jrester code suggests sync type values can include
 	// "v1", "v2", and "v2.1"
 	SyncType string `json:"sync_type"` // v1
+	// DIN identifies the gateway.
+	DIN string `json:"din"`
 }
 
 func (m *monitor) GetStatus() (*Status, error) {
@@ -367,6 +548,10 @@ type MeterDetails struct {
 	LastPhasePowerCommunicationTime   Time    `json:"last_phase_power_communication_time"`
 	// Would like to turn Timeout into a time.Duration, but I need to know units.
 	Timeout int64 `json:"timeout"`
+	// Some firmware also reports the energy since local midnight.  These
+	// are nil when it doesn't.
+	EnergyExportedToday *float64 `json:"energy_exported_today"`
+	EnergyImportedToday *float64 `json:"energy_imported_today"`
 }
 
 type Aggregates struct {
@@ -384,6 +569,84 @@ func (m *monitor) GetAggregates() (*Aggregates, error) {
 	return &rval, nil
 }
 
+// CTConnection describes how the gateway reaches a meter.
+type CTConnection struct {
+	ShortID      string `json:"short_id"`
+	DeviceSerial string `json:"device_serial"` // of the Neurio meter
+}
+
+// CTReadings are the most recent readings of a meter's current
+// transformer clamps.  Suffixes a, b and c, or 1, 2 and 3, name the CT.
+type CTReadings struct {
+	LastCommunicationTime Time    `json:"last_communication_time"`
+	InstantPower          float64 `json:"instant_power"`
+	Frequency             float64 `json:"frequency"`
+	EnergyExported        float64 `json:"energy_exported"`
+	EnergyImported        float64 `json:"energy_imported"`
+	RealPowerA            float64 `json:"real_power_a"`
+	RealPowerB            float64 `json:"real_power_b"`
+	RealPowerC            float64 `json:"real_power_c"`
+	ReactivePowerA        float64 `json:"reactive_power_a"`
+	ReactivePowerB        float64 `json:"reactive_power_b"`
+	ReactivePowerC        float64 `json:"reactive_power_c"`
+	VoltageL1N            float64 `json:"v_l1n"`
+	VoltageL2N            float64 `json:"v_l2n"`
+	VoltageL3N            float64 `json:"v_l3n"`
+	CurrentA              float64 `json:"i_a_current"`
+	CurrentB              float64 `json:"i_b_current"`
+	CurrentC              float64 `json:"i_c_current"`
+	SerialNumber          string  `json:"serial_number"`
+	Version               string  `json:"version"`
+}
+
+// CTMeter is one of the meters behind /meters/site or /meters/solar.
+type CTMeter struct {
+	ID             int          `json:"id"`
+	Location       string       `json:"location"` // "site"
+	Type           string       `json:"type"`     // "neurio_w2_tcp"
+	CTs            []bool       `json:"cts"`      // which clamps are in use
+	Inverted       []bool       `json:"inverted"`
+	Connection     CTConnection `json:"connection"`
+	CachedReadings CTReadings   `json:"Cached_readings"`
+}
+
+func (m *monitor) GetMetersSite() ([]CTMeter, error) {
+	var rval []CTMeter
+	if err := m.issueRequest(kGet, "/meters/site", nil, &rval); err != nil {
+		return nil, err
+	}
+	return rval, nil
+}
+
+func (m *monitor) GetMetersSolar() ([]CTMeter, error) {
+	var rval []CTMeter
+	if err := m.issueRequest(kGet, "/meters/solar", nil, &rval); err != nil {
+		return nil, err
+	}
+	return rval, nil
+}
+
+// MeterReading is one meter's entry in /meters/readings, which reports
+// the revenue grade lifetime totals of the gateway's internal Neurio meter.
+// They diverge slightly from /meters/aggregates.
+type MeterReading struct {
+	Type           string  `json:"type"`     // "neurio_w2_tcp"
+	Location       string  `json:"location"` // "site"
+	Connected      bool    `json:"connected"`
+	EnergyImported float64 `json:"energy_imported"` // Wh
+	EnergyExported float64 `json:"energy_exported"` // Wh
+}
+
+// GetMetersReadings returns the readings of each revenue grade meter,
+// keyed by serial number.
+func (m *monitor) GetMetersReadings() (map[string]MeterReading, error) {
+	var rval map[string]MeterReading
+	if err := m.issueRequest(kGet, "/meters/readings", nil, &rval); err != nil {
+		return nil, err
+	}
+	return rval, nil
+}
+
 type SOE struct {
 	Percentage float64 `json:"percentage"`
 }
@@ -409,6 +672,42 @@ func (m *monitor) GetGridStatus() (*GridStatus, error) {
 	return &rval, nil
 }
 
+// GridFault is an entry in the gateway's history of recent grid faults.
+type GridFault struct {
+	Timestamp    MillisecondTime `json:"timestamp"`
+	AlertName    string          `json:"alert_name"` // "PINV_a008_vfCheckRocof"
+	AlertIsFault bool            `json:"alert_is_fault"`
+	// DecodedAlert is a JSON encoded list of name/value pairs,
+	// such as [{"name":"PINV_alertID","value":"PINV_a008_vfCheckRocof"}]
+	DecodedAlert           string `json:"decoded_alert"`
+	AlertRaw               int64  `json:"alert_raw"`
+	GitHash                string `json:"git_hash"`
+	SiteUID                string `json:"site_uid"`
+	EcuType                string `json:"ecu_type"` // "TEPINV"
+	EcuPackagePartNumber   string `json:"ecu_package_part_number"`
+	EcuPackageSerialNumber string `json:"ecu_package_serial_number"`
+}
+
+func (m *monitor) GetGridFaults() ([]GridFault, error) {
+	var rval []GridFault
+	if err := m.issueRequest(kGet, "/system_status/grid_faults", nil, &rval); err != nil {
+		return nil, err
+	}
+	return rval, nil
+}
+
+// BackupEvent is a time the site went off grid and ran on its batteries.
+type BackupEvent struct {
+	Start    time.Time
+	Duration time.Duration
+}
+
+// GetBackupEvents returns nil, since the gateway doesn't serve its backup
+// history under /api; only Tesla's cloud does.
+func (m *monitor) GetBackupEvents() ([]BackupEvent, error) {
+	return nil, nil
+}
+
 type Solar struct {
 	Brand            string `json:"brand"`              // "SolarEdge Technologies"
 	Model            string `json:"model"`              // SE 1000A-US (240V)
@@ -448,4 +747,105 @@ func (m *monitor) GetInstaller() (*Installer, error) {
 	return &rval, nil
 }
 
-// getlogs returns a gzipped tarball of logs
+// WifiNetwork is a Wi-Fi network the gateway can see.
+type WifiNetwork struct {
+	SSID string `json:"ssid"`
+	// RSSI is the received signal strength in dBm, such as -60.
+	RSSI    int `json:"rssi"`
+	Channel int `json:"channel"`
+	// Connected is true for the network the gateway is joined to.
+	Connected bool `json:"connected"`
+}
+
+// WifiStatus is the gateway's most recent scan of the Wi-Fi networks
+// around it.
+type WifiStatus struct {
+	Networks []WifiNetwork `json:"networks"`
+}
+
+// Connected returns the network the gateway is joined to, or nil if it
+// isn't using Wi-Fi.
+func (w *WifiStatus) Connected() *WifiNetwork {
+	for i := range w.Networks {
+		if w.Networks[i].Connected {
+			return &w.Networks[i]
+		}
+	}
+	return nil
+}
+
+func (m *monitor) GetWifiStatus() (*WifiStatus, error) {
+	var rval WifiStatus
+	if err := m.issueRequest(kGet, "/networks/wifi_scan", nil, &rval); err != nil {
+		return nil, err
+	}
+	return &rval, nil
+}
+
+func (m *monitor) GetVitals() ([]vitals.Device, error) {
+	const endpoint = "/devices/vitals"
+	var rval []vitals.Device
+	err := m.withRetries(kGet, endpoint, func(ctx context.Context) error {
+		before := time.Now()
+		defer func() {
+			m.opts.Metrics.observeLatency(endpoint, time.Since(before))
+		}()
+		b, err := m.fetch(ctx, kGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		rval, err = vitals.Decode(b)
+		if err != nil {
+			return &decodeError{err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &RequestError{Endpoint: endpoint, Err: err}
+	}
+	return rval, nil
+}
+
+func (m *monitor) GetRaw(endpoint string) (json.RawMessage, error) {
+	var rval json.RawMessage
+	if err := m.issueRequest(kGet, endpoint, nil, &rval); err != nil {
+		return nil, err
+	}
+	return rval, nil
+}
+
+// kLogsEndpoint returns a gzipped tarball of logs.
+const kLogsEndpoint = "/getlogs"
+
+// LogFetcher is implemented by Monitors which can download the gateway's
+// logs.
+type LogFetcher interface {
+	// GetLogs writes the gateway's logs, a gzipped tarball, to w.  Nothing
+	// is written unless the gateway starts sending them.
+	GetLogs(ctx context.Context, w io.Writer) error
+}
+
+// GetLogs isn't retried, since the tarball is streamed to w as it
+// arrives, and can take far longer than the usual request timeout.
+func (m *monitor) GetLogs(ctx context.Context, w io.Writer) error {
+	hreq, err := http.NewRequestWithContext(ctx, string(kGet), m.baseUrl+kLogsEndpoint, nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %v", err)
+	}
+	hresp, err := m.cli.Do(hreq)
+	if err != nil {
+		return &RequestError{Endpoint: kLogsEndpoint, Err: fmt.Errorf("c.cli.Do(): %v", err)}
+	}
+	defer func() {
+		if err := hresp.Body.Close(); err != nil {
+			glog.Errorf("hresp.Body.Close(): %v", err)
+		}
+	}()
+	if hresp.StatusCode != 200 {
+		return &RequestError{Endpoint: kLogsEndpoint, Err: &statusError{code: hresp.StatusCode}}
+	}
+	if _, err := io.Copy(w, hresp.Body); err != nil {
+		return &RequestError{Endpoint: kLogsEndpoint, Err: fmt.Errorf("reading body of response: %v", err)}
+	}
+	return nil
+}
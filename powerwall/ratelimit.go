@@ -0,0 +1,112 @@
+package powerwall
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// kBurstFraction is the fraction of a minute's requests a full bucket
+// lets through at once, so a poll's burst of requests isn't spread over
+// the whole minute.
+const kBurstFraction = 6
+
+// tokenBucket allows perMinute requests a minute, in bursts of up to
+// perMinute/kBurstFraction.
+type tokenBucket struct {
+	mu        sync.Mutex
+	perMinute int
+	tokens    float64
+	last      time.Time
+}
+
+var (
+	bucketsMu sync.Mutex
+	// buckets holds a bucket for each gateway, shared by every monitor
+	// talking to it: the exporter's, the prober's and those built by a
+	// reload.
+	buckets = make(map[string]*tokenBucket)
+)
+
+// bucketFor returns the shared bucket for gateway, set to perMinute.
+func bucketFor(gateway string, perMinute int) *tokenBucket {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	b, ok := buckets[gateway]
+	if !ok {
+		b = &tokenBucket{last: time.Now()}
+		buckets[gateway] = b
+	}
+	b.mu.Lock()
+	if b.perMinute != perMinute {
+		b.perMinute = perMinute
+		b.tokens = b.burst()
+	}
+	b.mu.Unlock()
+	return b
+}
+
+func (b *tokenBucket) burst() float64 {
+	if rval := float64(b.perMinute) / kBurstFraction; rval > 1 {
+		return rval
+	}
+	return 1
+}
+
+// reserve takes a token and returns how long to wait before using it.
+// The bucket may go negative, queueing the callers behind each other.
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	rate := float64(b.perMinute) / float64(time.Minute)
+	b.tokens += float64(now.Sub(b.last)) * rate
+	if burst := b.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate)
+}
+
+// cancel returns a token taken by reserve whose request was abandoned.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+}
+
+// rateLimiter delays requests to keep within its bucket.
+type rateLimiter struct {
+	bucket  *tokenBucket
+	metrics *Metrics
+	base    http.RoundTripper
+}
+
+// limitRate wraps base so that requests to gateway, from any monitor,
+// stay within perMinute a minute, recording the waits in metrics.
+// perMinute < 1 means no limit.
+func limitRate(gateway string, perMinute int, metrics *Metrics, base http.RoundTripper) http.RoundTripper {
+	if perMinute < 1 {
+		return base
+	}
+	return &rateLimiter{bucket: bucketFor(gateway, perMinute), metrics: metrics, base: base}
+}
+
+func (r *rateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := r.bucket.reserve(); wait > 0 {
+		r.metrics.addRateLimitWait(wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			r.bucket.cancel()
+			return nil, req.Context().Err()
+		}
+	}
+	return r.base.RoundTrip(req)
+}
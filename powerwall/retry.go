@@ -0,0 +1,113 @@
+package powerwall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"math/rand"
+	"time"
+)
+
+// RequestPolicy describes how long to wait for the gateway and how hard
+// to try.  The gateway's web server frequently times out the first request
+// after it wakes from idle, so a retry or two smooths over most failures.
+type RequestPolicy struct {
+	// Timeout bounds each attempt.  Zero means 5 seconds.
+	Timeout time.Duration
+	// Retries is the number of additional attempts after the first fails.
+	Retries int
+	// Backoff is the wait before the first retry.  It doubles with each
+	// retry, with up to 50% random jitter added.  Zero means 250ms.
+	Backoff time.Duration
+}
+
+const (
+	kDefaultRequestTimeout = 5 * time.Second
+	kDefaultBackoff        = 250 * time.Millisecond
+	// kRetryBudget is how long retries may keep a request going, so a
+	// poll still finishes inside Prometheus's default 10s scrape timeout.
+	// A first attempt with a longer Timeout is allowed to finish, but
+	// isn't retried.
+	kRetryBudget = 8 * time.Second
+)
+
+// statusError is returned when the gateway answers with a status other
+// than 200.
+type statusError struct {
+	code int
+}
+
+func (s *statusError) Error() string {
+	return fmt.Sprintf("got status code %d, want 200", s.code)
+}
+
+// IsAuthError returns true if err means the gateway rejected our
+// credentials.
+func IsAuthError(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && (se.code == 401 || se.code == 403)
+}
+
+// retryable returns true for failures that might go away on their own:
+// timeouts, connection problems and server errors.  Client errors,
+// responses that don't decode and requests a read-only build refuses are
+// not retried.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+	var de *decodeError
+	var ro *readOnlyError
+	return !errors.As(err, &de) && !errors.As(err, &ro)
+}
+
+// policy returns the request policy for endpoint.
+func (m *monitor) policy(endpoint string) RequestPolicy {
+	p, ok := m.opts.EndpointPolicies[endpoint]
+	if !ok {
+		p = m.opts.Request
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = kDefaultRequestTimeout
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = kDefaultBackoff
+	}
+	return p
+}
+
+// withRetries calls attempt until it succeeds, fails with an error that
+// is not retryable, or the policy's retries or kRetryBudget are
+// exhausted.  Only GETs are retried: repeating a POST could repeat what
+// it does, and repeating a failed login could lock the account out.
+func (m *monitor) withRetries(method HTTPMethod, endpoint string, attempt func(ctx context.Context) error) error {
+	p := m.policy(endpoint)
+	if method != kGet {
+		p.Retries = 0
+	}
+	deadline := time.Now().Add(kRetryBudget)
+	timeout := p.Timeout
+	backoff := p.Backoff
+	var err error
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = attempt(ctx)
+		cancel()
+		if err == nil || i >= p.Retries || !retryable(err) {
+			return err
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		left := time.Until(deadline) - wait
+		if left <= 0 {
+			return err
+		}
+		if timeout > left {
+			timeout = left
+		}
+		glog.Warningf("Attempt %d of %s failed, retrying in %s: %v", i+1, endpoint, wait, err)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
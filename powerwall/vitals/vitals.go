@@ -0,0 +1,212 @@
+// Package vitals decodes the protobuf encoded response of the gateway's
+// /api/devices/vitals endpoint, which reports the internals of every
+// device in the system: inverter temperatures, PVAC, PINV and THC data,
+// and string level solar voltage and current.
+//
+// Tesla doesn't publish the schema.  The field numbers here follow the
+// tesla.proto reverse engineered by the pypowerwall project.  Rather than
+// generate code for the whole thing, we walk the wire format and pick out
+// the few fields we use.
+package vitals
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"strings"
+)
+
+// Device is one device in the system, such as a powerwall, its inverter,
+// or the gateway itself.
+type Device struct {
+	// DIN is the device identification number, such as
+	// "1538000-25-J--TG1234567890AB".
+	DIN          string
+	PartNumber   string
+	SerialNumber string
+	// Values holds the device's numeric vitals by name, such as
+	// "THC_AmbientTemp" or "PVAC_PVMeasuredVoltage_A".  Booleans are 0 or
+	// 1.
+	Values map[string]float64
+	// Strings holds the device's textual vitals by name.
+	Strings map[string]string
+	// Alerts lists the alerts the device currently has raised.
+	Alerts []string
+}
+
+// Component returns the subsystem a vital belongs to, which is the prefix
+// of its name: "PVAC" for "PVAC_Fout".
+func Component(vital string) string {
+	if i := strings.Index(vital, "_"); i > 0 {
+		return vital[:i]
+	}
+	return ""
+}
+
+// Field numbers, per pypowerwall's tesla.proto.
+const (
+	// DevicesWithVitals
+	fDevices = 1
+	// DeviceWithVitals
+	fDevice = 1
+	fVitals = 2
+	fAlerts = 3
+	// Device
+	fAttributes = 1
+	// DeviceAttributes
+	fDIN          = 1
+	fPartNumber   = 2
+	fSerialNumber = 3
+	// Vital
+	fName        = 1
+	fIntValue    = 3
+	fFloatValue  = 4
+	fStringValue = 5
+	fBoolValue   = 6
+	// google.protobuf.StringValue
+	fWrappedValue = 1
+)
+
+// Decode parses a /devices/vitals response.
+func Decode(b []byte) ([]Device, error) {
+	var rval []Device
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != fDevices || typ != protowire.BytesType {
+			return nil
+		}
+		d, err := decodeDevice(v)
+		if err != nil {
+			return err
+		}
+		rval = append(rval, d)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("vitals.Decode(): %v", err)
+	}
+	return rval, nil
+}
+
+// walk calls visit for each field in a message.  Length delimited fields
+// come with their contents in v; varint and fixed width fields with their
+// value in n.
+func walk(b []byte, visit func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, l = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		if err := visit(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeDevice(b []byte) (Device, error) {
+	rval := Device{
+		Values:  make(map[string]float64),
+		Strings: make(map[string]string),
+	}
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case fDevice:
+			return walk(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				if num != fAttributes || typ != protowire.BytesType {
+					return nil
+				}
+				return decodeAttributes(v, &rval)
+			})
+		case fVitals:
+			return decodeVital(v, &rval)
+		case fAlerts:
+			rval.Alerts = append(rval.Alerts, string(v))
+		}
+		return nil
+	})
+	return rval, err
+}
+
+func decodeAttributes(b []byte, d *Device) error {
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		var dst *string
+		switch num {
+		case fDIN:
+			dst = &d.DIN
+		case fPartNumber:
+			dst = &d.PartNumber
+		case fSerialNumber:
+			dst = &d.SerialNumber
+		default:
+			return nil
+		}
+		return walk(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+			if num == fWrappedValue && typ == protowire.BytesType {
+				*dst = string(v)
+			}
+			return nil
+		})
+	})
+}
+
+func decodeVital(b []byte, d *Device) error {
+	var name string
+	var value *float64
+	var str *string
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case fName:
+			name = string(v)
+		case fIntValue:
+			f := float64(int64(n))
+			value = &f
+		case fFloatValue:
+			f := math.Float64frombits(n)
+			value = &f
+		case fBoolValue:
+			f := float64(n)
+			value = &f
+		case fStringValue:
+			s := string(v)
+			str = &s
+		}
+		return nil
+	})
+	if err != nil || name == "" {
+		return err
+	}
+	if value != nil {
+		d.Values[name] = *value
+	}
+	if str != nil {
+		d.Strings[name] = *str
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+// Package powerwalltest serves a fake Tesla Energy Gateway, so the
+// exporter can be exercised in tests and demos without hardware.  It
+// answers every endpoint powerwall.Monitor reads with canned responses,
+// except the power flows and charge, which follow a simulated day.
+package powerwalltest
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kToken is what the fake gateway hands out at login.
+const kToken = "powerwalltest-token"
+
+// Gateway is a fake gateway listening on a local HTTPS port.
+type Gateway struct {
+	srv *httptest.Server
+
+	mu sync.Mutex
+	// responses overrides the simulated response for an endpoint.
+	responses map[string][]byte
+	// errors makes an endpoint fail with an HTTP status code.
+	errors map[string]int
+	sim    simulation
+}
+
+// NewGateway starts a fake gateway.  Call Close when done with it.
+func NewGateway() *Gateway {
+	g := &Gateway{
+		responses: make(map[string][]byte),
+		errors:    make(map[string]int),
+		sim:       newSimulation(time.Now()),
+	}
+	g.srv = httptest.NewTLSServer(http.HandlerFunc(g.serve))
+	return g
+}
+
+// Host is the address to pass as powerwall.Options.Gateway.
+func (g *Gateway) Host() string {
+	return strings.TrimPrefix(g.srv.URL, "https://")
+}
+
+// Close shuts the gateway down.
+func (g *Gateway) Close() {
+	g.srv.Close()
+}
+
+// Set makes the gateway answer endpoint, relative to /api, with v encoded
+// as JSON instead of its usual response.
+func (g *Gateway) Set(endpoint string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.responses[endpoint] = b
+	return nil
+}
+
+// SetError makes requests for endpoint fail with the HTTP status code.
+// A code of 0 makes it succeed again.
+func (g *Gateway) SetError(endpoint string, code int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if code == 0 {
+		delete(g.errors, endpoint)
+		return
+	}
+	g.errors[endpoint] = code
+}
+
+func (g *Gateway) serve(rw http.ResponseWriter, req *http.Request) {
+	endpoint := strings.TrimPrefix(req.URL.Path, "/api")
+	g.mu.Lock()
+	code, failing := g.errors[endpoint]
+	b, overridden := g.responses[endpoint]
+	g.mu.Unlock()
+	if failing {
+		http.Error(rw, http.StatusText(code), code)
+		return
+	}
+	if endpoint != "/login/Basic" && !authorized(req) {
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if endpoint == "/operation" && req.Method == http.MethodPost {
+		g.setOperation(rw, req)
+		return
+	}
+	if endpoint == "/getlogs" && !overridden {
+		rw.Header().Set("Content-Type", "application/gzip")
+		if err := writeLogs(rw); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if !overridden {
+		v := g.response(endpoint)
+		if v == nil {
+			http.NotFound(rw, req)
+			return
+		}
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if endpoint == "/login/Basic" {
+		// The gateway authorizes later requests by cookie.
+		http.SetCookie(rw, &http.Cookie{Name: "AuthCookie", Value: kToken, Path: "/"})
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
+
+// setOperation applies a POST to /operation, so later GETs see the new
+// settings, and answers with them.
+func (g *Gateway) setOperation(rw http.ResponseWriter, req *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	op := g.response("/operation").(map[string]interface{})
+	if b, ok := g.responses["/operation"]; ok {
+		if err := json.Unmarshal(b, &op); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := json.NewDecoder(req.Body).Decode(&op); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(op)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	g.responses["/operation"] = b
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
+
+// authorized reports whether the request carries the cookie handed out at
+// login.
+func authorized(req *http.Request) bool {
+	c, err := req.Cookie("AuthCookie")
+	return err == nil && c.Value == kToken
+}
+
+// writeLogs writes a gzipped tarball with a single log file, as /getlogs
+// serves.
+func writeLogs(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	log := []byte(time.Now().Format(time.RFC3339) + " powerwalltest: simulated gateway started\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "logs/gateway.log", Mode: 0644, Size: int64(len(log)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(log); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// response returns the usual response for endpoint, or nil if the gateway
+// doesn't serve it.  /devices/vitals isn't served, like newer firmware.
+func (g *Gateway) response(endpoint string) interface{} {
+	now := time.Now()
+	switch endpoint {
+	case "/login/Basic":
+		return map[string]interface{}{
+			"email":     "demo@example.com",
+			"firstname": "Tesla",
+			"lastname":  "Energy",
+			"roles":     []string{"Home_Owner"},
+			"token":     kToken,
+			"provider":  "Basic",
+			"loginTime": now.Format(kTimeLayout),
+		}
+	case "/networks":
+		return []interface{}{map[string]interface{}{
+			"network_name": "ethernet_tesla_internal_default",
+			"interface":    "EthType",
+			"dhcp":         true,
+			"enabled":      true,
+			"active":       true,
+			"primary":      true,
+			"iface_network_info": map[string]interface{}{
+				"network_name":    "ethernet_tesla_internal_default",
+				"interface":       "EthType",
+				"state":           "DeviceStateReady",
+				"signal_strength": 0,
+				"hw_address":      "00:00:5e:00:53:01",
+			},
+		}}
+	case "/site_info":
+		return map[string]interface{}{
+			"site_name":                 "Demo Home",
+			"timezone":                  "America/New_York",
+			"max_system_energy_kWh":     27,
+			"max_system_power_kW":       10,
+			"max_site_meter_power_kW":   48,
+			"min_site_meter_power_kW":   -48,
+			"nominal_system_energy_kWh": kCapacityWh / 1000,
+			"nominal_system_power_kW":   10,
+			"grid_code": map[string]interface{}{
+				"grid_code":            "60Hz_240V_s_UL1741SA:2018_ISO-NE",
+				"grid_voltage_setting": 240,
+				"grid_freq_setting":    60,
+				"grid_phase_setting":   "Split",
+				"country":              "United States",
+				"state":                "Massachusetts",
+				"utility":              "Demo Electric",
+			},
+		}
+	case "/operation":
+		return map[string]interface{}{
+			"real_mode":                    "self_consumption",
+			"backup_reserve_percent":       20,
+			"freq_shift_load_shed_soe":     65,
+			"freq_shift_load_shed_delta_f": -0.32,
+		}
+	case "/config/completed":
+		return map[string]interface{}{}
+	case "/config":
+		return map[string]interface{}{"vin": "1232100-00-E--TG000000000000"}
+	case "/powerwalls":
+		var pws []interface{}
+		for _, serial := range []string{"TG000000000001", "TG000000000002"} {
+			pws = append(pws, map[string]interface{}{
+				"PackagePartNumber":              "2012170-25-E",
+				"PackageSerialNumber":            serial,
+				"type":                           "acpw",
+				"grid_state":                     "Grid_Compliant",
+				"grid_reconnection_time_seconds": 0,
+			})
+		}
+		return map[string]interface{}{"powerwalls": pws}
+	case "/status":
+		up := now.Sub(g.sim.start) + 3*24*time.Hour
+		return map[string]interface{}{
+			"start_time":       now.Add(-up).Format(kTimeLayout),
+			"up_time_seconds":  fmt.Sprintf("%dh%dm%d.%09ds", int(up.Hours()), int(up.Minutes())%60, int(up.Seconds())%60, up.Nanoseconds()%1e9),
+			"version":          "23.12.0",
+			"git_hash":         "0000000000000000000000000000000000000000",
+			"commission_count": 0,
+			"device_type":      "teg",
+			"sync_type":        "v2.1",
+			"din":              "1232100-00-E--TG000000000000",
+		}
+	case "/sitemaster":
+		return map[string]interface{}{
+			"status":             "StatusUp",
+			"running":            true,
+			"connected_to_tesla": true,
+			"power_supply_mode":  false,
+		}
+	case "/meters/aggregates":
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.sim.aggregates(now)
+	case "/meters/site", "/meters/solar":
+		return []interface{}{}
+	case "/meters/readings":
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.sim.advance(now)
+		// The revenue grade meter reads a little differently.
+		return map[string]interface{}{
+			"VAH0000000000": map[string]interface{}{
+				"type":            "neurio_w2_tcp",
+				"location":        "site",
+				"connected":       true,
+				"energy_imported": g.sim.imported["site"] * 1.002,
+				"energy_exported": g.sim.exported["site"] * 0.998,
+			},
+		}
+	case "/system_status/soe":
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.sim.advance(now)
+		return map[string]interface{}{"percentage": g.sim.soe}
+	case "/system_status/grid_status":
+		return map[string]interface{}{
+			"grid_status":          "SystemGridConnected",
+			"grid_services_active": false,
+		}
+	case "/system_status/grid_faults":
+		return []interface{}{}
+	case "/solars":
+		return []interface{}{map[string]interface{}{
+			"brand":              "Tesla",
+			"model":              "Solar Inverter 7.6",
+			"power_rating_watts": 7600,
+		}}
+	case "/installer":
+		return map[string]interface{}{
+			"company":            "Demo Solar",
+			"installation_types": []string{"Residential"},
+		}
+	case "/networks/wifi_scan":
+		return map[string]interface{}{
+			"networks": []interface{}{
+				map[string]interface{}{"ssid": "Demo Home", "rssi": -58, "channel": 6, "connected": true},
+				map[string]interface{}{"ssid": "Neighbor", "rssi": -81, "channel": 11, "connected": false},
+			},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package powerwalltest_test
+
+import (
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwalltest"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/view"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
+
+// poll logs in to g and polls it once, as the exporter does.
+func poll(t *testing.T, g *powerwalltest.Gateway) (*model.FixedInfo, *model.TeslaEnergyGatewayMetrics) {
+	t.Helper()
+	mon, err := powerwall.New(powerwall.Options{Gateway: g.Host(), Username: "test", Password: "test"})
+	if err != nil {
+		t.Fatalf("powerwall.New(): %v", err)
+	}
+	t.Cleanup(func() { mon.Close() })
+	fixed, err := model.New(mon, model.PollOptions{})
+	if err != nil {
+		t.Fatalf("model.New(): %v", err)
+	}
+	m, err := model.Poll(mon, fixed, model.PollOptions{})
+	if err != nil {
+		t.Fatalf("model.Poll(): %v", err)
+	}
+	return fixed, m
+}
+
+// gather returns the metric families the Prometheus collector exports
+// for m, by name.  The pedantic registry fails on anything Prometheus
+// would reject in a scrape, such as two series with the same labels.
+func gather(t *testing.T, fixed *model.FixedInfo, m *model.TeslaEnergyGatewayMetrics) map[string]*dto.MetricFamily {
+	t.Helper()
+	c := view.NewCollector(fixed, view.Options{})
+	if err := c.Update(m); err != nil {
+		t.Fatalf("Update(): %v", err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("Register(): %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather(): %v", err)
+	}
+	rval := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		rval[mf.GetName()] = mf
+	}
+	return rval
+}
+
+func label(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestPoll(t *testing.T) {
+	g := powerwalltest.NewGateway()
+	defer g.Close()
+
+	fixed, m := poll(t, g)
+	if got := fixed.SiteName; got != "Demo Home" {
+		t.Errorf("SiteName = %q, want %q", got, "Demo Home")
+	}
+	if m.Version.Major != 23 || m.Version.Minor != 12 || m.Version.Release != 0 {
+		t.Errorf("Version = %d.%d.%d, want 23.12.0", m.Version.Major, m.Version.Minor, m.Version.Release)
+	}
+	if len(m.UnknownEnumValues) != 0 {
+		t.Errorf("UnknownEnumValues = %v, want none", m.UnknownEnumValues)
+	}
+	mfs := gather(t, fixed, m)
+	if info := mfs["network_info"].GetMetric(); len(info) != 1 {
+		t.Errorf("network_info = %v, want one series", info)
+	}
+}
+
+func TestPollUnusualResponses(t *testing.T) {
+	g := powerwalltest.NewGateway()
+	defer g.Close()
+	// Firmware that appends its build to the version.
+	if err := g.Set("/status", map[string]interface{}{
+		"start_time":      "2024-01-02T03:04:05+00:00",
+		"up_time_seconds": "72h0m0.000000000s",
+		"version":         "23.44.0 9e2a0a8b",
+		"din":             "1232100-00-E--TG000000000000",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// An operating mode newer than the exporter.
+	if err := g.Set("/operation", map[string]interface{}{
+		"real_mode":              "future_mode",
+		"backup_reserve_percent": 20,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// An interface listing the same address twice.
+	if err := g.Set("/networks", []interface{}{map[string]interface{}{
+		"network_name": "ethernet_tesla_internal_default",
+		"interface":    "EthType",
+		"enabled":      true,
+		"iface_network_info": map[string]interface{}{
+			"interface": "EthType",
+			"networks": []interface{}{
+				map[string]interface{}{"ip": "192.0.2.10", "netmask": 24},
+				map[string]interface{}{"ip": "192.0.2.10", "netmask": 24},
+			},
+		},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fixed, m := poll(t, g)
+	if m.Version.Major != 23 || m.Version.Minor != 44 || m.Version.Release != 0 {
+		t.Errorf("Version = %d.%d.%d, want 23.44.0", m.Version.Major, m.Version.Minor, m.Version.Release)
+	}
+	want := powerwall.UnknownValue{Type: "OperatingMode", Value: "future_mode"}
+	if len(m.UnknownEnumValues) != 1 || m.UnknownEnumValues[0] != want {
+		t.Errorf("UnknownEnumValues = %v, want [%v]", m.UnknownEnumValues, want)
+	}
+	mfs := gather(t, fixed, m)
+	info := mfs["network_info"].GetMetric()
+	if len(info) != 1 || label(info[0], "ip") != "192.0.2.10/24" {
+		t.Errorf("network_info = %v, want one series for 192.0.2.10/24", info)
+	}
+	unknown := mfs["unknown_enum_values_total"].GetMetric()
+	if len(unknown) != 1 || label(unknown[0], "value") != "future_mode" {
+		t.Errorf("unknown_enum_values_total = %v, want one series for future_mode", unknown)
+	}
+}
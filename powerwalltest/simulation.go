@@ -0,0 +1,113 @@
+package powerwalltest
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// kTimeLayout is how the gateway formats timestamps.
+	kTimeLayout = "2006-01-02T15:04:05-07:00"
+	// kCapacityWh is the energy the simulated powerwalls hold.
+	kCapacityWh = 27000.0
+	// kPeakSolarW is the simulated array's output at noon.
+	kPeakSolarW = 7000.0
+	// kReservePercent is the charge the simulated powerwalls stop
+	// discharging at.
+	kReservePercent = 20.0
+)
+
+// simulation models a home with solar and powerwalls in self consumption
+// mode: solar follows the sun, load wanders, the powerwalls soak up
+// surplus solar or cover the shortfall while they have charge, and the
+// grid covers the rest.
+type simulation struct {
+	start time.Time
+	last  time.Time
+	soe   float64
+	// Lifetime energy in watt hours, by meter and direction.
+	imported, exported map[string]float64
+	// The flows at last, in watts.  Positive battery power is discharge,
+	// positive site power is import.
+	solar, load, battery, site float64
+}
+
+func newSimulation(now time.Time) simulation {
+	s := simulation{
+		start: now,
+		last:  now,
+		soe:   60,
+		imported: map[string]float64{
+			"site": 4.1e6, "load": 9.8e6, "battery": 2.2e6, "solar": 120,
+		},
+		exported: map[string]float64{
+			"site": 3.5e6, "load": 0, "battery": 1.9e6, "solar": 7.3e6,
+		},
+	}
+	s.flows(now)
+	return s
+}
+
+// flows sets the power flows for the time of day.
+func (s *simulation) flows(now time.Time) {
+	hour := float64(now.Hour()) + float64(now.Minute())/60
+	s.solar = math.Max(0, kPeakSolarW*math.Sin(math.Pi*(hour-6)/12))
+	// A base load, a bump in the evening, and a few minutes' wander.
+	s.load = 600 + 900*math.Exp(-math.Pow(hour-19, 2)/4) + 250*math.Sin(float64(now.Unix())/300)
+	s.battery = s.load - s.solar
+	if s.battery > 0 && s.soe <= kReservePercent {
+		s.battery = 0
+	}
+	if s.battery < 0 && s.soe >= 100 {
+		s.battery = 0
+	}
+	s.site = s.load - s.solar - s.battery
+}
+
+// advance runs the simulation forward to now.
+func (s *simulation) advance(now time.Time) {
+	hours := now.Sub(s.last).Hours()
+	if hours <= 0 {
+		return
+	}
+	s.last = now
+	s.record("solar", -s.solar, hours)
+	s.record("load", s.load, hours)
+	s.record("battery", s.battery, hours)
+	s.record("site", s.site, hours)
+	s.soe = math.Min(100, math.Max(0, s.soe-s.battery*hours/kCapacityWh*100))
+	s.flows(now)
+}
+
+// record adds the energy a meter saw flowing at w watts for hours.
+func (s *simulation) record(meter string, w, hours float64) {
+	if w >= 0 {
+		s.imported[meter] += w * hours
+	} else {
+		s.exported[meter] -= w * hours
+	}
+}
+
+func (s *simulation) aggregates(now time.Time) map[string]interface{} {
+	s.advance(now)
+	meter := func(name string, w float64) map[string]interface{} {
+		return map[string]interface{}{
+			"last_communication_time": now.Format(kTimeLayout),
+			"instant_power":           w,
+			"instant_reactive_power":  w * 0.05,
+			"instant_apparant_power":  math.Abs(w) * 1.001,
+			"frequency":               60 + 0.01*math.Sin(float64(now.Unix())/60),
+			"energy_exported":         s.exported[name],
+			"energy_imported":         s.imported[name],
+			"instant_average_voltage": 240 + 2*math.Sin(float64(now.Unix())/90),
+			"instant_total_current":   w / 240,
+			"timeout":                 1500000000,
+		}
+	}
+	return map[string]interface{}{
+		"site":    meter("site", s.site),
+		"battery": meter("battery", s.battery),
+		"load":    meter("load", s.load),
+		"solar":   meter("solar", s.solar),
+	}
+}
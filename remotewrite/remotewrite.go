@@ -0,0 +1,207 @@
+// Package remotewrite sends metrics to a Prometheus remote write endpoint,
+// such as Grafana Cloud, Mimir or VictoriaMetrics, in version 1 of the
+// protocol: a snappy compressed protobuf WriteRequest.  As with the
+// gateway's vitals, the few messages it needs are encoded with protowire
+// rather than pulling in Prometheus itself for its generated types.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/egress"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Series is a time series with a single sample.
+type Series struct {
+	// Labels includes __name__, and is sorted by label name.
+	Labels [][2]string
+	Value  float64
+	// Timestamp is the sample's unix time in milliseconds.
+	Timestamp int64
+}
+
+// FromFamilies flattens mfs into series as Prometheus would on scraping
+// them: histograms and summaries become their _bucket or quantile, _sum
+// and _count series.  Samples without a timestamp of their own get now.
+// extra labels every series, as Prometheus adds job and instance, in
+// place of any label of the same name the metric has.
+func FromFamilies(mfs []*dto.MetricFamily, now time.Time, extra ...[2]string) []Series {
+	overridden := make(map[string]bool)
+	for _, l := range extra {
+		overridden[l[0]] = true
+	}
+	var rval []Series
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			ms := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				ms = m.GetTimestampMs()
+			}
+			add := func(suffix string, v float64, more ...string) {
+				labels := append([][2]string{{"__name__", name + suffix}}, extra...)
+				for _, l := range m.GetLabel() {
+					if !overridden[l.GetName()] {
+						labels = append(labels, [2]string{l.GetName(), l.GetValue()})
+					}
+				}
+				for i := 0; i+1 < len(more); i += 2 {
+					labels = append(labels, [2]string{more[i], more[i+1]})
+				}
+				sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+				rval = append(rval, Series{Labels: labels, Value: v, Timestamp: ms})
+			}
+			switch {
+			case m.Gauge != nil:
+				add("", m.Gauge.GetValue())
+			case m.Counter != nil:
+				add("", m.Counter.GetValue())
+			case m.Untyped != nil:
+				add("", m.Untyped.GetValue())
+			case m.Summary != nil:
+				for _, q := range m.Summary.GetQuantile() {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", m.Summary.GetSampleSum())
+				add("_count", float64(m.Summary.GetSampleCount()))
+			case m.Histogram != nil:
+				for _, b := range m.Histogram.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					add("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add("_bucket", float64(m.Histogram.GetSampleCount()), "le", "+Inf")
+				add("_sum", m.Histogram.GetSampleSum())
+				add("_count", float64(m.Histogram.GetSampleCount()))
+			}
+		}
+	}
+	return rval
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Client writes to one remote write endpoint.
+type Client struct {
+	url string
+	// token, if set, is sent as a bearer token.  Endpoints that want basic
+	// auth, such as Grafana Cloud, can take it in the URL instead.
+	token string
+	cli   *http.Client
+}
+
+// New returns a Client for the endpoint at url, such as
+// https://prometheus-prod-10-prod-us-central-0.grafana.net/api/prom/push.
+// token may be empty.
+func New(url, token string) *Client {
+	return &Client{
+		url:   url,
+		token: token,
+		cli:   &http.Client{Transport: egress.Wrap(nil)},
+	}
+}
+
+// Write sends series in one request.
+func (c *Client) Write(ctx context.Context, series []Series) error {
+	body := snappy.Encode(nil, encodeRequest(series))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &StatusError{Code: resp.StatusCode, Message: string(bytes.TrimSpace(msg))}
+	}
+	return nil
+}
+
+// StatusError is returned when the endpoint rejects a write.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("got status code %d: %s", s.Code, s.Message)
+}
+
+// Retryable reports whether err might go away if the write is tried
+// again.  The remote write spec says 4xx responses other than 429 won't.
+func Retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500 || se.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Field numbers, per Prometheus' prompb/remote.proto and types.proto.
+const (
+	// WriteRequest
+	fTimeseries = 1
+	// TimeSeries
+	fLabels  = 1
+	fSamples = 2
+	// Label
+	fLabelName  = 1
+	fLabelValue = 2
+	// Sample
+	fSampleValue     = 1
+	fSampleTimestamp = 2
+)
+
+// encodeRequest encodes series as a prompb.WriteRequest.
+func encodeRequest(series []Series) []byte {
+	var b []byte
+	for _, s := range series {
+		b = protowire.AppendTag(b, fTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeSeries(s))
+	}
+	return b
+}
+
+// encodeSeries encodes s as a prompb.TimeSeries.
+func encodeSeries(s Series) []byte {
+	var b []byte
+	for _, l := range s.Labels {
+		var label []byte
+		label = protowire.AppendTag(label, fLabelName, protowire.BytesType)
+		label = protowire.AppendString(label, l[0])
+		label = protowire.AppendTag(label, fLabelValue, protowire.BytesType)
+		label = protowire.AppendString(label, l[1])
+		b = protowire.AppendTag(b, fLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, label)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, fSampleValue, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+	sample = protowire.AppendTag(sample, fSampleTimestamp, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+	b = protowire.AppendTag(b, fSamples, protowire.BytesType)
+	return protowire.AppendBytes(b, sample)
+}
@@ -0,0 +1,175 @@
+package remotewrite
+
+import (
+	"context"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeRequest returns the descriptor of prompb.WriteRequest, as declared
+// in Prometheus' prompb/remote.proto and types.proto, so requests can be
+// decoded by the protobuf library itself rather than by the code under
+// test.
+func writeRequest(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   typ.Enum(),
+			Label:  label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	const (
+		optional = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		repeated = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	)
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("remote.proto"),
+		Package: proto.String("prometheus"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("WriteRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("timeseries", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".prometheus.TimeSeries"),
+			},
+		}, {
+			Name: proto.String("TimeSeries"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("labels", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".prometheus.Label"),
+				field("samples", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".prometheus.Sample"),
+			},
+		}, {
+			Name: proto.String("Label"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+				field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+			},
+		}, {
+			Name: proto.String("Sample"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("value", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional, ""),
+				field("timestamp", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+			},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("protodesc.NewFile(): %v", err)
+	}
+	return fd.Messages().ByName("WriteRequest")
+}
+
+// decode parses a snappy compressed WriteRequest back into Series.
+func decode(t *testing.T, desc protoreflect.MessageDescriptor, body []byte) []Series {
+	t.Helper()
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("snappy.Decode(): %v", err)
+	}
+	req := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(b, req); err != nil {
+		t.Fatalf("proto.Unmarshal(): %v", err)
+	}
+	var rval []Series
+	ts := req.Get(desc.Fields().ByName("timeseries")).List()
+	for i := 0; i < ts.Len(); i++ {
+		m := ts.Get(i).Message()
+		var s Series
+		labels := m.Get(m.Descriptor().Fields().ByName("labels")).List()
+		for j := 0; j < labels.Len(); j++ {
+			l := labels.Get(j).Message()
+			fields := l.Descriptor().Fields()
+			s.Labels = append(s.Labels, [2]string{l.Get(fields.ByName("name")).String(), l.Get(fields.ByName("value")).String()})
+		}
+		samples := m.Get(m.Descriptor().Fields().ByName("samples")).List()
+		if samples.Len() != 1 {
+			t.Fatalf("series %d has %d samples, want 1", i, samples.Len())
+		}
+		sample := samples.Get(0).Message()
+		fields := sample.Descriptor().Fields()
+		s.Value = sample.Get(fields.ByName("value")).Float()
+		s.Timestamp = sample.Get(fields.ByName("timestamp")).Int()
+		rval = append(rval, s)
+	}
+	return rval
+}
+
+func TestWrite(t *testing.T) {
+	desc := writeRequest(t)
+	want := []Series{{
+		Labels:    [][2]string{{"__name__", "power_watts"}, {"instance", "home"}, {"meter", "site"}},
+		Value:     -1234.5,
+		Timestamp: 1700000000123,
+	}, {
+		Labels:    [][2]string{{"__name__", "up"}},
+		Value:     1,
+		Timestamp: 1700000000123,
+	}}
+	var got []Series
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("ReadAll(): %v", err)
+		}
+		got = decode(t, desc, body)
+	}))
+	defer srv.Close()
+
+	if err := New(srv.URL, "secret").Write(context.Background(), want); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Write() sent %v, want %v", got, want)
+	}
+	for k, v := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"Authorization":                     "Bearer secret",
+	} {
+		if got := header.Get(k); got != v {
+			t.Errorf("Write() sent %s %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestFromFamilies(t *testing.T) {
+	mfs := []*dto.MetricFamily{{
+		Name: proto.String("power_watts"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("meter"), Value: proto.String("site")},
+				{Name: proto.String("instance"), Value: proto.String("gateway")},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(42)},
+		}},
+	}}
+	now := time.Unix(1700000000, 0)
+	got := FromFamilies(mfs, now, [2]string{"instance", "home"}, [2]string{"job", "powerwall"})
+	want := []Series{{
+		Labels:    [][2]string{{"__name__", "power_watts"}, {"instance", "home"}, {"job", "powerwall"}, {"meter", "site"}},
+		Value:     42,
+		Timestamp: 1700000000000,
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FromFamilies() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/version"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/view"
+	"io/ioutil"
+	"os"
+)
+
+// schemaFile is the JSON written by the schema subcommand and read by
+// schema-diff.
+type schemaFile struct {
+	Version string              `json:"version"`
+	Metrics []view.MetricSchema `json:"metrics"`
+}
+
+var previousSchema string
+
+func init() {
+	subcommands["schema"] = &subcommand{
+		help: "print the metric schema of this build as JSON, for later use with schema-diff",
+		run:  printSchema,
+	}
+	subcommands["schema-diff"] = &subcommand{
+		help: "list metrics added, removed or renamed since the schema in --previous",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&previousSchema, "previous", "", "schema JSON written by the schema subcommand of an earlier release")
+		},
+		run: diffSchema,
+	}
+}
+
+func currentSchema() (schemaFile, error) {
+	opts, err := viewOptions()
+	if err != nil {
+		return schemaFile{}, err
+	}
+	return schemaFile{
+		Version: version.Get().Version,
+		Metrics: view.Schema(opts),
+	}, nil
+}
+
+func printSchema() error {
+	current, err := currentSchema()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(current)
+}
+
+func diffSchema() error {
+	if previousSchema == "" {
+		return fmt.Errorf("you must provide --previous")
+	}
+	b, err := ioutil.ReadFile(previousSchema)
+	if err != nil {
+		return err
+	}
+	var older schemaFile
+	if err := json.Unmarshal(b, &older); err != nil {
+		return fmt.Errorf("decoding %s: %v", previousSchema, err)
+	}
+	newer, err := currentSchema()
+	if err != nil {
+		return err
+	}
+	d := view.Diff(older.Metrics, newer.Metrics)
+	fmt.Printf("Metric schema changes from %s to %s:\n", older.Version, newer.Version)
+	for _, m := range d.Added {
+		fmt.Printf("+ %s (%s) %v\n", m.Name, m.Type, m.Labels)
+	}
+	for _, m := range d.Removed {
+		fmt.Printf("- %s (%s) %v\n", m.Name, m.Type, m.Labels)
+	}
+	for _, r := range d.Renamed {
+		fmt.Printf("~ %s -> %s\n", r.From.Name, r.To.Name)
+	}
+	for _, r := range d.Changed {
+		fmt.Printf("! %s: %s %v -> %s %v\n", r.To.Name, r.From.Type, r.From.Labels, r.To.Type, r.To.Labels)
+	}
+	if len(d.Added)+len(d.Removed)+len(d.Renamed)+len(d.Changed) == 0 {
+		fmt.Println("No changes.")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+var serviceName string
+
+func init() {
+	name := func(fs *flag.FlagSet) {
+		fs.StringVar(&serviceName, "service_name", "powerwall_exporter", "name of the service")
+	}
+	subcommands["install-service"] = &subcommand{
+		help:  "install the exporter as a Windows service, launchd daemon or systemd unit, running with the flags in --config_file",
+		flags: name,
+		run:   installService,
+	}
+	subcommands["uninstall-service"] = &subcommand{
+		help:  "remove the service install-service installed",
+		flags: name,
+		run:   uninstallService,
+	}
+	subcommands["run-service"] = &subcommand{
+		help:  "run the exporter under the service manager; install-service sets this up",
+		flags: name,
+		run:   runService,
+	}
+}
+
+// serviceArgs returns the absolute path of the exporter and the arguments
+// the service runs it with.
+func serviceArgs() (string, []string, error) {
+	if *configFile == "" {
+		return "", nil, errors.New("you must provide --config_file, which the service reads its flags from")
+	}
+	config, err := filepath.Abs(*configFile)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := os.Stat(config); err != nil {
+		return "", nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+	return exe, []string{"run-service", "--service_name=" + serviceName, "--config_file=" + config}, nil
+}
+
+// runService reads --config_file and runs the exporter until the service
+// manager stops it.
+func runService() error {
+	if err := loadConfigFile(); err != nil {
+		return fmt.Errorf("--config_file: %v", err)
+	}
+	checkWriteTargets()
+	logthrottle.SetInterval(*logRepeat)
+	opts, err := exporterOptions()
+	if err != nil {
+		return err
+	}
+	opts.Reload = reloadOptions
+	return runAsService(opts)
+}
+
+// systemdUnit returns a systemd unit running exe with args as user.  If
+// writable is set, the unit may write only there, and in a private /tmp
+// for its logs.  setup and install-service both install units from it.
+func systemdUnit(exe string, args []string, user, writable string) string {
+	var b strings.Builder
+	b.WriteString(`[Unit]
+Description=Powerwall Prometheus exporter
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+`)
+	var cmd []string
+	for _, a := range append([]string{exe}, args...) {
+		// Only command lines expand $ variables.
+		cmd = append(cmd, systemdQuote(strings.ReplaceAll(a, "$", "$$")))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(cmd, " "))
+	b.WriteString("ExecReload=/bin/kill -HUP $MAINPID\nRestart=on-failure\n")
+	if user != "" {
+		fmt.Fprintf(&b, "User=%s\n", user)
+	}
+	if writable != "" {
+		fmt.Fprintf(&b, "ProtectSystem=strict\nPrivateTmp=true\nReadWritePaths=%s\n", systemdQuote(writable))
+	}
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// systemdQuote quotes s as one word of a unit file setting, so spaces
+// don't split it and systemd doesn't expand its % specifiers.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace(s)
+	return `"` + s + `"`
+}
+
+// serviceUser returns the account a unit should run as: whoever ran sudo
+// to install it, or else the current user.  The exporter needs no root
+// privileges.
+func serviceUser() (string, error) {
+	if u := os.Getenv("SUDO_USER"); u != "" {
+		return u, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
@@ -0,0 +1,75 @@
+//go:build darwin
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/controller"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// plistPath is where launchd looks for system daemons.
+func plistPath() string {
+	return filepath.Join("/Library/LaunchDaemons", "com.github.jeffbstewart."+serviceName+".plist")
+}
+
+func installService() error {
+	exe, args, err := serviceArgs()
+	if err != nil {
+		return err
+	}
+	var program strings.Builder
+	for _, a := range append([]string{exe}, args...) {
+		program.WriteString("\t\t<string>")
+		if err := xml.EscapeText(&program, []byte(a)); err != nil {
+			return err
+		}
+		program.WriteString("</string>\n")
+	}
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>com.github.jeffbstewart.%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`, serviceName, program.String())
+	if err := ioutil.WriteFile(plistPath(), []byte(plist), 0644); err != nil {
+		return fmt.Errorf("writing %s (are you root?): %v", plistPath(), err)
+	}
+	if out, err := exec.Command("launchctl", "load", "-w", plistPath()).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl load: %v: %s", err, out)
+	}
+	fmt.Printf("Installed and loaded %s.\n", plistPath())
+	return nil
+}
+
+func uninstallService() error {
+	if out, err := exec.Command("launchctl", "unload", "-w", plistPath()).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl unload: %v: %s", err, out)
+	}
+	if err := os.Remove(plistPath()); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %s.\n", plistPath())
+	return nil
+}
+
+// runAsService runs the exporter in the foreground, which is how launchd
+// expects daemons to run.
+func runAsService(opts controller.Options) error {
+	return controller.Run(opts)
+}
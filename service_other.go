@@ -0,0 +1,69 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/controller"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// unitPath is where systemd looks for units installed by the
+// administrator.
+func unitPath() string {
+	return filepath.Join("/etc/systemd/system", serviceName+".service")
+}
+
+func installService() error {
+	exe, args, err := serviceArgs()
+	if err != nil {
+		return err
+	}
+	user, err := serviceUser()
+	if err != nil {
+		return err
+	}
+	unit := systemdUnit(exe, args, user, "")
+	if err := ioutil.WriteFile(unitPath(), []byte(unit), 0644); err != nil {
+		return fmt.Errorf("writing %s (are you root?): %v", unitPath(), err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("enable", "--now", filepath.Base(unitPath())); err != nil {
+		return err
+	}
+	fmt.Printf("Installed and started %s.\n", unitPath())
+	return nil
+}
+
+func uninstallService() error {
+	if err := systemctl("disable", "--now", filepath.Base(unitPath())); err != nil {
+		return err
+	}
+	if err := os.Remove(unitPath()); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %s.\n", unitPath())
+	return nil
+}
+
+func systemctl(args ...string) error {
+	if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// runAsService runs the exporter in the foreground, which is how systemd
+// expects services to run.
+func runAsService(opts controller.Options) error {
+	return controller.Run(opts)
+}
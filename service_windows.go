@@ -0,0 +1,112 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/controller"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func installService() error {
+	exe, args, err := serviceArgs()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("mgr.Connect() (are you an administrator?): %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Powerwall Prometheus exporter",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("CreateService(): %v", err)
+	}
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("installed %s, but starting it failed: %v", serviceName, err)
+	}
+	fmt.Printf("Installed and started the %s service.\n", serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("mgr.Connect() (are you an administrator?): %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("OpenService(): %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Control(svc.Stop); err != nil {
+		glog.Warningf("Stopping %s: %v", serviceName, err)
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("Delete(): %v", err)
+	}
+	fmt.Printf("Removed the %s service.\n", serviceName)
+	return nil
+}
+
+// runAsService runs the exporter under the Windows service control
+// manager, or in the foreground when started from a console.
+func runAsService(opts controller.Options) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("svc.IsWindowsService(): %v", err)
+	}
+	if !isService {
+		return controller.Run(opts)
+	}
+	h := &serviceHandler{opts: opts}
+	if err := svc.Run(serviceName, h); err != nil {
+		return fmt.Errorf("svc.Run(): %v", err)
+	}
+	return h.err
+}
+
+// serviceHandler answers the service control manager.
+type serviceHandler struct {
+	opts controller.Options
+	err  error // why the exporter stopped, if not asked to.
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- controller.RunUntil(h.opts, stop)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			// The exporter failed on its own.
+			glog.Errorf("controller.RunUntil(): %v", err)
+			h.err = err
+			return true, 1
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				if err := <-done; err != nil {
+					glog.Errorf("Stopping the exporter: %v", err)
+				}
+				glog.Flush()
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"golang.org/x/term"
+	"io/ioutil"
+	gohttp "net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	setupConfigOut string
+	setupUnitOut   string
+)
+
+func init() {
+	subcommands["setup"] = &subcommand{
+		help: "interactively find the gateway, check credentials, write a config file and optionally a systemd unit, then test a poll",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&setupConfigOut, "config_out", "powerwall_exporter.conf", "file to write the exporter's settings to, in the --config_file format")
+			fs.StringVar(&setupUnitOut, "unit_out", "/etc/systemd/system/powerwall_exporter.service", "where to install the systemd unit, if asked to")
+		},
+		run: runSetup,
+	}
+}
+
+// kGatewayCandidates are addresses a gateway commonly answers on: the
+// names it registers on the home network, and its own wifi access point.
+var kGatewayCandidates = []string{"powerwall", "teg", "192.168.91.1"}
+
+type prompter struct {
+	in *bufio.Reader
+}
+
+func (p *prompter) ask(question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	line, _ := p.in.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return def
+	}
+	return line
+}
+
+func (p *prompter) askSecret(question string) string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return p.ask(question, "")
+	}
+	fmt.Printf("%s: ", question)
+	b, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func (p *prompter) yes(question string) bool {
+	return strings.HasPrefix(strings.ToLower(p.ask(question+" (y/N)", "")), "y")
+}
+
+// discoverGateway returns the first candidate that answers /api/status,
+// which doesn't need a login.
+func discoverGateway(candidates []string) string {
+	cli := &gohttp.Client{
+		Timeout: 3 * time.Second,
+		Transport: &gohttp.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		fmt.Printf("Looking for a gateway at %s... ", c)
+		resp, err := cli.Get("https://" + c + "/api/status")
+		if err != nil {
+			fmt.Println("no")
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == 200 {
+			fmt.Println("found it")
+			return c
+		}
+		fmt.Printf("got %s\n", resp.Status)
+	}
+	return ""
+}
+
+func runSetup() error {
+	p := &prompter{in: bufio.NewReader(os.Stdin)}
+	fmt.Println("This will set up the powerwall exporter.  Press enter to accept defaults in brackets.")
+
+	gw := discoverGateway(append([]string{*gateway}, kGatewayCandidates...))
+	if gw == "" {
+		fmt.Println("Couldn't find the gateway automatically.  Its address is shown in the Tesla app, or on your router's list of devices.")
+	}
+	gw = p.ask("Gateway hostname or IP address", gw)
+	if gw == "" {
+		return fmt.Errorf("a gateway address is required")
+	}
+
+	fmt.Printf("\nThe exporter logs in as the gateway's customer account.  If you haven't set it up,\n"+
+		"browse to https://%s, choose Customer, and follow the prompts.  The default password\n"+
+		"is the last 5 characters of the password on the sticker inside the gateway's door.\n\n", gw)
+	var opts powerwall.Options
+	var mon powerwall.Monitor
+	for {
+		opts = powerwall.Options{
+			Gateway:  gw,
+			Username: p.ask("Customer email", *customerUsername),
+			Password: p.askSecret("Customer password"),
+			Request: powerwall.RequestPolicy{
+				Timeout: *requestTimeout,
+				Retries: *requestRetries,
+			},
+		}
+		var err error
+		mon, err = powerwall.New(opts)
+		if err == nil {
+			fmt.Println("Logged in.")
+			break
+		}
+		fmt.Printf("Logging in failed: %v\n", err)
+		if !p.yes("Try again?") {
+			return err
+		}
+	}
+	defer mon.Close()
+
+	fmt.Println("\nTesting a poll...")
+	fixed, err := model.New(mon, model.PollOptions{})
+	if err != nil {
+		return fmt.Errorf("model.New(): %v", err)
+	}
+	m, err := model.Poll(mon, fixed, model.PollOptions{})
+	if err != nil {
+		return fmt.Errorf("model.Poll(): %v", err)
+	}
+	fmt.Printf("%s: %d powerwall(s), %.1f%% charged, firmware %d.%d.%d\n",
+		fixed.SiteName, fixed.NumPowerwalls, m.PowerwallChargePercent, m.Version.Major, m.Version.Minor, m.Version.Release)
+
+	metricsPort := p.ask("Port to serve metrics on", fmt.Sprint(*port))
+	settings := []string{
+		"--gateway=" + gw,
+		"--customer_username=" + opts.Username,
+		"--password=" + opts.Password,
+		"--port=" + metricsPort,
+		"--poll_mode=background",
+		"--state_file=" + stateFileFor(setupConfigOut),
+	}
+	config, err := configFileContents(settings)
+	if err != nil {
+		return err
+	}
+	// It holds the password, so only the owner may read it.
+	if err := ioutil.WriteFile(setupConfigOut, []byte(config), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", setupConfigOut)
+
+	if p.yes("Install a systemd unit?") {
+		if err := installUnit(setupConfigOut, setupUnitOut); err != nil {
+			fmt.Printf("Couldn't install the unit (are you root?): %v\n", err)
+		} else {
+			fmt.Printf("Wrote %s.  Start it with:\n  systemctl daemon-reload && systemctl enable --now %s\n",
+				setupUnitOut, filepath.Base(setupUnitOut))
+		}
+	} else {
+		fmt.Printf("Run the exporter with:\n  %s --config_file=%s\n", os.Args[0], setupConfigOut)
+	}
+	return nil
+}
+
+// configFileContents returns a --config_file holding settings, each of
+// the form --name=value.  The format has no quoting, so a value must fit
+// on its line and not start or end with a space.
+func configFileContents(settings []string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by powerwall exporter setup on %s.\n", time.Now().Format("2006-01-02"))
+	for _, s := range settings {
+		nv := strings.SplitN(s, "=", 2)
+		if len(nv) == 2 && (strings.ContainsAny(nv[1], "\r\n") || nv[1] != strings.TrimSpace(nv[1])) {
+			return "", fmt.Errorf("%s can't be written to a config file: its value has a line break or surrounding spaces", nv[0])
+		}
+		b.WriteString(s + "\n")
+	}
+	return b.String(), nil
+}
+
+// stateFileFor puts the state file next to the config file.
+func stateFileFor(config string) string {
+	abs, err := filepath.Abs(config)
+	if err != nil {
+		abs = config
+	}
+	return filepath.Join(filepath.Dir(abs), "powerwall_exporter.state")
+}
+
+func installUnit(config, unitPath string) error {
+	*configFile = config
+	serviceName = strings.TrimSuffix(filepath.Base(unitPath), ".service")
+	exe, args, err := serviceArgs()
+	if err != nil {
+		return err
+	}
+	user, err := serviceUser()
+	if err != nil {
+		return err
+	}
+	// Run by sudo, we wrote the config file as root, but the unit runs
+	// as the user who ran sudo.
+	if uid, gid := os.Getenv("SUDO_UID"), os.Getenv("SUDO_GID"); uid != "" && gid != "" {
+		u, err := strconv.Atoi(uid)
+		if err != nil {
+			return fmt.Errorf("SUDO_UID: %v", err)
+		}
+		g, err := strconv.Atoi(gid)
+		if err != nil {
+			return fmt.Errorf("SUDO_GID: %v", err)
+		}
+		if err := os.Chown(config, u, g); err != nil {
+			return err
+		}
+	}
+	unit := systemdUnit(exe, args, user, filepath.Dir(stateFileFor(config)))
+	return ioutil.WriteFile(unitPath, []byte(unit), 0644)
+}
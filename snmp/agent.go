@@ -0,0 +1,250 @@
+// Package snmp is a small SNMP v1/v2c agent exposing the key gateway
+// metrics, for facility monitoring that only speaks SNMP.  It answers GET
+// and GETNEXT for the objects in POWERWALL-EXPORTER-MIB.txt; everything is
+// read only.
+package snmp
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Options describes how to serve SNMP.
+type Options struct {
+	// Port is the UDP port to listen on.  If zero, there is no agent.
+	Port int
+	// Community is the read community string requests must carry.
+	Community string
+}
+
+// kEnterprise is the root of our MIB.  It isn't registered with IANA;
+// change it if it collides with something on your network.
+var kEnterprise = oid{1, 3, 6, 1, 4, 1, 99999, 1}
+
+// object is one scalar in the MIB.
+type object struct {
+	oid oid
+	// get returns the encoded value from a snapshot.
+	get func(m *model.TeslaEnergyGatewayMetrics) []byte
+}
+
+// gridStatusValues are the gridStatus enumeration in the MIB.
+var gridStatusValues = map[powerwall.SystemStatus]int64{
+	powerwall.GridConnected:    1,
+	powerwall.IslandedReady:    2,
+	powerwall.IslandedActive:   3,
+	powerwall.TransitionToGrid: 4,
+}
+
+func meterWatts(mt model.MeterType) func(m *model.TeslaEnergyGatewayMetrics) []byte {
+	return func(m *model.TeslaEnergyGatewayMetrics) []byte {
+		return encodeInt(tagInteger, int64(m.Meters[mt].InstantPower))
+	}
+}
+
+func scalar(n int, get func(m *model.TeslaEnergyGatewayMetrics) []byte) object {
+	o := append(append(oid{}, kEnterprise...), n, 0)
+	return object{oid: o, get: get}
+}
+
+// objects is sorted by OID.
+var objects = []object{
+	scalar(1, func(m *model.TeslaEnergyGatewayMetrics) []byte {
+		// hundredths of a percent, since SNMP has no floats.
+		return encodeGauge(int64(m.PowerwallChargePercent * 100))
+	}),
+	scalar(2, func(m *model.TeslaEnergyGatewayMetrics) []byte {
+		return encodeInt(tagInteger, gridStatusValues[m.GridStatus])
+	}),
+	scalar(3, meterWatts(model.Total)),
+	scalar(4, meterWatts(model.Load)),
+	scalar(5, meterWatts(model.Solar)),
+	scalar(6, meterWatts(model.Battery)),
+}
+
+func init() {
+	sort.Slice(objects, func(i, j int) bool { return objects[i].oid.less(objects[j].oid) })
+}
+
+// Agent answers SNMP requests from the most recent snapshot.
+type Agent struct {
+	opts   Options
+	latest func() *model.TeslaEnergyGatewayMetrics
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
+}
+
+// New returns an Agent which reads values from latest.  latest may return
+// nil before the first poll.
+func New(opts Options, latest func() *model.TeslaEnergyGatewayMetrics) *Agent {
+	return &Agent{opts: opts, latest: latest}
+}
+
+// ListenAndServe does not return under normal operation.  After Close, it
+// returns nil.
+func (a *Agent) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", a.opts.Port))
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return conn.Close()
+	}
+	a.conn = conn
+	a.mu.Unlock()
+	glog.Infof("Serving SNMP on UDP port %d", a.opts.Port)
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.closed {
+				return nil
+			}
+			return err
+		}
+		resp, err := a.handle(buf[:n])
+		if err != nil {
+			glog.V(1).Infof("Ignoring SNMP request from %s: %v", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			glog.Errorf("Replying to SNMP request from %s: %v", addr, err)
+		}
+	}
+}
+
+// Close stops the agent.
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	if a.conn == nil {
+		return nil
+	}
+	return a.conn.Close()
+}
+
+// SNMP error-status values.
+const (
+	errNone       = 0
+	errNoSuchName = 2
+	errGenErr     = 5
+)
+
+// handle decodes a request and returns the encoded response.
+func (a *Agent) handle(req []byte) ([]byte, error) {
+	tag, msg, _, err := readTLV(req)
+	if err != nil || tag != tagSequence {
+		return nil, fmt.Errorf("not an SNMP message")
+	}
+	_, ver, msg, err := readTLV(msg)
+	if err != nil {
+		return nil, err
+	}
+	version := decodeInt(ver)
+	_, community, msg, err := readTLV(msg)
+	if err != nil {
+		return nil, err
+	}
+	if string(community) != a.opts.Community {
+		return nil, fmt.Errorf("wrong community")
+	}
+	pduType, pdu, _, err := readTLV(msg)
+	if err != nil {
+		return nil, err
+	}
+	if pduType != tagGetRequest && pduType != tagGetNext {
+		return nil, fmt.Errorf("unsupported PDU type %#x", pduType)
+	}
+	_, reqID, pdu, err := readTLV(pdu)
+	if err != nil {
+		return nil, err
+	}
+	// skip error-status and error-index.
+	if _, _, pdu, err = readTLV(pdu); err != nil {
+		return nil, err
+	}
+	if _, _, pdu, err = readTLV(pdu); err != nil {
+		return nil, err
+	}
+	_, vbs, _, err := readTLV(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	m := a.latest()
+	var out [][]byte
+	errStatus, errIndex := int64(errNone), int64(0)
+	for i := 1; len(vbs) > 0; i++ {
+		var vb []byte
+		if _, vb, vbs, err = readTLV(vbs); err != nil {
+			return nil, err
+		}
+		_, rawOID, _, err := readTLV(vb)
+		if err != nil {
+			return nil, err
+		}
+		o, err := decodeOID(rawOID)
+		if err != nil {
+			return nil, err
+		}
+		respOID, value := a.lookup(pduType, o, m, version)
+		if value == nil {
+			// SNMPv1 has no exception values, only an error for the
+			// whole request.
+			errStatus, errIndex = errNoSuchName, int64(i)
+			value = tlv(tagNull, nil)
+		}
+		if m == nil && errStatus == errNone {
+			errStatus, errIndex = errGenErr, int64(i)
+		}
+		out = append(out, sequence(tagSequence, encodeOID(respOID), value))
+	}
+	return sequence(tagSequence,
+		encodeInt(tagInteger, version),
+		tlv(tagOctetString, community),
+		sequence(tagGetResponse,
+			tlv(tagInteger, reqID),
+			encodeInt(tagInteger, errStatus),
+			encodeInt(tagInteger, errIndex),
+			sequence(tagSequence, out...),
+		),
+	), nil
+}
+
+// lookup finds the object a GET or GETNEXT names, returning the OID to
+// answer with and its encoded value.  A nil value means SNMPv1's
+// noSuchName; SNMPv2c gets an exception value instead.
+func (a *Agent) lookup(pduType byte, o oid, m *model.TeslaEnergyGatewayMetrics, version int64) (oid, []byte) {
+	const v1 = 0
+	for _, obj := range objects {
+		if pduType == tagGetRequest && !obj.oid.equal(o) {
+			continue
+		}
+		if pduType == tagGetNext && !o.less(obj.oid) {
+			continue
+		}
+		if m == nil {
+			return obj.oid, tlv(tagNull, nil)
+		}
+		return obj.oid, obj.get(m)
+	}
+	if version == v1 {
+		return o, nil
+	}
+	if pduType == tagGetNext {
+		return o, tlv(tagEndOfMib, nil)
+	}
+	return o, tlv(tagNoSuchObj, nil)
+}
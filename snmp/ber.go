@@ -0,0 +1,157 @@
+package snmp
+
+import (
+	"fmt"
+)
+
+// BER tags used by SNMP v1 and v2c.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+	tagGauge32     = 0x42
+	tagNoSuchObj   = 0x80
+	tagEndOfMib    = 0x82
+
+	tagGetRequest  = 0xa0
+	tagGetNext     = 0xa1
+	tagGetResponse = 0xa2
+)
+
+// readTLV splits the first tag-length-value off b.
+func readTLV(b []byte) (tag byte, value, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated TLV")
+	}
+	tag = b[0]
+	n := int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		octets := n & 0x7f
+		if octets == 0 || octets > 3 || len(b) < octets {
+			return 0, nil, nil, fmt.Errorf("bad length")
+		}
+		n = 0
+		for _, c := range b[:octets] {
+			n = n<<8 | int(c)
+		}
+		b = b[octets:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, fmt.Errorf("truncated value")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// tlv encodes a tag-length-value.
+func tlv(tag byte, value []byte) []byte {
+	n := len(value)
+	var l []byte
+	switch {
+	case n < 0x80:
+		l = []byte{byte(n)}
+	case n < 0x100:
+		l = []byte{0x81, byte(n)}
+	default:
+		l = []byte{0x82, byte(n >> 8), byte(n)}
+	}
+	rval := append([]byte{tag}, l...)
+	return append(rval, value...)
+}
+
+func sequence(tag byte, parts ...[]byte) []byte {
+	var v []byte
+	for _, p := range parts {
+		v = append(v, p...)
+	}
+	return tlv(tag, v)
+}
+
+func decodeInt(b []byte) int64 {
+	var rval int64
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			rval = -1
+		}
+		rval = rval<<8 | int64(c)
+	}
+	return rval
+}
+
+func encodeInt(tag byte, v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if (v == 0 && b[0]&0x80 == 0) || (v == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return tlv(tag, b)
+}
+
+// encodeGauge encodes an unsigned 32 bit value, clamping negatives to 0.
+func encodeGauge(v int64) []byte {
+	if v < 0 {
+		v = 0
+	}
+	if v > 0xffffffff {
+		v = 0xffffffff
+	}
+	return encodeInt(tagGauge32, v)
+}
+
+type oid []int
+
+func (o oid) String() string {
+	s := ""
+	for _, n := range o {
+		s += fmt.Sprintf(".%d", n)
+	}
+	return s
+}
+
+// less orders OIDs lexicographically, as GETNEXT walks them.
+func (o oid) less(p oid) bool {
+	for i := 0; i < len(o) && i < len(p); i++ {
+		if o[i] != p[i] {
+			return o[i] < p[i]
+		}
+	}
+	return len(o) < len(p)
+}
+
+func (o oid) equal(p oid) bool {
+	return !o.less(p) && !p.less(o)
+}
+
+func decodeOID(b []byte) (oid, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty OID")
+	}
+	rval := oid{int(b[0]) / 40, int(b[0]) % 40}
+	n := 0
+	for _, c := range b[1:] {
+		n = n<<7 | int(c&0x7f)
+		if c&0x80 == 0 {
+			rval = append(rval, n)
+			n = 0
+		}
+	}
+	return rval, nil
+}
+
+func encodeOID(o oid) []byte {
+	b := []byte{byte(o[0]*40 + o[1])}
+	for _, n := range o[2:] {
+		var enc []byte
+		enc = append(enc, byte(n&0x7f))
+		for n >>= 7; n > 0; n >>= 7 {
+			enc = append([]byte{byte(n&0x7f | 0x80)}, enc...)
+		}
+		b = append(b, enc...)
+	}
+	return tlv(tagOID, b)
+}
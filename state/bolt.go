@@ -0,0 +1,59 @@
+package state
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var kBucket = []byte("state")
+
+// boltDB keeps each value under its own key in a bbolt database, so a Put
+// doesn't rewrite the others.
+type boltDB struct {
+	db *bolt.DB
+}
+
+func openBolt(path string) (*boltDB, error) {
+	// Fail rather than hang if another exporter has the database open.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(kBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltDB{db: db}, nil
+}
+
+func (b *boltDB) Load() (map[string]json.RawMessage, error) {
+	rval := make(map[string]json.RawMessage)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(kBucket).ForEach(func(k, v []byte) error {
+			// v is only valid during the transaction.
+			rval[string(k)] = append(json.RawMessage(nil), v...)
+			return nil
+		})
+	})
+	return rval, err
+}
+
+func (b *boltDB) Close() error {
+	return b.db.Close()
+}
+
+func (b *boltDB) Put(values map[string]json.RawMessage) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for k, v := range values {
+			if err := tx.Bucket(kBucket).Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// file keeps every value in one JSON file.
+type file struct {
+	path   string
+	values map[string]json.RawMessage
+}
+
+func (f *file) Load() (map[string]json.RawMessage, error) {
+	f.values = make(map[string]json.RawMessage)
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return f.copy(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state file: %v", err)
+	}
+	if err := json.Unmarshal(b, &f.values); err != nil {
+		return nil, fmt.Errorf("decoding state file %s: %v", f.path, err)
+	}
+	return f.copy(), nil
+}
+
+func (f *file) copy() map[string]json.RawMessage {
+	rval := make(map[string]json.RawMessage)
+	for k, v := range f.values {
+		rval[k] = v
+	}
+	return rval
+}
+
+func (f *file) Put(values map[string]json.RawMessage) error {
+	for k, v := range values {
+		f.values[k] = v
+	}
+	return f.save()
+}
+
+// save writes the values to a temporary file and renames it over the old
+// one, so a crash never leaves a half written state file behind.
+func (f *file) save() error {
+	b, err := json.MarshalIndent(f.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("creating state file: %v", err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("closing state file: %v", err)
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
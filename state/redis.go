@@ -0,0 +1,180 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kRedisKey     = "powerwall_exporter"
+	kRedisTimeout = 5 * time.Second
+)
+
+// redis keeps the values as fields of a hash in a Redis server.  It
+// connects for each operation, since they're rare, and so a restarted
+// server needs no reconnect logic.  Only the handful of commands it needs
+// are spoken.
+type redis struct {
+	addr     string
+	username string
+	password string
+	db       int
+	key      string
+}
+
+func openRedis(spec string) (*redis, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	r := &redis{
+		addr: u.Host,
+		key:  kRedisKey,
+	}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("bad database %q: %v", db, err)
+		}
+	}
+	if k := u.Query().Get("key"); k != "" {
+		r.key = k
+	}
+	return r, nil
+}
+
+func (r *redis) Load() (map[string]json.RawMessage, error) {
+	reply, err := r.do("HGETALL", r.key)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("HGETALL: unexpected reply %v", reply)
+	}
+	rval := make(map[string]json.RawMessage)
+	for i := 0; i < len(fields); i += 2 {
+		k, kok := fields[i].(string)
+		v, vok := fields[i+1].(string)
+		if !kok || !vok {
+			return nil, fmt.Errorf("HGETALL: unexpected reply %v", reply)
+		}
+		rval[k] = json.RawMessage(v)
+	}
+	return rval, nil
+}
+
+func (r *redis) Put(values map[string]json.RawMessage) error {
+	args := []string{"HSET", r.key}
+	for k, v := range values {
+		args = append(args, k, string(v))
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+// do connects, authenticates, selects the database and runs one command,
+// returning its reply.
+func (r *redis) do(args ...string) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, kRedisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(kRedisTimeout))
+	rd := bufio.NewReader(conn)
+	var cmds [][]string
+	switch {
+	case r.password != "" && r.username != "":
+		cmds = append(cmds, []string{"AUTH", r.username, r.password})
+	case r.password != "":
+		cmds = append(cmds, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	cmds = append(cmds, args)
+	var reply interface{}
+	for _, cmd := range cmds {
+		if _, err := conn.Write(encodeCommand(cmd)); err != nil {
+			return nil, err
+		}
+		if reply, err = readReply(rd); err != nil {
+			return nil, fmt.Errorf("%s: %v", cmd[0], err)
+		}
+	}
+	return reply, nil
+}
+
+// encodeCommand encodes a command as a RESP array of bulk strings.
+func encodeCommand(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return []byte(b.String())
+}
+
+// readReply decodes one RESP reply.  Strings come back as string,
+// integers as int64, arrays as []interface{}, and nil replies as nil.
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		rval := make([]interface{}, n)
+		for i := range rval {
+			if rval[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return rval, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
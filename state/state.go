@@ -0,0 +1,131 @@
+// Package state persists small pieces of exporter state between runs.
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Backend is where a Store keeps its values.
+type Backend interface {
+	// Load returns every saved value, keyed by name.
+	Load() (map[string]json.RawMessage, error)
+	// Put saves values, keyed by name, in one write.
+	Put(values map[string]json.RawMessage) error
+}
+
+// Store is a set of JSON encoded values keyed by name.  Every Put writes
+// through to the backend, so it is meant for a handful of small values,
+// not for history.
+type Store struct {
+	backend Backend
+	path    string
+	mu      sync.Mutex
+	values  map[string]json.RawMessage
+}
+
+const (
+	kBoltPrefix  = "bolt:"
+	kRedisPrefix = "redis://"
+)
+
+// Open loads the store described by spec, which is one of:
+//
+//	""                  memory only; nothing is saved
+//	/path/to/file       a JSON file
+//	bolt:/path/to/file  a bbolt database
+//	redis://[:password@]host:port[/db][?key=name]
+//	                    a hash in Redis, for deployments without a
+//	                    persistent volume
+//
+// A missing file yields an empty store.
+func Open(spec string) (*Store, error) {
+	s := &Store{values: make(map[string]json.RawMessage)}
+	switch {
+	case spec == "":
+		return s, nil
+	case strings.HasPrefix(spec, kBoltPrefix):
+		s.path = strings.TrimPrefix(spec, kBoltPrefix)
+		b, err := openBolt(s.path)
+		if err != nil {
+			return nil, fmt.Errorf("openBolt(): %v", err)
+		}
+		s.backend = b
+	case strings.HasPrefix(spec, kRedisPrefix):
+		b, err := openRedis(spec)
+		if err != nil {
+			return nil, fmt.Errorf("openRedis(): %v", err)
+		}
+		s.backend = b
+	default:
+		s.path = spec
+		s.backend = &file{path: spec}
+	}
+	values, err := s.backend.Load()
+	if err != nil {
+		return nil, err
+	}
+	s.values = values
+	return s, nil
+}
+
+// Close releases the backend.  The store can't be used afterwards.
+func (s *Store) Close() error {
+	if c, ok := s.backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Path returns the file the store is kept in, or "" if it isn't kept on
+// the local disk.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get decodes the value saved under key into v.  It returns false if
+// nothing has been saved under key.
+func (s *Store) Get(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	raw, ok := s.values[key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, fmt.Errorf("decoding state %q: %v", key, err)
+	}
+	return true, nil
+}
+
+// Put saves v under key and writes it to the backend.
+func (s *Store) Put(key string, v interface{}) error {
+	return s.PutAll(map[string]interface{}{key: v})
+}
+
+// PutAll saves each of values under its key, and writes those which
+// changed to the backend in one go.  Nothing is written if none did.
+func (s *Store) PutAll(values map[string]interface{}) error {
+	changed := make(map[string]json.RawMessage)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, v := range values {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("encoding state %q: %v", key, err)
+		}
+		if old, ok := s.values[key]; ok && bytes.Equal(old, raw) {
+			continue
+		}
+		s.values[key] = raw
+		changed[key] = raw
+	}
+	if s.backend == nil || len(changed) == 0 {
+		return nil
+	}
+	return s.backend.Put(changed)
+}
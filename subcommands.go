@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+	"sort"
+)
+
+// subcommand is an alternative to running the exporter, selected by the
+// first command line argument.
+type subcommand struct {
+	help string
+	// flags registers flags specific to the subcommand.  May be nil.
+	flags func(fs *flag.FlagSet)
+	run   func() error
+}
+
+// subcommands is filled in by the init functions of the files
+// implementing each one.
+var subcommands = make(map[string]*subcommand)
+
+// runSubcommand parses args with the exporter's flags plus the
+// subcommand's own, then runs it.
+func runSubcommand(name string, args []string) {
+	sc, ok := subcommands[name]
+	if !ok {
+		var names []string
+		for n := range subcommands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %q.  Known subcommands are:\n", name)
+		for _, n := range names {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", n, subcommands[n].help)
+		}
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	if sc.flags != nil {
+		sc.flags(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		glog.Exitf("%s: %v", name, err)
+	}
+	// glog complains about logging before flag.Parse, so mark the global
+	// flag set parsed; its values were set through fs.
+	if err := flag.CommandLine.Parse(nil); err != nil {
+		glog.Exitf("%s: %v", name, err)
+	}
+	if err := sc.run(); err != nil {
+		glog.Exitf("%s: %v", name, err)
+	}
+	glog.Flush()
+}
+
+// flagValues returns the current value of every flag, by name.
+func flagValues() map[string]string {
+	rval := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		rval[f.Name] = f.Value.String()
+	})
+	return rval
+}
@@ -0,0 +1,219 @@
+// Package support gathers diagnostic information for bug reports.
+package support
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/version"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// kRedacted replaces sensitive values in the bundle.
+const kRedacted = "REDACTED"
+
+// sensitiveKeys are JSON keys in gateway responses whose values identify
+// the owner or the hardware, and so are scrubbed from bundles.
+var sensitiveKeys = map[string]bool{
+	"email":                     true,
+	"phone":                     true,
+	"customer_id":               true,
+	"site_uid":                  true,
+	"vin":                       true,
+	"token":                     true,
+	"site_name":                 true,
+	"network_name":              true,
+	"ssid":                      true,
+	"hw_address":                true,
+	"ip":                        true,
+	"gateway":                   true,
+	"PackageSerialNumber":       true,
+	"ecu_package_serial_number": true,
+	"serial_number":             true,
+	"device_serial":             true,
+	"location":                  true,
+}
+
+// sensitiveFlags are command line flags whose values are never written to
+// a bundle.  The customer username is the owner's email address.
+var sensitiveFlags = []string{"password", "token", "secret", "community", "customer_username"}
+
+// maxLogBytes bounds how much of each log file is included.
+const maxLogBytes = 1 << 20
+
+// BundleOptions describes what goes into a support bundle.
+type BundleOptions struct {
+	// Monitor fetches the raw gateway responses.  If nil, the bundle
+	// omits them.
+	Monitor powerwall.Monitor
+	// Flags are the exporter's command line settings, by name.  Values of
+	// sensitive flags are redacted.
+	Flags map[string]string
+	// LogDir is where glog writes its log files.
+	LogDir string
+}
+
+// WriteBundle writes a gzipped tarball of diagnostic information to w.
+// Failures to fetch individual pieces are recorded in the bundle rather
+// than failing it, since a broken gateway is usually why a bundle is
+// wanted.
+func WriteBundle(w io.Writer, opts BundleOptions) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name string, contents []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(contents)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(contents)
+		return err
+	}
+	addJSON := func(name string, v interface{}) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, b)
+	}
+
+	if err := addJSON("version.json", version.Get()); err != nil {
+		return err
+	}
+	if err := addJSON("config.json", redactFlags(opts.Flags)); err != nil {
+		return err
+	}
+	var problems []string
+	if opts.Monitor != nil {
+		for _, ep := range powerwall.Endpoints {
+			name := "gateway" + ep + ".json"
+			raw, err := opts.Monitor.GetRaw(ep)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", ep, err))
+				continue
+			}
+			if err := add(name, Sanitize(raw)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, sev := range []string{"INFO", "WARNING", "ERROR"} {
+		b, err := tailLog(opts.LogDir, sev)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s log: %v", sev, err))
+			continue
+		}
+		if err := add("logs/"+sev+".log", b); err != nil {
+			return err
+		}
+	}
+	if err := add("problems.txt", []byte(strings.Join(problems, "\n"))); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Sanitize replaces the values of sensitive keys in a JSON document.  If
+// raw is not valid JSON it is returned unchanged.
+func Sanitize(raw []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return raw
+	}
+	b, err := json.MarshalIndent(scrub(v), "", "  ")
+	if err != nil {
+		return raw
+	}
+	return b
+}
+
+func scrub(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if sensitiveKeys[k] {
+				t[k] = kRedacted
+				continue
+			}
+			t[k] = scrub(child)
+		}
+		return t
+	case []interface{}:
+		for i, child := range t {
+			t[i] = scrub(child)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func redactFlags(flags map[string]string) map[string]string {
+	rval := make(map[string]string)
+	for name, value := range flags {
+		rval[name] = redactURL(value)
+		for _, s := range sensitiveFlags {
+			if strings.Contains(name, s) && value != "" {
+				rval[name] = kRedacted
+			}
+		}
+	}
+	return rval
+}
+
+// redactURL replaces the user and password of a URL valued flag, such as
+// --mqtt_broker, --remote_write_url or a redis --state_file, and returns
+// other values unchanged.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	u.User = url.User(kRedacted)
+	return u.String()
+}
+
+// tailLog returns the end of the most recent glog file of the given
+// severity.  glog keeps a symlink named program.SEVERITY pointing at it.
+func tailLog(dir, severity string) ([]byte, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := filepath.Join(dir, filepath.Base(os.Args[0])+"."+severity)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			glog.Errorf("closing %s: %v", name, err)
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > maxLogBytes {
+		if _, err := f.Seek(-maxLogBytes, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/support"
+	"os"
+)
+
+var bundleOut string
+
+func init() {
+	subcommands["support-bundle"] = &subcommand{
+		help: "write sanitized gateway responses, redacted config, version info and recent logs to a tarball for bug reports",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&bundleOut, "out", "bundle.tgz", "file to write the support bundle to")
+		},
+		run: writeSupportBundle,
+	}
+}
+
+func writeSupportBundle() error {
+	opts := support.BundleOptions{
+		Flags: flagValues(),
+	}
+	if f := flag.Lookup("log_dir"); f != nil {
+		opts.LogDir = f.Value.String()
+	}
+	// Without a gateway the bundle is still worth writing; the config
+	// and logs may say why.
+	if pwOpts, err := powerwallOptions(); err != nil {
+		glog.Errorf("Leaving the gateway's responses out of the bundle: %v", err)
+	} else if mon, err := powerwall.New(pwOpts); err != nil {
+		glog.Errorf("powerwall.New(): %v", err)
+	} else {
+		opts.Monitor = mon
+	}
+	f, err := os.Create(bundleOut)
+	if err != nil {
+		return err
+	}
+	if err := support.WriteBundle(f, opts); err != nil {
+		f.Close()
+		return fmt.Errorf("support.WriteBundle(): %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", bundleOut)
+	return nil
+}
@@ -0,0 +1,50 @@
+// Package version describes the build of the exporter.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Version and Revision may be set at link time, for example:
+//
+//	go build -ldflags "-X github.com/jeffbstewart/powerwall_prometheus_exporter/version.Version=1.2.3"
+//
+// If they are not, they are filled in from the module build info where
+// available.
+var (
+	Version  = ""
+	Revision = ""
+)
+
+// Info describes the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns information about the running binary.
+func Get() Info {
+	r := Info{
+		Version:   Version,
+		Revision:  Revision,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if r.Version == "" {
+			r.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" && r.Revision == "" {
+				r.Revision = s.Value
+			}
+		}
+	}
+	if r.Version == "" {
+		r.Version = "unknown"
+	}
+	return r
+}
@@ -2,11 +2,15 @@ package view
 
 import (
 	"fmt"
-	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/locale"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
 	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
 	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/powerwall/vitals"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/state"
 	"github.com/prometheus/client_golang/prometheus"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -18,6 +22,67 @@ type Options struct {
 	// Subsystem is part of the Prometheus hierarchy of namign.  It does not
 	// appear to affect the exported statistics.  Just set it to something.
 	Subsystem string
+	// Provider labels energy and cost metrics with the electricity
+	// provider, so multi-property setups can break them down by utility.
+	// If empty, the utility from the gateway's grid code is used.
+	Provider string
+	// Plan labels energy and cost metrics with the electricity plan or
+	// tariff.  If empty, there is no plan label.
+	Plan string
+	// ConventionalNames exports metrics under names that follow the
+	// Prometheus naming conventions, with base units, rather than the
+	// historical names.  See conventionalNames.
+	ConventionalNames bool
+	// InstanceID, if set, labels every metric with the exporter
+	// installation's ID.
+	InstanceID string
+	// LabelInstanceID asks the controller to fill in InstanceID.
+	LabelInstanceID bool
+	// NoSiteLabels leaves off the site, vin and gateway_din labels which
+	// otherwise tell apart the series from different sites.
+	NoSiteLabels bool
+	// JSONFile is where the json_file sink writes.
+	JSONFile string
+	// HistoryDB is the SQLite database the history sink records to.
+	HistoryDB string
+	// HistoryRetention is how long the history sink keeps each poll.
+	// Zero keeps them forever.
+	HistoryRetention time.Duration
+	// MQTTBroker is where the homeassistant sink publishes, as
+	// tcp://[user:password@]host[:port].
+	MQTTBroker string
+	// HomeAssistantPrefix is Home Assistant's MQTT discovery prefix.
+	// Empty means homeassistant.
+	HomeAssistantPrefix string
+	// RemoteWriteURL is where the remotewrite sink writes.
+	RemoteWriteURL string
+	// RemoteWriteToken, if set, is sent to RemoteWriteURL as a bearer
+	// token.
+	RemoteWriteToken string
+	// RemoteWriteBatch is how many polls the remotewrite sink sends in
+	// each request.  Less than 1 means 1.
+	RemoteWriteBatch int
+	// MeterResetFromZero says that when a meter's lifetime reading goes
+	// backwards, as some firmware updates do, the gateway started counting
+	// again from zero, so the new reading is added to cumulative_power.
+	// Otherwise the new reading is just the baseline for later growth.
+	MeterResetFromZero bool
+	// Timestamps stamps every metric read from the gateway with the time
+	// its poll began, so PromQL combining meters sees one instant rather
+	// than the scrape times.
+	Timestamps bool
+	// Locale is the language of the metric help text and the dashboard.
+	// The zero value is English.
+	Locale locale.Locale
+	// State, if set, keeps the cumulative counters across restarts, so a
+	// restart doesn't look like a counter reset to Prometheus.
+	State *state.Store
+}
+
+func init() {
+	RegisterSink("prometheus", func(fixed *model.FixedInfo, opts Options) (Sink, error) {
+		return New(fixed, opts)
+	})
 }
 
 const (
@@ -30,207 +95,366 @@ const (
 	kTruePower     = "truePower"
 	kReactivePower = "reactivePower"
 	kApparentPower = "apparentPower"
+	kType          = "type"
+	kValue         = "value"
+	kName          = "name"
+	kProvider      = "provider"
+	kPlan          = "plan"
+	kState         = "state"
+	kMode          = "mode"
+	kSerial        = "serial"
+	kDiagnostic    = "diagnostic"
+	kCheck         = "check"
+	kKind          = "kind"
+	kEndpoint      = "endpoint"
+	kMetric        = "metric"
+	kBasis         = "basis"
+	kCT            = "ct"
+	kMeterSerial   = "meter_serial"
+	kInstanceID    = "instance_id"
+	kSite          = "site"
+	kVIN           = "vin"
+	kDIN           = "din"
+	kGatewayDIN    = "gateway_din"
+	kComponent     = "component"
+	kVital         = "vital"
+	kAlert         = "alert"
+	kString        = "string"
+	kSensor        = "sensor"
+	kField         = "field"
+	kIndex         = "index"
+	kCurrency      = "currency"
+	kSource        = "source"
+	kWindow        = "window"
+	kVersion       = "version"
+	kGitHash       = "git_hash"
+	kDeviceType    = "device_type"
+	kSyncType      = "sync_type"
+	kGateway       = "gateway"
+	kIP            = "ip"
+	kHWAddress     = "hw_address"
+	kSSID          = "ssid"
+	kChannel       = "channel"
+	kDerived       = "derived"
+	kPeriod        = "period"
+	kPartNumber    = "part_number"
 )
 
+// tariffLabels returns the constant labels identifying the electricity
+// provider and plan, for energy and cost metrics.
+func tariffLabels(fixed *model.FixedInfo, opts Options) prometheus.Labels {
+	r := prometheus.Labels{}
+	provider := opts.Provider
+	if provider == "" {
+		provider = fixed.Utility
+	}
+	if provider != "" {
+		r[kProvider] = provider
+	}
+	if opts.Plan != "" {
+		r[kPlan] = opts.Plan
+	}
+	return r
+}
+
+// siteLabels are the labels every metric carries: the instance ID, and
+// the site's name and IDs unless Options.NoSiteLabels.
+func siteLabels(fixed *model.FixedInfo, opts Options) prometheus.Labels {
+	r := prometheus.Labels{}
+	if opts.InstanceID != "" {
+		r[kInstanceID] = opts.InstanceID
+	}
+	if opts.NoSiteLabels {
+		return r
+	}
+	for k, v := range map[string]string{kSite: fixed.SiteName, kVIN: fixed.VIN, kGatewayDIN: fixed.DIN} {
+		if v != "" {
+			r[k] = v
+		}
+	}
+	return r
+}
+
+// New returns a prometheus.Collector that reports the most recent snapshot
+// passed to Update, and registers it with the default registry.
 func New(fixed *model.FixedInfo, opts Options) (*PrometheusCounters, error) {
-	ss, ns := opts.Subsystem, opts.Namespace
-	r := &PrometheusCounters{
-		powerwallChargePercent: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "powerwall_charge_percent",
-			Help:      "percent of nominal powerwall power available for supply generation",
-		}),
-		nominalSystemEnergykWh: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "nominal_system_energy_kWh",
-			Help:      "nominal rated energy that can be delivered by the inverter.",
-		}),
-		nominalSystemPowerkW: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "nominal_system_power_kW",
-			Help:      "nominal rated power that can be delivered by the inverter.",
-		}),
-		numPowerwalls: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "num_powerwalls",
-			Help:      "Number of powerwall battery systems managed by the energy gateway",
-		}),
-		totalSolarRatingWatts: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "total_solar_rating_W",
-			Help:      "rated total power output of all solar arrays connected to the inverter",
-		}),
-		backupMode: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "operating_in_backup_only_mode",
-			Help:      "if 1, the powerwalls are only consumed for backup power",
-		}),
-		selfConsumptionMode: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "operating_in_self_consumption_mode",
-			Help:      "if 1, the powerwalls cycle between charging and discharing",
-		}),
-		backupReservePercent: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "backup_reserve_percent",
-			Help:      "Percent of battery capacity not used unless the grid is out",
-		}),
-		uptimeSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "uptime_seconds",
-			Help:      "Runtime of the Tesla energy gateway",
-		}),
-		majorVersion: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "major_version",
-			Help:      "The major version of the software in the Tesla energy gateway.  In version 1.2.3, the major version is the 1",
-		}),
-		minorVersion: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "minor_version",
-			Help:      "The minor version of the software in the Telsa energy gateway.  In version 1.2.3, the minor version is the 2",
-		}),
-		releaseVersion: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "release_version",
-			Help:      "The release version of the software in the Tesla energy gateway.  In version 1.2.3, the release version is the 3",
-		}),
-		flattenedVersion: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "flattened_version",
-			Help:      "The version of the software in the Tesla energy gateway, flattened.  Version 10.12.7 would be 10127",
-		}),
-		networkActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "network_active",
-			Help:      "if 1, the given network interface appears to be usable",
-		}, []string{kInterface}),
-		networkEnabled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "network_enabled",
-			Help:      "if 1, the given network interface is administratively enabled",
-		}, []string{kInterface}),
-		networkPrimary: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "network_primary",
-			Help:      "if 1, the given network interface is the preferred interface",
-		}, []string{kInterface}),
-		networkSignalStrength: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "network_signal_strength",
-			Help:      "signal to noise ratio in dB for the interface.  Only populated for cellular",
-		}, []string{kInterface}),
-		siteMasterRunning: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "sitemaster_running",
-			Help:      "if 1, the site master is running",
-		}),
-		siteMasterConnectedToTesla: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "site_master_connected_to_tesla",
-			Help:      "if 1, the site master can communicate with Tesla",
-		}),
-		siteMasterSupplyingPower: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "site_master_supplying_power",
-			Help:      "if 1, the site master is supplying power instead of the grid",
-		}),
-		instantPower: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "instant_power",
-			Help:      "power measured by the given meter at a moment in time",
-		}, []string{kMeter, kPowerType}),
-		cumulativePower: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "cumulative_power",
-			Help:      "cumulative power measured over the lifetime of the given meter, in units of kWh",
-		}, []string{kMeter, kDirection}),
-		instantAverageVoltage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "instant_average_voltage",
-			Help:      "electrical potential measured by the given meter at a moment in time, in units of volts",
-		}, []string{kMeter}),
-		instantTotalCurrent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "instant_total_current_amps",
-			Help:      "electrical current measured by the given meter at a moment in time, in units of amperes",
-		}, []string{kMeter}),
-		gridConnected: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "grid_connected",
-			Help:      "if 1, the grid is available to supply power",
-		}),
-		gridActive: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: ns,
-			Subsystem: ss,
-			Name:      "grid_active",
-			Help:      "if 1, the grid is actively supplying power",
-		}),
-	}
-	r.nominalSystemEnergykWh.Set(fixed.NominalSystemEnergykWh)
-	r.nominalSystemPowerkW.Set(fixed.NominalSystemPowerkW)
-	r.numPowerwalls.Set(float64(fixed.NumPowerwalls))
-	r.totalSolarRatingWatts.Set(float64(fixed.TotalSolarPowerRatingWatts))
+	r := newCounters(fixed, opts)
+	if err := r.restore(); err != nil {
+		return nil, fmt.Errorf("restore(): %v", err)
+	}
+	if err := prometheus.Register(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	cols := []prometheus.Collector{
-		r.powerwallChargePercent,
-		r.nominalSystemEnergykWh,
-		r.nominalSystemPowerkW,
-		r.numPowerwalls,
-		r.totalSolarRatingWatts,
-		r.backupMode,
-		r.selfConsumptionMode,
-		r.backupReservePercent,
-		r.uptimeSeconds,
-		r.majorVersion,
-		r.minorVersion,
-		r.releaseVersion,
-		r.flattenedVersion,
-		r.networkActive,
-		r.networkEnabled,
-		r.networkPrimary,
-		r.networkSignalStrength,
-		r.siteMasterRunning,
-		r.siteMasterConnectedToTesla,
-		r.siteMasterSupplyingPower,
-		r.instantPower,
-		r.cumulativePower,
-		r.instantAverageVoltage,
-		r.instantTotalCurrent,
-		r.gridConnected,
-		r.gridActive,
-	}
-	for _, c := range cols {
-		if err := prometheus.Register(c); err != nil {
-			return nil, err
+// NewCollector is like New, but leaves registering the collector to the
+// caller, for when it should go in a registry of its own.
+func NewCollector(fixed *model.FixedInfo, opts Options) *PrometheusCounters {
+	return newCounters(fixed, opts)
+}
+
+// metricName is the full name the metric with the given historical name is
+// exported under with opts.
+func metricName(opts Options, name string) string {
+	if c, ok := conventionalNames[name]; ok && opts.ConventionalNames {
+		name = c.name
+	}
+	return prometheus.BuildFQName(opts.Namespace, opts.Subsystem, name)
+}
+
+func newCounters(fixed *model.FixedInfo, opts Options) *PrometheusCounters {
+	r := &PrometheusCounters{
+		store:      opts.State,
+		fromZero:   opts.MeterResetFromZero,
+		timestamps: opts.Timestamps,
+		fixed:      *fixed,
+		scale:      make(map[*prometheus.Desc]float64),
+	}
+	common := siteLabels(fixed, opts)
+	constDesc := func(typ string, constLabels prometheus.Labels, name, help string, labels ...string) *prometheus.Desc {
+		c, rename := conventionalNames[name]
+		if len(common) > 0 {
+			l := prometheus.Labels{}
+			for k, v := range common {
+				l[k] = v
+			}
+			for k, v := range constLabels {
+				l[k] = v
+			}
+			constLabels = l
 		}
+		fqName := metricName(opts, name)
+		// The schema keeps the English help, which schema diffs match on.
+		d := prometheus.NewDesc(fqName, opts.Locale.Help(name, help), labels, constLabels)
+		if rename && opts.ConventionalNames && c.scale != 0 {
+			r.scale[d] = c.scale
+		}
+		r.descs = append(r.descs, d)
+		r.schema = append(r.schema, newMetricSchema(typ, fqName, help, constLabels, labels))
+		return d
+	}
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return constDesc(kGaugeType, nil, name, help, labels...)
+	}
+	counterDesc := func(constLabels prometheus.Labels, name, help string, labels ...string) *prometheus.Desc {
+		return constDesc(kCounterType, constLabels, name, help, labels...)
+	}
+	histogramDesc := func(name, help string) *prometheus.Desc {
+		return constDesc(kHistogramType, nil, name, help)
 	}
+	tariff := tariffLabels(fixed, opts)
+	r.powerwallChargePercent = desc("powerwall_charge_percent",
+		"percent of nominal powerwall power available for supply generation")
+	r.appChargePercent = desc("app_charge_percent",
+		"powerwall charge percent as the Tesla app shows it, which hides a reserve at the bottom of the battery")
+	r.appPower = desc("app_power_kw",
+		"power as the Tesla app's home screen shows it, in kW to one decimal place.  powerwall is positive when discharging, grid when importing", kMeter)
+	r.energyRemaining = desc("energy_remaining_watt_hours",
+		"energy left in the powerwalls, from the raw charge percent or as the Tesla app computes it", kBasis)
+	r.energyRemainingDiscrepancy = desc("energy_remaining_discrepancy_watt_hours",
+		"how much more energy the raw charge percent implies than the Tesla app shows")
+	r.nominalSystemEnergykWh = desc("nominal_system_energy_kWh",
+		"nominal rated energy that can be delivered by the inverter.")
+	r.nominalSystemPowerkW = desc("nominal_system_power_kW",
+		"nominal rated power that can be delivered by the inverter.")
+	r.maxSiteMeterPowerkW = desc("max_site_meter_power_kW",
+		"most power the site meter is rated to carry, for alerting before the service entrance or gateway is overloaded")
+	r.siteUtilization = desc("site_power_utilization_ratio",
+		"site meter power as a fraction of max_site_meter_power_kW.  Negative when exporting")
+	r.offGridSolarCapable = desc("offgrid_solar_capable",
+		"1 if the grid code's name matches a standard that requires solar inverters to respond to frequency shifts, so solar can likely keep running during an outage.  A heuristic: it doesn't check how the inverters are configured")
+	r.frequencyShift = desc("frequency_shift_setting",
+		"grid code overrides tuning the frequency shift the powerwalls use to curtail solar while off grid", kName)
+	r.numPowerwalls = desc("num_powerwalls",
+		"Number of powerwall battery systems managed by the energy gateway")
+	r.totalSolarRatingWatts = desc("total_solar_rating_W",
+		"rated total power output of all solar arrays connected to the inverter")
+	r.operatingMode = desc("operating_mode",
+		"1 for the mode the powerwalls are operating in, 0 for the others.  In backup mode the powerwalls are only consumed for backup power; in self_consumption mode they cycle between charging and discharging", kMode)
+	r.backupReservePercent = desc("backup_reserve_percent",
+		"Percent of battery capacity not used unless the grid is out")
+	r.freqShiftSOE = desc("freq_shift_load_shed_soe_percent",
+		"Off grid, the charge percent above which the gateway shifts its frequency to curtail solar")
+	r.freqShiftDeltaF = desc("freq_shift_load_shed_delta_f_hz",
+		"Off grid, how far the gateway shifts its frequency to curtail solar")
+	r.uptimeSeconds = desc("uptime_seconds",
+		"Runtime of the Tesla energy gateway")
+	r.majorVersion = desc("major_version",
+		"The major version of the software in the Tesla energy gateway.  In version 1.2.3, the major version is the 1")
+	r.minorVersion = desc("minor_version",
+		"The minor version of the software in the Telsa energy gateway.  In version 1.2.3, the minor version is the 2")
+	r.releaseVersion = desc("release_version",
+		"The release version of the software in the Tesla energy gateway.  In version 1.2.3, the release version is the 3")
+	r.flattenedVersion = desc("flattened_version",
+		"The version of the software in the Tesla energy gateway, flattened.  Version 10.12.7 would be 10127")
+	r.buildInfo = desc("build_info",
+		"1, labeled with the gateway's full software version, git hash, device type and sync type", kVersion, kGitHash, kDeviceType, kSyncType)
+	r.energyFlows = make(map[[2]string]*prometheus.Desc)
+	for _, route := range model.EnergyFlowRoutes {
+		r.energyFlows[route] = desc(fmt.Sprintf("%s_to_%s_w", route[0], route[1]),
+			fmt.Sprintf("power flowing from the %s to the %s, as the Tesla app shows it", route[0], route[1]))
+	}
+	r.overlayValue = desc("overlay_value",
+		"a field read as described by the schema overlay, for firmware this exporter doesn't know yet", kEndpoint, kField, kIndex)
+	r.apiDeprecationWarning = desc("api_deprecation_warning",
+		"1 if the gateway's firmware is known to have removed or changed the given endpoint", kEndpoint)
+	r.networkActive = desc("network_active",
+		"if 1, the given network interface appears to be usable", kInterface)
+	r.networkEnabled = desc("network_enabled",
+		"if 1, the given network interface is administratively enabled", kInterface)
+	r.networkPrimary = desc("network_primary",
+		"if 1, the given network interface is the preferred interface", kInterface)
+	r.networkSignalStrength = desc("network_signal_strength",
+		"signal to noise ratio in dB for the interface.  Only populated for cellular", kInterface)
+	r.networkInfo = desc("network_info",
+		"1 for each IP address of the given network interface, labeled with the address, default gateway, hardware address and connection state, to follow connectivity changes over time", kInterface, kIP, kGateway, kHWAddress, kState)
+	r.networkDHCP = desc("network_dhcp",
+		"if 1, the given network interface's address is assigned by DHCP; if 0, it is static", kInterface)
+	r.wifiRSSI = desc("wifi_rssi_dbm",
+		"received signal strength in dBm of the Wi-Fi network the gateway is joined to.  Below about -75 the connection is unreliable")
+	r.wifiInfo = desc("wifi_info",
+		"1, labeled with the SSID and channel of the Wi-Fi network the gateway is joined to", kSSID, kChannel)
+	r.wifiScanRSSI = desc("wifi_scan_rssi_dbm",
+		"received signal strength in dBm of each Wi-Fi network the gateway can see", kSSID, kChannel)
+	r.siteMasterRunning = desc("sitemaster_running",
+		"if 1, the site master is running")
+	r.siteMasterConnectedToTesla = desc("site_master_connected_to_tesla",
+		"if 1, the site master can communicate with Tesla")
+	r.siteMasterSupplyingPower = desc("site_master_supplying_power",
+		"if 1, the site master is supplying power instead of the grid")
+	r.instantPower = desc("instant_power",
+		"power measured by the given meter at a moment in time", kMeter, kPowerType)
+	r.cumulativePower = counterDesc(tariff, "cumulative_power",
+		"cumulative energy measured over the lifetime of the given meter, in units of Wh", kMeter, kDirection)
+	r.instantAverageVoltage = desc("instant_average_voltage",
+		"electrical potential measured by the given meter at a moment in time, in units of volts", kMeter)
+	r.instantTotalCurrent = desc("instant_total_current_amps",
+		"electrical current measured by the given meter at a moment in time, in units of amperes", kMeter)
+	r.revenueEnergy = counterDesc(tariff, "revenue_meter_energy_kwh_total",
+		"lifetime energy through the given revenue grade meter, from /meters/readings, which diverges slightly from cumulative_power", kMeter, kMeterSerial, kDirection)
+	r.gridFrequency = histogramDesc("grid_frequency_hz",
+		"grid frequency at the site meter over every poll while on grid, bucketed around the nominal 50 or 60 Hz")
+	r.gridVoltage = histogramDesc("grid_voltage_volts",
+		"average grid voltage at the site meter over every poll while on grid, bucketed within 1% to 10% of the nominal voltage")
+	r.ctRealPower = desc("ct_real_power_watts",
+		"real power measured by the given current transformer clamp", kMeter, kMeterSerial, kCT)
+	r.ctVoltage = desc("ct_voltage_volts",
+		"line to neutral voltage at the given current transformer clamp", kMeter, kMeterSerial, kCT)
+	r.ctCurrent = desc("ct_current_amperes",
+		"current measured by the given current transformer clamp", kMeter, kMeterSerial, kCT)
+	r.deviceVital = desc("device_vital",
+		"numeric vital reported by the given device in /devices/vitals, such as THC_AmbientTemp", kDIN, kComponent, kVital)
+	r.deviceAlert = desc("device_alert",
+		"1 for each alert the given device has raised", kDIN, kAlert)
+	r.pvStringVoltage = desc("pv_string_voltage",
+		"voltage of the given solar string, in volts", kDIN, kString)
+	r.pvStringCurrent = desc("pv_string_current",
+		"current from the given solar string, in amperes", kDIN, kString)
+	r.pvStringPower = desc("pv_string_power",
+		"power from the given solar string, in watts", kDIN, kString)
+	r.temperature = desc("temperature_celsius",
+		"temperature reported by the given sensor, such as an inverter heat sink or the ambient air, to make thermal derating visible", kSerial, kComponent, kSensor)
+	r.gridConnected = desc("grid_connected",
+		"if 1, the grid is available to supply power")
+	r.gridActive = desc("grid_active",
+		"if 1, the grid is actively supplying power")
+	r.gridStatus = desc("grid_status",
+		"1 for the grid status the gateway reports, 0 for the others", kState)
+	r.powerwallGridState = desc("powerwall_grid_state",
+		"1 for the grid compliance state the given powerwall reports, 0 for the others", kSerial, kState)
+	r.underPhaseDetection = desc("powerwall_under_phase_detection",
+		"if 1, the given powerwall is running phase detection", kSerial)
+	r.powerwallInfo = desc("powerwall_info",
+		"1 for each powerwall, labeled with its part number and type, so hardware swaps show up in the history", kSerial, kPartNumber, kType)
+	r.gatewayInfo = desc("gateway_info",
+		"1, labeled with the gateway's DIN and the part and serial numbers it is made of, so a replacement gateway shows up in the history", kDIN, kPartNumber, kSerial)
+	r.powerwallUpdating = desc("powerwall_updating",
+		"if 1, the given powerwall is updating its firmware", kSerial)
+	r.diagnosticCheckFailed = desc("powerwall_diagnostic_check_failed",
+		"1 for each diagnostic check the given powerwall last failed", kSerial, kDiagnostic, kCheck)
+	r.updating = desc("updating",
+		"if 1, the gateway is updating powerwall firmware")
+	r.enumerating = desc("enumerating",
+		"if 1, the gateway is discovering the powerwalls attached to it")
+	r.gridQualifying = desc("grid_qualifying",
+		"if 1, the gateway is checking that the grid is fit to reconnect to")
+	r.gridCodeValidating = desc("grid_code_validating",
+		"if 1, the gateway is validating its grid code settings")
+	r.bubbleShedding = desc("bubble_shedding",
+		"if 1, the gateway is shedding load while islanded")
+	r.gridFaults = desc("grid_faults",
+		"number of faults in the gateway's grid fault history")
+	r.gridFaultsByName = desc("grid_faults_by_name",
+		"number of faults in the gateway's grid fault history with the given alert name", kName)
+	r.lastGridFaultTimestamp = desc("last_grid_fault_timestamp_seconds",
+		"unix time of the most recent fault in the gateway's grid fault history")
+	r.backupEvents = desc("backup_events",
+		"number of events in Tesla's backup history, the times the site has run on its batteries without the grid.  Tesla drops old events, so this can go down.  Only the cloud backend reports it")
+	r.lastBackupEvent = desc("last_backup_event_timestamp_seconds",
+		"unix time the most recent event in Tesla's backup history began")
+	r.soeGapChangePercent = desc("soe_gap_change_percent",
+		"change in powerwall charge percent across the most recent gap in polling")
+	r.soeGapSeconds = desc("soe_gap_seconds",
+		"length of the most recent gap in polling")
+	r.soeGapEndTimestamp = desc("soe_gap_end_timestamp_seconds",
+		"unix time at which the most recent gap in polling ended")
+	r.todayEnergy = desc("daily_energy_kwh",
+		"energy through each meter so far today, in the gateway's time zone, as the gateway reports it or as the exporter works it out from the lifetime readings", kMeter, kDirection, kSource)
+	r.selfPowered = desc("self_powered_percent",
+		"percent of today's home usage supplied by solar and the battery rather than the grid, as the Tesla app's daily view shows it")
+	r.gridCost = counterDesc(tariff, "grid_cost_total",
+		"estimated cost of the energy bought from the grid under the configured tariff, since the exporter's state began", kCurrency)
+	r.exportCredit = counterDesc(tariff, "export_credit_total",
+		"estimated credit for the energy sold to the grid under the configured tariff, since the exporter's state began", kCurrency)
+	r.tariffPeriod = desc("tariff_period",
+		"1 for the tariff period in effect", kPeriod)
+	r.dailyEnergy = desc("daily_summary_energy_watt_hours",
+		"energy of the given kind over the most recent complete local day", kKind)
+	r.dailyBatteryCycles = desc("daily_summary_battery_cycles",
+		"battery discharge over the most recent complete local day, as a fraction of nominal system energy")
+	r.dailyTimestamp = desc("daily_summary_timestamp_seconds",
+		"unix time of the midnight starting the day the daily summary covers")
+	r.smoothed = desc("smoothed_value",
+		"the given metric after smoothing out noise", kMetric)
+	r.counterResets = counterDesc(nil, "counter_resets_total",
+		"number of times the given meter's lifetime reading went backwards, as after some firmware updates", kMeter, kDirection)
+	r.gridOutages = counterDesc(nil, "grid_outages_total",
+		"number of times the site went off grid, since the exporter's state began")
+	r.timeIslanded = counterDesc(nil, "time_islanded_seconds_total",
+		"time the site has spent off grid while the exporter was watching")
+	r.lastOutage = desc("last_outage_timestamp_seconds",
+		"unix time the most recent grid outage began")
+	r.sheddingSpells = counterDesc(nil, "bubble_shedding_spells_total",
+		"number of times the gateway started shedding load while islanded, since the exporter's state began")
+	r.sheddingSeconds = counterDesc(nil, "bubble_shedding_seconds_total",
+		"time the gateway has spent shedding load while islanded while the exporter was watching")
+	r.sheddingSince = desc("bubble_shedding_since_timestamp_seconds",
+		"unix time the gateway began shedding load, while it is.  See bubble_shedding for the current state")
+	r.recordIslanded = desc("record_longest_islanded_seconds",
+		"longest single stretch the site has spent off grid, over all time or the last 30 days", kWindow)
+	r.recordMinCharge = desc("record_min_charge_percent",
+		"lowest powerwall charge percent seen, over all time or the last 30 days", kWindow)
+	r.recordMaxBattery = desc("record_max_battery_discharge_watts",
+		"most power the battery has supplied, over all time or the last 30 days", kWindow)
+	r.soeChangeRate = desc("soe_change_percent_per_hour",
+		"rate the powerwall charge percent is changing, fitted over the configured window")
+	r.batteryRamp = desc("battery_power_ramp_watts_per_second",
+		"rate the battery's power is changing, fitted over the configured window")
+	r.unknownEnumValues = counterDesc(nil, "unknown_enum_values_total",
+		"number of times the gateway reported an enumeration value this exporter does not recognize", kType, kValue)
+	r.snapshotTimestamp = desc("snapshot_timestamp_seconds",
+		"unix time the poll the exported values come from began")
+	r.cacheAgeSeconds = desc("cache_age_seconds",
+		"time since the exported values were last refreshed from the gateway")
+
+	r.unknownCounts = make(map[powerwall.UnknownValue]float64)
+	r.frequencies = newFrequencyHistogram(fixed.NominalFrequencyHz)
+	r.voltages = newVoltageHistogram()
+	r.countUnknown(fixed.UnknownEnumValues)
 	r.priorCumulative = make(map[model.MeterType]map[string]float64)
+	r.cumulative = make(map[model.MeterType]map[string]float64)
+	r.resets = make(map[model.MeterType]map[string]float64)
 	for _, mt := range []model.MeterType{
 		model.Total,
 		model.Solar,
@@ -238,118 +462,543 @@ func New(fixed *model.FixedInfo, opts Options) (*PrometheusCounters, error) {
 		model.Load,
 	} {
 		r.priorCumulative[mt] = make(map[string]float64)
+		r.cumulative[mt] = make(map[string]float64)
+		r.resets[mt] = make(map[string]float64)
 	}
-	return r, nil
+	return r
 }
 
+// PrometheusCounters is a prometheus.Collector which generates metrics
+// from the most recent snapshot at scrape time.
 type PrometheusCounters struct {
-	powerwallChargePercent     prometheus.Gauge
-	nominalSystemEnergykWh     prometheus.Gauge
-	nominalSystemPowerkW       prometheus.Gauge
-	numPowerwalls              prometheus.Gauge
-	totalSolarRatingWatts      prometheus.Gauge
-	backupMode                 prometheus.Gauge
-	selfConsumptionMode        prometheus.Gauge
-	backupReservePercent       prometheus.Gauge
-	uptimeSeconds              prometheus.Gauge
-	majorVersion               prometheus.Gauge
-	minorVersion               prometheus.Gauge
-	releaseVersion             prometheus.Gauge
-	flattenedVersion           prometheus.Gauge
-	networkActive              *prometheus.GaugeVec
-	networkEnabled             *prometheus.GaugeVec
-	networkPrimary             *prometheus.GaugeVec
-	networkSignalStrength      *prometheus.GaugeVec
-	siteMasterRunning          prometheus.Gauge
-	siteMasterConnectedToTesla prometheus.Gauge
-	siteMasterSupplyingPower   prometheus.Gauge
-	instantPower               *prometheus.GaugeVec
-	priorCumulative            map[model.MeterType]map[string] /* direction*/ float64
-	cumulativePower            *prometheus.CounterVec
-	instantAverageVoltage      *prometheus.GaugeVec
-	instantTotalCurrent        *prometheus.GaugeVec
-	gridConnected              prometheus.Gauge
-	gridActive                 prometheus.Gauge
+	powerwallChargePercent     *prometheus.Desc
+	appChargePercent           *prometheus.Desc
+	appPower                   *prometheus.Desc
+	energyRemaining            *prometheus.Desc
+	energyRemainingDiscrepancy *prometheus.Desc
+	nominalSystemEnergykWh     *prometheus.Desc
+	nominalSystemPowerkW       *prometheus.Desc
+	maxSiteMeterPowerkW        *prometheus.Desc
+	offGridSolarCapable        *prometheus.Desc
+	frequencyShift             *prometheus.Desc
+	siteUtilization            *prometheus.Desc
+	numPowerwalls              *prometheus.Desc
+	totalSolarRatingWatts      *prometheus.Desc
+	operatingMode              *prometheus.Desc
+	backupReservePercent       *prometheus.Desc
+	freqShiftSOE               *prometheus.Desc
+	freqShiftDeltaF            *prometheus.Desc
+	uptimeSeconds              *prometheus.Desc
+	majorVersion               *prometheus.Desc
+	minorVersion               *prometheus.Desc
+	releaseVersion             *prometheus.Desc
+	flattenedVersion           *prometheus.Desc
+	buildInfo                  *prometheus.Desc
+	apiDeprecationWarning      *prometheus.Desc
+	overlayValue               *prometheus.Desc
+	energyFlows                map[[2]string]*prometheus.Desc
+	networkActive              *prometheus.Desc
+	networkEnabled             *prometheus.Desc
+	networkPrimary             *prometheus.Desc
+	networkSignalStrength      *prometheus.Desc
+	networkInfo                *prometheus.Desc
+	networkDHCP                *prometheus.Desc
+	wifiRSSI                   *prometheus.Desc
+	wifiInfo                   *prometheus.Desc
+	wifiScanRSSI               *prometheus.Desc
+	siteMasterRunning          *prometheus.Desc
+	siteMasterConnectedToTesla *prometheus.Desc
+	siteMasterSupplyingPower   *prometheus.Desc
+	instantPower               *prometheus.Desc
+	cumulativePower            *prometheus.Desc
+	instantAverageVoltage      *prometheus.Desc
+	instantTotalCurrent        *prometheus.Desc
+	ctRealPower                *prometheus.Desc
+	ctVoltage                  *prometheus.Desc
+	ctCurrent                  *prometheus.Desc
+	deviceVital                *prometheus.Desc
+	deviceAlert                *prometheus.Desc
+	pvStringVoltage            *prometheus.Desc
+	pvStringCurrent            *prometheus.Desc
+	pvStringPower              *prometheus.Desc
+	temperature                *prometheus.Desc
+	gridConnected              *prometheus.Desc
+	gridActive                 *prometheus.Desc
+	gridStatus                 *prometheus.Desc
+	gridFaults                 *prometheus.Desc
+	updating                   *prometheus.Desc
+	enumerating                *prometheus.Desc
+	gridQualifying             *prometheus.Desc
+	gridCodeValidating         *prometheus.Desc
+	bubbleShedding             *prometheus.Desc
+	powerwallGridState         *prometheus.Desc
+	underPhaseDetection        *prometheus.Desc
+	powerwallUpdating          *prometheus.Desc
+	powerwallInfo              *prometheus.Desc
+	gatewayInfo                *prometheus.Desc
+	diagnosticCheckFailed      *prometheus.Desc
+	gridFaultsByName           *prometheus.Desc
+	lastGridFaultTimestamp     *prometheus.Desc
+	backupEvents               *prometheus.Desc
+	lastBackupEvent            *prometheus.Desc
+	revenueEnergy              *prometheus.Desc
+	gridFrequency              *prometheus.Desc
+	gridVoltage                *prometheus.Desc
+	soeGapChangePercent        *prometheus.Desc
+	soeGapSeconds              *prometheus.Desc
+	soeGapEndTimestamp         *prometheus.Desc
+	dailyEnergy                *prometheus.Desc
+	todayEnergy                *prometheus.Desc
+	gridCost                   *prometheus.Desc
+	exportCredit               *prometheus.Desc
+	tariffPeriod               *prometheus.Desc
+	selfPowered                *prometheus.Desc
+	dailyBatteryCycles         *prometheus.Desc
+	dailyTimestamp             *prometheus.Desc
+	smoothed                   *prometheus.Desc
+	counterResets              *prometheus.Desc
+	soeChangeRate              *prometheus.Desc
+	recordIslanded             *prometheus.Desc
+	recordMinCharge            *prometheus.Desc
+	recordMaxBattery           *prometheus.Desc
+	batteryRamp                *prometheus.Desc
+	gridOutages                *prometheus.Desc
+	sheddingSpells             *prometheus.Desc
+	sheddingSeconds            *prometheus.Desc
+	sheddingSince              *prometheus.Desc
+	timeIslanded               *prometheus.Desc
+	lastOutage                 *prometheus.Desc
+	unknownEnumValues          *prometheus.Desc
+	cacheAgeSeconds            *prometheus.Desc
+	snapshotTimestamp          *prometheus.Desc
+	descs                      []*prometheus.Desc
+	// scale converts values to the units in the metric name, for metrics
+	// whose conventional name has a different unit than the historical one.
+	scale map[*prometheus.Desc]float64
+	// schema describes every metric the collector can export.
+	schema []MetricSchema
+
+	fixed    model.FixedInfo
+	store    *state.Store
+	fromZero bool
+	// timestamps stamps the metrics from each poll with its time.
+	timestamps bool
+
+	// mu guards everything below, which Update writes and Collect reads.
+	mu              sync.Mutex
+	latest          *model.TeslaEnergyGatewayMetrics
+	flatVersion     float64
+	lastUpdate      time.Time
+	priorCumulative map[model.MeterType]map[string] /* direction*/ float64
+	cumulative      map[model.MeterType]map[string] /* direction*/ float64
+	resets          map[model.MeterType]map[string] /* direction*/ float64
+	unknownCounts   map[powerwall.UnknownValue]float64
+	frequencies     *gridHistogram
+	voltages        *gridHistogram
+	// lastSave is when Update last wrote the cumulative counters.
+	lastSave time.Time
+}
+
+func (p *PrometheusCounters) countUnknown(values []powerwall.UnknownValue) {
+	for _, u := range values {
+		p.unknownCounts[u]++
+	}
+}
+
+const kCumulativeKey = "cumulative_counters"
+
+// kSaveInterval is how often Update writes the cumulative counters to the
+// state store.  Close writes them too, so only a crash loses the rest.
+const kSaveInterval = time.Minute
+
+// savedCumulative is how the cumulative counters are kept in the state
+// store.
+type savedCumulative struct {
+	Prior      map[model.MeterType]map[string]float64 `json:"prior"`
+	Cumulative map[model.MeterType]map[string]float64 `json:"cumulative"`
+	Resets     map[model.MeterType]map[string]float64 `json:"resets"`
+}
+
+// restore picks up the cumulative counters where the last run left them.
+func (p *PrometheusCounters) restore() error {
+	if p.store == nil {
+		return nil
+	}
+	var saved savedCumulative
+	ok, err := p.store.Get(kCumulativeKey, &saved)
+	if err != nil || !ok {
+		return err
+	}
+	for mt, dirs := range saved.Cumulative {
+		if _, ok := p.cumulative[mt]; !ok {
+			continue
+		}
+		for dir, v := range dirs {
+			p.cumulative[mt][dir] = v
+			p.priorCumulative[mt][dir] = saved.Prior[mt][dir]
+			p.resets[mt][dir] = saved.Resets[mt][dir]
+		}
+	}
+	return nil
 }
 
+// accumulate adds the growth of a lifetime meter reading to the exported
+// counter.  A decrease is a reset of the meter; see
+// Options.MeterResetFromZero.
+func (p *PrometheusCounters) accumulate(mt model.MeterType, direction string, reading float64) {
+	delta := reading - p.priorCumulative[mt][direction]
+	p.priorCumulative[mt][direction] = reading
+	const epsilon = 0.00001
+	if delta >= 0 {
+		p.cumulative[mt][direction] += delta
+		return
+	}
+	if delta > -epsilon {
+		return
+	}
+	p.resets[mt][direction]++
+	if p.fromZero {
+		p.cumulative[mt][direction] += reading
+	}
+	logthrottle.Warningf(fmt.Sprintf("decrease %s %s", mt, direction), "Meter %s cumulative energy %s reset: went back %.4f Wh to %.4f Wh", mt, direction, -delta, reading)
+}
+
+// Update replaces the snapshot reported by Collect.
 func (p *PrometheusCounters) Update(m *model.TeslaEnergyGatewayMetrics) error {
-	p.powerwallChargePercent.Set(m.PowerwallChargePercent)
-	if m.Mode == powerwall.Backup {
-		p.backupMode.Set(1)
-	} else {
-		p.backupMode.Set(0)
-	}
-	if m.Mode == powerwall.SelfConsumption {
-		p.selfConsumptionMode.Set(1)
-	} else {
-		p.selfConsumptionMode.Set(0)
-	}
-	// not sure what to do with Autonomous, Scheduler, or SiteControl.
-	// Is Scheduler "use the power on this schedule" mode?
-	// If so, that might make a useful export.
-	p.backupReservePercent.Set(m.BackupReservePercent)
-	p.uptimeSeconds.Set(float64(m.Uptime) / float64(time.Second))
-	p.majorVersion.Set(float64(m.Version.Major))
-	p.minorVersion.Set(float64(m.Version.Minor))
-	p.releaseVersion.Set(float64(m.Version.Release))
 	fs := fmt.Sprintf("%02d%02d%02d", m.Version.Major, m.Version.Minor, m.Version.Release)
 	flat, err := strconv.ParseInt(fs, 10, 64)
 	if err != nil {
 		return err
 	}
-	p.flattenedVersion.Set(float64(flat))
-	boolToFloat := func(b bool) float64 {
-		if b {
-			return 1
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for mt, meter := range m.Meters {
+		p.accumulate(mt, kTo, meter.CumulativeEnergyTo)
+		p.accumulate(mt, kFrom, meter.CumulativeEnergyFrom)
+	}
+	// The counters are already ahead of the store, so a failed save
+	// mustn't hold back the snapshot too; the next one will catch up.
+	now := time.Now()
+	if p.store != nil && now.Sub(p.lastSave) >= kSaveInterval {
+		p.lastSave = now
+		if err := p.save(); err != nil {
+			logthrottle.Errorf("save cumulative", "%v", err)
+		}
+	}
+	p.countUnknown(m.UnknownEnumValues)
+	if site, ok := m.Meters[model.Total]; ok && m.GridConnected {
+		p.frequencies.observe(site.Frequency)
+		p.voltages.observe(site.InstantAverageVoltage)
+	}
+	p.latest = m
+	p.flatVersion = float64(flat)
+	p.lastUpdate = now
+	return nil
+}
+
+// save writes the cumulative counters to the state store.  p.mu must be
+// held.
+func (p *PrometheusCounters) save() error {
+	saved := savedCumulative{Prior: p.priorCumulative, Cumulative: p.cumulative, Resets: p.resets}
+	if err := p.store.Put(kCumulativeKey, saved); err != nil {
+		return fmt.Errorf("saving cumulative counters: %v", err)
+	}
+	return nil
+}
+
+// Close saves the cumulative counters, which Update only saves every
+// kSaveInterval.
+func (p *PrometheusCounters) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.store == nil || p.lastSave.IsZero() {
+		return nil
+	}
+	return p.save()
+}
+
+// Describe implements prometheus.Collector.
+func (p *PrometheusCounters) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range p.descs {
+		ch <- d
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Collect implements prometheus.Collector.
+func (p *PrometheusCounters) Collect(ch chan<- prometheus.Metric) {
+	// stamp, once set, is the time of the poll the metrics being sent came
+	// from.
+	var stamp time.Time
+	send := func(d *prometheus.Desc, vt prometheus.ValueType, v float64, labels ...string) {
+		if s, ok := p.scale[d]; ok {
+			v *= s
+		}
+		m := prometheus.MustNewConstMetric(d, vt, v, labels...)
+		if !stamp.IsZero() {
+			m = prometheus.NewMetricWithTimestamp(stamp, m)
+		}
+		ch <- m
+	}
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		send(d, prometheus.GaugeValue, v, labels...)
+	}
+	counter := func(d *prometheus.Desc, v float64, labels ...string) {
+		send(d, prometheus.CounterValue, v, labels...)
+	}
+	histogram := func(d *prometheus.Desc, h *gridHistogram) {
+		b := h.buckets()
+		if b == nil {
+			return
 		}
-		return 0
+		m := prometheus.MustNewConstHistogram(d, h.count, h.sum, b)
+		if !stamp.IsZero() {
+			m = prometheus.NewMetricWithTimestamp(stamp, m)
+		}
+		ch <- m
+	}
+	gauge(p.nominalSystemEnergykWh, p.fixed.NominalSystemEnergykWh)
+	gauge(p.nominalSystemPowerkW, p.fixed.NominalSystemPowerkW)
+	if p.fixed.MaxSiteMeterPowerkW > 0 {
+		gauge(p.maxSiteMeterPowerkW, p.fixed.MaxSiteMeterPowerkW)
+	}
+	gauge(p.numPowerwalls, float64(p.fixed.NumPowerwalls))
+	gauge(p.offGridSolarCapable, boolToFloat(p.fixed.OffGridSolarCapable))
+	for name, v := range p.fixed.FrequencyShiftSettings {
+		gauge(p.frequencyShift, v, name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for u, n := range p.unknownCounts {
+		counter(p.unknownEnumValues, n, u.Type, u.Value)
+	}
+	m := p.latest
+	if m == nil {
+		return
+	}
+	gauge(p.cacheAgeSeconds, time.Now().Sub(p.lastUpdate).Seconds())
+	gauge(p.snapshotTimestamp, float64(m.PolledAt.UnixNano())/1e9)
+	if p.timestamps {
+		stamp = m.PolledAt
+	}
+	gauge(p.powerwallChargePercent, m.PowerwallChargePercent)
+	gauge(p.appChargePercent, m.AppChargePercent())
+	for _, a := range m.AppPowers() {
+		gauge(p.appPower, a.KW, a.Name)
+	}
+	gauge(p.energyRemaining, m.EnergyRemainingWh(), "raw")
+	gauge(p.energyRemaining, m.AppEnergyRemainingWh(), "app")
+	gauge(p.energyRemainingDiscrepancy, m.EnergyRemainingWh()-m.AppEnergyRemainingWh())
+	if u, ok := m.SitePowerUtilization(); ok {
+		gauge(p.siteUtilization, u)
+	}
+	for _, mode := range powerwall.OperatingModes {
+		gauge(p.operatingMode, boolToFloat(m.Mode == mode), string(mode))
+	}
+	if !m.Mode.Known() {
+		gauge(p.operatingMode, 1, string(m.Mode))
+	}
+	gauge(p.backupReservePercent, m.BackupReservePercent)
+	if m.FreqShiftLoadShedSOE != 0 || m.FreqShiftLoadShedDeltaF != 0 {
+		gauge(p.freqShiftSOE, m.FreqShiftLoadShedSOE)
+		gauge(p.freqShiftDeltaF, m.FreqShiftLoadShedDeltaF)
+	}
+	gauge(p.uptimeSeconds, float64(m.Uptime)/float64(time.Second))
+	gauge(p.majorVersion, float64(m.Version.Major))
+	gauge(p.buildInfo, 1, m.Version.Full, m.Version.GitHash, m.Version.DeviceType, m.Version.SyncType)
+	if m.Hardware.DIN != "" {
+		gauge(p.gatewayInfo, 1, m.Hardware.DIN, m.Hardware.PartNumber, m.Hardware.SerialNumber)
+	}
+	gauge(p.minorVersion, float64(m.Version.Minor))
+	gauge(p.releaseVersion, float64(m.Version.Release))
+	gauge(p.flattenedVersion, p.flatVersion)
+	for _, d := range m.Deprecations {
+		gauge(p.apiDeprecationWarning, 1, d.Endpoint)
+	}
+	for _, f := range m.EnergyFlows() {
+		gauge(p.energyFlows[[2]string{f.From, f.To}], f.Watts)
+	}
+	for _, v := range m.OverlayValues {
+		gauge(p.overlayValue, v.Value, v.Endpoint, v.Name, v.Index)
 	}
 	for _, net := range m.NetworkInterfaces {
-		labels := prometheus.Labels{kInterface: net.Transport.String()}
-		p.networkEnabled.With(labels).Set(boolToFloat(net.Enabled))
-		p.networkActive.With(labels).Set(boolToFloat(net.Active))
-		p.networkPrimary.With(labels).Set(boolToFloat(net.Primary))
-		p.networkSignalStrength.With(labels).Set(float64(net.SignalStrength))
-	}
-	p.siteMasterRunning.Set(boolToFloat(m.SiteMasterRunning))
-	p.siteMasterConnectedToTesla.Set(boolToFloat(m.SiteMasterConnectedToTesla))
-	p.siteMasterSupplyingPower.Set(boolToFloat(m.SiteMasterSupplyingPower))
-	for mt, meter := range m.Meters {
-		p.instantPower.With(prometheus.Labels{kMeter: mt.String(), kPowerType: kTruePower}).Set(meter.InstantPower)
-		p.instantPower.With(prometheus.Labels{kMeter: mt.String(), kPowerType: kReactivePower}).Set(meter.InstantReactivePower)
-		p.instantPower.With(prometheus.Labels{kMeter: mt.String(), kPowerType: kApparentPower}).Set(meter.InstantApparentPower)
-		labels := prometheus.Labels{kMeter: mt.String()}
-		p.instantAverageVoltage.With(labels).Set(meter.InstantAverageVoltage)
-		p.instantTotalCurrent.With(labels).Set(meter.InstantTotalCurrent)
-		prior := p.priorCumulative[mt][kTo]
-		delta := meter.CumulativeEnergyTo - prior
-		p.priorCumulative[mt][kTo] = meter.CumulativeEnergyTo
-		const epsilon = 0.00001
-		if delta < 0 {
-			if delta < -epsilon {
-				glog.Warningf("Meter %s cumulative energy to decreased: %.4f", mt, delta)
-			}
-		} else {
-			p.cumulativePower.With(prometheus.Labels{
-				kMeter:     mt.String(),
-				kDirection: kTo,
-			}).Add(delta)
+		iface := net.Transport.String()
+		gauge(p.networkEnabled, boolToFloat(net.Enabled), iface)
+		gauge(p.networkActive, boolToFloat(net.Active), iface)
+		gauge(p.networkPrimary, boolToFloat(net.Primary), iface)
+		gauge(p.networkSignalStrength, float64(net.SignalStrength), iface)
+		gauge(p.networkDHCP, boolToFloat(net.DHCP), iface)
+		addresses := net.Addresses
+		if len(addresses) == 0 {
+			addresses = []string{""}
 		}
-		prior = p.priorCumulative[mt][kFrom]
-		delta = meter.CumulativeEnergyFrom - prior
-		if delta < 0 {
-			if delta < -epsilon {
-				glog.Warningf("Meter %s cumulative energy from decreased: %.4f", mt, delta)
+		seen := make(map[string]bool)
+		for _, ip := range addresses {
+			// The gateway may list an address twice, and the same
+			// labels twice would fail the whole scrape.
+			if seen[ip] {
+				continue
 			}
-		} else {
-			p.cumulativePower.With(prometheus.Labels{
-				kMeter:     mt.String(),
-				kDirection: kFrom,
-			}).Add(delta)
+			seen[ip] = true
+			gauge(p.networkInfo, 1, iface, ip, net.Gateway, net.HardwareAddress, net.State)
 		}
-		p.priorCumulative[mt][kFrom] = meter.CumulativeEnergyFrom
 	}
-	p.gridConnected.Set(boolToFloat(m.GridConnected))
-	p.gridActive.Set(boolToFloat(m.GridActive))
-	return nil
+	for _, w := range m.WifiNetworks {
+		channel := strconv.Itoa(w.Channel)
+		gauge(p.wifiScanRSSI, float64(w.RSSI), w.SSID, channel)
+		if w.Connected {
+			gauge(p.wifiRSSI, float64(w.RSSI))
+			gauge(p.wifiInfo, 1, w.SSID, channel)
+		}
+	}
+	gauge(p.siteMasterRunning, boolToFloat(m.SiteMasterRunning))
+	gauge(p.siteMasterConnectedToTesla, boolToFloat(m.SiteMasterConnectedToTesla))
+	gauge(p.siteMasterSupplyingPower, boolToFloat(m.SiteMasterSupplyingPower))
+	for mt, meter := range m.Meters {
+		meterName := mt.String()
+		gauge(p.instantPower, meter.InstantPower, meterName, kTruePower)
+		gauge(p.instantPower, meter.InstantReactivePower, meterName, kReactivePower)
+		gauge(p.instantPower, meter.InstantApparentPower, meterName, kApparentPower)
+		gauge(p.instantAverageVoltage, meter.InstantAverageVoltage, meterName)
+		gauge(p.instantTotalCurrent, meter.InstantTotalCurrent, meterName)
+		counter(p.cumulativePower, p.cumulative[mt][kTo], meterName, kTo)
+		counter(p.cumulativePower, p.cumulative[mt][kFrom], meterName, kFrom)
+		counter(p.counterResets, p.resets[mt][kTo], meterName, kTo)
+		counter(p.counterResets, p.resets[mt][kFrom], meterName, kFrom)
+	}
+	histogram(p.gridFrequency, p.frequencies)
+	histogram(p.gridVoltage, p.voltages)
+	for _, r := range m.RevenueMeters {
+		counter(p.revenueEnergy, r.ImportedWh/1000, r.Location, r.Serial, kTo)
+		counter(p.revenueEnergy, r.ExportedWh/1000, r.Location, r.Serial, kFrom)
+	}
+	for _, meter := range m.CTMeters {
+		for _, ct := range meter.CTs {
+			gauge(p.ctRealPower, ct.RealPower, meter.Location, meter.Serial, ct.CT)
+			gauge(p.ctVoltage, ct.Voltage, meter.Location, meter.Serial, ct.CT)
+			gauge(p.ctCurrent, ct.Current, meter.Location, meter.Serial, ct.CT)
+		}
+	}
+	for _, d := range m.Devices {
+		for name, v := range d.Values {
+			gauge(p.deviceVital, v, d.DIN, vitals.Component(name), name)
+		}
+		for _, a := range d.Alerts {
+			gauge(p.deviceAlert, 1, d.DIN, a)
+		}
+	}
+	for _, s := range m.PVStrings {
+		gauge(p.pvStringVoltage, s.Voltage, s.DIN, s.String)
+		gauge(p.pvStringCurrent, s.Current, s.DIN, s.String)
+		gauge(p.pvStringPower, s.Power, s.DIN, s.String)
+	}
+	for _, t := range m.Temperatures {
+		gauge(p.temperature, t.Celsius, t.Serial, t.Component, t.Sensor)
+	}
+	gauge(p.gridConnected, boolToFloat(m.GridConnected))
+	gauge(p.gridActive, boolToFloat(m.GridActive))
+	for _, s := range powerwall.SystemStatuses {
+		gauge(p.gridStatus, boolToFloat(m.GridStatus == s), s.String())
+	}
+	if !m.GridStatus.Known() {
+		gauge(p.gridStatus, 1, m.GridStatus.String())
+	}
+	gauge(p.updating, boolToFloat(m.Updating))
+	gauge(p.enumerating, boolToFloat(m.Enumerating))
+	gauge(p.gridQualifying, boolToFloat(m.GridQualifying))
+	gauge(p.gridCodeValidating, boolToFloat(m.GridCodeValidating))
+	gauge(p.bubbleShedding, boolToFloat(m.BubbleShedding))
+	for _, pw := range m.Powerwalls {
+		for _, s := range powerwall.GridStates {
+			gauge(p.powerwallGridState, boolToFloat(pw.GridState == s), pw.SerialNumber, s.String())
+		}
+		if !pw.GridState.Known() {
+			gauge(p.powerwallGridState, 1, pw.SerialNumber, pw.GridState.String())
+		}
+		gauge(p.underPhaseDetection, boolToFloat(pw.UnderPhaseDetection), pw.SerialNumber)
+		gauge(p.powerwallUpdating, boolToFloat(pw.Updating), pw.SerialNumber)
+		gauge(p.powerwallInfo, 1, pw.SerialNumber, pw.PartNumber, pw.Type)
+		for _, c := range pw.FailedChecks {
+			gauge(p.diagnosticCheckFailed, 1, pw.SerialNumber, c.Diagnostic, c.Check)
+		}
+	}
+	if !m.Skipped[model.CollectorSolars] {
+		gauge(p.totalSolarRatingWatts, float64(p.fixed.TotalSolarPowerRatingWatts))
+	}
+	if !m.Skipped[model.CollectorGridFaults] {
+		gauge(p.gridFaults, float64(m.GridFaults.Count))
+		for name, n := range m.GridFaults.CountByName {
+			gauge(p.gridFaultsByName, float64(n), name)
+		}
+		if !m.GridFaults.MostRecent.IsZero() {
+			gauge(p.lastGridFaultTimestamp, float64(m.GridFaults.MostRecent.Unix()))
+		}
+	}
+	if b := m.BackupEvents; b != nil {
+		gauge(p.backupEvents, float64(b.Count))
+		if !b.Last.IsZero() {
+			gauge(p.lastBackupEvent, float64(b.Last.Unix()))
+		}
+	}
+	if gap := m.Derived.LastSOEGap; gap != nil {
+		gauge(p.soeGapChangePercent, gap.ChangePercent)
+		gauge(p.soeGapSeconds, gap.Duration.Seconds())
+		gauge(p.soeGapEndTimestamp, float64(gap.End.Unix()))
+	}
+	if t := m.Derived.Tariff; t != nil {
+		counter(p.gridCost, t.GridCost, t.Currency)
+		counter(p.exportCredit, t.ExportCredit, t.Currency)
+		gauge(p.tariffPeriod, 1, t.Period)
+	}
+	for mt, e := range m.Derived.Today {
+		gauge(p.todayEnergy, e.ToWh/1000, mt.String(), kTo, kDerived)
+		gauge(p.todayEnergy, e.FromWh/1000, mt.String(), kFrom, kDerived)
+	}
+	counter(p.gridOutages, m.Derived.Outages.Count)
+	counter(p.timeIslanded, m.Derived.Outages.IslandedSeconds)
+	if !m.Derived.Outages.LastOutage.IsZero() {
+		gauge(p.lastOutage, float64(m.Derived.Outages.LastOutage.Unix()))
+	}
+	counter(p.sheddingSpells, m.Derived.Shedding.Count)
+	counter(p.sheddingSeconds, m.Derived.Shedding.Seconds)
+	if !m.Derived.Shedding.Since.IsZero() {
+		gauge(p.sheddingSince, float64(m.Derived.Shedding.Since.Unix()))
+	}
+	for mt, e := range m.GatewayToday {
+		gauge(p.todayEnergy, e.ToWh/1000, mt.String(), kTo, kGateway)
+		gauge(p.todayEnergy, e.FromWh/1000, mt.String(), kFrom, kGateway)
+	}
+	if v, ok := m.SelfPoweredPercent(); ok {
+		gauge(p.selfPowered, v)
+	}
+	if d := m.Derived.LastDailySummary; d != nil {
+		gauge(p.dailyEnergy, d.SolarWh, "solar")
+		gauge(p.dailyEnergy, d.UsageWh, "usage")
+		gauge(p.dailyEnergy, d.ImportWh, "import")
+		gauge(p.dailyEnergy, d.ExportWh, "export")
+		gauge(p.dailyEnergy, d.BatteryDischargeWh, "battery_discharge")
+		gauge(p.dailyBatteryCycles, d.BatteryCycles)
+		gauge(p.dailyTimestamp, float64(d.Day.Unix()))
+	}
+	for metric, v := range m.Derived.Smoothed {
+		gauge(p.smoothed, v, metric)
+	}
+	if r := m.Derived.Records; r != nil {
+		for window, rec := range map[string]model.Record{"all_time": r.AllTime, "30d": r.Last30Days} {
+			gauge(p.recordIslanded, rec.LongestIslanded.Seconds(), window)
+			gauge(p.recordMinCharge, rec.MinChargePercent, window)
+			gauge(p.recordMaxBattery, rec.MaxBatteryWatts, window)
+		}
+	}
+	if r := m.Derived.Rates; r != nil {
+		gauge(p.soeChangeRate, r.SOEPercentPerHour)
+		gauge(p.batteryRamp, r.BatteryRampWattsPerSecond)
+	}
 }
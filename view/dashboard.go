@@ -0,0 +1,107 @@
+package view
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"net/http"
+	"strings"
+)
+
+// panel is one graph on the dashboard.  The exprs use %s for the name of
+// metric, which is given by its historical name.
+type panel struct {
+	title  string
+	unit   string
+	metric string
+	exprs  []string
+	legend string
+}
+
+// dashboardPanels are the graphs Dashboard draws.  They avoid metrics
+// whose unit changes with Options.ConventionalNames.
+var dashboardPanels = []panel{
+	{title: "Battery charge", unit: "percent", metric: "powerwall_charge_percent", exprs: []string{"%s"}, legend: "gateway"},
+	{title: "Battery charge (app)", unit: "percent", metric: "app_charge_percent", exprs: []string{"%s"}, legend: "app"},
+	{title: "Power", unit: "watt", metric: "instant_power", exprs: []string{`%s{powerType="truePower"}`}, legend: "{{meter}}"},
+	{title: "Energy per hour", unit: "watth", metric: "cumulative_power", exprs: []string{"increase(%s[1h])"}, legend: "{{meter}} {{direction}}"},
+	{title: "Grid status", metric: "grid_status", exprs: []string{"%s == 1"}, legend: "{{state}}"},
+	{title: "Backup reserve", unit: "percent", metric: "backup_reserve_percent", exprs: []string{"%s"}},
+}
+
+func init() {
+	flows := panel{title: "Energy flows", unit: "watt"}
+	for _, route := range model.EnergyFlowRoutes {
+		flows.exprs = append(flows.exprs, fmt.Sprintf("%s_to_%s_w", route[0], route[1]))
+	}
+	dashboardPanels = append(dashboardPanels, flows)
+}
+
+const kDatasource = "${datasource}"
+
+// Dashboard is a Grafana dashboard of the main metrics, under the names
+// they're exported as with opts, so it can't drift from the exporter.
+func Dashboard(opts Options) map[string]interface{} {
+	ds := map[string]string{"type": "prometheus", "uid": kDatasource}
+	var panels []interface{}
+	for i, p := range dashboardPanels {
+		var targets []interface{}
+		for j, expr := range p.exprs {
+			t := map[string]interface{}{"datasource": ds, "refId": string(rune('A' + j))}
+			if p.metric != "" {
+				t["expr"] = fmt.Sprintf(expr, metricName(opts, p.metric))
+			} else {
+				// Each expr is itself a historical metric name.
+				t["expr"] = metricName(opts, expr)
+				t["legendFormat"] = strings.Replace(strings.TrimSuffix(expr, "_w"), "_", " ", -1)
+			}
+			if p.legend != "" {
+				t["legendFormat"] = p.legend
+			}
+			targets = append(targets, t)
+		}
+		panels = append(panels, map[string]interface{}{
+			"id":         i + 1,
+			"type":       "timeseries",
+			"title":      opts.Locale.Text(p.title),
+			"datasource": ds,
+			"gridPos":    map[string]int{"h": 8, "w": 12, "x": 12 * (i % 2), "y": 8 * (i / 2)},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]string{"unit": p.unit},
+				"overrides": []interface{}{},
+			},
+			"targets": targets,
+		})
+	}
+	return map[string]interface{}{
+		"uid":           "powerwall-exporter",
+		"title":         "Powerwall",
+		"schemaVersion": 39,
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"refresh":       "1m",
+		"templating": map[string]interface{}{
+			"list": []interface{}{map[string]interface{}{
+				"name":  "datasource",
+				"label": opts.Locale.Text("Data source"),
+				"type":  "datasource",
+				"query": "prometheus",
+			}},
+		},
+		"panels": panels,
+	}
+}
+
+// DashboardHandler serves Dashboard, for Grafana provisioning to fetch.
+func DashboardHandler(opts Options) http.Handler {
+	b, err := json.MarshalIndent(Dashboard(opts), "", "  ")
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err != nil {
+			glog.Errorf("encoding dashboard: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(b)
+	})
+}
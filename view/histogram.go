@@ -0,0 +1,102 @@
+package view
+
+import (
+	"math"
+	"sort"
+)
+
+// gridHistogram accumulates a grid reading from the site meter across
+// polls, so excursions show up even between scrapes.  Its buckets are set
+// around the grid code's nominal value, or if the grid code doesn't give
+// one, the common value nearest the first reading.
+type gridHistogram struct {
+	nominals []float64
+	// offsets from the nominal value bound the buckets above and below
+	// it.  scaled offsets are fractions of the nominal value.
+	offsets []float64
+	scaled  bool
+
+	bounds []float64 // ascending; nil until the first reading.
+	counts []uint64  // per bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+// newFrequencyHistogram buckets frequencies around nominal, or if that is
+// zero, around 50 or 60 Hz.
+func newFrequencyHistogram(nominal float64) *gridHistogram {
+	h := &gridHistogram{
+		nominals: []float64{50, 60},
+		offsets:  []float64{0.02, 0.05, 0.1, 0.2, 0.5, 1},
+	}
+	if nominal > 0 {
+		h.setBounds(nominal)
+	}
+	return h
+}
+
+// newVoltageHistogram buckets voltages within 1% to 10% of the common
+// service voltages.  The grid code's voltage setting isn't used: split
+// phase sites set 240V, but their site meters report the average of the
+// two 120V legs.
+func newVoltageHistogram() *gridHistogram {
+	return &gridHistogram{
+		nominals: []float64{120, 208, 230, 240, 277},
+		offsets:  []float64{0.01, 0.02, 0.05, 0.1},
+		scaled:   true,
+	}
+}
+
+// observe adds a reading.  Readings of zero or less, which the meter
+// reports when it has none, are ignored.
+func (h *gridHistogram) observe(v float64) {
+	if v <= 0 || math.IsNaN(v) {
+		return
+	}
+	if h.bounds == nil {
+		h.setBounds(h.nearest(v))
+	}
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.count++
+	h.sum += v
+}
+
+// nearest returns the common nominal value nearest v.
+func (h *gridHistogram) nearest(v float64) float64 {
+	rval := h.nominals[0]
+	for _, n := range h.nominals[1:] {
+		if math.Abs(v-n) < math.Abs(v-rval) {
+			rval = n
+		}
+	}
+	return rval
+}
+
+// setBounds sets the buckets around nominal.
+func (h *gridHistogram) setBounds(nominal float64) {
+	for _, o := range h.offsets {
+		if h.scaled {
+			o *= nominal
+		}
+		h.bounds = append(h.bounds, nominal-o, nominal+o)
+	}
+	h.bounds = append(h.bounds, nominal)
+	sort.Float64s(h.bounds)
+	// The last count is for readings above every bound.
+	h.counts = make([]uint64, len(h.bounds)+1)
+}
+
+// buckets returns the cumulative count at each upper bound, or nil if
+// there have been no readings.
+func (h *gridHistogram) buckets() map[float64]uint64 {
+	if h.count == 0 {
+		return nil
+	}
+	rval := make(map[float64]uint64, len(h.bounds))
+	var n uint64
+	for i, b := range h.bounds {
+		n += h.counts[i]
+		rval[b] = n
+	}
+	return rval
+}
@@ -0,0 +1,234 @@
+package view
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	_ "modernc.org/sqlite"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// kHistoryPruneInterval is how often the history sink deletes polls
+	// older than its retention.
+	kHistoryPruneInterval = time.Hour
+	// kHistoryMaxPoints bounds the points /history returns, so a small
+	// step over a long range can't build an enormous response.
+	kHistoryMaxPoints = 5000
+)
+
+const kHistorySchema = `CREATE TABLE IF NOT EXISTS polls (
+	polled_at INTEGER PRIMARY KEY,
+	charge_percent REAL NOT NULL,
+	site_w REAL NOT NULL,
+	load_w REAL NOT NULL,
+	solar_w REAL NOT NULL,
+	battery_w REAL NOT NULL,
+	grid_connected INTEGER NOT NULL
+)`
+
+func init() {
+	RegisterSink("history", newHistory)
+}
+
+// History records the key figures of each poll in a local SQLite
+// database, for simple charts without running Prometheus.  It serves
+// them as JSON on /history.
+type History struct {
+	db        *sql.DB
+	retention time.Duration
+
+	mu       sync.Mutex
+	prunedAt time.Time
+}
+
+// HistoryPoint is one recorded poll, or for /history the average of the
+// polls in its step.
+type HistoryPoint struct {
+	Time          time.Time `json:"time" parquet:"time,timestamp(millisecond)"`
+	ChargePercent float64   `json:"charge_percent" parquet:"charge_percent"`
+	SiteW         float64   `json:"site_w" parquet:"site_w"`
+	LoadW         float64   `json:"load_w" parquet:"load_w"`
+	SolarW        float64   `json:"solar_w" parquet:"solar_w"`
+	BatteryW      float64   `json:"battery_w" parquet:"battery_w"`
+	// GridConnected is the fraction of the step the grid was up; 0 or 1
+	// for a single poll.
+	GridConnected float64 `json:"grid_connected" parquet:"grid_connected"`
+}
+
+func newHistory(fixed *model.FixedInfo, opts Options) (Sink, error) {
+	if opts.HistoryDB == "" {
+		return nil, fmt.Errorf("the history sink needs a database file")
+	}
+	return OpenHistory(opts.HistoryDB, opts.HistoryRetention)
+}
+
+// OpenHistory opens the history database at path, creating it if need be.
+// Polls older than retention are deleted as new ones arrive; zero keeps
+// them forever.
+func OpenHistory(path string, retention time.Duration) (*History, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	// SQLite allows one writer; a single connection saves us from
+	// SQLITE_BUSY between Update and the pruning.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(kHistorySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating the history table in %s: %v", path, err)
+	}
+	return &History{db: db, retention: retention}, nil
+}
+
+// OpenHistoryReadOnly opens an existing history database at path for
+// reading, failing rather than creating one if there is none.
+func OpenHistoryReadOnly(path string) (*History, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	u := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite", u.String())
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	return &History{db: db}, nil
+}
+
+// Update appends m to the database, and every kHistoryPruneInterval
+// deletes polls older than the retention.
+func (h *History) Update(m *model.TeslaEnergyGatewayMetrics) error {
+	at := m.PolledAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	connected := 0
+	if m.GridConnected {
+		connected = 1
+	}
+	_, err := h.db.Exec(`INSERT OR REPLACE INTO polls VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		at.Unix(), m.PowerwallChargePercent,
+		m.Meters[model.Total].InstantPower, m.Meters[model.Load].InstantPower,
+		m.Meters[model.Solar].InstantPower, m.Meters[model.Battery].InstantPower,
+		connected)
+	if err != nil {
+		return fmt.Errorf("recording poll: %v", err)
+	}
+	return h.prune(at)
+}
+
+func (h *History) prune(now time.Time) error {
+	if h.retention <= 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.prunedAt) < kHistoryPruneInterval {
+		return nil
+	}
+	h.prunedAt = now
+	if _, err := h.db.Exec(`DELETE FROM polls WHERE polled_at < ?`, now.Add(-h.retention).Unix()); err != nil {
+		return fmt.Errorf("pruning history: %v", err)
+	}
+	return nil
+}
+
+// Close closes the database.
+func (h *History) Close() error {
+	return h.db.Close()
+}
+
+// ServeHTTP serves the recorded history as a JSON array of HistoryPoint.
+// The since parameter, a duration defaulting to 24h, picks how far back
+// to go, and step, defaulting to a 500th of since, how long each point
+// averages over.
+func (h *History) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	since, err := durationParam(req, "since", 24*time.Hour)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, err := durationParam(req, "step", since/500)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	if since/step > kHistoryMaxPoints {
+		http.Error(rw, fmt.Sprintf("since/step asks for more than %d points", kHistoryMaxPoints), http.StatusBadRequest)
+		return
+	}
+	points, err := h.query(time.Now().Add(-since), step)
+	if err != nil {
+		glog.Errorf("querying history: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(points); err != nil {
+		glog.Errorf("encoding history: %v", err)
+	}
+}
+
+func (h *History) query(from time.Time, step time.Duration) ([]HistoryPoint, error) {
+	s := int64(step / time.Second)
+	rows, err := h.db.Query(`SELECT polled_at / ? * ? AS t, AVG(charge_percent), AVG(site_w),
+		AVG(load_w), AVG(solar_w), AVG(battery_w), AVG(grid_connected)
+		FROM polls WHERE polled_at >= ? GROUP BY t ORDER BY t`, s, s, from.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanHistory(rows)
+}
+
+// Polls returns every recorded poll at or after from and before to, oldest
+// first.
+func (h *History) Polls(from, to time.Time) ([]HistoryPoint, error) {
+	rows, err := h.db.Query(`SELECT polled_at, charge_percent, site_w, load_w, solar_w,
+		battery_w, grid_connected FROM polls WHERE polled_at >= ? AND polled_at < ?
+		ORDER BY polled_at`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanHistory(rows)
+}
+
+func scanHistory(rows *sql.Rows) ([]HistoryPoint, error) {
+	rval := []HistoryPoint{}
+	for rows.Next() {
+		var t int64
+		var p HistoryPoint
+		if err := rows.Scan(&t, &p.ChargePercent, &p.SiteW, &p.LoadW, &p.SolarW, &p.BatteryW, &p.GridConnected); err != nil {
+			return nil, err
+		}
+		p.Time = time.Unix(t, 0).UTC()
+		rval = append(rval, p)
+	}
+	return rval, rows.Err()
+}
+
+func durationParam(req *http.Request, name string, def time.Duration) (time.Duration, error) {
+	v := req.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s=%q isn't a positive duration", name, v)
+	}
+	return d, nil
+}
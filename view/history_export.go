@@ -0,0 +1,44 @@
+package view
+
+import (
+	"encoding/csv"
+	"github.com/parquet-go/parquet-go"
+	"io"
+	"strconv"
+	"time"
+)
+
+// kHistoryColumns heads the CSV written by WriteHistoryCSV, and matches
+// the parquet column names of HistoryPoint.
+var kHistoryColumns = []string{"time", "charge_percent", "site_w", "load_w", "solar_w", "battery_w", "grid_connected"}
+
+// WriteHistoryCSV writes points to w as CSV with a header row, times in
+// RFC 3339, for spreadsheets and pandas.read_csv.
+func WriteHistoryCSV(w io.Writer, points []HistoryPoint) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(kHistoryColumns); err != nil {
+		return err
+	}
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	for _, p := range points {
+		row := []string{p.Time.Format(time.RFC3339), f(p.ChargePercent), f(p.SiteW), f(p.LoadW), f(p.SolarW), f(p.BatteryW), f(p.GridConnected)}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteHistoryParquet writes points to w as a Parquet file, for
+// pandas.read_parquet and other columnar tools.
+func WriteHistoryParquet(w io.Writer, points []HistoryPoint) error {
+	pw := parquet.NewGenericWriter[HistoryPoint](w)
+	if _, err := pw.Write(points); err != nil {
+		pw.Close()
+		return err
+	}
+	return pw.Close()
+}
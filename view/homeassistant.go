@@ -0,0 +1,197 @@
+package view
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	RegisterSink("homeassistant", newHomeAssistant)
+}
+
+// haSensor is one Home Assistant sensor, with the device and state
+// classes its energy dashboard needs to build long term statistics.
+type haSensor struct {
+	key         string
+	name        string
+	deviceClass string
+	stateClass  string
+	unit        string
+	value       func(m *model.TeslaEnergyGatewayMetrics) float64
+}
+
+func haEnergy(mt model.MeterType, to bool) func(m *model.TeslaEnergyGatewayMetrics) float64 {
+	return func(m *model.TeslaEnergyGatewayMetrics) float64 {
+		if to {
+			return m.Meters[mt].CumulativeEnergyTo / 1000
+		}
+		return m.Meters[mt].CumulativeEnergyFrom / 1000
+	}
+}
+
+func haPower(mt model.MeterType) func(m *model.TeslaEnergyGatewayMetrics) float64 {
+	return func(m *model.TeslaEnergyGatewayMetrics) float64 {
+		return m.Meters[mt].InstantPower
+	}
+}
+
+var haSensors = []haSensor{
+	{"grid_import", "Grid import", "energy", "total_increasing", "kWh", haEnergy(model.Total, true)},
+	{"grid_export", "Grid export", "energy", "total_increasing", "kWh", haEnergy(model.Total, false)},
+	{"solar_production", "Solar production", "energy", "total_increasing", "kWh", haEnergy(model.Solar, false)},
+	{"battery_charge", "Battery charge energy", "energy", "total_increasing", "kWh", haEnergy(model.Battery, true)},
+	{"battery_discharge", "Battery discharge energy", "energy", "total_increasing", "kWh", haEnergy(model.Battery, false)},
+	{"home_usage", "Home usage", "energy", "total_increasing", "kWh", haEnergy(model.Load, true)},
+	{"grid_power", "Grid power", "power", "measurement", "W", haPower(model.Total)},
+	{"solar_power", "Solar power", "power", "measurement", "W", haPower(model.Solar)},
+	{"battery_power", "Battery power", "power", "measurement", "W", haPower(model.Battery)},
+	{"home_power", "Home power", "power", "measurement", "W", haPower(model.Load)},
+	{"battery_level", "Battery level", "battery", "measurement", "%", func(m *model.TeslaEnergyGatewayMetrics) float64 {
+		return m.PowerwallChargePercent
+	}},
+}
+
+var haUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// haNodeID names the site in Home Assistant's unique IDs and MQTT topics.
+func haNodeID(fixed *model.FixedInfo) string {
+	id := fixed.DIN
+	if id == "" {
+		id = fixed.VIN
+	}
+	return "powerwall_" + strings.Trim(haUnsafe.ReplaceAllString(id, "_"), "_")
+}
+
+// haState is a sensor's value rounded the way Home Assistant shows it.
+func haState(s haSensor, m *model.TeslaEnergyGatewayMetrics) float64 {
+	if s.unit == "kWh" {
+		return math.Round(s.value(m)*1000) / 1000
+	}
+	return math.Round(s.value(m)*10) / 10
+}
+
+// haDevice describes the site as a Home Assistant device.
+func haDevice(fixed *model.FixedInfo) map[string]interface{} {
+	name := fixed.SiteName
+	if name == "" {
+		name = "Powerwall"
+	}
+	return map[string]interface{}{
+		"identifiers":  []string{haNodeID(fixed)},
+		"name":         name,
+		"manufacturer": "Tesla",
+		"model":        "Powerwall",
+	}
+}
+
+// haDiscovery is the discovery config of sensor s, less where the state
+// comes from.
+func haDiscovery(s haSensor, fixed *model.FixedInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"name":                s.name,
+		"unique_id":           haNodeID(fixed) + "_" + s.key,
+		"device_class":        s.deviceClass,
+		"state_class":         s.stateClass,
+		"unit_of_measurement": s.unit,
+		"device":              haDevice(fixed),
+	}
+}
+
+// HomeAssistantHandler serves the Home Assistant sensors with their
+// current states, for a REST or command line sensor setup that doesn't
+// go through MQTT.
+func HomeAssistantHandler(fixed *model.FixedInfo, latest func() *model.TeslaEnergyGatewayMetrics) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		m := latest()
+		if m == nil {
+			http.Error(rw, "the gateway hasn't been polled yet", http.StatusServiceUnavailable)
+			return
+		}
+		var sensors []map[string]interface{}
+		for _, s := range haSensors {
+			d := haDiscovery(s, fixed)
+			d["state"] = haState(s, m)
+			sensors = append(sensors, d)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(map[string]interface{}{"sensors": sensors}); err != nil {
+			glog.Errorf("encoding Home Assistant sensors: %v", err)
+		}
+	})
+}
+
+// homeAssistant publishes Home Assistant MQTT discovery configs for the
+// sensors each time it connects to the broker, then their states after
+// each poll.
+type homeAssistant struct {
+	broker *mqttBroker
+	prefix string
+	fixed  model.FixedInfo
+}
+
+func newHomeAssistant(fixed *model.FixedInfo, opts Options) (Sink, error) {
+	if opts.MQTTBroker == "" {
+		return nil, fmt.Errorf("the homeassistant sink needs an MQTT broker")
+	}
+	b, err := newMQTTBroker(opts.MQTTBroker, haNodeID(fixed))
+	if err != nil {
+		return nil, err
+	}
+	prefix := opts.HomeAssistantPrefix
+	if prefix == "" {
+		prefix = "homeassistant"
+	}
+	h := &homeAssistant{broker: b, prefix: prefix, fixed: *fixed}
+	b.onConnect = h.discovery
+	return h, nil
+}
+
+func (h *homeAssistant) stateTopic() string {
+	return fmt.Sprintf("%s/sensor/%s/state", h.prefix, haNodeID(&h.fixed))
+}
+
+// discovery returns the retained discovery configs for the sensors.  They
+// are sent on every connection, so sensors come back after a broker which
+// lost its retained messages restarts.
+func (h *homeAssistant) discovery() ([]mqttMessage, error) {
+	var rval []mqttMessage
+	for _, s := range haSensors {
+		d := haDiscovery(s, &h.fixed)
+		d["state_topic"] = h.stateTopic()
+		d["value_template"] = fmt.Sprintf("{{ value_json.%s }}", s.key)
+		b, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", h.prefix, haNodeID(&h.fixed), s.key)
+		rval = append(rval, mqttMessage{topic: topic, payload: b, retain: true})
+	}
+	return rval, nil
+}
+
+// Update publishes the states from m.
+func (h *homeAssistant) Update(m *model.TeslaEnergyGatewayMetrics) error {
+	state := make(map[string]float64)
+	for _, s := range haSensors {
+		state[s.key] = haState(s, m)
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := h.broker.publish(mqttMessage{topic: h.stateTopic(), payload: b}); err != nil {
+		return fmt.Errorf("publishing to MQTT: %v", err)
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (h *homeAssistant) Close() error {
+	return h.broker.close()
+}
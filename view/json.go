@@ -0,0 +1,90 @@
+package view
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// flatJSON is the document served by JSONHandler.
+type flatJSON struct {
+	// Data maps each series to its value.  Series with labels are keyed
+	// name[label=value,...], with labels sorted by name.
+	Data map[string]float64 `json:"data"`
+	// Discovery lists the label sets of each metric with labels, in the
+	// form Zabbix low level discovery expects: {"{#LABEL}": "value"}.
+	Discovery map[string][]map[string]string `json:"discovery"`
+}
+
+// JSONHandler serves the metrics gathered from g as flat key/value JSON,
+// for Zabbix and other pollers that don't speak the Prometheus format.
+// Histograms and summaries are reduced to their sum and count.
+func JSONHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mfs, err := g.Gather()
+		if err != nil {
+			glog.Errorf("g.Gather(): %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(flatten(mfs)); err != nil {
+			glog.Errorf("encoding JSON metrics: %v", err)
+		}
+	})
+}
+
+// WriteJSON writes the metrics gathered from g to w in the form
+// JSONHandler serves.
+func WriteJSON(w io.Writer, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(flatten(mfs))
+}
+
+func flatten(mfs []*dto.MetricFamily) flatJSON {
+	rval := flatJSON{
+		Data:      make(map[string]float64),
+		Discovery: make(map[string][]map[string]string),
+	}
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			pairs := m.GetLabel()
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+			key := name
+			if len(pairs) > 0 {
+				var kv []string
+				macros := make(map[string]string)
+				for _, l := range pairs {
+					kv = append(kv, l.GetName()+"="+l.GetValue())
+					macros["{#"+strings.ToUpper(l.GetName())+"}"] = l.GetValue()
+				}
+				key += "[" + strings.Join(kv, ",") + "]"
+				rval.Discovery[name] = append(rval.Discovery[name], macros)
+			}
+			switch {
+			case m.Gauge != nil:
+				rval.Data[key] = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				rval.Data[key] = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				rval.Data[key] = m.GetUntyped().GetValue()
+			case m.Histogram != nil:
+				rval.Data[key+".sum"] = m.GetHistogram().GetSampleSum()
+				rval.Data[key+".count"] = float64(m.GetHistogram().GetSampleCount())
+			case m.Summary != nil:
+				rval.Data[key+".sum"] = m.GetSummary().GetSampleSum()
+				rval.Data[key+".count"] = float64(m.GetSummary().GetSampleCount())
+			}
+		}
+	}
+	return rval
+}
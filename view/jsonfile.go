@@ -0,0 +1,50 @@
+package view
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	RegisterSink("json_file", newJSONFile)
+}
+
+// jsonFile writes each poll to a file as JSON, replacing the previous one,
+// for scripts that would rather read a file than scrape.
+type jsonFile struct {
+	path string
+}
+
+func newJSONFile(fixed *model.FixedInfo, opts Options) (Sink, error) {
+	if opts.JSONFile == "" {
+		return nil, fmt.Errorf("the json_file sink needs a file to write")
+	}
+	return &jsonFile{path: opts.JSONFile}, nil
+}
+
+// Update writes m to a temporary file and renames it over the old one, so
+// readers never see a half written file.
+func (j *jsonFile) Update(m *model.TeslaEnergyGatewayMetrics) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("creating %s: %v", j.path, err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing %s: %v", j.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("closing %s: %v", j.path, err)
+	}
+	return os.Rename(tmp.Name(), j.path)
+}
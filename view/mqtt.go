@@ -0,0 +1,211 @@
+package view
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const kMQTTTimeout = 10 * time.Second
+
+// mqttBroker publishes to an MQTT 3.1.1 broker at QoS 0, which is all a
+// sink needs.  It keeps one connection open, and connects again when the
+// broker drops it, as when the broker restarts.
+type mqttBroker struct {
+	addr     string
+	clientID string
+	username string
+	password string
+	hasUser  bool
+	// onConnect, if set, returns messages to send first on each new
+	// connection, such as discovery configs a restarted broker has lost.
+	onConnect func() ([]mqttMessage, error)
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+	// gone is closed when the broker closes conn.
+	gone chan struct{}
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// newMQTTBroker parses a broker address, tcp://[user:password@]host[:port].
+func newMQTTBroker(spec, clientID string) (*mqttBroker, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "tcp" && u.Scheme != "mqtt" {
+		return nil, fmt.Errorf("MQTT broker %q: want tcp://host:port", spec)
+	}
+	b := &mqttBroker{addr: u.Host, clientID: clientID}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	if u.User != nil {
+		b.hasUser = true
+		b.username = u.User.Username()
+		b.password, _ = u.User.Password()
+	}
+	return b, nil
+}
+
+// publish sends msgs, connecting first if need be.
+func (b *mqttBroker) publish(msgs ...mqttMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		select {
+		case <-b.gone:
+			b.drop()
+		default:
+		}
+	}
+	if b.conn == nil {
+		if err := b.dial(); err != nil {
+			return err
+		}
+		if b.onConnect != nil {
+			first, err := b.onConnect()
+			if err != nil {
+				b.drop()
+				return err
+			}
+			msgs = append(first, msgs...)
+		}
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(kMQTTTimeout))
+	for _, m := range msgs {
+		var body bytes.Buffer
+		mqttString(&body, m.topic)
+		body.Write(m.payload)
+		header := byte(0x30)
+		if m.retain {
+			header |= 0x01
+		}
+		mqttPacket(b.w, header, body.Bytes())
+	}
+	if err := b.w.Flush(); err != nil {
+		b.drop()
+		return err
+	}
+	return nil
+}
+
+// dial connects to the broker, and watches for it hanging up.
+func (b *mqttBroker) dial() error {
+	conn, err := net.DialTimeout("tcp", b.addr, kMQTTTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(kMQTTTimeout))
+	w := bufio.NewWriter(conn)
+	if err := b.connect(w); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	var ack [4]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		conn.Close()
+		return fmt.Errorf("reading CONNACK: %v", err)
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("broker refused the connection: CONNACK % x", ack)
+	}
+	conn.SetDeadline(time.Time{})
+	gone := make(chan struct{})
+	go func() {
+		// At QoS 0 the broker sends nothing more; a read returning
+		// means it has hung up.
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+	b.conn, b.w, b.gone = conn, w, gone
+	return nil
+}
+
+// drop closes the connection, so the next publish connects again.
+func (b *mqttBroker) drop() {
+	b.conn.Close()
+	b.conn, b.w = nil, nil
+}
+
+// close disconnects from the broker.
+func (b *mqttBroker) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(kMQTTTimeout))
+	mqttPacket(b.w, 0xe0, nil) // DISCONNECT
+	err := b.w.Flush()
+	b.drop()
+	return err
+}
+
+func (b *mqttBroker) connect(w *bufio.Writer) error {
+	var body bytes.Buffer
+	mqttString(&body, "MQTT")
+	body.WriteByte(4) // protocol level 3.1.1
+	flags := byte(0x02)
+	if b.hasUser {
+		flags |= 0x80
+		if b.password != "" {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	// No keep alive: polls may be further apart than any sensible
+	// interval, and a lost connection is found when publishing.
+	body.Write([]byte{0, 0})
+	mqttString(&body, b.clientID)
+	if b.hasUser {
+		mqttString(&body, b.username)
+		if b.password != "" {
+			mqttString(&body, b.password)
+		}
+	}
+	return mqttPacket(w, 0x10, body.Bytes())
+}
+
+func mqttString(buf *bytes.Buffer, s string) {
+	buf.Write([]byte{byte(len(s) >> 8), byte(len(s))})
+	buf.WriteString(s)
+}
+
+// mqttPacket writes a packet with the remaining length encoded as MQTT's
+// variable length integer.
+func mqttPacket(w *bufio.Writer, header byte, body []byte) error {
+	w.WriteByte(header)
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		w.WriteByte(digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(body)
+	return err
+}
@@ -0,0 +1,40 @@
+package view
+
+// conventional is the name and unit scaling of a metric under the
+// Prometheus naming conventions.
+type conventional struct {
+	name string
+	// scale converts the historical unit to the base unit in name.  Zero
+	// means no conversion.
+	scale float64
+}
+
+// conventionalNames maps historical metric names to ones that follow the
+// Prometheus conventions: lower case, base units spelled out in the name,
+// and _total on counters.  Metrics not listed already conform.  The
+// historical names are kept by default so existing dashboards continue to
+// work; Options.ConventionalNames switches to these.
+var conventionalNames = map[string]conventional{
+	"nominal_system_energy_kWh":  {name: "nominal_system_energy_watt_hours", scale: 1000},
+	"nominal_system_power_kW":    {name: "nominal_system_power_watts", scale: 1000},
+	"max_site_meter_power_kW":    {name: "max_site_meter_power_watts", scale: 1000},
+	"total_solar_rating_W":       {name: "total_solar_rating_watts"},
+	"network_signal_strength":    {name: "network_signal_strength_decibels"},
+	"sitemaster_running":         {name: "site_master_running"},
+	"instant_power":              {name: "power_watts"},
+	"cumulative_power":           {name: "energy_watt_hours_total"}, // the gateway counts Wh
+	"instant_average_voltage":    {name: "voltage_volts"},
+	"instant_total_current_amps": {name: "current_amperes"},
+	"pv_string_voltage":          {name: "pv_string_voltage_volts"},
+	"pv_string_current":          {name: "pv_string_current_amperes"},
+	"pv_string_power":            {name: "pv_string_power_watts"},
+	"app_power_kw":               {name: "app_power_watts", scale: 1000},
+	"daily_energy_kwh":           {name: "daily_energy_watt_hours", scale: 1000},
+	"solar_to_home_w":            {name: "solar_to_home_watts"},
+	"solar_to_battery_w":         {name: "solar_to_battery_watts"},
+	"solar_to_grid_w":            {name: "solar_to_grid_watts"},
+	"battery_to_home_w":          {name: "battery_to_home_watts"},
+	"battery_to_grid_w":          {name: "battery_to_grid_watts"},
+	"grid_to_home_w":             {name: "grid_to_home_watts"},
+	"grid_to_battery_w":          {name: "grid_to_battery_watts"},
+}
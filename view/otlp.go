@@ -0,0 +1,196 @@
+package view
+
+import (
+	"context"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"math"
+	"time"
+)
+
+func init() {
+	RegisterSink("otel", newOTLP)
+}
+
+// kOTLPTimeout bounds each push to the collector.
+const kOTLPTimeout = 10 * time.Second
+
+// otlp pushes the same metrics /metrics serves to an OpenTelemetry
+// collector over OTLP/gRPC after each poll.  The collector's address and
+// credentials come from the standard OTEL_EXPORTER_OTLP_* environment
+// variables, and OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES describe
+// the exporter.  Pushes happen in the background, so an unreachable
+// collector doesn't hold up polling; if one is still running when the
+// next poll is done, only the newest metrics wait their turn.
+type otlp struct {
+	// counters is a collector of the sink's own, so the sink doesn't
+	// depend on where it comes in the list of sinks.
+	counters *PrometheusCounters
+	reg      *prometheus.Registry
+	exp      *otlpmetricgrpc.Exporter
+	res      *resource.Resource
+	start    time.Time
+	// pending holds the metrics waiting to be pushed.
+	pending chan *metricdata.ResourceMetrics
+	stopped chan struct{}
+}
+
+func newOTLP(fixed *model.FixedInfo, opts Options) (Sink, error) {
+	ctx := context.Background()
+	exp, err := otlpmetricgrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("otlpmetricgrpc.New(): %v", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "powerwall_exporter")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, fmt.Errorf("resource.New(): %v", err)
+	}
+	// The prometheus sink keeps the cumulative counters in the state
+	// store; a second copy there would fight it.
+	opts.State = nil
+	r := &otlp{
+		counters: NewCollector(fixed, opts),
+		reg:      prometheus.NewRegistry(),
+		exp:      exp,
+		res:      res,
+		start:    time.Now(),
+		pending:  make(chan *metricdata.ResourceMetrics, 1),
+		stopped:  make(chan struct{}),
+	}
+	if err := r.reg.Register(r.counters); err != nil {
+		return nil, err
+	}
+	go r.push()
+	return r, nil
+}
+
+// Update queues the metrics from m for pushing to the collector, in
+// place of any still waiting.
+func (o *otlp) Update(m *model.TeslaEnergyGatewayMetrics) error {
+	if err := o.counters.Update(m); err != nil {
+		return err
+	}
+	mfs, err := o.reg.Gather()
+	if err != nil {
+		return err
+	}
+	rm := &metricdata.ResourceMetrics{
+		Resource: o.res,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: "github.com/jeffbstewart/powerwall_prometheus_exporter"},
+			Metrics: otlpMetrics(mfs, o.start, time.Now()),
+		}},
+	}
+	for {
+		select {
+		case o.pending <- rm:
+			return nil
+		default:
+		}
+		// Drop the stale metrics waiting, and try again.
+		select {
+		case <-o.pending:
+		default:
+		}
+	}
+}
+
+// push sends queued metrics to the collector until Close.
+func (o *otlp) push() {
+	defer close(o.stopped)
+	for rm := range o.pending {
+		ctx, cancel := context.WithTimeout(context.Background(), kOTLPTimeout)
+		if err := o.exp.Export(ctx, rm); err != nil {
+			logthrottle.Errorf("otlp", "Pushing to the OTLP collector: %v", err)
+		}
+		cancel()
+	}
+}
+
+// Close pushes whatever is queued, then disconnects from the collector.
+// Update must not be called after Close.
+func (o *otlp) Close() error {
+	close(o.pending)
+	<-o.stopped
+	ctx, cancel := context.WithTimeout(context.Background(), kOTLPTimeout)
+	defer cancel()
+	return o.exp.Shutdown(ctx)
+}
+
+// otlpMetrics converts gathered gauges, counters and histograms to their
+// OpenTelemetry equivalents.  Counters and histograms are cumulative since
+// start.
+func otlpMetrics(mfs []*dto.MetricFamily, start, now time.Time) []metricdata.Metrics {
+	var rval []metricdata.Metrics
+	for _, mf := range mfs {
+		var gauge metricdata.Gauge[float64]
+		sum := metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+		hist := metricdata.Histogram[float64]{Temporality: metricdata.CumulativeTemporality}
+		for _, m := range mf.GetMetric() {
+			var kvs []attribute.KeyValue
+			for _, l := range m.GetLabel() {
+				kvs = append(kvs, attribute.String(l.GetName(), l.GetValue()))
+			}
+			dp := metricdata.DataPoint[float64]{Attributes: attribute.NewSet(kvs...), Time: now}
+			switch {
+			case m.Gauge != nil:
+				dp.Value = m.GetGauge().GetValue()
+				gauge.DataPoints = append(gauge.DataPoints, dp)
+			case m.Counter != nil:
+				dp.StartTime, dp.Value = start, m.GetCounter().GetValue()
+				sum.DataPoints = append(sum.DataPoints, dp)
+			case m.Histogram != nil:
+				hist.DataPoints = append(hist.DataPoints, otlpHistogram(m.GetHistogram(), dp.Attributes, start, now))
+			}
+		}
+		metric := metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp()}
+		switch {
+		case len(gauge.DataPoints) > 0:
+			metric.Data = gauge
+		case len(sum.DataPoints) > 0:
+			metric.Data = sum
+		case len(hist.DataPoints) > 0:
+			metric.Data = hist
+		default:
+			continue
+		}
+		rval = append(rval, metric)
+	}
+	return rval
+}
+
+// otlpHistogram converts a Prometheus histogram, whose buckets count every
+// observation up to their bound, to OpenTelemetry's, whose buckets count
+// those between one bound and the next.
+func otlpHistogram(h *dto.Histogram, attrs attribute.Set, start, now time.Time) metricdata.HistogramDataPoint[float64] {
+	rval := metricdata.HistogramDataPoint[float64]{
+		Attributes: attrs,
+		StartTime:  start,
+		Time:       now,
+		Count:      h.GetSampleCount(),
+		Sum:        h.GetSampleSum(),
+	}
+	var below uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		rval.Bounds = append(rval.Bounds, b.GetUpperBound())
+		rval.BucketCounts = append(rval.BucketCounts, b.GetCumulativeCount()-below)
+		below = b.GetCumulativeCount()
+	}
+	// The last bucket is everything above the highest bound.
+	rval.BucketCounts = append(rval.BucketCounts, rval.Count-below)
+	return rval
+}
@@ -0,0 +1,82 @@
+package view
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// kPypowerwallPrefix is where PypowerwallHandler is served.
+const kPypowerwallPrefix = "/api/ha"
+
+// pypowerwallMeter is one meter of /meters/aggregates, in the gateway's
+// own field names.
+type pypowerwallMeter struct {
+	LastCommunicationTime string  `json:"last_communication_time"`
+	InstantPower          float64 `json:"instant_power"`
+	InstantReactivePower  float64 `json:"instant_reactive_power"`
+	InstantApparentPower  float64 `json:"instant_apparant_power"` // sic, as the gateway spells it
+	Frequency             float64 `json:"frequency"`
+	EnergyExported        float64 `json:"energy_exported"`
+	EnergyImported        float64 `json:"energy_imported"`
+	InstantAverageVoltage float64 `json:"instant_average_voltage"`
+	InstantTotalCurrent   float64 `json:"instant_total_current"`
+}
+
+// PypowerwallHandler serves the last poll in the JSON shapes of the
+// gateway, as the pypowerwall proxy does, so Home Assistant integrations
+// built for that proxy can read this exporter rather than poll the
+// gateway a second time.  Beneath /api/ha it serves aggregates, soe and
+// grid_status by pypowerwall's short names and by the gateway's paths,
+// such as /api/ha/api/meters/aggregates.
+func PypowerwallHandler(latest func() *model.TeslaEnergyGatewayMetrics) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		m := latest()
+		if m == nil {
+			http.Error(rw, "the gateway hasn't been polled yet", http.StatusServiceUnavailable)
+			return
+		}
+		var body interface{}
+		switch strings.TrimPrefix(req.URL.Path, kPypowerwallPrefix) {
+		case "/aggregates", "/api/meters/aggregates":
+			body = pypowerwallAggregates(m)
+		case "/soe", "/api/system_status/soe":
+			body = map[string]float64{"percentage": m.PowerwallChargePercent}
+		case "/grid_status", "/api/system_status/grid_status":
+			body = map[string]interface{}{
+				"grid_status":          string(m.GridStatus),
+				"grid_services_active": m.GridActive,
+			}
+		default:
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(body); err != nil {
+			glog.Errorf("encoding pypowerwall response: %v", err)
+		}
+	})
+}
+
+func pypowerwallAggregates(m *model.TeslaEnergyGatewayMetrics) map[string]pypowerwallMeter {
+	polled := m.PolledAt.Format(time.RFC3339)
+	rval := make(map[string]pypowerwallMeter)
+	for _, mt := range []model.MeterType{model.Total, model.Load, model.Solar, model.Battery} {
+		d := m.Meters[mt]
+		rval[mt.String()] = pypowerwallMeter{
+			LastCommunicationTime: polled,
+			InstantPower:          d.InstantPower,
+			InstantReactivePower:  d.InstantReactivePower,
+			InstantApparentPower:  d.InstantApparentPower,
+			Frequency:             d.Frequency,
+			EnergyExported:        d.CumulativeEnergyFrom,
+			EnergyImported:        d.CumulativeEnergyTo,
+			InstantAverageVoltage: d.InstantAverageVoltage,
+			InstantTotalCurrent:   d.InstantTotalCurrent,
+		}
+	}
+	return rval
+}
@@ -0,0 +1,171 @@
+package view
+
+import (
+	"context"
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/logthrottle"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/remotewrite"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("remotewrite", newRemoteWrite)
+}
+
+const (
+	// kRemoteWriteTimeout bounds each write to the endpoint.
+	kRemoteWriteTimeout = 30 * time.Second
+	// kMaxQueuedPolls is how many polls are kept while the endpoint is
+	// failing before the oldest are dropped.
+	kMaxQueuedPolls = 360
+)
+
+// remoteWrite sends the same metrics /metrics serves straight to a
+// Prometheus remote write endpoint, such as Grafana Cloud, Mimir or
+// VictoriaMetrics, without a local Prometheus.  Each sample carries the
+// time of its poll, so polls can be batched into fewer requests and held
+// while the endpoint is down.  Writes happen in the background, so a slow
+// or failing endpoint doesn't hold up polling.
+type remoteWrite struct {
+	// counters is a collector of the sink's own, as with the otel sink.
+	counters *PrometheusCounters
+	reg      *prometheus.Registry
+	client   *remotewrite.Client
+	batch    int
+	instance string
+	// ready is signalled when a batch is queued; done closes the writer.
+	ready   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu sync.Mutex
+	// queued holds the series of each poll not yet written.
+	queued [][]remotewrite.Series
+}
+
+func newRemoteWrite(fixed *model.FixedInfo, opts Options) (Sink, error) {
+	if opts.RemoteWriteURL == "" {
+		return nil, fmt.Errorf("the remotewrite sink needs a remote write URL")
+	}
+	instance := fixed.DIN
+	if instance == "" {
+		instance = fixed.SiteName
+	}
+	if instance == "" {
+		return nil, fmt.Errorf("the remotewrite sink needs the gateway's DIN or site name for its instance label, and the gateway reported neither")
+	}
+	// The prometheus sink keeps the cumulative counters in the state
+	// store; a second copy there would fight it.
+	opts.State = nil
+	r := &remoteWrite{
+		counters: NewCollector(fixed, opts),
+		reg:      prometheus.NewRegistry(),
+		client:   remotewrite.New(opts.RemoteWriteURL, opts.RemoteWriteToken),
+		batch:    opts.RemoteWriteBatch,
+		instance: instance,
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if r.batch < 1 {
+		r.batch = 1
+	}
+	if err := r.reg.Register(r.counters); err != nil {
+		return nil, err
+	}
+	go r.write()
+	return r, nil
+}
+
+// Update queues the metrics from m, and wakes the writer once the queue
+// holds a batch.
+func (r *remoteWrite) Update(m *model.TeslaEnergyGatewayMetrics) error {
+	if err := r.counters.Update(m); err != nil {
+		return err
+	}
+	mfs, err := r.reg.Gather()
+	if err != nil {
+		return err
+	}
+	polled := m.PolledAt
+	if polled.IsZero() {
+		polled = time.Now()
+	}
+	series := remotewrite.FromFamilies(mfs, polled,
+		[2]string{"job", "powerwall_exporter"}, [2]string{"instance", r.instance})
+	r.mu.Lock()
+	r.queued = append(r.queued, series)
+	if n := len(r.queued) - kMaxQueuedPolls; n > 0 {
+		logthrottle.Warningf("remotewrite drops", "Dropping %d poll(s) the remote write endpoint hasn't taken", n)
+		r.queued = r.queued[n:]
+	}
+	full := len(r.queued) >= r.batch
+	r.mu.Unlock()
+	if full {
+		select {
+		case r.ready <- struct{}{}:
+		default:
+			// The writer is already due to run.
+		}
+	}
+	return nil
+}
+
+// write flushes the queue each time Update says a batch is ready, until
+// Close.
+func (r *remoteWrite) write() {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.ready:
+			if err := r.flush(); err != nil {
+				logthrottle.Errorf("remotewrite", "%v", err)
+			}
+		}
+	}
+}
+
+// flush writes everything queued.  A write the endpoint says will never
+// succeed is dropped rather than retried forever; other failures leave
+// the polls queued for the next flush.
+func (r *remoteWrite) flush() error {
+	r.mu.Lock()
+	polls := r.queued
+	r.queued = nil
+	r.mu.Unlock()
+	if len(polls) == 0 {
+		return nil
+	}
+	var all []remotewrite.Series
+	for _, s := range polls {
+		all = append(all, s...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kRemoteWriteTimeout)
+	defer cancel()
+	err := r.client.Write(ctx, all)
+	if err != nil && remotewrite.Retryable(err) {
+		// Put them back ahead of whatever arrived meanwhile.
+		r.mu.Lock()
+		r.queued = append(polls, r.queued...)
+		if n := len(r.queued) - kMaxQueuedPolls; n > 0 {
+			r.queued = r.queued[n:]
+		}
+		r.mu.Unlock()
+	}
+	if err != nil {
+		return fmt.Errorf("writing %d poll(s) to the remote write endpoint: %v", len(polls), err)
+	}
+	return nil
+}
+
+// Close stops the writer and writes whatever is still queued.
+func (r *remoteWrite) Close() error {
+	close(r.done)
+	<-r.stopped
+	return r.flush()
+}
@@ -0,0 +1,100 @@
+package view
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// alertRule is one Prometheus alerting rule.  expr uses %[1]s, %[2]s and
+// so on for the names of metrics, which are given by their historical
+// names.
+type alertRule struct {
+	name     string
+	metrics  []string
+	expr     string
+	duration time.Duration
+	severity string
+	summary  string
+}
+
+// alertRules are the rules AlertRules writes.  Like the dashboard, they
+// avoid metrics whose unit changes with Options.ConventionalNames.
+var alertRules = []alertRule{
+	{
+		name:     "PowerwallGridDown",
+		metrics:  []string{"grid_connected"},
+		expr:     "%[1]s == 0",
+		duration: time.Minute,
+		severity: "warning",
+		summary:  "The grid is down and the site is running on its batteries",
+	},
+	{
+		name:     "PowerwallChargeBelowReserve",
+		metrics:  []string{"powerwall_charge_percent", "backup_reserve_percent"},
+		expr:     "%[1]s < %[2]s",
+		duration: 15 * time.Minute,
+		severity: "warning",
+		summary:  "The powerwalls have discharged below the backup reserve",
+	},
+	{
+		// The exporter's own metrics aren't renamed.
+		name:     "PowerwallGatewayUnreachable",
+		expr:     "powerwall_up == 0",
+		duration: 5 * time.Minute,
+		severity: "critical",
+		summary:  "The exporter hasn't been able to poll the gateway",
+	},
+	{
+		name:    "PowerwallBatteryNotCharging",
+		metrics: []string{"instant_power", "powerwall_charge_percent"},
+		expr: `%[1]s{meter="solar",powerType="truePower"} > 500` +
+			` and ignoring(meter) %[1]s{meter="battery",powerType="truePower"} >= 0` +
+			` and ignoring(meter, powerType) %[2]s < 95`,
+		duration: 30 * time.Minute,
+		severity: "warning",
+		summary:  "Solar is producing but the powerwalls, which aren't full, aren't charging",
+	},
+}
+
+// AlertRules writes a Prometheus alerting rules file for the metrics under
+// the names they're exported as with opts.
+func AlertRules(opts Options, w io.Writer) error {
+	// JSON strings are valid YAML double quoted scalars.
+	quote := func(s string) string {
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		enc.Encode(s)
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+	if _, err := fmt.Fprintf(w, "groups:\n  - name: powerwall\n    rules:\n"); err != nil {
+		return err
+	}
+	for _, r := range alertRules {
+		var names []interface{}
+		for _, m := range r.metrics {
+			names = append(names, metricName(opts, m))
+		}
+		_, err := fmt.Fprintf(w, "      - alert: %s\n        expr: %s\n        for: %s\n        labels:\n          severity: %s\n        annotations:\n          summary: %s\n",
+			r.name, quote(fmt.Sprintf(r.expr, names...)), promDuration(r.duration), r.severity, quote(r.summary))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promDuration formats d as Prometheus does, such as 15m.
+func promDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
@@ -0,0 +1,121 @@
+package view
+
+import (
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+)
+
+// MetricSchema describes one exported metric.
+type MetricSchema struct {
+	Name string `json:"name"`
+	// Type is "gauge", "counter" or "histogram".
+	Type   string   `json:"type"`
+	Help   string   `json:"help"`
+	Labels []string `json:"labels"`
+}
+
+// The metric types MetricSchema.Type takes.
+const (
+	kGaugeType     = "gauge"
+	kCounterType   = "counter"
+	kHistogramType = "histogram"
+)
+
+func newMetricSchema(typ, fqName, help string, constLabels prometheus.Labels, labels []string) MetricSchema {
+	r := MetricSchema{
+		Name: fqName,
+		Type: typ,
+		Help: help,
+	}
+	for l := range constLabels {
+		r.Labels = append(r.Labels, l)
+	}
+	r.Labels = append(r.Labels, labels...)
+	sort.Strings(r.Labels)
+	return r
+}
+
+// Schema describes every metric exported with the given options, sorted by
+// name.
+func Schema(opts Options) []MetricSchema {
+	r := newCounters(&model.FixedInfo{}, opts).schema
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// Rename pairs a metric which disappeared with the one that replaced it.
+type Rename struct {
+	From MetricSchema `json:"from"`
+	To   MetricSchema `json:"to"`
+}
+
+// SchemaDiff lists the differences between two schemas.
+type SchemaDiff struct {
+	Added   []MetricSchema `json:"added"`
+	Removed []MetricSchema `json:"removed"`
+	// Renamed holds metrics that disappeared while another with the same
+	// help text appeared.
+	Renamed []Rename `json:"renamed"`
+	// Changed holds metrics whose name survived but whose type or labels
+	// did not.
+	Changed []Rename `json:"changed"`
+}
+
+// Diff compares an older schema with a newer one.
+func Diff(older, newer []MetricSchema) SchemaDiff {
+	byName := func(s []MetricSchema) map[string]MetricSchema {
+		r := make(map[string]MetricSchema)
+		for _, m := range s {
+			r[m.Name] = m
+		}
+		return r
+	}
+	oldByName, newByName := byName(older), byName(newer)
+	var d SchemaDiff
+	var added []MetricSchema
+	for _, m := range newer {
+		o, ok := oldByName[m.Name]
+		if !ok {
+			added = append(added, m)
+			continue
+		}
+		if o.Type != m.Type || !sameLabels(o.Labels, m.Labels) {
+			d.Changed = append(d.Changed, Rename{From: o, To: m})
+		}
+	}
+	addedByHelp := make(map[string]int)
+	for i, m := range added {
+		addedByHelp[m.Help] = i
+	}
+	renamedTo := make(map[int]bool)
+	for _, m := range older {
+		if _, ok := newByName[m.Name]; ok {
+			continue
+		}
+		if i, ok := addedByHelp[m.Help]; ok && !renamedTo[i] {
+			renamedTo[i] = true
+			d.Renamed = append(d.Renamed, Rename{From: m, To: added[i]})
+			continue
+		}
+		d.Removed = append(d.Removed, m)
+	}
+	for i, m := range added {
+		if !renamedTo[i] {
+			d.Added = append(d.Added, m)
+		}
+	}
+	return d
+}
+
+func sameLabels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package view
+
+import (
+	"fmt"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"sort"
+)
+
+// Sink receives the metrics from every successful poll.
+type Sink interface {
+	Update(m *model.TeslaEnergyGatewayMetrics) error
+}
+
+// SinkFactory creates a sink for the gateway described by fixed.
+type SinkFactory func(fixed *model.FixedInfo, opts Options) (Sink, error)
+
+var sinks = make(map[string]SinkFactory)
+
+// RegisterSink makes a sink available to NewSink under name.  It is meant
+// to be called from init().
+func RegisterSink(name string, f SinkFactory) {
+	if _, ok := sinks[name]; ok {
+		panic(fmt.Sprintf("sink %q registered twice", name))
+	}
+	sinks[name] = f
+}
+
+// SinkNames lists the registered sinks in alphabetical order.
+func SinkNames() []string {
+	var rval []string
+	for name := range sinks {
+		rval = append(rval, name)
+	}
+	sort.Strings(rval)
+	return rval
+}
+
+// NewSink creates the sink registered under name.
+func NewSink(name string, fixed *model.FixedInfo, opts Options) (Sink, error) {
+	f, ok := sinks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q, want one of %v", name, SinkNames())
+	}
+	return f(fixed, opts)
+}
@@ -0,0 +1,124 @@
+package view
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jeffbstewart/powerwall_prometheus_exporter/model"
+	"net/http"
+)
+
+// The snapshot documents evolve additively: within a schema version,
+// fields are only ever added, never renamed, removed or given a new
+// meaning.  Any other change gets a new version, served alongside the old
+// ones so existing consumers keep working.
+const (
+	// SnapshotV1 has a fixed field for each of the four aggregate meters.
+	SnapshotV1 = 1
+	// SnapshotV2 keys the meters by name, so meter types added later show
+	// up as new keys rather than a schema change.
+	SnapshotV2 = 2
+)
+
+// SnapshotVersions lists the versions SnapshotHandler serves.
+var SnapshotVersions = []int{SnapshotV1, SnapshotV2}
+
+type snapshotMeter struct {
+	InstantPowerWatts   float64 `json:"instant_power_watts"`
+	EnergyToWattHours   float64 `json:"energy_to_watt_hours"`
+	EnergyFromWattHours float64 `json:"energy_from_watt_hours"`
+	AverageVoltageVolts float64 `json:"average_voltage_volts"`
+	TotalCurrentAmperes float64 `json:"total_current_amperes"`
+	ReactivePowerVAR    float64 `json:"reactive_power_var"`
+	ApparentPowerVA     float64 `json:"apparent_power_va"`
+}
+
+// snapshotCommon holds the fields every version shares.
+type snapshotCommon struct {
+	SchemaVersion        int     `json:"schema_version"`
+	Version              string  `json:"version"`
+	ChargePercent        float64 `json:"charge_percent"`
+	AppChargePercent     float64 `json:"app_charge_percent"`
+	BackupReservePercent float64 `json:"backup_reserve_percent"`
+	OperatingMode        string  `json:"operating_mode"`
+	GridStatus           string  `json:"grid_status"`
+	UptimeSeconds        float64 `json:"uptime_seconds"`
+}
+
+type snapshotV1 struct {
+	snapshotCommon
+	Site    snapshotMeter `json:"site"`
+	Load    snapshotMeter `json:"load"`
+	Solar   snapshotMeter `json:"solar"`
+	Battery snapshotMeter `json:"battery"`
+}
+
+type snapshotV2 struct {
+	snapshotCommon
+	Meters map[string]snapshotMeter `json:"meters"`
+}
+
+func newSnapshotMeter(d model.MeterDetails) snapshotMeter {
+	return snapshotMeter{
+		InstantPowerWatts:   d.InstantPower,
+		EnergyToWattHours:   d.CumulativeEnergyTo,
+		EnergyFromWattHours: d.CumulativeEnergyFrom,
+		AverageVoltageVolts: d.InstantAverageVoltage,
+		TotalCurrentAmperes: d.InstantTotalCurrent,
+		ReactivePowerVAR:    d.InstantReactivePower,
+		ApparentPowerVA:     d.InstantApparentPower,
+	}
+}
+
+// Snapshot renders m as the given schema version.
+func Snapshot(version int, m *model.TeslaEnergyGatewayMetrics) (interface{}, error) {
+	common := snapshotCommon{
+		SchemaVersion:        version,
+		Version:              fmt.Sprintf("%d.%d.%d", m.Version.Major, m.Version.Minor, m.Version.Release),
+		ChargePercent:        m.PowerwallChargePercent,
+		AppChargePercent:     m.AppChargePercent(),
+		BackupReservePercent: m.BackupReservePercent,
+		OperatingMode:        m.Mode.String(),
+		GridStatus:           m.GridStatus.String(),
+		UptimeSeconds:        m.Uptime.Seconds(),
+	}
+	switch version {
+	case SnapshotV1:
+		return snapshotV1{
+			snapshotCommon: common,
+			Site:           newSnapshotMeter(m.Meters[model.Total]),
+			Load:           newSnapshotMeter(m.Meters[model.Load]),
+			Solar:          newSnapshotMeter(m.Meters[model.Solar]),
+			Battery:        newSnapshotMeter(m.Meters[model.Battery]),
+		}, nil
+	case SnapshotV2:
+		rval := snapshotV2{snapshotCommon: common, Meters: make(map[string]snapshotMeter)}
+		for mt, d := range m.Meters {
+			rval.Meters[mt.String()] = newSnapshotMeter(d)
+		}
+		return rval, nil
+	default:
+		return nil, fmt.Errorf("unknown snapshot schema version %d", version)
+	}
+}
+
+// SnapshotHandler serves the most recent poll, from latest, as JSON in
+// the given schema version.
+func SnapshotHandler(version int, latest func() *model.TeslaEnergyGatewayMetrics) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		m := latest()
+		if m == nil {
+			http.Error(rw, "the gateway hasn't been polled yet", http.StatusServiceUnavailable)
+			return
+		}
+		doc, err := Snapshot(version, m)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(doc); err != nil {
+			glog.Errorf("encoding snapshot: %v", err)
+		}
+	})
+}